@@ -0,0 +1,177 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An attributeChecker remembers the attributes most recently returned to the
+// kernel for each inode, and notices when a later reply contradicts them while
+// the kernel may still be caching the earlier ones. See
+// MountConfig.EnableAttributeConsistencyCheck.
+type attributeChecker struct {
+	mu sync.Mutex
+
+	// The last attributes returned for each inode, and the time until which the
+	// kernel was allowed to cache them.
+	//
+	// GUARDED_BY(mu)
+	last map[fuseops.InodeID]cachedAttributes
+}
+
+type cachedAttributes struct {
+	attrs      fuseops.InodeAttributes
+	expiration time.Time
+}
+
+func newAttributeChecker() *attributeChecker {
+	return &attributeChecker{
+		last: make(map[fuseops.InodeID]cachedAttributes),
+	}
+}
+
+// Inspect the successful reply to the supplied op at the given time, returning
+// a description of any inconsistency found or the empty string if none.
+//
+// LOCKS_EXCLUDED(ac.mu)
+func (ac *attributeChecker) check(op interface{}, now time.Time) string {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return ac.checkEntry(o.Entry, now)
+
+	case *fuseops.MkDirOp:
+		return ac.checkEntry(o.Entry, now)
+
+	case *fuseops.MkNodeOp:
+		return ac.checkEntry(o.Entry, now)
+
+	case *fuseops.CreateFileOp:
+		return ac.checkEntry(o.Entry, now)
+
+	case *fuseops.CreateSymlinkOp:
+		return ac.checkEntry(o.Entry, now)
+
+	case *fuseops.CreateLinkOp:
+		return ac.checkEntry(o.Entry, now)
+
+	case *fuseops.GetInodeAttributesOp:
+		return ac.checkAttributes(
+			o.Inode,
+			o.Attributes,
+			expiration(now, o.AttributesExpiration, o.AttributesValidity),
+			now)
+
+	// Ops through which the kernel knows the attributes may legitimately
+	// change. Start afresh with whatever is returned next.
+	case *fuseops.SetInodeAttributesOp:
+		ac.last[o.Inode] = cachedAttributes{
+			o.Attributes,
+			expiration(now, o.AttributesExpiration, o.AttributesValidity),
+		}
+
+	case *fuseops.WriteFileOp:
+		delete(ac.last, o.Inode)
+
+	case *fuseops.FallocateOp:
+		delete(ac.last, o.Inode)
+
+	case *fuseops.CopyFileRangeOp:
+		delete(ac.last, o.InodeOut)
+
+	case *fuseops.ForgetInodeOp:
+		delete(ac.last, o.Inode)
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range o.Entries {
+			delete(ac.last, e.Inode)
+		}
+	}
+
+	return ""
+}
+
+// LOCKS_REQUIRED(ac.mu)
+func (ac *attributeChecker) checkEntry(
+	e fuseops.ChildInodeEntry,
+	now time.Time) string {
+	return ac.checkAttributes(
+		e.Child,
+		e.Attributes,
+		expiration(now, e.AttributesExpiration, e.AttributesValidity),
+		now)
+}
+
+// Return the time at which attributes returned at the given time expire, given
+// an expiration time and a validity duration that takes precedence over it if
+// non-zero.
+func expiration(
+	now time.Time,
+	t time.Time,
+	validity time.Duration) time.Time {
+	if validity != 0 {
+		return now.Add(validity)
+	}
+
+	return t
+}
+
+// LOCKS_REQUIRED(ac.mu)
+func (ac *attributeChecker) checkAttributes(
+	inode fuseops.InodeID,
+	attrs fuseops.InodeAttributes,
+	expiration time.Time,
+	now time.Time) (msg string) {
+	prev, ok := ac.last[inode]
+	ac.last[inode] = cachedAttributes{attrs, expiration}
+
+	// Differences are only a problem while the kernel may still be using the
+	// earlier attributes.
+	if !ok || !now.Before(prev.expiration) {
+		return ""
+	}
+
+	// Compare the fields that the kernel caches and that don't change as a
+	// side effect of ops on other inodes (as Nlink does for unlink and rename).
+	a, b := prev.attrs, attrs
+	switch {
+	case a.Size != b.Size:
+		msg = fmt.Sprintf("size %d vs. %d", a.Size, b.Size)
+
+	case a.Mode != b.Mode:
+		msg = fmt.Sprintf("mode %v vs. %v", a.Mode, b.Mode)
+
+	case a.Uid != b.Uid:
+		msg = fmt.Sprintf("uid %d vs. %d", a.Uid, b.Uid)
+
+	case a.Gid != b.Gid:
+		msg = fmt.Sprintf("gid %d vs. %d", a.Gid, b.Gid)
+
+	default:
+		return ""
+	}
+
+	return fmt.Sprintf(
+		"inode %d: attributes changed while still cached by the kernel: %s",
+		inode,
+		msg)
+}
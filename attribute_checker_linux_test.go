@@ -0,0 +1,144 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/sys/unix"
+)
+
+// A file system containing a single file named "foo", which deliberately
+// reports a different size from GetInodeAttributes than from LookUpInode.
+type inconsistentFS struct {
+	minimalFS
+}
+
+const inconsistentFooID = fuseops.RootInodeID + 1
+
+func (fs *inconsistentFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = inconsistentFooID
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+		Size:  1,
+	}
+
+	op.Entry.AttributesExpiration = time.Now().Add(time.Hour)
+	return nil
+}
+
+func (fs *inconsistentFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	switch op.Inode {
+	case fuseops.RootInodeID:
+		op.Attributes = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0777 | os.ModeDir,
+		}
+
+	case inconsistentFooID:
+		op.Attributes = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0444,
+			Size:  2,
+		}
+
+	default:
+		return fuse.ENOENT
+	}
+
+	op.AttributesExpiration = time.Now().Add(time.Hour)
+	return nil
+}
+
+// A writer that may be written to concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAttributeConsistencyCheck(t *testing.T) {
+	ctx := context.Background()
+
+	// Mount, capturing errors logged.
+	var logged syncBuffer
+	mfs := mountFS(t, &inconsistentFS{}, &fuse.MountConfig{
+		ErrorLogger:                     log.New(&logged, "", 0),
+		EnableAttributeConsistencyCheck: true,
+	})
+
+	// Look up the file, then force the kernel to ask for its attributes again
+	// even though it has them cached.
+	p := path.Join(mfs.Dir(), "foo")
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+
+	var stx unix.Statx_t
+	err := unix.Statx(
+		unix.AT_FDCWD,
+		p,
+		unix.AT_STATX_FORCE_SYNC,
+		unix.STATX_BASIC_STATS,
+		&stx)
+
+	if err != nil {
+		t.Errorf("Statx: %v", err)
+	}
+
+	// Unmount so that all replies have been logged.
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Joining: %v", err)
+	}
+
+	const want = "size 1 vs. 2"
+	if got := logged.String(); !strings.Contains(got, want) {
+		t.Errorf("Expected warning containing %q, got: %q", want, got)
+	}
+}
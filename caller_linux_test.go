@@ -0,0 +1,75 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A minimalFS that records the OpContext of the most recent LookUpInodeOp.
+type callerFS struct {
+	minimalFS
+
+	mu     sync.Mutex
+	caller fuseops.OpContext // GUARDED_BY(mu)
+}
+
+func (fs *callerFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.caller = op.OpContext
+	return fuse.ENOENT
+}
+
+func TestOpContextIdentifiesCaller(t *testing.T) {
+	fs := &callerFS{}
+	mfs := mountFS(t, fs, &fuse.MountConfig{})
+
+	// Cause a lookup from this thread. The kernel reports the ID of the calling
+	// thread, which is the process ID only for the main thread.
+	runtime.LockOSThread()
+	tid := syscall.Gettid()
+	_, err := os.Stat(path.Join(mfs.Dir(), "foo"))
+	runtime.UnlockOSThread()
+
+	if !os.IsNotExist(err) {
+		t.Fatalf("Unexpected stat error: %v", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	expected := fuseops.OpContext{
+		Pid: uint32(tid),
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	if fs.caller != expected {
+		t.Errorf("OpContext: got %+v, want %+v", fs.caller, expected)
+	}
+}
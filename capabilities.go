@@ -0,0 +1,286 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"runtime"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Capabilities enumerates the optional FUSE features that may be negotiated
+// with the kernel during the init handshake.
+//
+// The file system requests features by setting fields of
+// MountConfig.Capabilities, and each is used only if the kernel offers it too.
+// The outcome is reported in the same form by Connection.Capabilities, with a
+// field set for each feature both requested and offered.
+//
+// Features that need support in this package that it doesn't yet have, such as
+// splice and BSD locks, are never requested and so have no field here.
+type Capabilities struct {
+	// The kernel may send multiple concurrent reads for the same file handle.
+	AsyncRead bool
+
+	// The kernel may send writes larger than a single page. Always requested.
+	BigWrites bool
+
+	// The kernel may send reads and writes of up to 256 pages (Linux >= 4.20).
+	// Always requested.
+	MaxPages bool
+
+	// The kernel buffers writes in its page cache. Requested unless
+	// MountConfig.DisableWritebackCaching is set, which see; setting this field
+	// in MountConfig.Capabilities has no effect.
+	WritebackCache bool
+
+	// Linux only.
+	//
+	// The kernel caches symlink targets in its page cache (Linux >= 4.20):
+	// https://github.com/torvalds/linux/commit/5571f1e65486be025f73fa6aa30fb03725d362a2
+	//
+	// This is not requested by default because the old behavior masked a bug:
+	// file systems could return any size in the inode attributes of symlinks.
+	// With caching, the specified size caps the symlink target.
+	SymlinkCaching bool
+
+	// Linux only.
+	//
+	// Returning ENOSYS from OpenFileOp tells the kernel that it need not send
+	// OpenFileOp at all (Linux >= 3.16).
+	NoOpenSupport bool
+
+	// Linux only.
+	//
+	// Returning ENOSYS from OpenDirOp tells the kernel that it need not send
+	// OpenDirOp at all (Linux >= 5.1).
+	NoOpendirSupport bool
+
+	// Linux only.
+	//
+	// The kernel may send concurrent LookUpInodeOps and ReadDirOps for the
+	// same directory, rather than serializing them (Linux >= 4.7). The file
+	// system must be prepared for this.
+	ParallelDirOps bool
+
+	// Linux only.
+	//
+	// The kernel passes O_TRUNC through in OpenFileOp.OpenFlags, rather than
+	// following the open with a SetInodeAttributesOp that sets the size to
+	// zero. The file system is then responsible for truncating the file on
+	// open.
+	AtomicTrunc bool
+
+	// Linux only.
+	//
+	// The file system will answer LookUpInodeOps for the names "." and "..", as
+	// needed for exporting it over NFS.
+	ExportSupport bool
+
+	// Linux only.
+	//
+	// The file system takes over from the kernel the clearing of the setuid and
+	// setgid bits when a file is modified by a user without CAP_FSETID, by
+	// negotiating FUSE_HANDLE_KILLPRIV_V2 (Linux >= 5.11).
+	//
+	// By default the kernel does this itself, by sending a
+	// SetInodeAttributesOp with the bits cleared from the mode before the write
+	// or truncate that calls for it. That costs an extra op, and leaves a window
+	// in which the bits are gone but the file is unmodified, or, for a file
+	// system whose attributes may be stale in the kernel, may clobber a mode
+	// changed by other means.
+	//
+	// With this set, the kernel instead marks the ops themselves: the
+	// KillSuidgid field is set on WriteFileOp, on SetInodeAttributesOp for a
+	// truncate, and on OpenFileOp and CreateFileOp for an open with O_TRUNC
+	// (where the file system truncates; see AtomicTrunc). The file system must
+	// then clear the setuid bit, and the setgid bit if the file is
+	// group-executable, as part of serving the op. It must also clear both bits
+	// itself when serving a SetInodeAttributesOp that changes the owner or
+	// group without changing the mode, regardless of the caller's privileges,
+	// since the kernel no longer adds the new mode to such ops.
+	HandleKillPrivV2 bool
+
+	// Linux only.
+	//
+	// The kernel sends SetXattrOp in its extended form (Linux >= 5.16), which
+	// reports SetXattrOp.KillSgid. This matters only to file systems that store
+	// POSIX ACLs; others need not request it.
+	SetxattrExt bool
+
+	// Linux only.
+	//
+	// Files opened with OpenFileOp.UseDirectIO may be mapped with mmap(2) using
+	// MAP_SHARED, which the kernel otherwise refuses with ENODEV (Linux >=
+	// 6.6). Such mappings go through the page cache, so the file system must be
+	// prepared for reads and writes of whole pages on behalf of the mapping,
+	// alongside the direct IO of the handle.
+	DirectIOMmap bool
+
+	// POSIX byte-range locks (fcntl(2) F_GETLK, F_SETLK and F_SETLKW) are
+	// delegated to the file system, which is sent GetLkOp, SetLkOp and
+	// SetLkwOp. By default the kernel handles them itself, so they are enforced
+	// only among processes on this machine.
+	//
+	// Request this only if the file system implements all three ops.
+	PosixLocks bool
+
+	// Linux only.
+	//
+	// The kernel may send ReadDirPlusOp, which returns the inode of each entry
+	// along with it, rather than ReadDirOp (Linux >= 3.9). This saves a
+	// LookUpInodeOp per entry for users that stat what they list, e.g. ls -l.
+	// The server returned by fuseutil.NewFileSystemServer answers the op with
+	// ReadDir for file systems that don't implement ReadDirPlus.
+	Readdirplus bool
+
+	// The kernel supports Connection.NotifyResend (Linux >= 6.9). Unlike the
+	// features above, this is offered by the kernel without needing to be
+	// requested, since it only resends requests when asked to.
+	Resend bool
+}
+
+func newCapabilities(
+	flags fusekernel.InitFlags,
+	flags2 fusekernel.InitFlags2) Capabilities {
+	return Capabilities{
+		AsyncRead:        flags&fusekernel.InitAsyncRead != 0,
+		BigWrites:        flags&fusekernel.InitBigWrites != 0,
+		MaxPages:         flags&fusekernel.InitMaxPages != 0,
+		WritebackCache:   flags&fusekernel.InitWritebackCache != 0,
+		SymlinkCaching:   flags&fusekernel.InitCacheSymlinks != 0,
+		NoOpenSupport:    flags&fusekernel.InitNoOpenSupport != 0,
+		NoOpendirSupport: flags&fusekernel.InitNoOpendirSupport != 0,
+		ParallelDirOps:   flags&fusekernel.InitParallelDirops != 0,
+		AtomicTrunc:      flags&fusekernel.InitAtomicTrunc != 0,
+		ExportSupport:    flags&fusekernel.InitExportSupport != 0,
+		HandleKillPrivV2: flags&fusekernel.InitHandleKillprivV2 != 0,
+		SetxattrExt:      flags&fusekernel.InitSetxattrExt != 0,
+		DirectIOMmap:     flags2&fusekernel.InitDirectIOAllowMmap != 0,
+		PosixLocks:       flags&fusekernel.InitPosixLocks != 0,
+		Readdirplus:      flags&fusekernel.InitDoReaddirplus != 0,
+	}
+}
+
+// Return the features requested by the config: those set in c.Capabilities,
+// along with those requested through the deprecated fields that predate it.
+func (c *MountConfig) requested() Capabilities {
+	r := c.Capabilities
+	r.BigWrites = true
+	r.MaxPages = true
+	r.WritebackCache = !c.DisableWritebackCaching
+
+	r.AsyncRead = r.AsyncRead || c.EnableAsyncReads
+	r.SymlinkCaching = r.SymlinkCaching || c.EnableSymlinkCaching
+	r.NoOpenSupport = r.NoOpenSupport || c.EnableNoOpenSupport
+	r.NoOpendirSupport = r.NoOpendirSupport || c.EnableNoOpendirSupport
+	r.ParallelDirOps = r.ParallelDirOps || c.EnableParallelDirOps
+	r.AtomicTrunc = r.AtomicTrunc || c.EnableAtomicTrunc
+	r.ExportSupport = r.ExportSupport || c.EnableExportSupport
+	r.HandleKillPrivV2 = r.HandleKillPrivV2 || c.HandleKillPrivV2
+	r.SetxattrExt = r.SetxattrExt || c.EnableSetxattrExt
+	r.DirectIOMmap = r.DirectIOMmap || c.EnableDirectIOMmap
+	r.PosixLocks = r.PosixLocks || c.EnablePosixLocks
+	r.Readdirplus = r.Readdirplus || c.EnableReaddirplus
+
+	return r
+}
+
+// Compute the flags to send in the reply to the kernel's init op, given the
+// flags that the kernel offered in the request.
+func (c *MountConfig) initFlags(
+	offered fusekernel.InitFlags) (flags fusekernel.InitFlags) {
+	r := c.requested()
+
+	// Tell the kernel not to use pitifully small 4 KiB writes.
+	flags |= fusekernel.InitBigWrites
+
+	if r.AsyncRead {
+		flags |= fusekernel.InitAsyncRead
+	}
+
+	// kernel 4.20 increases the max from 32 -> 256
+	flags |= fusekernel.InitMaxPages
+
+	// Enable writeback caching if the user hasn't asked us not to.
+	if r.WritebackCache {
+		flags |= fusekernel.InitWritebackCache
+	}
+
+	// Enable caching symlink targets in the kernel page cache if the user opted
+	// into it (might require fixing the size field of inode attributes first):
+	if r.SymlinkCaching && offered&fusekernel.InitCacheSymlinks != 0 {
+		flags |= fusekernel.InitCacheSymlinks
+	}
+
+	// Tell the kernel to treat returning -ENOSYS on OpenFile as not needing
+	// OpenFile calls at all (Linux >= 3.16):
+	if r.NoOpenSupport && offered&fusekernel.InitNoOpenSupport != 0 {
+		flags |= fusekernel.InitNoOpenSupport
+	}
+
+	// Tell the kernel to treat returning -ENOSYS on OpenDir as not needing
+	// OpenDir calls at all (Linux >= 5.1):
+	if r.NoOpendirSupport && offered&fusekernel.InitNoOpendirSupport != 0 {
+		flags |= fusekernel.InitNoOpendirSupport
+	}
+
+	// Features that the file system must opt into, since they change what it
+	// may be asked to do.
+	if r.ParallelDirOps && offered&fusekernel.InitParallelDirops != 0 {
+		flags |= fusekernel.InitParallelDirops
+	}
+
+	if r.PosixLocks && offered&fusekernel.InitPosixLocks != 0 {
+		flags |= fusekernel.InitPosixLocks
+	}
+
+	// Let the kernel choose between ReadDirOp and ReadDirPlusOp for each read,
+	// rather than always sending the latter.
+	if r.Readdirplus && offered&fusekernel.InitDoReaddirplus != 0 {
+		flags |= fusekernel.InitDoReaddirplus
+		flags |= offered & fusekernel.InitReaddirplusAuto
+	}
+
+	if r.AtomicTrunc && offered&fusekernel.InitAtomicTrunc != 0 {
+		flags |= fusekernel.InitAtomicTrunc
+	}
+
+	if r.ExportSupport && offered&fusekernel.InitExportSupport != 0 {
+		flags |= fusekernel.InitExportSupport
+	}
+
+	// These bits mean something else on OS X.
+	if r.HandleKillPrivV2 && offered&fusekernel.InitHandleKillprivV2 != 0 && runtime.GOOS == "linux" {
+		flags |= fusekernel.InitHandleKillprivV2
+	}
+
+	if r.SetxattrExt && offered&fusekernel.InitSetxattrExt != 0 && runtime.GOOS == "linux" {
+		flags |= fusekernel.InitSetxattrExt
+	}
+
+	return flags
+}
+
+// Like initFlags, for the second word of flags, which newer kernels offer
+// (protocol >= 7.36). offered is zero for kernels that don't.
+func (c *MountConfig) initFlags2(
+	offered fusekernel.InitFlags2) (flags fusekernel.InitFlags2) {
+	if c.requested().DirectIOMmap && offered&fusekernel.InitDirectIOAllowMmap != 0 {
+		flags |= fusekernel.InitDirectIOAllowMmap
+	}
+
+	return flags
+}
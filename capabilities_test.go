@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestInitFlags(t *testing.T) {
+	const everything = ^fusekernel.InitFlags(0)
+	const base = fusekernel.InitBigWrites | fusekernel.InitMaxPages
+
+	testCases := []struct {
+		desc     string
+		cfg      MountConfig
+		offered  fusekernel.InitFlags
+		expected fusekernel.InitFlags
+	}{
+		{
+			desc:     "defaults",
+			cfg:      MountConfig{},
+			offered:  everything,
+			expected: base | fusekernel.InitWritebackCache,
+		},
+
+		{
+			desc: "all enabled",
+			cfg: MountConfig{
+				Capabilities: Capabilities{
+					AsyncRead:        true,
+					SymlinkCaching:   true,
+					NoOpenSupport:    true,
+					NoOpendirSupport: true,
+					ParallelDirOps:   true,
+					PosixLocks:       true,
+					AtomicTrunc:      true,
+					ExportSupport:    true,
+					Readdirplus:      true,
+				},
+			},
+			offered: everything,
+			expected: base |
+				fusekernel.InitWritebackCache |
+				fusekernel.InitAsyncRead |
+				fusekernel.InitCacheSymlinks |
+				fusekernel.InitNoOpenSupport |
+				fusekernel.InitNoOpendirSupport |
+				fusekernel.InitParallelDirops |
+				fusekernel.InitPosixLocks |
+				fusekernel.InitAtomicTrunc |
+				fusekernel.InitExportSupport |
+				fusekernel.InitDoReaddirplus |
+				fusekernel.InitReaddirplusAuto,
+		},
+
+		{
+			desc: "not offered",
+			cfg: MountConfig{
+				DisableWritebackCaching: true,
+				Capabilities: Capabilities{
+					SymlinkCaching:   true,
+					NoOpenSupport:    true,
+					NoOpendirSupport: true,
+					AtomicTrunc:      true,
+					Readdirplus:      true,
+				},
+			},
+			offered:  fusekernel.InitNoOpenSupport | fusekernel.InitExportSupport,
+			expected: base | fusekernel.InitNoOpenSupport,
+		},
+
+		{
+			desc: "always requested or not requestable",
+			cfg: MountConfig{
+				DisableWritebackCaching: true,
+				Capabilities: Capabilities{
+					WritebackCache: true,
+					Resend:         true,
+				},
+			},
+			offered:  everything,
+			expected: base,
+		},
+
+		{
+			desc: "deprecated fields",
+			cfg: MountConfig{
+				EnableAsyncReads:     true,
+				EnablePosixLocks:     true,
+				EnableReaddirplus:    true,
+				EnableExportSupport:  true,
+				EnableSymlinkCaching: true,
+				Capabilities:         Capabilities{AtomicTrunc: true},
+			},
+			offered: everything,
+			expected: base |
+				fusekernel.InitWritebackCache |
+				fusekernel.InitAsyncRead |
+				fusekernel.InitPosixLocks |
+				fusekernel.InitDoReaddirplus |
+				fusekernel.InitReaddirplusAuto |
+				fusekernel.InitExportSupport |
+				fusekernel.InitCacheSymlinks |
+				fusekernel.InitAtomicTrunc,
+		},
+	}
+
+	// Killpriv v2 and extended setxattr share their bits with other features on
+	// OS X, so are negotiated only on Linux.
+	type testCase = struct {
+		desc     string
+		cfg      MountConfig
+		offered  fusekernel.InitFlags
+		expected fusekernel.InitFlags
+	}
+
+	if runtime.GOOS == "linux" {
+		testCases = append(
+			testCases,
+			testCase{
+				desc:     "killpriv v2",
+				cfg:      MountConfig{Capabilities: Capabilities{HandleKillPrivV2: true}},
+				offered:  everything,
+				expected: base | fusekernel.InitWritebackCache | fusekernel.InitHandleKillprivV2,
+			},
+			testCase{
+				desc:     "extended setxattr",
+				cfg:      MountConfig{Capabilities: Capabilities{SetxattrExt: true}},
+				offered:  everything,
+				expected: base | fusekernel.InitWritebackCache | fusekernel.InitSetxattrExt,
+			})
+	} else {
+		testCases = append(testCases, testCase{
+			desc: "linux only",
+			cfg: MountConfig{
+				Capabilities: Capabilities{
+					HandleKillPrivV2: true,
+					SetxattrExt:      true,
+				},
+			},
+			offered:  everything,
+			expected: base | fusekernel.InitWritebackCache,
+		})
+	}
+
+	for _, tc := range testCases {
+		if got := tc.cfg.initFlags(tc.offered); got != tc.expected {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.expected)
+		}
+	}
+}
+
+func TestNewCapabilities(t *testing.T) {
+	cfg := MountConfig{
+		Capabilities: Capabilities{
+			AsyncRead:     true,
+			NoOpenSupport: true,
+		},
+	}
+
+	// A kernel that offers async reads and writeback caching, but not big
+	// writes or the others.
+	offered := fusekernel.InitAsyncRead | fusekernel.InitWritebackCache
+
+	got := newCapabilities(cfg.initFlags(offered)&offered, 0)
+	expected := Capabilities{
+		AsyncRead:      true,
+		WritebackCache: true,
+	}
+
+	if got != expected {
+		t.Errorf("got %+v, want %+v", got, expected)
+	}
+}
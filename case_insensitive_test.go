@@ -0,0 +1,152 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A file system whose root matches names without regard to case, and which
+// asks the kernel to cache negative entries for an hour.
+type caseFS struct {
+	minimalFS
+
+	mu   sync.Mutex
+	name string // GUARDED_BY(mu)
+}
+
+const caseFileID = fuseops.RootInodeID + 1
+
+func (fs *caseFS) attributes(
+	inode fuseops.InodeID) (fuseops.InodeAttributes, error) {
+	switch inode {
+	case fuseops.RootInodeID:
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0777 | os.ModeDir}, nil
+
+	case caseFileID:
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0666}, nil
+
+	default:
+		return fuseops.InodeAttributes{}, fuse.ENOENT
+	}
+}
+
+func (fs *caseFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID {
+		return fuse.ENOENT
+	}
+
+	if fs.name == "" || !strings.EqualFold(op.Name, fs.name) {
+		op.Entry.EntryExpiration = time.Now().Add(time.Hour)
+		return nil
+	}
+
+	op.Entry.Child = caseFileID
+	op.Entry.Attributes, _ = fs.attributes(caseFileID)
+	return nil
+}
+
+func (fs *caseFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	var err error
+	op.Attributes, err = fs.attributes(op.Inode)
+	return err
+}
+
+func (fs *caseFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID {
+		return fuse.EIO
+	}
+
+	if fs.name != "" {
+		return fuse.EEXIST
+	}
+
+	fs.name = op.Name
+	op.Entry.Child = caseFileID
+	op.Entry.Attributes, _ = fs.attributes(caseFileID)
+	return nil
+}
+
+func (fs *caseFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *caseFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	dir := mountFS(t, &caseFS{}, &fuse.MountConfig{CaseInsensitive: true}).Dir()
+
+	// Look up the file before it exists, which would leave a negative entry
+	// in the kernel's cache were it honored.
+	if _, err := os.Stat(path.Join(dir, "foo")); !os.IsNotExist(err) {
+		t.Fatalf("Stat before create: %v", err)
+	}
+
+	// Create it with different case.
+	f, err := os.OpenFile(
+		path.Join(dir, "FoO"),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0666)
+
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Both spellings should now find it.
+	fa, err := os.Stat(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatalf("Stat foo: %v", err)
+	}
+
+	fb, err := os.Stat(path.Join(dir, "FoO"))
+	if err != nil {
+		t.Fatalf("Stat FoO: %v", err)
+	}
+
+	if !os.SameFile(fa, fb) {
+		t.Errorf("foo and FoO are different files")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FUSE_DEV_IOC_CLONE, i.e. _IOR(229, 0, uint32_t). Cf. include/uapi/linux/fuse.h.
+const fuseDevIocClone = 0x8004e500
+
+// Open a new /dev/fuse file descriptor attached to the same connection as the
+// supplied one (Linux >= 4.2). Replies must be written to the descriptor from
+// which the corresponding request was read.
+func cloneDevice(dev *os.File) (*os.File, error) {
+	// As in directmount, open in blocking mode.
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/fuse", Err: err}
+	}
+
+	orig := uint32(dev.Fd())
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		fuseDevIocClone,
+		uintptr(unsafe.Pointer(&orig)))
+
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("FUSE_DEV_IOC_CLONE", errno)
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/fuse"), nil
+}
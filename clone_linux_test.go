@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+)
+
+// Compare the throughput of uncached stat(2) calls from many goroutines when
+// all requests are read from a single /dev/fuse descriptor against when each
+// reader has its own cloned descriptor.
+func BenchmarkDeviceClones(b *testing.B) {
+	for _, clones := range []int{0, runtime.NumCPU() - 1} {
+		b.Run(fmt.Sprintf("clones=%d", clones), func(b *testing.B) {
+			benchmarkStat(b, clones)
+		})
+	}
+}
+
+func benchmarkStat(b *testing.B, clones int) {
+	// Mount. handleAttrsFS doesn't allow the kernel to cache anything, so every
+	// stat reaches the file system.
+	mfs := mountFS(b, newHandleAttrsFS(), &fuse.MountConfig{DeviceClones: clones})
+
+	p := path.Join(mfs.Dir(), "foo")
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := os.Stat(p); err != nil {
+				b.Errorf("Stat: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func TestDeviceClones(t *testing.T) {
+	// Mount with a few cloned descriptors.
+	mfs := mountFS(t, newHandleAttrsFS(), &fuse.MountConfig{DeviceClones: 3})
+
+	// Requests should be answered whichever descriptor they are read from.
+	for i := 0; i < 100; i++ {
+		fi, err := os.Stat(path.Join(mfs.Dir(), "foo"))
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+
+		if fi.Size() != 1 {
+			t.Fatalf("Unexpected size: %d", fi.Size())
+		}
+	}
+}
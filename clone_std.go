@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import (
+	"errors"
+	"os"
+)
+
+func cloneDevice(dev *os.File) (*os.File, error) {
+	return nil, errors.New("Cloning the fuse device is only supported on Linux")
+}
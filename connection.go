@@ -22,8 +22,11 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
+	"unsafe"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
@@ -51,8 +54,12 @@ var contextKey interface{} = contextKeyType(0)
 //
 //  *  (http://goo.gl/JnhbdL) Don't read ahead at all if that field is zero.
 //
-// Reading a page at a time is a drag. Ask for a larger size.
-const maxReadahead = 1 << 20
+// Reading a page at a time is a drag. Ask for a larger size, unless
+// MountConfig.MaxReadahead says otherwise.
+const defaultMaxReadahead = 1 << 20
+
+// The smallest max_write the kernel accepts, raising anything less to it.
+const minMaxWrite = 4096
 
 // Connection represents a connection to the fuse kernel process. It is used to
 // receive and reply to requests from the kernel.
@@ -66,25 +73,115 @@ type Connection struct {
 	dev      *os.File
 	protocol fusekernel.Protocol
 
+	// Additional descriptors for the device cloned from dev, and a pool of those
+	// descriptors (dev included) that are not currently being read from.
+	clones   []*os.File
+	idleDevs chan *os.File
+
+	// The protocol version offered by the kernel, which may be newer than the
+	// one we're using.
+	kernelProtocol fusekernel.Protocol
+
+	// The access time behavior requested in the mount options, reported to the
+	// file system on reads.
+	atime fuseops.AtimeMode
+
+	// The optional features negotiated during Init.
+	capabilities Capabilities
+
+	// The largest writes and reads the kernel will send, and how far it will
+	// read ahead, as negotiated during Init.
+	maxWrite     uint32
+	maxRead      uint32
+	maxReadahead uint32
+
+	// Non-nil if MountConfig.EnableAttributeConsistencyCheck is set.
+	attrChecker *attributeChecker
+
+	// Non-nil if MountConfig.EnableTimeMonotonicityCheck is set.
+	timeChecker *timeChecker
+
+	// Non-nil if MountConfig.EnableDirectoryAliasCheck is set.
+	dirAliasChecker *dirAliasChecker
+
+	// Non-nil if debug logging is enabled.
+	genChecker *generationChecker
+
+	// Non-nil if MountConfig.EnableInodeLifecycleTracing is set.
+	inodeTracker *inodeTracker
+
+	// Statistics about reads from the device, for Stats.
+	queueStats queueStats
+
+	// Outstanding ops and recent errors, for Health.
+	health healthTracker
+
+	// Closed by close, to stop watchForStalls.
+	closed chan struct{}
+
 	mu sync.Mutex
 
 	// A map from fuse "unique" request ID (*not* the op ID for logging used
 	// above) to a function that cancel's its associated context.
 	//
 	// GUARDED_BY(mu)
-	cancelFuncs map[uint64]func()
+	cancelFuncs map[uint64]func(error)
+
+	// Set once NotifyResend has been called, after which the following are
+	// maintained:
+	//
+	//  *  outstanding has a key for the ID of each op read but not yet
+	//     answered, less fusekernel.UniqueResend. The value is nil unless the
+	//     kernel has resent the request, in which case it is the resend, to
+	//     which the reply must go.
+	//
+	//  *  resendable has a key for each op that was outstanding when
+	//     NotifyResend was last called, and so may be resent, until the op is
+	//     answered or its resend arrives.
+	//
+	//  *  unclaimedReplies holds replies to those ops that the kernel refused,
+	//     presumably because it had taken the request back to resend it, until
+	//     the resend arrives. A reply to any other op that the kernel refuses,
+	//     e.g. because it gave up on the op when it was interrupted, is
+	//     dropped, as is any reply left over when NotifyResend is next called.
+	//
+	// GUARDED_BY(mu)
+	resendRequested  bool
+	outstanding      map[uint64]*resentRequest
+	resendable       map[uint64]bool
+	unclaimedReplies map[uint64][]byte
+
+	// While dispatch is paused, a channel that Resume closes. Nil otherwise.
+	//
+	// GUARDED_BY(mu)
+	resumed chan struct{}
 
 	// Freelists, serviced by freelists.go.
 	inMessages  freelist.Freelist // GUARDED_BY(mu)
 	outMessages freelist.Freelist // GUARDED_BY(mu)
 }
 
+// A request that the kernel has resent, identified by the ID it carries and
+// the device descriptor from which it was read.
+type resentRequest struct {
+	fuseID uint64
+	dev    *os.File
+}
+
 // State that is maintained for each in-flight op. This is stuffed into the
 // context that the user uses to reply to the op.
 type opState struct {
 	inMsg  *buffer.InMessage
 	outMsg *buffer.OutMessage
 	op     interface{}
+
+	// The device descriptor from which the op was read, to which the reply must
+	// be written.
+	dev *os.File
+
+	// Non-nil if MountConfig.OpTracer is set: the function with which to report
+	// the op's result to the tracer.
+	endTrace func(error)
 }
 
 // Create a connection wrapping the supplied file descriptor connected to the
@@ -101,7 +198,32 @@ func newConnection(
 		debugLogger: debugLogger,
 		errorLogger: errorLogger,
 		dev:         dev,
-		cancelFuncs: make(map[uint64]func()),
+		atime:       cfg.atimeMode(),
+		idleDevs:    make(chan *os.File, 1+cfg.DeviceClones),
+		cancelFuncs: make(map[uint64]func(error)),
+		closed:      make(chan struct{}),
+	}
+
+	c.idleDevs <- dev
+
+	if cfg.EnableAttributeConsistencyCheck {
+		c.attrChecker = newAttributeChecker()
+	}
+
+	if cfg.EnableTimeMonotonicityCheck {
+		c.timeChecker = newTimeChecker()
+	}
+
+	if cfg.EnableDirectoryAliasCheck {
+		c.dirAliasChecker = newDirAliasChecker()
+	}
+
+	if debugLogger != nil {
+		c.genChecker = newGenerationChecker()
+	}
+
+	if cfg.EnableInodeLifecycleTracing {
+		c.inodeTracker = newInodeTracker()
 	}
 
 	// Initialize.
@@ -110,9 +232,47 @@ func newConnection(
 		return nil, fmt.Errorf("Init: %v", err)
 	}
 
+	// Clone the device if requested. This must happen after Init, since the
+	// kernel refuses to clone a device whose connection isn't yet set up.
+	for i := 0; i < cfg.DeviceClones; i++ {
+		clone, err := cloneDevice(dev)
+		if err != nil {
+			c.close()
+			return nil, fmt.Errorf("cloneDevice: %v", err)
+		}
+
+		c.clones = append(c.clones, clone)
+		c.idleDevs <- clone
+	}
+
+	if cfg.ReadStallThreshold > 0 && errorLogger != nil {
+		go c.watchForStalls(cfg.ReadStallThreshold)
+	}
+
 	return c, nil
 }
 
+// NewConnection performs the init handshake over the supplied file, which
+// must behave like /dev/fuse (one message per read and write), and returns a
+// connection ready to be served. Mount takes care of this for real mounts; this
+// is for speaking the protocol over something else, such as a socket used to
+// replay captured requests in a test.
+//
+// The caller is responsible for closing dev once the connection has been
+// served.
+func NewConnection(config *MountConfig, dev *os.File) (*Connection, error) {
+	cfgCopy := *config
+	if cfgCopy.OpContext == nil {
+		cfgCopy.OpContext = context.Background()
+	}
+
+	return newConnection(
+		cfgCopy,
+		config.DebugLogger,
+		config.ErrorLogger,
+		dev)
+}
+
 // Init performs the work necessary to cause the mount process to complete.
 func (c *Connection) Init() error {
 	// Read the init op.
@@ -139,6 +299,7 @@ func (c *Connection) Init() error {
 	}
 
 	// Downgrade our protocol if necessary.
+	c.kernelProtocol = initOp.Kernel
 	c.protocol = fusekernel.Protocol{
 		fusekernel.ProtoVersionMaxMajor,
 		fusekernel.ProtoVersionMaxMinor,
@@ -148,53 +309,205 @@ func (c *Connection) Init() error {
 		c.protocol = initOp.Kernel
 	}
 
-	cacheSymlinks := initOp.Flags&fusekernel.InitCacheSymlinks > 0
-	noOpenSupport := initOp.Flags&fusekernel.InitNoOpenSupport > 0
-	noOpendirSupport := initOp.Flags&fusekernel.InitNoOpendirSupport > 0
-
 	// Respond to the init op.
+	offered := initOp.Flags
+	offered2 := initOp.Flags2
+
 	initOp.Library = c.protocol
-	initOp.MaxReadahead = maxReadahead
-	initOp.MaxWrite = buffer.MaxWriteSize
+	initOp.MaxReadahead = c.cfg.maxReadahead(initOp.MaxReadahead)
+	initOp.MaxWrite = c.cfg.maxWrite()
+	initOp.Flags = c.cfg.initFlags(offered)
+	initOp.Flags2 = c.cfg.initFlags2(offered2)
+
+	// The kernel only looks at the second word of flags if told to.
+	if initOp.Flags2 != 0 {
+		initOp.Flags |= fusekernel.InitInitExt
+	}
 
-	initOp.Flags = 0
+	// kernel 4.20 increases the max from 32 -> 256
+	initOp.MaxPages = 256
+
+	c.capabilities = newCapabilities(
+		initOp.Flags&offered,
+		initOp.Flags2&offered2)
+
+	c.capabilities.Resend = offered2&fusekernel.InitHasResend != 0
 
-	// Tell the kernel not to use pitifully small 4 KiB writes.
-	initOp.Flags |= fusekernel.InitBigWrites
+	c.maxWrite, c.maxRead = c.requestLimits(initOp)
+	c.maxReadahead = initOp.MaxReadahead
 
-	if c.cfg.EnableAsyncReads {
-		initOp.Flags |= fusekernel.InitAsyncRead
+	c.debugLog(
+		ctx.Value(contextKey).(opState).inMsg.Header().Unique,
+		1,
+		"Negotiated max_write %d, max_read %d, max_readahead %d",
+		c.maxWrite,
+		c.maxRead,
+		c.maxReadahead)
+
+	c.Reply(ctx, nil)
+	return nil
+}
+
+// The kernel's limit on the number of pages in a request, when it doesn't
+// support InitMaxPages (FUSE_DEFAULT_MAX_PAGES_PER_REQ).
+const defaultMaxPages = 32
+
+// Work out the largest writes and reads the kernel will send, given our
+// response to the init op.
+//
+// The kernel caps both at the number of pages it allows in a request: ours if
+// it accepted InitMaxPages, otherwise its default. Writes are further capped at
+// the max_write in the response, and reads at any max_read mount option.
+func (c *Connection) requestLimits(initOp *initOp) (maxWrite, maxRead uint32) {
+	pages := uint32(defaultMaxPages)
+	if c.capabilities.MaxPages {
+		pages = uint32(initOp.MaxPages)
 	}
 
-	// kernel 4.20 increases the max from 32 -> 256
-	initOp.Flags |= fusekernel.InitMaxPages
-	initOp.MaxPages = 256
+	limit := pages * uint32(os.Getpagesize())
 
-	// Enable writeback caching if the user hasn't asked us not to.
-	if !c.cfg.DisableWritebackCaching {
-		initOp.Flags |= fusekernel.InitWritebackCache
+	maxWrite = limit
+	if initOp.MaxWrite < maxWrite {
+		maxWrite = initOp.MaxWrite
 	}
 
-	// Enable caching symlink targets in the kernel page cache if the user opted
-	// into it (might require fixing the size field of inode attributes first):
-	if c.cfg.EnableSymlinkCaching && cacheSymlinks {
-		initOp.Flags |= fusekernel.InitCacheSymlinks
+	maxRead = limit
+	if s, ok := c.cfg.Options["max_read"]; ok {
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err == nil && uint32(n) < maxRead {
+			maxRead = uint32(n)
+		}
 	}
 
-	// Tell the kernel to treat returning -ENOSYS on OpenFile as not needing
-	// OpenFile calls at all (Linux >= 3.16):
-	if c.cfg.EnableNoOpenSupport && noOpenSupport {
-		initOp.Flags |= fusekernel.InitNoOpenSupport
+	return maxWrite, maxRead
+}
+
+// MaxWrite returns the largest number of bytes the kernel will send in a
+// single WriteFileOp, as negotiated when the connection was initialized. File
+// systems may use it to size write buffers or choose chunk sizes. See
+// MountConfig.MaxWrite.
+func (c *Connection) MaxWrite() uint32 {
+	return c.maxWrite
+}
+
+// MaxRead returns the largest number of bytes the kernel will ask for in a
+// single ReadFileOp, as negotiated when the connection was initialized.
+func (c *Connection) MaxRead() uint32 {
+	return c.maxRead
+}
+
+// MaxReadahead returns how many bytes the kernel may read ahead of sequential
+// reads, as negotiated when the connection was initialized. See
+// MountConfig.MaxReadahead.
+func (c *Connection) MaxReadahead() uint32 {
+	return c.maxReadahead
+}
+
+// Capabilities returns the optional features that were negotiated with the
+// kernel when the connection was initialized: those that were both requested
+// (see MountConfig.Capabilities) and offered by the kernel.
+func (c *Connection) Capabilities() Capabilities {
+	return c.capabilities
+}
+
+// Stats returns statistics about the requests read from the kernel so far,
+// including an estimate of how long they wait to be read. This is useful for
+// deciding how many goroutines to devote to serving the connection.
+func (c *Connection) Stats() ConnectionStats {
+	return c.queueStats.get()
+}
+
+// InodeRefCounts returns a snapshot of the kernel's lookup count for each
+// inode it currently holds, as seen in the ops served so far, or nil unless
+// MountConfig.EnableInodeLifecycleTracing is set. Inodes whose count has
+// returned to zero are omitted.
+func (c *Connection) InodeRefCounts() map[fuseops.InodeID]int64 {
+	if c.inodeTracker == nil {
+		return nil
 	}
 
-	// Tell the kernel to treat returning -ENOSYS on OpenDir as not needing
-	// OpenDir calls at all (Linux >= 5.1):
-	if c.cfg.EnableNoOpendirSupport && noOpendirSupport {
-		initOp.Flags |= fusekernel.InitNoOpendirSupport
+	return c.inodeTracker.snapshot()
+}
+
+// Health reports whether the connection is alive, and if so whether ops are
+// being answered promptly and mostly successfully. See HealthStatus.
+func (c *Connection) Health() HealthStatus {
+	threshold := c.cfg.StuckOpThreshold
+	if threshold == 0 {
+		threshold = defaultStuckOpThreshold
 	}
 
-	c.Reply(ctx, nil)
-	return nil
+	return c.health.status(c.now(), threshold)
+}
+
+// Pause stops ReadOp from returning ops until Resume is called, e.g. for the
+// duration of a backend failover or maintenance window. Requests queue up in
+// the kernel meanwhile, and the processes making them wait rather than seeing
+// errors, for as long as the kernel is willing to wait. Ops already returned
+// by ReadOp are unaffected, and may be replied to as usual.
+//
+// A call to ReadOp that is already waiting for a request when Pause is called
+// may still read one, and holds on to it until Resume. There can be one such
+// call per device descriptor, so with MountConfig.DeviceClones set up to
+// DeviceClones+1 requests may be held. Apart from those, nothing is read from
+// the kernel while paused, including interrupts and the end of the connection,
+// so MountedFileSystem.Join doesn't return until dispatch is resumed.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+}
+
+// Resume undoes Pause, letting ReadOp return ops again.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+// Block while dispatch is paused.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) waitUntilResumed() {
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// Return the current time according to MountConfig.Clock.
+func (c *Connection) now() time.Time {
+	if c.cfg.Clock != nil {
+		return c.cfg.Clock.Now()
+	}
+
+	return time.Now()
+}
+
+// KernelProtocol returns the FUSE protocol version that the kernel offered when
+// the connection was initialized, and the version negotiated for use on it.
+// The latter is the older of the former and the newest version supported by
+// this package, and determines which features may be enabled.
+func (c *Connection) KernelProtocol() (
+	offeredMajor, offeredMinor, negotiatedMajor, negotiatedMinor uint32) {
+	return c.kernelProtocol.Major,
+		c.kernelProtocol.Minor,
+		c.protocol.Major,
+		c.protocol.Minor
 }
 
 // Log information for an operation with the given ID. calldepth is the depth
@@ -234,7 +547,7 @@ func (c *Connection) debugLog(
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) recordCancelFunc(
 	fuseID uint64,
-	f func()) {
+	f func(error)) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -243,17 +556,38 @@ func (c *Connection) recordCancelFunc(
 	}
 
 	c.cancelFuncs[fuseID] = f
+	if c.resendRequested {
+		c.outstanding[fuseID&^fusekernel.UniqueResend] = nil
+	}
+}
+
+// Is the supplied opcode one of the forget ops, to which the kernel expects no
+// reply?
+func isForget(opCode uint32) bool {
+	return opCode == fusekernel.OpForget || opCode == fusekernel.OpBatchForget
+}
+
+// Is the supplied op one of the forget ops?
+func isForgetOp(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+		return true
+	}
+
+	return false
 }
 
 // Set up state for an op that is about to be returned to the user, given its
-// underlying fuse opcode and request ID.
+// underlying fuse opcode and request ID, and the timeout to apply to it (zero
+// for none).
 //
 // Return a context that should be used for the op.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) beginOp(
 	opCode uint32,
-	fuseID uint64) context.Context {
+	fuseID uint64,
+	timeout time.Duration) context.Context {
 	// Start with the parent context.
 	ctx := c.cfg.OpContext
 
@@ -265,10 +599,12 @@ func (c *Connection) beginOp(
 	// should not record any state keyed on their ID.
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
-	if opCode != fusekernel.OpForget {
-		var cancel func()
-		ctx, cancel = context.WithCancel(ctx)
+	if !isForget(opCode) {
+		var cancel func(error)
+		ctx, cancel = newOpContext(ctx, timeout)
+
 		c.recordCancelFunc(fuseID, cancel)
+		c.health.opStarted(fuseID, c.now())
 	}
 
 	return ctx
@@ -292,13 +628,13 @@ func (c *Connection) finishOp(
 	//
 	// Special case: we don't do this for Forget requests. See the note in
 	// beginOp above.
-	if opCode != fusekernel.OpForget {
+	if !isForget(opCode) {
 		cancel, ok := c.cancelFuncs[fuseID]
 		if !ok {
 			panic(fmt.Sprintf("Unknown request ID in finishOp: %v", fuseID))
 		}
 
-		cancel()
+		cancel(nil)
 		delete(c.cancelFuncs, fuseID)
 	}
 }
@@ -322,24 +658,46 @@ func (c *Connection) handleInterrupt(fuseID uint64) {
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
 	// Cf. http://comments.gmane.org/gmane.comp.file-systems.fuse.devel/14675
+	//
+	// The interrupt of a request that the kernel has resent names the resend,
+	// which we may have folded into the original (see claimResend).
 	cancel, ok := c.cancelFuncs[fuseID]
+	if !ok {
+		cancel, ok = c.cancelFuncs[fuseID&^fusekernel.UniqueResend]
+	}
+
 	if !ok {
 		return
 	}
 
-	cancel()
+	cancel(ErrInterrupted)
+}
+
+// Cancel the contexts of all ops that have yet to be replied to, because the
+// kernel has closed the connection.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) cancelAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cancel := range c.cancelFuncs {
+		cancel(ErrShutdown)
+	}
 }
 
 // Read the next message from the kernel. The message must later be destroyed
 // using destroyInMessage.
-func (c *Connection) readMessage() (*buffer.InMessage, error) {
+func (c *Connection) readMessage(dev *os.File) (*buffer.InMessage, error) {
 	// Allocate a message.
 	m := c.getInMessage()
 
 	// Loop past transient errors.
 	for {
 		// Attempt a reaed.
-		err := m.Init(c.dev)
+		start, busy := c.queueStats.startRead()
+		err := m.Init(dev)
+		c.queueStats.finishRead(start, busy, err == nil)
 
 		// Special cases:
 		//
@@ -361,6 +719,7 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 
 		if err != nil {
 			c.putInMessage(m)
+			c.health.markDead()
 			return nil, err
 		}
 
@@ -369,9 +728,9 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 }
 
 // Write the supplied message to the kernel.
-func (c *Connection) writeMessage(msg []byte) error {
+func (c *Connection) writeMessage(dev *os.File, msg []byte) error {
 	// Avoid the retry loop in os.File.Write.
-	n, err := syscall.Write(int(c.dev.Fd()), msg)
+	n, err := syscall.Write(int(dev.Fd()), msg)
 	if err != nil {
 		return err
 	}
@@ -387,30 +746,69 @@ func (c *Connection) writeMessage(msg []byte) error {
 // context that should be used for work related to the op. It returns io.EOF if
 // the kernel has closed the connection.
 //
+// The context is canceled with cause ErrInterrupted if the kernel interrupts
+// the op, e.g. because the process that made the request received a signal.
+// Handlers for ops that may take a while should then give up and reply with
+// EINTR. See context.Cause for the other causes.
+//
 // If err != nil, the user is responsible for later calling c.Reply with the
 // returned context.
 //
 // This function delivers ops in exactly the order they are received from
-// /dev/fuse. It must not be called multiple times concurrently.
+// /dev/fuse. It must not be called multiple times concurrently, except when the
+// connection has cloned device descriptors (see MountConfig.DeviceClones): then
+// it may be called by up to ReadConcurrency goroutines at once, each call
+// reading from a descriptor that no other is using, and ops are no longer
+// ordered between the goroutines.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 	// Keep going until we find a request we know how to convert.
 	for {
-		// Read the next message from the kernel.
-		inMsg, err := c.readMessage()
+		// Leave requests with the kernel while dispatch is paused.
+		c.waitUntilResumed()
+
+		// Read the next message from the kernel, using a device descriptor that
+		// no concurrent call is reading from.
+		dev := <-c.idleDevs
+		inMsg, err := c.readMessage(dev)
+		c.idleDevs <- dev
+		if err == io.EOF {
+			c.cancelAll()
+		}
+
 		if err != nil {
 			return nil, nil, err
 		}
 
+		// Hold on to a message read while dispatch was being paused.
+		c.waitUntilResumed()
+
 		// Convert the message to an op.
 		outMsg := c.getOutMessage()
-		op, err = convertInMessage(inMsg, outMsg, c.protocol)
+		op, err = convertInMessage(inMsg, outMsg, c.protocol, c.capabilities)
 		if err != nil {
 			c.putOutMessage(outMsg)
 			return nil, nil, fmt.Errorf("convertInMessage: %v", err)
 		}
 
+		// Tell the file system whether the user cares about access times.
+		switch o := op.(type) {
+		case *fuseops.ReadFileOp:
+			o.Atime = c.atime
+
+		case *fuseops.ReadDirOp:
+			o.Atime = c.atime
+
+		case *fuseops.ReadDirPlusOp:
+			o.Atime = c.atime
+		}
+
+		// Start the file system off with the configured root attributes.
+		if c.isRootAttributesOp(op) {
+			op.(*fuseops.GetInodeAttributesOp).Attributes = *c.cfg.RootAttributes
+		}
+
 		// Choose an ID for this operation for the purposes of logging, and log it.
 		if c.debugLogger != nil {
 			c.debugLog(inMsg.Header().Unique, 1, "<- %s", describeRequest(op))
@@ -422,15 +820,172 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 			continue
 		}
 
+		// Special case: a request resent by the kernel that we have already
+		// dispatched is answered once, by the op we dispatched.
+		if c.claimResend(dev, inMsg.Header().Unique) {
+			c.putInMessage(inMsg)
+			c.putOutMessage(outMsg)
+			continue
+		}
+
 		// Set up a context that remembers information about this op.
-		ctx := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
-		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op})
+		ctx := c.beginOp(
+			inMsg.Header().Opcode,
+			inMsg.Header().Unique,
+			c.cfg.opTimeout(op))
+
+		// Let the tracer know, if any, about ops other than the init handshake.
+		var endTrace func(error)
+		if _, isInit := op.(*initOp); c.cfg.OpTracer != nil && !isInit {
+			ctx, endTrace = c.cfg.OpTracer.StartOp(ctx, OpTraceInfo{
+				Type:   OpTypeOf(op),
+				FuseID: inMsg.Header().Unique,
+				Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			})
+		}
+
+		ctx = context.WithValue(
+			ctx,
+			contextKey,
+			opState{inMsg, outMsg, op, dev, endTrace})
+
+		// Special case: refuse misaligned direct IO as a block device would.
+		if c.isMisalignedDirectIO(op) {
+			c.Reply(ctx, syscall.EINVAL)
+			continue
+		}
 
 		// Return the op to the user.
 		return ctx, op, nil
 	}
 }
 
+// If the request with the supplied ID is one that the kernel has resent (see
+// NotifyResend) and that we have already dispatched, arrange for it to be
+// answered without dispatching it again and return true. That is so if the op
+// is still outstanding, in which case its reply is redirected to the resend,
+// or if its reply was refused by the kernel, which we send again.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) claimResend(dev *os.File, fuseID uint64) bool {
+	if fuseID&fusekernel.UniqueResend == 0 {
+		return false
+	}
+
+	orig := fuseID &^ fusekernel.UniqueResend
+
+	c.mu.Lock()
+	if _, ok := c.outstanding[orig]; ok {
+		c.outstanding[orig] = &resentRequest{fuseID, dev}
+		c.mu.Unlock()
+		return true
+	}
+
+	reply, ok := c.unclaimedReplies[orig]
+	delete(c.unclaimedReplies, orig)
+	delete(c.resendable, orig)
+	c.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	(*fusekernel.OutHeader)(unsafe.Pointer(&reply[0])).Unique = fuseID
+	if err := c.writeMessage(dev, reply); err != nil && c.errorLogger != nil {
+		c.errorLogger.Printf("writeMessage: %v %v", err, reply)
+	}
+
+	return true
+}
+
+// Write the reply to the op with the supplied ID, which has been built in m,
+// taking into account that the kernel may have resent the request in the
+// meantime (see NotifyResend).
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) writeReply(
+	dev *os.File,
+	fuseID uint64,
+	m *buffer.OutMessage) error {
+	key := fuseID &^ fusekernel.UniqueResend
+
+	c.mu.Lock()
+	resent := c.outstanding[key]
+	c.mu.Unlock()
+
+	for {
+		if resent != nil {
+			fuseID, dev = resent.fuseID, resent.dev
+		}
+
+		m.OutHeader().Unique = fuseID
+		err := c.writeMessage(dev, m.Bytes())
+
+		var retry bool
+		resent, retry, err = c.replyWritten(key, resent, m.Bytes(), err)
+		if !retry {
+			return err
+		}
+	}
+}
+
+// Record the outcome of writing the supplied reply to the op with the supplied
+// ID less fusekernel.UniqueResend, which was addressed to resent if non-nil.
+// If the reply should instead be written to a resend that arrived in the
+// meantime, return that and true. Otherwise return the error to report.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) replyWritten(
+	key uint64,
+	resent *resentRequest,
+	reply []byte,
+	err error) (*resentRequest, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if latest := c.outstanding[key]; latest != resent && err == syscall.ENOENT {
+		// The resend arrived while we were writing: answer that instead.
+		return latest, true, nil
+	}
+
+	delete(c.outstanding, key)
+	if err == syscall.ENOENT && c.resendable[key] {
+		// The kernel may have taken the request back to resend it, and the
+		// resend has yet to be read. Keep the reply for claimResend.
+		c.unclaimedReplies[key] = append([]byte(nil), reply...)
+		return nil, false, nil
+	}
+
+	delete(c.resendable, key)
+	return nil, false, err
+}
+
+// Is the supplied op a read or write through a file opened with O_DIRECT that
+// doesn't meet MountConfig.DirectIOAlignment?
+func (c *Connection) isMisalignedDirectIO(op interface{}) bool {
+	align := int64(c.cfg.DirectIOAlignment)
+	if align == 0 {
+		return false
+	}
+
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		return o.OpenFlags.IsDirect() && (o.Offset%align != 0 || int64(len(o.Dst))%align != 0)
+
+	case *fuseops.WriteFileOp:
+		return o.OpenFlags.IsDirect() && (o.Offset%align != 0 || int64(len(o.Data))%align != 0)
+	}
+
+	return false
+}
+
+// Is the supplied op a request for the root's attributes, for which
+// MountConfig.RootAttributes is to be used?
+func (c *Connection) isRootAttributesOp(op interface{}) bool {
+	o, ok := op.(*fuseops.GetInodeAttributesOp)
+	return ok && o.Inode == fuseops.RootInodeID && c.cfg.RootAttributes != nil
+}
+
 // Skip errors that happen as a matter of course, since they spook users.
 func (c *Connection) shouldLogError(
 	op interface{},
@@ -445,26 +1000,37 @@ func (c *Connection) shouldLogError(
 		return false
 	}
 
+	// Misaligned direct IO is the caller's mistake, refused on our own account.
+	if err == syscall.EINVAL && c.isMisalignedDirectIO(op) {
+		return false
+	}
+
+	return !isRoutineError(op, err)
+}
+
+// Is the supplied error one that the file system returns for the op as a
+// matter of course, rather than a sign that something has gone wrong?
+func isRoutineError(op interface{}, err error) bool {
 	switch op.(type) {
 	case *fuseops.LookUpInodeOp:
 		// It is totally normal for the kernel to ask to look up an inode by name
 		// and find the name doesn't exist. For example, this happens when linking
 		// a new file.
 		if err == syscall.ENOENT {
-			return false
+			return true
 		}
 	case *fuseops.GetXattrOp, *fuseops.ListXattrOp:
-		if err == syscall.ENODATA || err == syscall.ERANGE {
-			return false
+		if err == ENOATTR || err == syscall.ERANGE {
+			return true
 		}
 	case *unknownOp:
 		// Don't bother the user with methods we intentionally don't support.
 		if err == syscall.ENOSYS {
-			return false
+			return true
 		}
 	}
 
-	return true
+	return false
 }
 
 // Reply replies to an op previously read using ReadOp, with the supplied error
@@ -489,8 +1055,14 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 	defer c.putInMessage(inMsg)
 	defer c.putOutMessage(outMsg)
 
+	// Serve the configured root attributes if the file system doesn't.
+	if opErr == ENOSYS && c.isRootAttributesOp(op) {
+		opErr = nil
+	}
+
 	// Clean up state for this op.
 	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
+	c.health.opFinished(fuseID, opErr != nil && !isRoutineError(op, opErr))
 
 	// Debug logging
 	if c.debugLogger != nil {
@@ -501,16 +1073,56 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 		}
 	}
 
+	// Tracing
+	if state.endTrace != nil {
+		state.endTrace(opErr)
+	}
+
 	// Error logging
 	if c.shouldLogError(op, opErr) {
 		c.errorLogger.Printf("%T error: %v", op, opErr)
 	}
 
+	// Attribute consistency checking
+	if c.attrChecker != nil && opErr == nil && c.errorLogger != nil {
+		if msg := c.attrChecker.check(op, c.now()); msg != "" {
+			c.errorLogger.Printf("%T: %s", op, msg)
+		}
+	}
+
+	// Time monotonicity checking
+	if c.timeChecker != nil && opErr == nil && c.errorLogger != nil {
+		if msg := c.timeChecker.check(op); msg != "" {
+			c.errorLogger.Printf("%T: %s", op, msg)
+		}
+	}
+
+	// Directory alias checking
+	if c.dirAliasChecker != nil && opErr == nil && c.errorLogger != nil {
+		if msg := c.dirAliasChecker.check(op); msg != "" {
+			c.errorLogger.Printf("%T: %s", op, msg)
+		}
+	}
+
+	// Generation number checking
+	if c.genChecker != nil {
+		if msg := c.genChecker.check(op, opErr); msg != "" {
+			c.debugLog(fuseID, 1, "Warning: %s", msg)
+		}
+	}
+
+	// Inode lifecycle tracing
+	if c.inodeTracker != nil {
+		for _, ch := range c.inodeTracker.record(op, opErr) {
+			c.debugLog(fuseID, 1, "Inode %d lookup count %+d -> %d", ch.id, ch.delta, ch.count)
+		}
+	}
+
 	// Send the reply to the kernel, if one is required.
 	noResponse := c.kernelResponse(outMsg, inMsg.Header().Unique, op, opErr)
 
 	if !noResponse {
-		err := c.writeMessage(outMsg.Bytes())
+		err := c.writeReply(state.dev, fuseID, outMsg)
 		if err != nil && c.errorLogger != nil {
 			c.errorLogger.Printf("writeMessage: %v %v", err, outMsg.Bytes())
 		}
@@ -523,5 +1135,17 @@ func (c *Connection) close() error {
 	// Posix doesn't say that close can be called concurrently with read or
 	// write, but luckily we exclude the possibility of a race by requiring the
 	// user to respond to all ops first.
+	close(c.closed)
+	for _, clone := range c.clones {
+		clone.Close()
+	}
+
 	return c.dev.Close()
 }
+
+// ReadConcurrency returns the number of goroutines that may usefully call
+// ReadOp concurrently: one per device descriptor for the connection. This is
+// one unless MountConfig.DeviceClones is set.
+func (c *Connection) ReadConcurrency() int {
+	return 1 + len(c.clones)
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestDirectIOAlignment(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{DirectIOAlignment: 512})
+	defer c.close()
+	defer kernel.Close()
+
+	// Discard the response to the init request.
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	read := func(offset uint64, size uint32, flags fusekernel.OpenFlags) []byte {
+		in := fusekernel.ReadIn{Offset: offset, Size: size, Flags: uint32(flags)}
+		return makeRequest(
+			fusekernel.OpRead,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+	}
+
+	write := func(offset uint64, size uint32, flags fusekernel.OpenFlags) []byte {
+		in := fusekernel.WriteIn{Offset: offset, Size: size, Flags: uint32(flags)}
+		return makeRequest(
+			fusekernel.OpWrite,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+			make([]byte, size))
+	}
+
+	direct := fusekernel.OpenReadWrite | fusekernel.OpenDirect
+	requests := [][]byte{
+		read(100, 512, direct),
+		read(512, 100, direct),
+		write(100, 512, direct),
+		write(512, 100, direct),
+		read(100, 100, fusekernel.OpenReadWrite),
+		read(1024, 512, direct),
+		write(512, 1024, direct),
+	}
+
+	for i, req := range requests {
+		(*fusekernel.InHeader)(unsafe.Pointer(&req[0])).Unique = uint64(i + 1)
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// Only the aligned direct IO, and the IO that isn't direct, should reach
+	// the file system.
+	for _, unique := range []uint64{5, 6, 7} {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		if got := ctx.Value(contextKey).(opState).inMsg.Header().Unique; got != unique {
+			t.Errorf("Got op %d (%T), want %d", got, op, unique)
+		}
+
+		switch op.(type) {
+		case *fuseops.ReadFileOp, *fuseops.WriteFileOp:
+		default:
+			t.Errorf("Unexpected op: %T", op)
+		}
+	}
+
+	// The rest should have been refused.
+	for unique := uint64(1); unique <= 4; unique++ {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		if n != int(unsafe.Sizeof(*h)) || h.Unique != unique || h.Error != -int32(syscall.EINVAL) {
+			t.Errorf("Unexpected reply of %d bytes: %+v", n, *h)
+		}
+	}
+}
@@ -0,0 +1,1207 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// The init request of a kernel offering the newest protocol version that we
+// support, and no flags.
+var latestInit = fusekernel.InitIn{
+	Major: fusekernel.ProtoVersionMaxMajor,
+	Minor: fusekernel.ProtoVersionMaxMinor,
+}
+
+// Create a connection that speaks to a socket standing in for /dev/fuse, which
+// preserves message boundaries as the device does, returning the connection
+// and the other end of the socket. The connection has received the supplied
+// init request, followed by ext for the extended request of newer kernels,
+// and replied to it.
+func newSocketConnection(
+	t *testing.T,
+	in fusekernel.InitIn,
+	cfg MountConfig,
+	ext ...[]byte) (c *Connection, kernel *os.File) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	dev := os.NewFile(uintptr(fds[0]), "dev")
+	kernel = os.NewFile(uintptr(fds[1]), "kernel")
+
+	body := [][]byte{structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in))}
+	msg := makeRequest(fusekernel.OpInit, append(body, ext...)...)
+	if _, err := kernel.Write(msg); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if cfg.OpContext == nil {
+		cfg.OpContext = context.Background()
+	}
+
+	c, err = newConnection(cfg, cfg.DebugLogger, cfg.ErrorLogger, dev)
+	if err != nil {
+		t.Fatalf("newConnection: %v", err)
+	}
+
+	return c, kernel
+}
+
+func TestKernelProtocol(t *testing.T) {
+	// Offer a newer minor version than we support.
+	offered := uint32(fusekernel.ProtoVersionMaxMinor + 5)
+	in := fusekernel.InitIn{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: offered,
+	}
+
+	c, kernel := newSocketConnection(t, in, MountConfig{})
+	defer kernel.Close()
+	defer c.close()
+
+	offeredMajor, offeredMinor, major, minor := c.KernelProtocol()
+	if offeredMajor != fusekernel.ProtoVersionMaxMajor || offeredMinor != offered {
+		t.Errorf("Offered: %d.%d", offeredMajor, offeredMinor)
+	}
+
+	if major != fusekernel.ProtoVersionMaxMajor ||
+		minor != fusekernel.ProtoVersionMaxMinor {
+		t.Errorf("Negotiated: %d.%d", major, minor)
+	}
+}
+
+func TestOpTimeouts(t *testing.T) {
+	const (
+		lookUpTimeout = 50 * time.Millisecond
+		readTimeout   = 500 * time.Millisecond
+	)
+
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{
+		OpTimeout: time.Hour,
+		OpTimeouts: map[OpType]time.Duration{
+			OpTypeOf(&fuseops.LookUpInodeOp{}):       lookUpTimeout,
+			OpTypeOf(&fuseops.ReadFileOp{}):          readTimeout,
+			OpTypeOf(&fuseops.ReleaseFileHandleOp{}): 0,
+		},
+	})
+
+	defer c.close()
+	defer kernel.Close()
+
+	// Send a lookup, a read, a getattr, and a release.
+	var readIn fusekernel.ReadIn
+	readIn.Size = 4096
+
+	var getattrIn fusekernel.GetattrIn
+	var releaseIn fusekernel.ReleaseIn
+
+	requests := [][]byte{
+		makeRequest(fusekernel.OpLookup, []byte("foo\x00")),
+		makeRequest(
+			fusekernel.OpRead,
+			structBytes(unsafe.Pointer(&readIn), unsafe.Sizeof(readIn))),
+		makeRequest(
+			fusekernel.OpGetattr,
+			structBytes(unsafe.Pointer(&getattrIn), unsafe.Sizeof(getattrIn))),
+		makeRequest(
+			fusekernel.OpRelease,
+			structBytes(unsafe.Pointer(&releaseIn), unsafe.Sizeof(releaseIn))),
+	}
+
+	contexts := make(map[OpType]context.Context)
+	for i, req := range requests {
+		// Give each request its own ID, since they are all in flight at once.
+		(*fusekernel.InHeader)(unsafe.Pointer(&req[0])).Unique = uint64(i + 1)
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		contexts[OpTypeOf(op)] = ctx
+	}
+
+	start := time.Now()
+	lookUpCtx := contexts["LookUpInodeOp"]
+	readCtx := contexts["ReadFileOp"]
+
+	// Each op's context should have its own deadline, with the global timeout
+	// applying to those without an override.
+	if _, ok := contexts["ReleaseFileHandleOp"].Deadline(); ok {
+		t.Error("ReleaseFileHandleOp has a deadline")
+	}
+
+	if d, ok := contexts["GetInodeAttributesOp"].Deadline(); !ok || d.Before(start.Add(time.Minute)) {
+		t.Errorf("GetInodeAttributesOp deadline: %v", d)
+	}
+
+	// The lookup should time out well before the read.
+	<-lookUpCtx.Done()
+	if lookUpCtx.Err() != context.DeadlineExceeded {
+		t.Errorf("LookUpInodeOp: %v", lookUpCtx.Err())
+	}
+
+	if readCtx.Err() != nil {
+		t.Errorf("ReadFileOp cancelled along with LookUpInodeOp: %v", readCtx.Err())
+	}
+
+	<-readCtx.Done()
+	if elapsed := time.Since(start); elapsed < readTimeout-lookUpTimeout {
+		t.Errorf("ReadFileOp timed out after only %v", elapsed)
+	}
+
+	for _, ctx := range contexts {
+		c.Reply(ctx, EIO)
+	}
+}
+
+func TestRootAttributes(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{
+		RootAttributes: &fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0750 | os.ModeDir,
+			Uid:   23,
+		},
+	})
+
+	defer c.close()
+	defer kernel.Close()
+
+	// Discard the response to the init request.
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// Request the root's attributes, and return the result of the file system
+	// replying to the op with the supplied function.
+	getRootAttrs := func(reply func(*fuseops.GetInodeAttributesOp) error) fusekernel.Attr {
+		var in fusekernel.GetattrIn
+		req := makeRequest(
+			fusekernel.OpGetattr,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+		(*fusekernel.InHeader)(unsafe.Pointer(&req[0])).Nodeid = fuseops.RootInodeID
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		c.Reply(ctx, reply(op.(*fuseops.GetInodeAttributesOp)))
+
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		if h.Error != 0 || n != buffer.OutMessageHeaderSize+int(fusekernel.AttrOutSize(c.protocol)) {
+			t.Fatalf("Unexpected response: error %d, %d bytes", h.Error, n)
+		}
+
+		out := (*fusekernel.AttrOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+		return out.Attr
+	}
+
+	// A file system that doesn't implement GetInodeAttributes gets the
+	// configured attributes.
+	attr := getRootAttrs(func(op *fuseops.GetInodeAttributesOp) error {
+		return ENOSYS
+	})
+
+	if attr.Mode != syscall.S_IFDIR|0750 || attr.Uid != 23 {
+		t.Errorf("Mode %o, uid %d", attr.Mode, attr.Uid)
+	}
+
+	// One that does starts with them, and may change them.
+	attr = getRootAttrs(func(op *fuseops.GetInodeAttributesOp) error {
+		if op.Attributes.Uid != 23 {
+			t.Errorf("Op started with uid %d", op.Attributes.Uid)
+		}
+
+		op.Attributes.Uid = 29
+		return nil
+	})
+
+	if attr.Mode != syscall.S_IFDIR|0750 || attr.Uid != 29 {
+		t.Errorf("Mode %o, uid %d", attr.Mode, attr.Uid)
+	}
+}
+
+func TestGetFlagsIoctl(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{})
+	defer c.close()
+	defer kernel.Close()
+
+	// Discard the response to the init request.
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// Send an ioctl for inode 23 through handle 17, returning the op read for
+	// it.
+	ioctl := func(cmd uint32) (context.Context, interface{}) {
+		in := fusekernel.IoctlIn{Fh: 17, Cmd: cmd, OutSize: 8}
+		req := makeRequest(
+			fusekernel.OpIoctl,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+		(*fusekernel.InHeader)(unsafe.Pointer(&req[0])).Nodeid = 23
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		return ctx, op
+	}
+
+	// FS_IOC_GETFLAGS is served as a request for the inode's flags.
+	ctx, op := ioctl(fusekernel.IoctlGetFlags)
+	getFlags, ok := op.(*fuseops.GetInodeFlagsOp)
+	if !ok {
+		t.Fatalf("Got %T", op)
+	}
+
+	if getFlags.Inode != 23 || getFlags.Handle != 17 {
+		t.Errorf("Inode %d, handle %d", getFlags.Inode, getFlags.Handle)
+	}
+
+	getFlags.Flags = fuseops.InodeFlags{Encrypted: true, NoDump: true}
+	c.Reply(ctx, nil)
+
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	const outSize = int(unsafe.Sizeof(fusekernel.IoctlOut{}))
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if h.Error != 0 || n != buffer.OutMessageHeaderSize+outSize+4 {
+		t.Fatalf("Unexpected response: error %d, %d bytes", h.Error, n)
+	}
+
+	out := (*fusekernel.IoctlOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+	if out.Result != 0 {
+		t.Errorf("Result: %d", out.Result)
+	}
+
+	flags := *(*fusekernel.InodeFlags)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize+outSize]))
+	if flags != fusekernel.InodeEncrypted|fusekernel.InodeNoDump {
+		t.Errorf("Flags: %#x", flags)
+	}
+
+	// Other ioctls are unknown.
+	ctx, op = ioctl(0x5401) // TCGETS
+	if _, ok := op.(*unknownOp); !ok {
+		t.Fatalf("Got %T", op)
+	}
+
+	c.Reply(ctx, ENOSYS)
+
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if h.Error != -int32(syscall.ENOSYS) {
+		t.Errorf("Error: %d", h.Error)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{})
+	defer c.close()
+	defer kernel.Close()
+
+	// Pause, then send a lookup.
+	c.Pause()
+
+	req := makeRequest(fusekernel.OpLookup, []byte("foo\x00"))
+	if _, err := kernel.Write(req); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	ops := make(chan interface{}, 1)
+	go func() {
+		_, op, err := c.ReadOp()
+		if err != nil {
+			t.Errorf("ReadOp: %v", err)
+		}
+
+		ops <- op
+	}()
+
+	// The op shouldn't be returned while paused.
+	select {
+	case op := <-ops:
+		t.Fatalf("Op returned while paused: %#v", op)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Nor should the request have been read from the kernel.
+	peek := make([]byte, len(req)+1)
+	n, _, err := unix.Recvfrom(
+		int(c.dev.Fd()),
+		peek,
+		unix.MSG_PEEK|unix.MSG_DONTWAIT)
+
+	if err != nil || n != len(req) {
+		t.Errorf("Peeking at the request: %d, %v", n, err)
+	}
+
+	// It should be once resumed.
+	c.Resume()
+
+	select {
+	case op := <-ops:
+		if _, ok := op.(*fuseops.LookUpInodeOp); !ok {
+			t.Errorf("Unexpected op: %#v", op)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the op after resuming")
+	}
+}
+
+func TestInodeRefCounts(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{
+		EnableInodeLifecycleTracing: true,
+	})
+
+	defer c.close()
+	defer kernel.Close()
+
+	// Send the supplied request, and reply to the op it becomes with the
+	// supplied function.
+	buf := make([]byte, 4096)
+	serve := func(req []byte, reply func(op interface{}) error) {
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		c.Reply(ctx, reply(op))
+	}
+
+	lookUp := func(child fuseops.InodeID, opErr error) {
+		serve(
+			makeRequest(fusekernel.OpLookup, []byte("foo\x00")),
+			func(op interface{}) error {
+				op.(*fuseops.LookUpInodeOp).Entry.Child = child
+				return opErr
+			})
+
+		// Discard the response.
+		if _, err := kernel.Read(buf); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+
+	forget := func(inode fuseops.InodeID, n uint64) {
+		in := fusekernel.ForgetIn{Nlookup: n}
+		req := makeRequest(
+			fusekernel.OpForget,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+		(*fusekernel.InHeader)(unsafe.Pointer(&req[0])).Nodeid = uint64(inode)
+		serve(req, func(op interface{}) error { return nil })
+	}
+
+	batchForget := func(entries ...fusekernel.ForgetOne) {
+		in := fusekernel.BatchForgetIn{Count: uint32(len(entries))}
+		body := [][]byte{structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in))}
+		for i := range entries {
+			body = append(
+				body,
+				structBytes(unsafe.Pointer(&entries[i]), unsafe.Sizeof(entries[i])))
+		}
+
+		req := makeRequest(fusekernel.OpBatchForget, body...)
+		serve(req, func(op interface{}) error { return nil })
+	}
+
+	// Discard the response to the init request.
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// Look up an inode a few times, and another once. A failed lookup doesn't
+	// count.
+	const lookups = 5
+	for i := 0; i < lookups; i++ {
+		lookUp(23, nil)
+	}
+
+	lookUp(29, nil)
+	lookUp(23, ENOENT)
+
+	// Forget some of the lookups of the first, in more than one op.
+	forget(23, 1)
+	forget(23, 2)
+
+	counts := c.InodeRefCounts()
+	expected := map[fuseops.InodeID]int64{23: lookups - 3, 29: 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("InodeRefCounts: got %v, want %v", counts, expected)
+	}
+
+	// An inode whose count returns to zero is no longer reported.
+	forget(29, 1)
+
+	counts = c.InodeRefCounts()
+	expected = map[fuseops.InodeID]int64{23: lookups - 3}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("InodeRefCounts: got %v, want %v", counts, expected)
+	}
+
+	// A batch forget counts for each of its entries.
+	lookUp(29, nil)
+	batchForget(
+		fusekernel.ForgetOne{Nodeid: 23, Nlookup: 1},
+		fusekernel.ForgetOne{Nodeid: 29, Nlookup: 1})
+
+	counts = c.InodeRefCounts()
+	expected = map[fuseops.InodeID]int64{23: lookups - 4}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("InodeRefCounts: got %v, want %v", counts, expected)
+	}
+
+	// The kernel expects no reply to forgets, so the next response it reads is
+	// that to the next request.
+	lookUp(31, nil)
+	out := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+	if out.Nodeid != 31 {
+		t.Errorf("Unexpected response: node ID %d", out.Nodeid)
+	}
+
+	// Each entry returned by a readdirplus with a node ID counts, other than
+	// "." and "..".
+	in := fusekernel.ReadIn{Size: 4096}
+	serve(
+		makeRequest(
+			fusekernel.OpReaddirplus,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in))),
+		func(op interface{}) error {
+			o := op.(*fuseops.ReadDirPlusOp)
+			for _, e := range []struct {
+				inode fuseops.InodeID
+				name  string
+			}{{19, "."}, {1, ".."}, {23, "foo"}, {0, "bar"}, {37, "bazqux"}} {
+				o.BytesRead += copy(o.Dst[o.BytesRead:], direntPlus(e.inode, e.name))
+			}
+
+			return nil
+		})
+
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	counts = c.InodeRefCounts()
+	expected = map[fuseops.InodeID]int64{23: lookups - 3, 31: 1, 37: 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("InodeRefCounts: got %v, want %v", counts, expected)
+	}
+}
+
+// Encode an entry as fuseutil.WriteDirentPlus does.
+func direntPlus(inode fuseops.InodeID, name string) []byte {
+	out := fusekernel.EntryOut{Nodeid: uint64(inode)}
+	b := structBytes(unsafe.Pointer(&out), unsafe.Sizeof(out))
+
+	de := fusekernel.Dirent{Ino: uint64(inode), Namelen: uint32(len(name))}
+	b = append(b, structBytes(unsafe.Pointer(&de), fusekernel.DirentSize)...)
+	b = append(b, name...)
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+func TestNotifyAttrChanged(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{})
+	defer c.close()
+	defer kernel.Close()
+
+	// Discard the response to the init request.
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if err := c.NotifyAttrChanged(23); err != nil {
+		t.Fatalf("NotifyAttrChanged: %v", err)
+	}
+
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	const size = buffer.OutMessageHeaderSize + int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))
+	if n != size {
+		t.Fatalf("Read %d bytes, want %d", n, size)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if h.Unique != 0 || h.Error != fusekernel.NotifyCodeInvalInode || int(h.Len) != size {
+		t.Errorf("Unexpected header: %+v", *h)
+	}
+
+	// Only attributes should be invalidated, not the page cache.
+	out := (*fusekernel.NotifyInvalInodeOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+	expected := fusekernel.NotifyInvalInodeOut{Ino: 23, Off: -1, Len: 0}
+	if *out != expected {
+		t.Errorf("got %+v, want %+v", *out, expected)
+	}
+}
+
+func TestInvalidateNode(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{})
+	defer kernel.Close()
+
+	// Discard the response to the init request.
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// Invalidate several inodes at once, from different goroutines.
+	const inodes = 8
+	var wg sync.WaitGroup
+	for i := 0; i < inodes; i++ {
+		wg.Add(1)
+		go func(inode fuseops.InodeID) {
+			defer wg.Done()
+			if err := c.InvalidateNode(inode, 4096, 8192); err != nil {
+				t.Errorf("InvalidateNode: %v", err)
+			}
+		}(fuseops.InodeID(100 + i))
+	}
+
+	wg.Wait()
+
+	// Each should arrive intact.
+	const size = buffer.OutMessageHeaderSize + int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))
+	seen := make(map[uint64]bool)
+	for i := 0; i < inodes; i++ {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		if n != size || h.Unique != 0 || h.Error != fusekernel.NotifyCodeInvalInode {
+			t.Fatalf("Unexpected notification of %d bytes: %+v", n, *h)
+		}
+
+		out := (*fusekernel.NotifyInvalInodeOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+		if out.Off != 4096 || out.Len != 8192 {
+			t.Errorf("Unexpected range: %+v", *out)
+		}
+
+		seen[out.Ino] = true
+	}
+
+	if len(seen) != inodes {
+		t.Errorf("Notified of inodes %v", seen)
+	}
+
+	// A kernel too old for notifications.
+	protocol := c.protocol
+	c.protocol = fusekernel.Protocol{Major: 7, Minor: 11}
+	if err := c.InvalidateNode(23, 0, 0); err != ErrNotifyNotSupported {
+		t.Errorf("InvalidateNode with old protocol: %v", err)
+	}
+
+	c.protocol = protocol
+
+	// A connection that has been closed.
+	c.close()
+	if err := c.InvalidateNode(23, 0, 0); err != ErrShutdown {
+		t.Errorf("InvalidateNode after close: %v", err)
+	}
+}
+
+func TestInvalidateEntry(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{})
+	defer kernel.Close()
+
+	// Discard the response to the init request.
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if err := c.InvalidateEntry(17, "taco"); err != nil {
+		t.Fatalf("InvalidateEntry: %v", err)
+	}
+
+	// The name should follow the fixed-size part of the message, terminated by
+	// a NUL that isn't included in its length.
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	const size = buffer.OutMessageHeaderSize + int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if n != size+len("taco\x00") || h.Len != uint32(n) || h.Unique != 0 || h.Error != fusekernel.NotifyCodeInvalEntry {
+		t.Fatalf("Unexpected notification of %d bytes: %+v", n, *h)
+	}
+
+	out := (*fusekernel.NotifyInvalEntryOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+	if out.Parent != 17 || out.Namelen != 4 {
+		t.Errorf("Unexpected notification: %+v", *out)
+	}
+
+	if got := string(buf[size:n]); got != "taco\x00" {
+		t.Errorf("Unexpected name: %q", got)
+	}
+
+	// A name as long as the kernel accepts, and one longer.
+	name := strings.Repeat("a", fusekernel.NotifyNameMax)
+	if err := c.InvalidateEntry(17, name); err != nil {
+		t.Fatalf("InvalidateEntry with long name: %v", err)
+	}
+
+	if n, err = kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if n != size+len(name)+1 {
+		t.Errorf("Unexpected notification of %d bytes for long name", n)
+	}
+
+	if err := c.InvalidateEntry(17, name+"a"); err != syscall.ENAMETOOLONG {
+		t.Errorf("InvalidateEntry with overlong name: %v", err)
+	}
+
+	// A kernel too old for notifications.
+	protocol := c.protocol
+	c.protocol = fusekernel.Protocol{Major: 7, Minor: 11}
+	if err := c.InvalidateEntry(17, "taco"); err != ErrNotifyNotSupported {
+		t.Errorf("InvalidateEntry with old protocol: %v", err)
+	}
+
+	c.protocol = protocol
+
+	// A connection that has been closed.
+	c.close()
+	if err := c.InvalidateEntry(17, "taco"); err != ErrShutdown {
+		t.Errorf("InvalidateEntry after close: %v", err)
+	}
+}
+
+func TestInvalidateEntries(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{})
+	defer kernel.Close()
+
+	// Discard the response to the init request.
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// A name that is too long fails without stopping the others.
+	long := strings.Repeat("a", fusekernel.NotifyNameMax+1)
+	err := c.InvalidateEntries(17, []string{"taco", long, "burrito"})
+
+	expected := InvalidateEntriesError{long: syscall.ENAMETOOLONG}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("InvalidateEntries: got %v, want %v", err, expected)
+	}
+
+	// Each other name gets its own notification.
+	const size = buffer.OutMessageHeaderSize + int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))
+	for _, name := range []string{"taco", "burrito"} {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		out := (*fusekernel.NotifyInvalEntryOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+		if n != size+len(name)+1 || h.Len != uint32(n) || h.Error != fusekernel.NotifyCodeInvalEntry || out.Parent != 17 {
+			t.Fatalf("Unexpected notification of %d bytes: %+v, %+v", n, *h, *out)
+		}
+
+		if got := string(buf[size : n-1]); got != name {
+			t.Errorf("Unexpected name: %q, want %q", got, name)
+		}
+	}
+
+	// A connection that has been closed.
+	c.close()
+	if err := c.InvalidateEntries(17, []string{"taco", "burrito"}); err != ErrShutdown {
+		t.Errorf("InvalidateEntries after close: %v", err)
+	}
+}
+
+func TestNotifyResend(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{})
+	defer c.close()
+	defer kernel.Close()
+
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// A kernel that doesn't offer resending.
+	if err := c.NotifyResend(); err != ErrNotifyNotSupported {
+		t.Fatalf("NotifyResend without support: %v", err)
+	}
+
+	c.capabilities.Resend = true
+
+	// Send a lookup with the supplied ID.
+	send := func(fuseID uint64, name string) {
+		req := makeRequest(fusekernel.OpLookup, []byte(name+"\x00"))
+		(*fusekernel.InHeader)(unsafe.Pointer(&req[0])).Unique = fuseID
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// Read the next lookup, returning its context and name.
+	read := func() (context.Context, string) {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		return ctx, op.(*fuseops.LookUpInodeOp).Name
+	}
+
+	// Read the next response, returning the ID it carries.
+	response := func() uint64 {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		if n < buffer.OutMessageHeaderSize {
+			t.Fatalf("Short response of %d bytes", n)
+		}
+
+		return (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0])).Unique
+	}
+
+	// Read a lookup, then ask for a resend while it's outstanding.
+	send(17, "foo")
+	ctx, _ := read()
+
+	if err := c.NotifyResend(); err != nil {
+		t.Fatalf("NotifyResend: %v", err)
+	}
+
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if n != buffer.OutMessageHeaderSize || h.Unique != 0 || h.Error != fusekernel.NotifyCodeResend {
+		t.Fatalf("Unexpected notification: %d bytes, %+v", n, *h)
+	}
+
+	// The kernel resends the outstanding lookup, then sends another. Only the
+	// latter is dispatched.
+	send(17|fusekernel.UniqueResend, "foo")
+	send(19, "bar")
+
+	ctx2, name := read()
+	if name != "bar" {
+		t.Fatalf("Dispatched %q; want bar", name)
+	}
+
+	// The reply to the original goes to the resend.
+	c.Reply(ctx, ENOENT)
+	if got, want := response(), 17|fusekernel.UniqueResend; got != want {
+		t.Errorf("Reply to resent op carries ID %#x; want %#x", got, want)
+	}
+
+	c.Reply(ctx2, ENOENT)
+	if got := response(); got != 19 {
+		t.Errorf("Reply to other op carries ID %#x", got)
+	}
+
+	// The resend of a request that this connection never read, e.g. because it
+	// was read by the process that had the connection before, is dispatched.
+	send(23|fusekernel.UniqueResend, "baz")
+
+	ctx, name = read()
+	if name != "baz" {
+		t.Fatalf("Dispatched %q; want baz", name)
+	}
+
+	c.Reply(ctx, ENOENT)
+	if got, want := response(), 23|fusekernel.UniqueResend; got != want {
+		t.Errorf("Reply to resend carries ID %#x; want %#x", got, want)
+	}
+}
+
+func TestNotifyResendDropsUnclaimedReplies(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{})
+	defer c.close()
+	defer kernel.Close()
+
+	c.capabilities.Resend = true
+
+	// Send and read a lookup with the supplied ID.
+	read := func(fuseID uint64) {
+		req := makeRequest(fusekernel.OpLookup, []byte("foo\x00"))
+		(*fusekernel.InHeader)(unsafe.Pointer(&req[0])).Unique = fuseID
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		if _, _, err := c.ReadOp(); err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+	}
+
+	unclaimed := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.unclaimedReplies)
+	}
+
+	reply := make([]byte, buffer.OutMessageHeaderSize)
+
+	// A lookup is outstanding when a resend is asked for, and another is read
+	// afterwards.
+	read(17)
+	if err := c.NotifyResend(); err != nil {
+		t.Fatalf("NotifyResend: %v", err)
+	}
+
+	read(19)
+
+	// The kernel refuses the reply to the latter, e.g. because it gave up on
+	// the op when it was interrupted. The request won't be resent, so the
+	// reply isn't kept.
+	if _, _, err := c.replyWritten(19, nil, reply, syscall.ENOENT); err != syscall.ENOENT {
+		t.Errorf("Reply to op read after NotifyResend: got %v, want ENOENT", err)
+	}
+
+	if n := unclaimed(); n != 0 {
+		t.Errorf("%d unclaimed replies after interrupted op", n)
+	}
+
+	// The reply to the former may be refused because the kernel is about to
+	// resend it, so it's kept...
+	if _, _, err := c.replyWritten(17, nil, reply, syscall.ENOENT); err != nil {
+		t.Errorf("Reply to op outstanding at NotifyResend: %v", err)
+	}
+
+	if n := unclaimed(); n != 1 {
+		t.Errorf("%d unclaimed replies; want 1", n)
+	}
+
+	// ...until the next request for resends, if the resend never comes.
+	if err := c.NotifyResend(); err != nil {
+		t.Fatalf("NotifyResend: %v", err)
+	}
+
+	if n := unclaimed(); n != 0 {
+		t.Errorf("%d unclaimed replies after second NotifyResend", n)
+	}
+}
+
+func TestInitFlags2(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		minor    uint32
+		cfg      MountConfig
+		expected fusekernel.InitFlags2
+	}{
+		{"requested", 39, MountConfig{Capabilities: Capabilities{DirectIOMmap: true}}, fusekernel.InitDirectIOAllowMmap},
+		{"not requested", 39, MountConfig{}, 0},
+		{"before flags2", 35, MountConfig{Capabilities: Capabilities{DirectIOMmap: true}}, 0},
+	}
+
+	for _, tc := range testCases {
+		// Offer everything, in the extended init request of newer kernels: the
+		// flags are followed by a second word of them, then unused space.
+		in := fusekernel.InitIn{
+			Major: fusekernel.ProtoVersionMaxMajor,
+			Minor: tc.minor,
+			Flags: uint32(fusekernel.InitInitExt),
+		}
+
+		ext := struct {
+			Flags2 uint32
+			Unused [11]uint32
+		}{Flags2: ^uint32(0)}
+
+		c, kernel := newSocketConnection(
+			t,
+			in,
+			tc.cfg,
+			structBytes(unsafe.Pointer(&ext), unsafe.Sizeof(ext)))
+
+		buf := make([]byte, 4096)
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		if n != buffer.OutMessageHeaderSize+int(unsafe.Sizeof(fusekernel.InitOut{})) {
+			t.Fatalf("%s: unexpected response size %d", tc.desc, n)
+		}
+
+		out := (*fusekernel.InitOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+		if got := fusekernel.InitFlags2(out.Flags2); got != tc.expected {
+			t.Errorf("%s: Flags2: got %v, want %v", tc.desc, got, tc.expected)
+		}
+
+		// The kernel must be told to look at the second word when it's used.
+		extended := fusekernel.InitFlags(out.Flags)&fusekernel.InitInitExt != 0
+		if extended != (tc.expected != 0) {
+			t.Errorf("%s: Flags: %v", tc.desc, fusekernel.InitFlags(out.Flags))
+		}
+
+		if got := c.Capabilities().DirectIOMmap; got != (tc.expected != 0) {
+			t.Errorf("%s: DirectIOMmap capability: %v", tc.desc, got)
+		}
+
+		// Resending is offered regardless of configuration.
+		if got := c.Capabilities().Resend; got != (tc.minor >= 36) {
+			t.Errorf("%s: Resend capability: %v", tc.desc, got)
+		}
+
+		c.close()
+		kernel.Close()
+	}
+}
+
+func TestMaxWriteAndMaxRead(t *testing.T) {
+	page := uint32(os.Getpagesize())
+	min := func(a, b uint32) uint32 {
+		if a < b {
+			return a
+		}
+		return b
+	}
+
+	testCases := []struct {
+		desc      string
+		flags     fusekernel.InitFlags
+		options   map[string]string
+		wantWrite uint32
+		wantRead  uint32
+	}{
+		{
+			"max pages",
+			fusekernel.InitMaxPages,
+			nil,
+			min(256*page, buffer.MaxWriteSize),
+			256 * page,
+		},
+		{
+			"no max pages",
+			0,
+			nil,
+			min(32*page, buffer.MaxWriteSize),
+			32 * page,
+		},
+		{
+			"max_read option",
+			fusekernel.InitMaxPages,
+			map[string]string{"max_read": "8192"},
+			min(256*page, buffer.MaxWriteSize),
+			8192,
+		},
+	}
+
+	for _, tc := range testCases {
+		in := latestInit
+		in.Flags = uint32(tc.flags)
+		c, kernel := newSocketConnection(t, in, MountConfig{Options: tc.options})
+
+		if got := c.MaxWrite(); got != tc.wantWrite {
+			t.Errorf("%s: MaxWrite: got %d, want %d", tc.desc, got, tc.wantWrite)
+		}
+
+		if got := c.MaxRead(); got != tc.wantRead {
+			t.Errorf("%s: MaxRead: got %d, want %d", tc.desc, got, tc.wantRead)
+		}
+
+		c.close()
+		kernel.Close()
+	}
+}
+
+func TestConfiguredMaxWriteAndMaxReadahead(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		maxWrite         uint32
+		maxReadahead     uint32
+		offeredReadahead uint32
+		wantWrite        uint32
+		wantReadahead    uint32
+	}{
+		{"defaults", 0, 0, 128 << 10, buffer.MaxWriteSize, 128 << 10},
+		{"smaller", 256 << 10, 64 << 10, 128 << 10, 256 << 10, 64 << 10},
+		{"too large", 8 << 20, 8 << 20, 128 << 10, buffer.MaxWriteSize, 128 << 10},
+		{"too small", 100, 0, 128 << 10, minMaxWrite, 128 << 10},
+		{"no readahead offered", 0, 0, 0, buffer.MaxWriteSize, defaultMaxReadahead},
+	}
+
+	for _, tc := range testCases {
+		in := latestInit
+		in.MaxReadahead = tc.offeredReadahead
+		in.Flags = uint32(fusekernel.InitMaxPages)
+
+		var debug strings.Builder
+		cfg := MountConfig{
+			MaxWrite:     tc.maxWrite,
+			MaxReadahead: tc.maxReadahead,
+			DebugLogger:  log.New(&debug, "", 0),
+		}
+
+		c, kernel := newSocketConnection(t, in, cfg)
+
+		// The clamped values should be sent to the kernel.
+		buf := make([]byte, 4096)
+		if _, err := kernel.Read(buf); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		out := (*fusekernel.InitOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+		if out.MaxWrite != tc.wantWrite {
+			t.Errorf("%s: max_write: got %d, want %d", tc.desc, out.MaxWrite, tc.wantWrite)
+		}
+
+		if out.MaxReadahead != tc.wantReadahead {
+			t.Errorf("%s: max_readahead: got %d, want %d", tc.desc, out.MaxReadahead, tc.wantReadahead)
+		}
+
+		// Neither exceeds a request's worth of pages here, so the connection
+		// should report the same.
+		if got := c.MaxWrite(); got != tc.wantWrite {
+			t.Errorf("%s: MaxWrite: got %d, want %d", tc.desc, got, tc.wantWrite)
+		}
+
+		if got := c.MaxReadahead(); got != tc.wantReadahead {
+			t.Errorf("%s: MaxReadahead: got %d, want %d", tc.desc, got, tc.wantReadahead)
+		}
+
+		// And log them.
+		want := fmt.Sprintf(
+			"max_write %d, max_read %d, max_readahead %d",
+			c.MaxWrite(),
+			c.MaxRead(),
+			c.MaxReadahead())
+
+		if !strings.Contains(debug.String(), want) {
+			t.Errorf("%s: debug log %q doesn't contain %q", tc.desc, debug.String(), want)
+		}
+
+		c.close()
+		kernel.Close()
+	}
+}
+
+func TestSetLkwInterrupted(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{Capabilities: Capabilities{PosixLocks: true}})
+	defer c.close()
+	defer kernel.Close()
+
+	// Discard the response to the init request.
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// Ask for a lock, as a process blocking in fcntl(F_SETLKW) does, then
+	// interrupt the request as the kernel does when the process is signalled.
+	// A lookup follows so that ReadOp gets past the interrupt, which it handles
+	// inline.
+	var lk fusekernel.LkIn
+	lk.Lk.Type = syscall.F_WRLCK
+	interrupt := fusekernel.InterruptIn{Unique: 17}
+
+	requests := [][]byte{
+		makeRequest(
+			fusekernel.OpSetlkw,
+			structBytes(unsafe.Pointer(&lk), unsafe.Sizeof(lk))),
+		makeRequest(
+			fusekernel.OpInterrupt,
+			structBytes(unsafe.Pointer(&interrupt), unsafe.Sizeof(interrupt))),
+		makeRequest(fusekernel.OpLookup, []byte("foo\x00")),
+	}
+
+	for i, req := range requests {
+		(*fusekernel.InHeader)(unsafe.Pointer(&req[0])).Unique = uint64(17 + i)
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	ctx, op, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	if _, ok := op.(*fuseops.SetLkwOp); !ok {
+		t.Fatalf("Unexpected op: %T", op)
+	}
+
+	if _, _, err := c.ReadOp(); err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SetLkwOp context not canceled by the interrupt")
+	}
+}
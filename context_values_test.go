@@ -0,0 +1,71 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type contextValueKey struct{}
+
+// A minimalFS that records the value associated with contextValueKey in the
+// context of the most recent LookUpInodeOp.
+type contextValueFS struct {
+	minimalFS
+
+	mu    sync.Mutex
+	value interface{} // GUARDED_BY(mu)
+}
+
+func (fs *contextValueFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.value = ctx.Value(contextValueKey{})
+	return fuse.ENOENT
+}
+
+func TestMountContextValues(t *testing.T) {
+	// Mount with a parent context carrying a value.
+	fs := &contextValueFS{}
+	mfs := mountFS(t, fs, &fuse.MountConfig{
+		OpContext: context.WithValue(
+			context.Background(),
+			contextValueKey{},
+			"taco"),
+	})
+
+	// Cause a lookup, which the file system will fail.
+	if _, err := os.Stat(path.Join(mfs.Dir(), "foo")); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected stat error: %v", err)
+	}
+
+	// The handler should have seen the value.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.value != "taco" {
+		t.Errorf("Unexpected context value: %v", fs.value)
+	}
+}
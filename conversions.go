@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
 	"syscall"
@@ -26,6 +27,7 @@ import (
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/convert"
 	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
@@ -40,7 +42,8 @@ import (
 func convertInMessage(
 	inMsg *buffer.InMessage,
 	outMsg *buffer.OutMessage,
-	protocol fusekernel.Protocol) (o interface{}, err error) {
+	protocol fusekernel.Protocol,
+	caps Capabilities) (o interface{}, err error) {
 	switch inMsg.Header().Opcode {
 	case fusekernel.OpLookup:
 		buf := inMsg.ConsumeBytes(inMsg.Len())
@@ -52,13 +55,22 @@ func convertInMessage(
 		o = &fuseops.LookUpInodeOp{
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(buf[:n-1]),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpGetattr:
-		o = &fuseops.GetInodeAttributesOp{
+		to := &fuseops.GetInodeAttributesOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
+		}
+		o = to
+
+		// Linux sends fuse_getattr_in, but osxfuse sends no body at all.
+		type input fusekernel.GetattrIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in != nil && fusekernel.GetattrFlags(in.GetattrFlags)&fusekernel.GetattrFh != 0 {
+			t := fuseops.HandleID(in.Fh)
+			to.Handle = &t
 		}
 
 	case fusekernel.OpSetattr:
@@ -70,7 +82,7 @@ func convertInMessage(
 
 		to := &fuseops.SetInodeAttributesOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 		o = to
 
@@ -84,6 +96,14 @@ func convertInMessage(
 			to.Mode = &mode
 		}
 
+		if valid&fusekernel.SetattrUid != 0 {
+			to.Uid = &in.Uid
+		}
+
+		if valid&fusekernel.SetattrGid != 0 {
+			to.Gid = &in.Gid
+		}
+
 		if valid&fusekernel.SetattrAtime != 0 {
 			t := time.Unix(int64(in.Atime), int64(in.AtimeNsec))
 			to.Atime = &t
@@ -99,6 +119,8 @@ func convertInMessage(
 			to.Handle = &t
 		}
 
+		to.KillSuidgid = valid.KillSuidgid()
+
 	case fusekernel.OpForget:
 		type input fusekernel.ForgetIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -109,7 +131,34 @@ func convertInMessage(
 		o = &fuseops.ForgetInodeOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			N:         in.Nlookup,
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
+		}
+
+	case fusekernel.OpBatchForget:
+		type input fusekernel.BatchForgetIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpBatchForget")
+		}
+
+		// Check the count before trusting it to size the slice.
+		type entry fusekernel.ForgetOne
+		if uintptr(in.Count) > inMsg.Len()/unsafe.Sizeof(entry{}) {
+			return nil, errors.New("Corrupt OpBatchForget")
+		}
+
+		to := &fuseops.BatchForgetOp{
+			Entries:   make([]fuseops.BatchForgetEntry, 0, in.Count),
+			OpContext: opContext(inMsg),
+		}
+		o = to
+
+		for i := uint32(0); i < in.Count; i++ {
+			e := (*entry)(inMsg.Consume(unsafe.Sizeof(entry{})))
+			to.Entries = append(to.Entries, fuseops.BatchForgetEntry{
+				Inode: fuseops.InodeID(e.Nodeid),
+				N:     e.Nlookup,
+			})
 		}
 
 	case fusekernel.OpMkdir:
@@ -136,7 +185,7 @@ func convertInMessage(
 			// opcode is mkdir. But we want the correct mode to go through, so ensure
 			// that os.ModeDir is set.
 			Mode:      convertFileMode(in.Mode) | os.ModeDir,
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpMknod:
@@ -156,7 +205,8 @@ func convertInMessage(
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(name),
 			Mode:      convertFileMode(in.Mode),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Rdev:      in.Rdev,
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpCreate:
@@ -173,10 +223,11 @@ func convertInMessage(
 		name = name[:i]
 
 		o = &fuseops.CreateFileOp{
-			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:      string(name),
-			Mode:      convertFileMode(in.Mode),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Parent:      fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:        string(name),
+			Mode:        convertFileMode(in.Mode),
+			KillSuidgid: fusekernel.OpenInFlags(in.OpenFlags)&fusekernel.OpenInKillSuidgid != 0,
+			OpContext:   opContext(inMsg),
 		}
 
 	case fusekernel.OpSymlink:
@@ -186,7 +237,7 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpSymlink")
 		}
 		i := bytes.IndexByte(names, '\x00')
-		if i < 0 {
+		if i < 0 || i == len(names)-1 {
 			return nil, errors.New("Corrupt OpSymlink")
 		}
 		newName, target := names[0:i], names[i+1:len(names)-1]
@@ -195,7 +246,7 @@ func convertInMessage(
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(newName),
 			Target:    string(target),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpRename:
@@ -214,7 +265,7 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpRename")
 		}
 		i := bytes.IndexByte(names, '\x00')
-		if i < 0 {
+		if i < 0 || i == len(names)-1 {
 			return nil, errors.New("Corrupt OpRename")
 		}
 		oldName, newName := names[:i], names[i+1:len(names)-1]
@@ -224,7 +275,7 @@ func convertInMessage(
 			OldName:   string(oldName),
 			NewParent: fuseops.InodeID(in.Newdir),
 			NewName:   string(newName),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpUnlink:
@@ -237,7 +288,7 @@ func convertInMessage(
 		o = &fuseops.UnlinkOp{
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(buf[:n-1]),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpRmdir:
@@ -250,19 +301,27 @@ func convertInMessage(
 		o = &fuseops.RmDirOp{
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(buf[:n-1]),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpOpen:
+		type input fusekernel.OpenIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpOpen")
+		}
+
 		o = &fuseops.OpenFileOp{
-			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Inode:       fuseops.InodeID(inMsg.Header().Nodeid),
+			OpenFlags:   fusekernel.OpenFlags(in.Flags),
+			KillSuidgid: fusekernel.OpenInFlags(in.OpenFlags)&fusekernel.OpenInKillSuidgid != 0,
+			OpContext:   opContext(inMsg),
 		}
 
 	case fusekernel.OpOpendir:
 		o = &fuseops.OpenDirOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpRead:
@@ -275,7 +334,8 @@ func convertInMessage(
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Handle:    fuseops.HandleID(in.Fh),
 			Offset:    int64(in.Offset),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpenFlags: fusekernel.OpenFlags(in.Flags),
+			OpContext: opContext(inMsg),
 		}
 		o = to
 
@@ -300,7 +360,32 @@ func convertInMessage(
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Handle:    fuseops.HandleID(in.Fh),
 			Offset:    fuseops.DirOffset(in.Offset),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
+		}
+		o = to
+
+		readSize := int(in.Size)
+		p := outMsg.GrowNoZero(readSize)
+		if p == nil {
+			return nil, fmt.Errorf("Can't grow for %d-byte read", readSize)
+		}
+
+		sh := (*reflect.SliceHeader)(unsafe.Pointer(&to.Dst))
+		sh.Data = uintptr(p)
+		sh.Len = readSize
+		sh.Cap = readSize
+
+	case fusekernel.OpReaddirplus:
+		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpReaddirplus")
+		}
+
+		to := &fuseops.ReadDirPlusOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Offset:    fuseops.DirOffset(in.Offset),
+			OpContext: opContext(inMsg),
 		}
 		o = to
 
@@ -324,7 +409,7 @@ func convertInMessage(
 
 		o = &fuseops.ReleaseFileHandleOp{
 			Handle:    fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpReleasedir:
@@ -336,7 +421,7 @@ func convertInMessage(
 
 		o = &fuseops.ReleaseDirHandleOp{
 			Handle:    fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpWrite:
@@ -351,11 +436,13 @@ func convertInMessage(
 		}
 
 		o = &fuseops.WriteFileOp{
-			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle:    fuseops.HandleID(in.Fh),
-			Data:      buf,
-			Offset:    int64(in.Offset),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Inode:       fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:      fuseops.HandleID(in.Fh),
+			Data:        buf,
+			Offset:      int64(in.Offset),
+			OpenFlags:   fusekernel.OpenFlags(in.Flags),
+			KillSuidgid: fusekernel.WriteFlags(in.WriteFlags)&fusekernel.WriteKillSuidgid != 0,
+			OpContext:   opContext(inMsg),
 		}
 
 	case fusekernel.OpFsync, fusekernel.OpFsyncdir:
@@ -368,7 +455,7 @@ func convertInMessage(
 		o = &fuseops.SyncFileOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Handle:    fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpFlush:
@@ -381,17 +468,19 @@ func convertInMessage(
 		o = &fuseops.FlushFileOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Handle:    fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpReadlink:
 		o = &fuseops.ReadSymlinkOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpStatfs:
-		o = &fuseops.StatFSOp{}
+		o = &fuseops.StatFSOp{
+			OpContext: opContext(inMsg),
+		}
 
 	case fusekernel.OpInterrupt:
 		type input fusekernel.InterruptIn
@@ -411,11 +500,23 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpInit")
 		}
 
-		o = &initOp{
+		to := &initOp{
 			Kernel:       fusekernel.Protocol{in.Major, in.Minor},
 			MaxReadahead: in.MaxReadahead,
 			Flags:        fusekernel.InitFlags(in.Flags),
 		}
+		o = to
+
+		// Newer kernels follow the flags with a second word of them. Check the
+		// version too, since OS X uses the bit announcing it for something else.
+		if to.Flags&fusekernel.InitInitExt != 0 && !to.Kernel.LT(fusekernel.Protocol{Major: 7, Minor: 36}) {
+			flags2 := (*uint32)(inMsg.Consume(unsafe.Sizeof(uint32(0))))
+			if flags2 == nil {
+				return nil, errors.New("Corrupt OpInit")
+			}
+
+			to.Flags2 = fusekernel.InitFlags2(*flags2)
+		}
 
 	case fusekernel.OpLink:
 		type input fusekernel.LinkIn
@@ -438,7 +539,7 @@ func convertInMessage(
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(name),
 			Target:    fuseops.InodeID(in.Oldnodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpRemovexattr:
@@ -451,7 +552,7 @@ func convertInMessage(
 		o = &fuseops.RemoveXattrOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(buf[:n-1]),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 
 	case fusekernel.OpGetxattr:
@@ -471,7 +572,7 @@ func convertInMessage(
 		to := &fuseops.GetXattrOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(name),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 		o = to
 
@@ -495,7 +596,7 @@ func convertInMessage(
 
 		to := &fuseops.ListXattrOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
 		}
 		o = to
 
@@ -511,30 +612,45 @@ func convertInMessage(
 			sh.Cap = readSize
 		}
 	case fusekernel.OpSetxattr:
-		type input fusekernel.SetxattrIn
-		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
-		if in == nil {
-			return nil, errors.New("Corrupt OpSetxattr")
+		// Once negotiated, the kernel sends the extended form of the input
+		// instead, with the same leading fields.
+		var size, flags uint32
+		var setxattrFlags fusekernel.SetxattrFlags
+		if caps.SetxattrExt {
+			type input fusekernel.SetxattrExtIn
+			in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+			if in == nil {
+				return nil, errors.New("Corrupt OpSetxattr")
+			}
+
+			size, flags, setxattrFlags = in.Size, in.Flags, in.SetxattrFlags
+		} else {
+			type input fusekernel.SetxattrIn
+			in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+			if in == nil {
+				return nil, errors.New("Corrupt OpSetxattr")
+			}
+
+			size, flags = in.Size, in.Flags
 		}
 
 		payload := inMsg.ConsumeBytes(inMsg.Len())
-		// payload should be "name\x00value"
-		if len(payload) < 3 {
-			return nil, errors.New("Corrupt OpSetxattr")
-		}
+		// payload should be "name\x00value", where the value may be empty.
 		i := bytes.IndexByte(payload, '\x00')
-		if i < 0 {
+		if i <= 0 || len(payload)-(i+1) < int(size) {
 			return nil, errors.New("Corrupt OpSetxattr")
 		}
 
-		name, value := payload[:i], payload[i+1:len(payload)]
+		// The value refers to the message, rather than being copied out of it.
+		name, value := payload[:i], payload[i+1:i+1+int(size)]
 
 		o = &fuseops.SetXattrOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(name),
 			Value:     value,
-			Flags:     in.Flags,
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Flags:     flags,
+			KillSgid:  setxattrFlags&fusekernel.SetxattrACLKillSgid != 0,
+			OpContext: opContext(inMsg),
 		}
 	case fusekernel.OpFallocate:
 		type input fusekernel.FallocateIn
@@ -549,7 +665,106 @@ func convertInMessage(
 			Offset:    in.Offset,
 			Length:    in.Length,
 			Mode:      in.Mode,
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: opContext(inMsg),
+		}
+
+	case fusekernel.OpCopyFileRange:
+		type input fusekernel.CopyFileRangeIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpCopyFileRange")
+		}
+
+		// The reply can report no more than a 32-bit count of bytes copied, so
+		// ask for no more than that. The kernel returns a short copy to the
+		// caller, who copies the rest with another call.
+		length := in.Len
+		if length > math.MaxUint32 {
+			length = math.MaxUint32
+		}
+
+		o = &fuseops.CopyFileRangeOp{
+			InodeIn:   fuseops.InodeID(inMsg.Header().Nodeid),
+			HandleIn:  fuseops.HandleID(in.FhIn),
+			OffsetIn:  in.OffIn,
+			InodeOut:  fuseops.InodeID(in.NodeidOut),
+			HandleOut: fuseops.HandleID(in.FhOut),
+			OffsetOut: in.OffOut,
+			Length:    length,
+			Flags:     in.Flags,
+			OpContext: opContext(inMsg),
+		}
+
+	case fusekernel.OpGetlk, fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpGetlk/OpSetlk/OpSetlkw")
+		}
+
+		inode := fuseops.InodeID(inMsg.Header().Nodeid)
+		handle := fuseops.HandleID(in.Fh)
+		lock := fuseops.FileLock{
+			Start: in.Lk.Start,
+			End:   in.Lk.End,
+			Type:  in.Lk.Type,
+			PID:   in.Lk.Pid,
+		}
+
+		opCtx := opContext(inMsg)
+
+		switch inMsg.Header().Opcode {
+		case fusekernel.OpGetlk:
+			o = &fuseops.GetLkOp{
+				Inode:     inode,
+				Handle:    handle,
+				Owner:     in.Owner,
+				Lock:      lock,
+				OpContext: opCtx,
+			}
+
+		case fusekernel.OpSetlk:
+			o = &fuseops.SetLkOp{
+				Inode:     inode,
+				Handle:    handle,
+				Owner:     in.Owner,
+				Lock:      lock,
+				OpContext: opCtx,
+			}
+
+		default:
+			o = &fuseops.SetLkwOp{
+				Inode:     inode,
+				Handle:    handle,
+				Owner:     in.Owner,
+				Lock:      lock,
+				OpContext: opCtx,
+			}
+		}
+
+	case fusekernel.OpIoctl:
+		type input fusekernel.IoctlIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpIoctl")
+		}
+
+		// The only ioctl we serve is the one asking for an inode's flags. Any
+		// other is unknown to us.
+		isGetFlags := in.Cmd == fusekernel.IoctlGetFlags ||
+			in.Cmd == fusekernel.IoctlGetFlags32
+
+		if !isGetFlags || in.OutSize < uint32(unsafe.Sizeof(fusekernel.InodeFlags(0))) {
+			o = &unknownOp{
+				OpCode: inMsg.Header().Opcode,
+				Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			}
+			break
+		}
+
+		o = &fuseops.GetInodeFlagsOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			OpContext: opContext(inMsg),
 		}
 
 	default:
@@ -562,6 +777,13 @@ func convertInMessage(
 	return o, nil
 }
 
+// Describe the process that sent the supplied request, as recorded by the
+// kernel in its header.
+func opContext(inMsg *buffer.InMessage) fuseops.OpContext {
+	h := inMsg.Header()
+	return fuseops.OpContext{Pid: h.Pid, Uid: h.Uid, Gid: h.Gid}
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Outgoing messages
 ////////////////////////////////////////////////////////////////////////
@@ -582,6 +804,9 @@ func (c *Connection) kernelResponse(
 	case *fuseops.ForgetInodeOp:
 		return true
 
+	case *fuseops.BatchForgetOp:
+		return true
+
 	case *interruptOp:
 		return true
 	}
@@ -592,8 +817,11 @@ func (c *Connection) kernelResponse(
 		handled := false
 
 		if !handled {
+			// Pass through error numbers, even when wrapped (e.g. to distinguish
+			// EDQUOT from ENOSPC), falling back to EIO for anything else.
 			m.OutHeader().Error = -int32(syscall.EIO)
-			if errno, ok := opErr.(syscall.Errno); ok {
+			var errno syscall.Errno
+			if errors.As(opErr, &errno) {
 				m.OutHeader().Error = -int32(errno)
 			}
 
@@ -625,37 +853,52 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.LookUpInodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(c.now(), &o.Entry, out)
+
+		// A cached negative entry would hide differently-cased names created
+		// later. See MountConfig.CaseInsensitive.
+		if c.cfg.CaseInsensitive && o.Entry.Child == 0 {
+			out.EntryValid, out.EntryValidNsec = 0, 0
+		}
 
 	case *fuseops.GetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		out.AttrValid, out.AttrValidNsec = convert.Expiration(
+			c.now(),
+			o.AttributesExpiration,
+			o.AttributesValidity)
+		convert.Attributes(o.Inode, &o.Attributes, &out.Attr)
+
+	case *fuseops.GetInodeFlagsOp:
+		m.Grow(int(unsafe.Sizeof(fusekernel.IoctlOut{})))
+		out := (*fusekernel.InodeFlags)(m.Grow(int(unsafe.Sizeof(fusekernel.InodeFlags(0)))))
+		*out = convert.Flags(&o.Flags)
 
 	case *fuseops.SetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		out.AttrValid, out.AttrValidNsec = convert.Expiration(
+			c.now(),
+			o.AttributesExpiration,
+			o.AttributesValidity)
+		convert.Attributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.MkDirOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(c.now(), &o.Entry, out)
 
 	case *fuseops.MkNodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(c.now(), &o.Entry, out)
 
 	case *fuseops.CreateFileOp:
 		eSize := int(fusekernel.EntryOutSize(c.protocol))
 
 		e := (*fusekernel.EntryOut)(m.Grow(eSize))
-		convertChildInodeEntry(&o.Entry, e)
+		convert.ChildInodeEntry(c.now(), &o.Entry, e)
 
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
@@ -663,12 +906,12 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(c.now(), &o.Entry, out)
 
 	case *fuseops.CreateLinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(c.now(), &o.Entry, out)
 
 	case *fuseops.RenameOp:
 		// Empty response
@@ -689,6 +932,10 @@ func (c *Connection) kernelResponseForOp(
 		// much the user read.
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
+	case *fuseops.ReadDirPlusOp:
+		// As for ReadDirOp.
+		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
+
 	case *fuseops.ReleaseDirHandleOp:
 		// Empty response
 
@@ -704,6 +951,10 @@ func (c *Connection) kernelResponseForOp(
 			out.OpenFlags |= uint32(fusekernel.OpenDirectIO)
 		}
 
+		if o.NoFlush || c.cfg.EnableReadOnlyNoFlush && o.OpenFlags.IsReadOnly() {
+			out.OpenFlags |= uint32(fusekernel.OpenNoFlush)
+		}
+
 	case *fuseops.ReadFileOp:
 		// convertInMessage already set up the destination buffer to be at the end
 		// of the out message. We need only shrink to the right size based on how
@@ -733,7 +984,10 @@ func (c *Connection) kernelResponseForOp(
 		out.St.Bavail = o.BlocksAvailable
 		out.St.Files = o.Inodes
 		out.St.Ffree = o.InodesFree
-		out.St.Namelen = 255
+		out.St.Namelen = o.MaxNameLength
+		if out.St.Namelen == 0 {
+			out.St.Namelen = 255
+		}
 
 		// The posix spec for sys/statvfs.h (http://goo.gl/LktgrF) defines the
 		// following fields of statvfs, among others:
@@ -789,6 +1043,29 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.FallocateOp:
 		// Empty response
 
+	case *fuseops.CopyFileRangeOp:
+		// The kernel's reply for this op is the same as for a write, with a
+		// 32-bit count. Length was capped to fit, but don't let a file system
+		// reporting more than that wrap it around.
+		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
+		out.Size = math.MaxUint32
+		if o.BytesCopied < math.MaxUint32 {
+			out.Size = uint32(o.BytesCopied)
+		}
+
+	case *fuseops.GetLkOp:
+		out := (*fusekernel.LkOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LkOut{}))))
+		out.Lk.Start = o.Lock.Start
+		out.Lk.End = o.Lock.End
+		out.Lk.Type = o.Lock.Type
+		out.Lk.Pid = o.Lock.PID
+
+	case *fuseops.SetLkOp:
+		// Empty response
+
+	case *fuseops.SetLkwOp:
+		// Empty response
+
 	case *initOp:
 		out := (*fusekernel.InitOut)(m.Grow(int(unsafe.Sizeof(fusekernel.InitOut{}))))
 
@@ -796,6 +1073,7 @@ func (c *Connection) kernelResponseForOp(
 		out.Minor = o.Library.Minor
 		out.MaxReadahead = o.MaxReadahead
 		out.Flags = uint32(o.Flags)
+		out.Flags2 = uint32(o.Flags2)
 		// Default values
 		out.MaxBackground = 12
 		out.CongestionThreshold = 9
@@ -814,81 +1092,6 @@ func (c *Connection) kernelResponseForOp(
 // General conversions
 ////////////////////////////////////////////////////////////////////////
 
-func convertTime(t time.Time) (secs uint64, nsec uint32) {
-	totalNano := t.UnixNano()
-	secs = uint64(totalNano / 1e9)
-	nsec = uint32(totalNano % 1e9)
-	return secs, nsec
-}
-
-func convertAttributes(
-	inodeID fuseops.InodeID,
-	in *fuseops.InodeAttributes,
-	out *fusekernel.Attr) {
-	out.Ino = uint64(inodeID)
-	out.Size = in.Size
-	out.Atime, out.AtimeNsec = convertTime(in.Atime)
-	out.Mtime, out.MtimeNsec = convertTime(in.Mtime)
-	out.Ctime, out.CtimeNsec = convertTime(in.Ctime)
-	out.SetCrtime(convertTime(in.Crtime))
-	out.Nlink = in.Nlink
-	out.Uid = in.Uid
-	out.Gid = in.Gid
-	// round up to the nearest 512 boundary
-	out.Blocks = (in.Size + 512 - 1) / 512
-
-	// Set the mode.
-	out.Mode = uint32(in.Mode) & 0777
-	switch {
-	default:
-		out.Mode |= syscall.S_IFREG
-	case in.Mode&os.ModeDir != 0:
-		out.Mode |= syscall.S_IFDIR
-	case in.Mode&os.ModeDevice != 0:
-		if in.Mode&os.ModeCharDevice != 0 {
-			out.Mode |= syscall.S_IFCHR
-		} else {
-			out.Mode |= syscall.S_IFBLK
-		}
-	case in.Mode&os.ModeNamedPipe != 0:
-		out.Mode |= syscall.S_IFIFO
-	case in.Mode&os.ModeSymlink != 0:
-		out.Mode |= syscall.S_IFLNK
-	case in.Mode&os.ModeSocket != 0:
-		out.Mode |= syscall.S_IFSOCK
-	}
-	if in.Mode&os.ModeSetuid != 0 {
-		out.Mode |= syscall.S_ISUID
-	}
-}
-
-// Convert an absolute cache expiration time to a relative time from now for
-// consumption by the fuse kernel module.
-func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
-	// Fuse represents durations as unsigned 64-bit counts of seconds and 32-bit
-	// counts of nanoseconds (cf. http://goo.gl/EJupJV). So negative durations
-	// are right out. There is no need to cap the positive magnitude, because
-	// 2^64 seconds is well longer than the 2^63 ns range of time.Duration.
-	d := t.Sub(time.Now())
-	if d > 0 {
-		secs = uint64(d / time.Second)
-		nsecs = uint32((d % time.Second) / time.Nanosecond)
-	}
-
-	return secs, nsecs
-}
-
-func convertChildInodeEntry(
-	in *fuseops.ChildInodeEntry,
-	out *fusekernel.EntryOut) {
-	out.Nodeid = uint64(in.Child)
-	out.Generation = uint64(in.Generation)
-	out.EntryValid, out.EntryValidNsec = convertExpirationTime(in.EntryExpiration)
-	out.AttrValid, out.AttrValidNsec = convertExpirationTime(in.AttributesExpiration)
-
-	convertAttributes(in.Child, &in.Attributes, &out.Attr)
-}
-
 func convertFileMode(unixMode uint32) os.FileMode {
 	mode := os.FileMode(unixMode & 0777)
 	switch unixMode & syscall.S_IFMT {
@@ -0,0 +1,52 @@
+//go:build go1.18
+// +build go1.18
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// FuzzParseRequest feeds arbitrary bytes through the path that parses
+// messages read from /dev/fuse into ops. Malformed input must result in an
+// error, never a panic or an out of bounds access.
+func FuzzParseRequest(f *testing.F) {
+	for _, seed := range seedRequests() {
+		f.Add(seed)
+	}
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	inMsg := buffer.NewInMessage()
+	outMsg := new(buffer.OutMessage)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := inMsg.Init(bytes.NewReader(data)); err != nil {
+			return
+		}
+
+		outMsg.Reset()
+		convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+	})
+}
@@ -0,0 +1,966 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestExpirationUsesConfiguredClock(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	c := &Connection{
+		cfg: MountConfig{Clock: &clock},
+		protocol: fusekernel.Protocol{
+			Major: fusekernel.ProtoVersionMaxMajor,
+			Minor: fusekernel.ProtoVersionMaxMinor,
+		},
+	}
+
+	// An entry with a validity duration for the attributes, and an absolute
+	// expiration for the entry.
+	op := &fuseops.LookUpInodeOp{
+		Entry: fuseops.ChildInodeEntry{
+			Child:              17,
+			AttributesValidity: 1500 * time.Millisecond,
+			EntryExpiration:    clock.Now().Add(3 * time.Second),
+		},
+	}
+
+	m := new(buffer.OutMessage)
+	m.Reset()
+	c.kernelResponseForOp(m, op)
+
+	out := (*fusekernel.EntryOut)(unsafe.Pointer(
+		&m.Bytes()[buffer.OutMessageHeaderSize]))
+
+	if out.AttrValid != 1 || out.AttrValidNsec != 500000000 {
+		t.Errorf("Attributes valid for %d s %d ns", out.AttrValid, out.AttrValidNsec)
+	}
+
+	if out.EntryValid != 3 || out.EntryValidNsec != 0 {
+		t.Errorf("Entry valid for %d s %d ns", out.EntryValid, out.EntryValidNsec)
+	}
+
+	// The same goes for attribute replies.
+	attrOp := &fuseops.GetInodeAttributesOp{
+		Inode:              17,
+		AttributesValidity: time.Minute,
+	}
+
+	m.Reset()
+	c.kernelResponseForOp(m, attrOp)
+
+	attrOut := (*fusekernel.AttrOut)(unsafe.Pointer(
+		&m.Bytes()[buffer.OutMessageHeaderSize]))
+
+	if attrOut.AttrValid != 60 || attrOut.AttrValidNsec != 0 {
+		t.Errorf(
+			"Attributes valid for %d s %d ns",
+			attrOut.AttrValid,
+			attrOut.AttrValidNsec)
+	}
+}
+
+func TestCaseInsensitiveNegativeEntries(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	testCases := []struct {
+		name            string
+		caseInsensitive bool
+		child           fuseops.InodeID
+		wantEntryValid  uint64
+	}{
+		{"negative", false, 0, 60},
+		{"negative, case insensitive", true, 0, 0},
+		{"positive, case insensitive", true, 17, 60},
+	}
+
+	for _, tc := range testCases {
+		c := &Connection{
+			cfg: MountConfig{
+				Clock:           &clock,
+				CaseInsensitive: tc.caseInsensitive,
+			},
+			protocol: fusekernel.Protocol{
+				Major: fusekernel.ProtoVersionMaxMajor,
+				Minor: fusekernel.ProtoVersionMaxMinor,
+			},
+		}
+
+		op := &fuseops.LookUpInodeOp{
+			Name: "foo",
+			Entry: fuseops.ChildInodeEntry{
+				Child:           tc.child,
+				EntryExpiration: clock.Now().Add(time.Minute),
+			},
+		}
+
+		m := new(buffer.OutMessage)
+		m.Reset()
+		c.kernelResponseForOp(m, op)
+
+		out := (*fusekernel.EntryOut)(unsafe.Pointer(
+			&m.Bytes()[buffer.OutMessageHeaderSize]))
+
+		if out.EntryValid != tc.wantEntryValid || out.EntryValidNsec != 0 {
+			t.Errorf(
+				"%s: entry valid for %d s %d ns, want %d s",
+				tc.name,
+				out.EntryValid,
+				out.EntryValidNsec,
+				tc.wantEntryValid)
+		}
+	}
+}
+
+func TestSetattrCarriesCombinedChanges(t *testing.T) {
+	// The setattr sent for chown(2) on a setuid file, which changes the owner
+	// and group and clears the setuid bit.
+	var in fusekernel.SetattrIn
+	in.Valid = uint32(
+		fusekernel.SetattrMode | fusekernel.SetattrUid | fusekernel.SetattrGid)
+	in.Mode = 0755 | syscall.S_IFREG
+	in.Uid = 17
+	in.Gid = 19
+
+	inMsg := buffer.NewInMessage()
+	req := makeRequest(
+		fusekernel.OpSetattr,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	outMsg := new(buffer.OutMessage)
+	outMsg.Reset()
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	// All three changes should show up in the one op, and nothing else.
+	op := o.(*fuseops.SetInodeAttributesOp)
+	if op.Mode == nil || *op.Mode != 0755 {
+		t.Errorf("Mode: %v", op.Mode)
+	}
+
+	if op.Uid == nil || *op.Uid != 17 {
+		t.Errorf("Uid: %v", op.Uid)
+	}
+
+	if op.Gid == nil || *op.Gid != 19 {
+		t.Errorf("Gid: %v", op.Gid)
+	}
+
+	if op.Size != nil || op.Atime != nil || op.Mtime != nil {
+		t.Errorf("Unexpected changes: %v %v %v", op.Size, op.Atime, op.Mtime)
+	}
+}
+
+func TestReadCarriesFileFlags(t *testing.T) {
+	var in fusekernel.ReadIn
+	in.Size = 4096
+	in.Flags = uint32(fusekernel.OpenReadOnly | fusekernel.OpenNonblock)
+
+	inMsg := buffer.NewInMessage()
+	req := makeRequest(
+		fusekernel.OpRead,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	outMsg := new(buffer.OutMessage)
+	outMsg.Reset()
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	op := o.(*fuseops.ReadFileOp)
+	if !op.OpenFlags.IsReadOnly() || !op.OpenFlags.IsNonblock() {
+		t.Errorf("OpenFlags: %v", op.OpenFlags)
+	}
+}
+
+func TestOpContextFromHeader(t *testing.T) {
+	var read fusekernel.ReadIn
+	read.Size = 4096
+
+	testCases := []struct {
+		opcode uint32
+		body   []byte
+	}{
+		{fusekernel.OpStatfs, nil},
+		{fusekernel.OpLookup, []byte("foo\x00")},
+		{fusekernel.OpRead, structBytes(unsafe.Pointer(&read), unsafe.Sizeof(read))},
+	}
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	for _, tc := range testCases {
+		inMsg := buffer.NewInMessage()
+		if err := inMsg.Init(bytes.NewReader(makeRequest(tc.opcode, tc.body))); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		outMsg := new(buffer.OutMessage)
+		outMsg.Reset()
+
+		o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		// makeRequest sends from UID 23, GID 29 and PID 31.
+		got := reflect.ValueOf(o).Elem().FieldByName("OpContext").Interface()
+		expected := fuseops.OpContext{Pid: 31, Uid: 23, Gid: 29}
+		if got != expected {
+			t.Errorf("%T: OpContext %+v, want %+v", o, got, expected)
+		}
+	}
+}
+
+func TestWriteCarriesFileFlags(t *testing.T) {
+	var in fusekernel.WriteIn
+	in.Offset = 11
+	in.Size = 4
+	in.Flags = uint32(fusekernel.OpenWriteOnly | fusekernel.OpenAppend)
+
+	inMsg := buffer.NewInMessage()
+	req := makeRequest(
+		fusekernel.OpWrite,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+		[]byte("taco"))
+
+	if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	outMsg := new(buffer.OutMessage)
+	outMsg.Reset()
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	op := o.(*fuseops.WriteFileOp)
+	if !op.OpenFlags.IsWriteOnly() || !op.OpenFlags.IsAppend() {
+		t.Errorf("OpenFlags: %v", op.OpenFlags)
+	}
+
+	if op.Offset != 11 || string(op.Data) != "taco" {
+		t.Errorf("Offset %d, data %q", op.Offset, op.Data)
+	}
+}
+
+func TestOpenReplyNoFlush(t *testing.T) {
+	testCases := []struct {
+		name          string
+		readOnlyFlush bool
+		op            *fuseops.OpenFileOp
+		want          bool
+	}{
+		{
+			"default",
+			false,
+			&fuseops.OpenFileOp{OpenFlags: fusekernel.OpenReadOnly},
+			false,
+		},
+		{
+			"requested for the handle",
+			false,
+			&fuseops.OpenFileOp{OpenFlags: fusekernel.OpenReadWrite, NoFlush: true},
+			true,
+		},
+		{
+			"read-only with EnableReadOnlyNoFlush",
+			true,
+			&fuseops.OpenFileOp{OpenFlags: fusekernel.OpenReadOnly},
+			true,
+		},
+		{
+			"writable with EnableReadOnlyNoFlush",
+			true,
+			&fuseops.OpenFileOp{OpenFlags: fusekernel.OpenWriteOnly},
+			false,
+		},
+	}
+
+	for _, tc := range testCases {
+		c := &Connection{
+			cfg: MountConfig{EnableReadOnlyNoFlush: tc.readOnlyFlush},
+		}
+
+		m := new(buffer.OutMessage)
+		m.Reset()
+		c.kernelResponseForOp(m, tc.op)
+
+		out := (*fusekernel.OpenOut)(unsafe.Pointer(
+			&m.Bytes()[buffer.OutMessageHeaderSize]))
+
+		got := fusekernel.OpenResponseFlags(out.OpenFlags)&fusekernel.OpenNoFlush != 0
+		if got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestKillSuidgid(t *testing.T) {
+	var write fusekernel.WriteIn
+	write.Size = 4
+	write.WriteFlags = uint32(fusekernel.WriteKillSuidgid)
+
+	var setattr fusekernel.SetattrIn
+	setattr.Valid = uint32(fusekernel.SetattrSize | fusekernel.SetattrKillSuidgid)
+
+	var open fusekernel.OpenIn
+	open.Flags = uint32(fusekernel.OpenWriteOnly | fusekernel.OpenTruncate)
+	open.OpenFlags = uint32(fusekernel.OpenInKillSuidgid)
+
+	var create fusekernel.CreateIn
+	create.Flags = uint32(fusekernel.OpenWriteOnly | fusekernel.OpenTruncate)
+	create.Mode = syscall.S_IFREG | 0644
+	create.OpenFlags = uint32(fusekernel.OpenInKillSuidgid)
+
+	testCases := []struct {
+		name   string
+		opcode uint32
+		body   [][]byte
+		get    func(o interface{}) bool
+	}{
+		{
+			"write",
+			fusekernel.OpWrite,
+			[][]byte{
+				structBytes(unsafe.Pointer(&write), unsafe.Sizeof(write)),
+				[]byte("taco"),
+			},
+			func(o interface{}) bool { return o.(*fuseops.WriteFileOp).KillSuidgid },
+		},
+		{
+			"setattr",
+			fusekernel.OpSetattr,
+			[][]byte{structBytes(unsafe.Pointer(&setattr), unsafe.Sizeof(setattr))},
+			func(o interface{}) bool { return o.(*fuseops.SetInodeAttributesOp).KillSuidgid },
+		},
+		{
+			"open",
+			fusekernel.OpOpen,
+			[][]byte{structBytes(unsafe.Pointer(&open), unsafe.Sizeof(open))},
+			func(o interface{}) bool { return o.(*fuseops.OpenFileOp).KillSuidgid },
+		},
+		{
+			"create",
+			fusekernel.OpCreate,
+			[][]byte{
+				structBytes(unsafe.Pointer(&create), unsafe.Sizeof(create)),
+				[]byte("foo\x00"),
+			},
+			func(o interface{}) bool { return o.(*fuseops.CreateFileOp).KillSuidgid },
+		},
+	}
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	for _, tc := range testCases {
+		inMsg := buffer.NewInMessage()
+		req := makeRequest(tc.opcode, tc.body...)
+		if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+			t.Fatalf("%s: Init: %v", tc.name, err)
+		}
+
+		outMsg := new(buffer.OutMessage)
+		outMsg.Reset()
+
+		o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+		if err != nil {
+			t.Fatalf("%s: convertInMessage: %v", tc.name, err)
+		}
+
+		if !tc.get(o) {
+			t.Errorf("%s: KillSuidgid not set", tc.name)
+		}
+	}
+}
+
+func TestStatFSReply(t *testing.T) {
+	// Multi-terabyte capacities need all 64 bits of the counts.
+	op := &fuseops.StatFSOp{
+		BlockSize:       1 << 15,
+		IoSize:          1 << 16,
+		Blocks:          1<<51 + 3,
+		BlocksFree:      1<<43 + 5,
+		BlocksAvailable: 1<<41 + 7,
+		Inodes:          1<<59 + 11,
+		InodesFree:      1<<58 + 13,
+	}
+
+	c := &Connection{}
+	m := new(buffer.OutMessage)
+	m.Reset()
+	c.kernelResponseForOp(m, op)
+
+	if n := m.Len(); n != buffer.OutMessageHeaderSize+int(unsafe.Sizeof(fusekernel.StatfsOut{})) {
+		t.Fatalf("Unexpected response size: %d", n)
+	}
+
+	out := (*fusekernel.StatfsOut)(unsafe.Pointer(
+		&m.Bytes()[buffer.OutMessageHeaderSize]))
+
+	expected := fusekernel.Kstatfs{
+		Blocks:  op.Blocks,
+		Bfree:   op.BlocksFree,
+		Bavail:  op.BlocksAvailable,
+		Files:   op.Inodes,
+		Ffree:   op.InodesFree,
+		Bsize:   op.IoSize,
+		Namelen: 255,
+		Frsize:  op.BlockSize,
+	}
+
+	if out.St != expected {
+		t.Errorf("got %+v, want %+v", out.St, expected)
+	}
+}
+
+func TestAttributesBlocks(t *testing.T) {
+	c := &Connection{
+		protocol: fusekernel.Protocol{
+			Major: fusekernel.ProtoVersionMaxMajor,
+			Minor: fusekernel.ProtoVersionMaxMinor,
+		},
+	}
+
+	testCases := []struct {
+		name  string
+		attrs fuseops.InodeAttributes
+		want  uint64
+	}{
+		{"derived from size", fuseops.InodeAttributes{Size: 1000}, 2},
+		{"set", fuseops.InodeAttributes{Size: 1000, Blocks: 1}, 1},
+		{"none allocated", fuseops.InodeAttributes{Size: 1000, BlocksValid: true}, 0},
+	}
+
+	for _, tc := range testCases {
+		m := new(buffer.OutMessage)
+		m.Reset()
+		c.kernelResponseForOp(m, &fuseops.GetInodeAttributesOp{Attributes: tc.attrs})
+
+		out := (*fusekernel.AttrOut)(unsafe.Pointer(
+			&m.Bytes()[buffer.OutMessageHeaderSize]))
+
+		if out.Attr.Blocks != tc.want {
+			t.Errorf("%s: got %d blocks, want %d", tc.name, out.Attr.Blocks, tc.want)
+		}
+	}
+}
+
+func TestGetXattrSizeProbe(t *testing.T) {
+	// getxattr(2) with a zero size asks only for the size of the value.
+	var in fusekernel.GetxattrIn
+
+	inMsg := buffer.NewInMessage()
+	req := makeRequest(
+		fusekernel.OpGetxattr,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+		[]byte("user.foo\x00"))
+
+	if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	outMsg := new(buffer.OutMessage)
+	outMsg.Reset()
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	op := o.(*fuseops.GetXattrOp)
+	if op.Name != "user.foo" || len(op.Dst) != 0 {
+		t.Fatalf("Name %q, %d-byte Dst", op.Name, len(op.Dst))
+	}
+
+	// The file system reports the size, which should be sent back in place of
+	// the value.
+	op.BytesRead = 17
+
+	c := &Connection{}
+	c.kernelResponse(outMsg, 1, op, nil)
+
+	const size = buffer.OutMessageHeaderSize + int(unsafe.Sizeof(fusekernel.GetxattrOut{}))
+	if outMsg.Len() != size {
+		t.Fatalf("Unexpected response size: %d", outMsg.Len())
+	}
+
+	out := (*fusekernel.GetxattrOut)(unsafe.Pointer(
+		&outMsg.Bytes()[buffer.OutMessageHeaderSize]))
+
+	if out.Size != 17 {
+		t.Errorf("Size: %d", out.Size)
+	}
+}
+
+func TestSetXattrValues(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		value string
+	}{
+		{"non-empty", "taco"},
+		{"empty", ""},
+		{"containing NULs", "bur\x00ri\x00to"},
+	}
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	for _, tc := range testCases {
+		var in fusekernel.SetxattrIn
+		in.Size = uint32(len(tc.value))
+		in.Flags = unix.XATTR_CREATE
+
+		inMsg := buffer.NewInMessage()
+		req := makeRequest(
+			fusekernel.OpSetxattr,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+			[]byte("user.foo\x00"+tc.value))
+
+		if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+			t.Fatalf("%s: Init: %v", tc.desc, err)
+		}
+
+		outMsg := new(buffer.OutMessage)
+		outMsg.Reset()
+
+		o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+		if err != nil {
+			t.Errorf("%s: convertInMessage: %v", tc.desc, err)
+			continue
+		}
+
+		op := o.(*fuseops.SetXattrOp)
+		if op.Name != "user.foo" || string(op.Value) != tc.value || op.Flags != unix.XATTR_CREATE {
+			t.Errorf("%s: name %q, value %q, flags %d", tc.desc, op.Name, op.Value, op.Flags)
+		}
+	}
+}
+
+func TestMkNodeFileTypes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		unixMode uint32
+		rdev     uint32
+		mode     os.FileMode
+	}{
+		{"char device", syscall.S_IFCHR | 0620, 0x0501, os.ModeDevice | os.ModeCharDevice | 0620},
+		{"block device", syscall.S_IFBLK | 0660, 0x0803, os.ModeDevice | 0660},
+		{"fifo", syscall.S_IFIFO | 0644, 0, os.ModeNamedPipe | 0644},
+		{"socket", syscall.S_IFSOCK | 0755, 0, os.ModeSocket | 0755},
+		{"regular file", syscall.S_IFREG | 0600, 0, 0600},
+	}
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	for _, tc := range testCases {
+		in := fusekernel.MknodIn{Mode: tc.unixMode, Rdev: tc.rdev}
+
+		inMsg := buffer.NewInMessage()
+		req := makeRequest(
+			fusekernel.OpMknod,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+			[]byte("foo\x00"))
+
+		if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+			t.Fatalf("%s: Init: %v", tc.name, err)
+		}
+
+		outMsg := new(buffer.OutMessage)
+		outMsg.Reset()
+
+		o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+		if err != nil {
+			t.Fatalf("%s: convertInMessage: %v", tc.name, err)
+		}
+
+		op := o.(*fuseops.MkNodeOp)
+		if op.Mode != tc.mode || op.Rdev != tc.rdev {
+			t.Errorf("%s: got mode %v rdev %#x, want %v %#x",
+				tc.name, op.Mode, op.Rdev, tc.mode, tc.rdev)
+		}
+
+		// Reply with the inode as a file system would, and check that the kernel
+		// sees the same type and device number.
+		op.Entry.Child = 23
+		op.Entry.Attributes.Mode = op.Mode
+		op.Entry.Attributes.Rdev = op.Rdev
+
+		c := &Connection{}
+		m := new(buffer.OutMessage)
+		m.Reset()
+		c.kernelResponseForOp(m, op)
+
+		out := (*fusekernel.EntryOut)(unsafe.Pointer(
+			&m.Bytes()[buffer.OutMessageHeaderSize]))
+
+		if out.Attr.Mode != tc.unixMode || out.Attr.Rdev != tc.rdev {
+			t.Errorf("%s: reply has mode %#o rdev %#x, want %#o %#x",
+				tc.name, out.Attr.Mode, out.Attr.Rdev, tc.unixMode, tc.rdev)
+		}
+	}
+}
+
+func TestCopyFileRangeLength(t *testing.T) {
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	testCases := []struct {
+		name   string
+		length uint64
+		want   uint64
+	}{
+		{"small", 4096, 4096},
+		{"largest reportable", math.MaxUint32, math.MaxUint32},
+		{"too large to report", math.MaxUint32 + 1, math.MaxUint32},
+		{"huge", 1 << 40, math.MaxUint32},
+	}
+
+	for _, tc := range testCases {
+		in := fusekernel.CopyFileRangeIn{FhIn: 17, FhOut: 19, NodeidOut: 23, Len: tc.length}
+		inMsg := buffer.NewInMessage()
+		req := makeRequest(fusekernel.OpCopyFileRange, structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+		if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+			t.Fatalf("%s: Init: %v", tc.name, err)
+		}
+
+		outMsg := new(buffer.OutMessage)
+		outMsg.Reset()
+
+		o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+		if err != nil {
+			t.Fatalf("%s: convertInMessage: %v", tc.name, err)
+		}
+
+		op := o.(*fuseops.CopyFileRangeOp)
+		if op.Length != tc.want {
+			t.Errorf("%s: Length %d, want %d", tc.name, op.Length, tc.want)
+		}
+
+		// A file system copying as many bytes as it was asked for has them all
+		// reported.
+		op.BytesCopied = op.Length
+
+		c := &Connection{}
+		m := new(buffer.OutMessage)
+		m.Reset()
+		c.kernelResponseForOp(m, op)
+
+		out := (*fusekernel.WriteOut)(unsafe.Pointer(
+			&m.Bytes()[buffer.OutMessageHeaderSize]))
+
+		if uint64(out.Size) != tc.want {
+			t.Errorf("%s: reply reports %d bytes copied, want %d", tc.name, out.Size, tc.want)
+		}
+	}
+
+	// A file system that reports more than it was asked for has the count
+	// clamped rather than wrapped around.
+	c := &Connection{}
+	m := new(buffer.OutMessage)
+	m.Reset()
+	c.kernelResponseForOp(m, &fuseops.CopyFileRangeOp{BytesCopied: 1<<32 + 5})
+
+	out := (*fusekernel.WriteOut)(unsafe.Pointer(
+		&m.Bytes()[buffer.OutMessageHeaderSize]))
+
+	if out.Size != math.MaxUint32 {
+		t.Errorf("Reply reports %d bytes copied, want %d", out.Size, uint32(math.MaxUint32))
+	}
+}
+
+func TestLockOps(t *testing.T) {
+	in := fusekernel.LkIn{
+		Fh:    23,
+		Owner: 0xdeadbeef,
+	}
+	in.Lk.Start = 100
+	in.Lk.End = math.MaxUint64
+	in.Lk.Type = syscall.F_WRLCK
+	in.Lk.Pid = 31
+
+	want := fuseops.FileLock{
+		Start: 100,
+		End:   math.MaxUint64,
+		Type:  syscall.F_WRLCK,
+		PID:   31,
+	}
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	for _, opcode := range []uint32{
+		fusekernel.OpGetlk,
+		fusekernel.OpSetlk,
+		fusekernel.OpSetlkw,
+	} {
+		inMsg := buffer.NewInMessage()
+		req := makeRequest(opcode, structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+		if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		outMsg := new(buffer.OutMessage)
+		outMsg.Reset()
+
+		o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		var inode fuseops.InodeID
+		var handle fuseops.HandleID
+		var owner uint64
+		var lock fuseops.FileLock
+
+		switch op := o.(type) {
+		case *fuseops.GetLkOp:
+			inode, handle, owner, lock = op.Inode, op.Handle, op.Owner, op.Lock
+		case *fuseops.SetLkOp:
+			inode, handle, owner, lock = op.Inode, op.Handle, op.Owner, op.Lock
+		case *fuseops.SetLkwOp:
+			inode, handle, owner, lock = op.Inode, op.Handle, op.Owner, op.Lock
+		default:
+			t.Fatalf("Opcode %d: unexpected op %T", opcode, o)
+		}
+
+		if inode != 19 || handle != 23 || owner != 0xdeadbeef || lock != want {
+			t.Errorf("%T: got inode %d handle %d owner %#x lock %+v",
+				o, inode, handle, owner, lock)
+		}
+	}
+
+	// A conflicting lock is returned to the kernel.
+	op := &fuseops.GetLkOp{
+		Lock: fuseops.FileLock{Start: 0, End: 99, Type: syscall.F_RDLCK, PID: 37},
+	}
+
+	c := &Connection{}
+	m := new(buffer.OutMessage)
+	m.Reset()
+	c.kernelResponseForOp(m, op)
+
+	if n := m.Len(); n != buffer.OutMessageHeaderSize+int(unsafe.Sizeof(fusekernel.LkOut{})) {
+		t.Fatalf("Unexpected response size: %d", n)
+	}
+
+	out := (*fusekernel.LkOut)(unsafe.Pointer(&m.Bytes()[buffer.OutMessageHeaderSize]))
+	if out.Lk.Start != 0 || out.Lk.End != 99 || out.Lk.Type != syscall.F_RDLCK || out.Lk.Pid != 37 {
+		t.Errorf("Unexpected reply: %+v", out.Lk)
+	}
+}
+
+func TestSetxattrFormats(t *testing.T) {
+	var legacy fusekernel.SetxattrIn
+	legacy.Size = 3
+	legacy.Flags = unix.XATTR_CREATE
+
+	ext := fusekernel.SetxattrExtIn{
+		Size:          3,
+		Flags:         unix.XATTR_REPLACE,
+		SetxattrFlags: fusekernel.SetxattrACLKillSgid,
+	}
+
+	testCases := []struct {
+		desc     string
+		caps     Capabilities
+		in       []byte
+		flags    uint32
+		killSgid bool
+	}{
+		{
+			desc:  "legacy",
+			in:    structBytes(unsafe.Pointer(&legacy), unsafe.Sizeof(legacy)),
+			flags: unix.XATTR_CREATE,
+		},
+		{
+			desc:     "extended",
+			caps:     Capabilities{SetxattrExt: true},
+			in:       structBytes(unsafe.Pointer(&ext), unsafe.Sizeof(ext)),
+			flags:    unix.XATTR_REPLACE,
+			killSgid: true,
+		},
+	}
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	for _, tc := range testCases {
+		inMsg := buffer.NewInMessage()
+		req := makeRequest(fusekernel.OpSetxattr, tc.in, []byte("user.foo\x00bar"))
+		if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		outMsg := new(buffer.OutMessage)
+		outMsg.Reset()
+
+		o, err := convertInMessage(inMsg, outMsg, protocol, tc.caps)
+		if err != nil {
+			t.Errorf("%s: convertInMessage: %v", tc.desc, err)
+			continue
+		}
+
+		op := o.(*fuseops.SetXattrOp)
+		if op.Name != "user.foo" || string(op.Value) != "bar" || op.Flags != tc.flags || op.KillSgid != tc.killSgid {
+			t.Errorf("%s: unexpected op: %+v", tc.desc, op)
+		}
+	}
+
+	// An extended message too short for its input is corrupt.
+	inMsg := buffer.NewInMessage()
+	req := makeRequest(fusekernel.OpSetxattr, structBytes(unsafe.Pointer(&ext), unsafe.Sizeof(ext))[:8])
+	if err := inMsg.Init(bytes.NewReader(req)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	outMsg := new(buffer.OutMessage)
+	outMsg.Reset()
+
+	if _, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{SetxattrExt: true}); err == nil {
+		t.Errorf("Expected an error for a truncated extended message")
+	}
+}
+
+func TestBatchForgetCount(t *testing.T) {
+	entries := []fusekernel.ForgetOne{
+		{Nodeid: 23, Nlookup: 1},
+		{Nodeid: 29, Nlookup: 2},
+	}
+
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	testCases := []struct {
+		name  string
+		count uint32
+		ok    bool
+	}{
+		{"matching", 2, true},
+		{"short", 1, true},
+		{"too large", 3, false},
+
+		// Large enough that the size of that many entries wraps around to a
+		// small one in a 32-bit uintptr.
+		{"huge", math.MaxUint32/uint32(unsafe.Sizeof(fusekernel.ForgetOne{})) + 2, false},
+	}
+
+	for _, tc := range testCases {
+		in := fusekernel.BatchForgetIn{Count: tc.count}
+		body := [][]byte{structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in))}
+		for i := range entries {
+			body = append(
+				body,
+				structBytes(unsafe.Pointer(&entries[i]), unsafe.Sizeof(entries[i])))
+		}
+
+		inMsg := buffer.NewInMessage()
+		if err := inMsg.Init(bytes.NewReader(makeRequest(fusekernel.OpBatchForget, body...))); err != nil {
+			t.Fatalf("%s: Init: %v", tc.name, err)
+		}
+
+		outMsg := new(buffer.OutMessage)
+		outMsg.Reset()
+
+		o, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{})
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: convertInMessage succeeded", tc.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: convertInMessage: %v", tc.name, err)
+			continue
+		}
+
+		op := o.(*fuseops.BatchForgetOp)
+		if len(op.Entries) != int(tc.count) {
+			t.Errorf("%s: got %d entries, want %d", tc.name, len(op.Entries), tc.count)
+		}
+	}
+}
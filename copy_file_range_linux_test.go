@@ -0,0 +1,264 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/sys/unix"
+)
+
+// A file system containing a file named "src" with fixed contents and an
+// initially empty file named "dst", whose CopyFileRange returns a settable
+// error.
+type copyFileRangeFS struct {
+	minimalFS
+
+	mu sync.Mutex
+
+	// The error for CopyFileRange to return, copying the data itself if nil.
+	copyErr error
+
+	// The number of CopyFileRange calls received.
+	copies int
+
+	dst []byte
+}
+
+const (
+	copySrcID = fuseops.RootInodeID + 1 + iota
+	copyDstID
+)
+
+const copySrcContents = "taco burrito enchilada"
+
+func (fs *copyFileRangeFS) attributes(
+	inode fuseops.InodeID) (fuseops.InodeAttributes, error) {
+	switch inode {
+	case fuseops.RootInodeID:
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0777 | os.ModeDir,
+		}, nil
+
+	case copySrcID:
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0444,
+			Size:  uint64(len(copySrcContents)),
+		}, nil
+
+	case copyDstID:
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0666,
+			Size:  uint64(len(fs.dst)),
+		}, nil
+
+	default:
+		return fuseops.InodeAttributes{}, fuse.ENOENT
+	}
+}
+
+func (fs *copyFileRangeFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID {
+		return fuse.ENOENT
+	}
+
+	switch op.Name {
+	case "src":
+		op.Entry.Child = copySrcID
+	case "dst":
+		op.Entry.Child = copyDstID
+	default:
+		return fuse.ENOENT
+	}
+
+	op.Entry.Attributes, _ = fs.attributes(op.Entry.Child)
+	return nil
+}
+
+func (fs *copyFileRangeFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var err error
+	op.Attributes, err = fs.attributes(op.Inode)
+	return err
+}
+
+func (fs *copyFileRangeFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *copyFileRangeFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if op.Inode != copySrcID {
+		return fuse.EIO
+	}
+
+	if op.Offset < int64(len(copySrcContents)) {
+		op.BytesRead = copy(op.Dst, copySrcContents[op.Offset:])
+	}
+
+	return nil
+}
+
+// Write data to dst at the given offset, extending it as necessary.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *copyFileRangeFS) writeDst(offset int64, data []byte) {
+	if end := int(offset) + len(data); end > len(fs.dst) {
+		fs.dst = append(fs.dst, make([]byte, end-len(fs.dst))...)
+	}
+
+	copy(fs.dst[offset:], data)
+}
+
+func (fs *copyFileRangeFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Inode != copyDstID {
+		return fuse.EIO
+	}
+
+	fs.writeDst(op.Offset, op.Data)
+	return nil
+}
+
+func (fs *copyFileRangeFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.copies++
+	if fs.copyErr != nil {
+		return fs.copyErr
+	}
+
+	if op.InodeIn != copySrcID || op.InodeOut != copyDstID {
+		return fuse.EIO
+	}
+
+	data := []byte(copySrcContents)
+	if op.OffsetIn < uint64(len(data)) {
+		data = data[op.OffsetIn:]
+	} else {
+		data = nil
+	}
+
+	if uint64(len(data)) > op.Length {
+		data = data[:op.Length]
+	}
+
+	fs.writeDst(int64(op.OffsetOut), data)
+	op.BytesCopied = uint64(len(data))
+	return nil
+}
+
+func TestCopyFileRangeENOSYS(t *testing.T) {
+	// Mount. Writes that the kernel falls back to should reach the file system
+	// straight away, rather than sitting in the page cache.
+	fs := &copyFileRangeFS{}
+	dir := mountFS(t, fs, &fuse.MountConfig{DisableWritebackCaching: true}).Dir()
+
+	src, err := os.Open(path.Join(dir, "src"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer src.Close()
+
+	dst, err := os.OpenFile(path.Join(dir, "dst"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	defer dst.Close()
+
+	// Copy with copy_file_range(2), which should succeed whether or not the
+	// file system does the copying, then check how many times the file system
+	// has been asked.
+	copyRange := func(copyErr error, offIn, offOut int64, n int, wantCopies int) {
+		t.Helper()
+
+		fs.mu.Lock()
+		fs.copyErr = copyErr
+		fs.mu.Unlock()
+
+		copied, err := unix.CopyFileRange(
+			int(src.Fd()), &offIn,
+			int(dst.Fd()), &offOut,
+			n, 0)
+
+		if err != nil {
+			t.Fatalf("CopyFileRange with %v: %v", copyErr, err)
+		}
+
+		if copied != n {
+			t.Errorf("CopyFileRange with %v: copied %d bytes; want %d", copyErr, copied, n)
+		}
+
+		fs.mu.Lock()
+		copies := fs.copies
+		fs.mu.Unlock()
+
+		if copies != wantCopies {
+			t.Errorf("CopyFileRange with %v: %d calls; want %d", copyErr, copies, wantCopies)
+		}
+	}
+
+	// The file system copies the data itself.
+	copyRange(nil, 0, 0, 4, 1)
+
+	// ENOTSUP declines each copy, but the kernel keeps asking.
+	copyRange(fuse.ENOTSUP, 4, 4, 8, 2)
+	copyRange(fuse.ENOTSUP, 12, 12, 10, 3)
+
+	// ENOSYS tells the kernel to stop asking.
+	copyRange(fuse.ENOSYS, 0, 22, 4, 4)
+	copyRange(fuse.ENOSYS, 4, 26, 8, 4)
+
+	// Either way, the data should have been copied.
+	const want = copySrcContents + "taco burrito"
+
+	fs.mu.Lock()
+	got := string(fs.dst)
+	fs.mu.Unlock()
+
+	if got != want {
+		t.Errorf("dst contains %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestAtomicCreateAndOpen(t *testing.T) {
+	ctx := context.Background()
+
+	// Mount. Disable writeback caching so that the write below reaches the file
+	// system before close(2) returns.
+	fs := &fileFS{}
+	mfs := mountFS(t, fs, &fuse.MountConfig{DisableWritebackCaching: true})
+
+	// Create, write through, and close the file.
+	f, err := os.OpenFile(
+		path.Join(mfs.Dir(), "foo"),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0666)
+
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	if _, err := f.Write([]byte("taco")); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	// Unmount and wait for the release to be processed.
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Joining: %v", err)
+	}
+
+	// A single op should have yielded both the inode and the handle, which the
+	// write and the release should both have been made through.
+	var creates []*fuseops.CreateFileOp
+	var opens int
+	var writes []*fuseops.WriteFileOp
+	var released []fuseops.HandleID
+
+	for _, op := range fs.recorded() {
+		switch op := op.(type) {
+		case *fuseops.CreateFileOp:
+			creates = append(creates, op)
+		case *fuseops.OpenFileOp:
+			opens++
+		case *fuseops.WriteFileOp:
+			writes = append(writes, op)
+		case *fuseops.ReleaseFileHandleOp:
+			released = append(released, op.Handle)
+		}
+	}
+
+	if len(creates) != 1 {
+		t.Fatalf("Unexpected CreateFile count: %d", len(creates))
+	}
+
+	if opens != 0 {
+		t.Errorf("Unexpected OpenFile count: %d", opens)
+	}
+
+	h := creates[0].Handle
+	if len(writes) != 1 || string(writes[0].Data) != "taco" {
+		t.Errorf("Unexpected writes: %d", len(writes))
+	}
+
+	for _, w := range writes {
+		if w.Handle != h {
+			t.Errorf("Unexpected write handle: %d", w.Handle)
+		}
+	}
+
+	if len(released) != 1 || released[0] != h {
+		t.Errorf("Unexpected released handles: %v", released)
+	}
+}
@@ -69,6 +69,17 @@ func describeRequest(op interface{}) (s string) {
 	case *unknownOp:
 		addComponent("opcode %d", typed.OpCode)
 
+	case *fuseops.BatchForgetOp:
+		addComponent("%d inodes", len(typed.Entries))
+
+	case *fuseops.GetInodeAttributesOp:
+		if typed.Handle != nil {
+			addComponent("handle %d", *typed.Handle)
+		}
+
+	case *fuseops.GetInodeFlagsOp:
+		addComponent("handle %d", typed.Handle)
+
 	case *fuseops.SetInodeAttributesOp:
 		if typed.Size != nil {
 			addComponent("size %d", *typed.Size)
@@ -78,6 +89,14 @@ func describeRequest(op interface{}) (s string) {
 			addComponent("mode %v", *typed.Mode)
 		}
 
+		if typed.Uid != nil {
+			addComponent("uid %d", *typed.Uid)
+		}
+
+		if typed.Gid != nil {
+			addComponent("gid %d", *typed.Gid)
+		}
+
 		if typed.Atime != nil {
 			addComponent("atime %v", *typed.Atime)
 		}
@@ -86,6 +105,10 @@ func describeRequest(op interface{}) (s string) {
 			addComponent("mtime %v", *typed.Mtime)
 		}
 
+		if typed.KillSuidgid {
+			addComponent("kill suidgid")
+		}
+
 	case *fuseops.RenameOp:
 		addComponent("old_parent %v", typed.OldParent)
 		addComponent("old_name %q", typed.OldName)
@@ -101,6 +124,13 @@ func describeRequest(op interface{}) (s string) {
 		addComponent("handle %d", typed.Handle)
 		addComponent("offset %d", typed.Offset)
 		addComponent("%d bytes", len(typed.Data))
+		if typed.OpenFlags.IsAppend() {
+			addComponent("append")
+		}
+
+		if typed.KillSuidgid {
+			addComponent("kill suidgid")
+		}
 
 	case *fuseops.RemoveXattrOp:
 		addComponent("name %s", typed.Name)
@@ -115,6 +145,26 @@ func describeRequest(op interface{}) (s string) {
 		addComponent("offset %d", typed.Offset)
 		addComponent("length %d", typed.Length)
 		addComponent("mode %d", typed.Mode)
+
+	case *fuseops.CopyFileRangeOp:
+		addComponent("handle %d", typed.HandleIn)
+		addComponent("offset %d", typed.OffsetIn)
+		addComponent("dst_inode %v", typed.InodeOut)
+		addComponent("dst_handle %d", typed.HandleOut)
+		addComponent("dst_offset %d", typed.OffsetOut)
+		addComponent("length %d", typed.Length)
+
+	case *fuseops.GetLkOp:
+		addComponent("owner %#x", typed.Owner)
+		addComponent("lock %+v", typed.Lock)
+
+	case *fuseops.SetLkOp:
+		addComponent("owner %#x", typed.Owner)
+		addComponent("lock %+v", typed.Lock)
+
+	case *fuseops.SetLkwOp:
+		addComponent("owner %#x", typed.Owner)
+		addComponent("lock %+v", typed.Lock)
 	}
 
 	// Use just the name if there is no extra info.
@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A dirAliasChecker remembers the names under which each directory inode has
+// been returned to the kernel, and notices when a file system that aliases
+// directories (returns the same directory inode under more than one name) does
+// so inconsistently. See MountConfig.EnableDirectoryAliasCheck.
+type dirAliasChecker struct {
+	mu sync.Mutex
+
+	// The names of each directory inode, and the directory inode for each name.
+	// Like the generation checker's state this grows without bound, which is
+	// acceptable only when debugging.
+	//
+	// GUARDED_BY(mu)
+	names  map[fuseops.InodeID]map[dirName]struct{}
+	byName map[dirName]fuseops.InodeID
+}
+
+// A name within a parent directory.
+type dirName struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+func newDirAliasChecker() *dirAliasChecker {
+	return &dirAliasChecker{
+		names:  make(map[fuseops.InodeID]map[dirName]struct{}),
+		byName: make(map[dirName]fuseops.InodeID),
+	}
+}
+
+// Inspect the successful reply to the supplied op, returning a description of
+// any problem with the directory it names or the empty string if none.
+//
+// LOCKS_EXCLUDED(dc.mu)
+func (dc *dirAliasChecker) check(op interface{}) string {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return dc.checkEntry(dirName{o.Parent, o.Name}, o.Entry)
+
+	case *fuseops.MkDirOp:
+		return dc.checkEntry(dirName{o.Parent, o.Name}, o.Entry)
+
+	case *fuseops.RmDirOp:
+		dc.forgetName(dirName{o.Parent, o.Name})
+
+	case *fuseops.RenameOp:
+		old := dirName{o.OldParent, o.OldName}
+		dc.forgetName(dirName{o.NewParent, o.NewName})
+		if id, ok := dc.byName[old]; ok {
+			dc.forgetName(old)
+			dc.addName(id, dirName{o.NewParent, o.NewName})
+		}
+	}
+
+	return ""
+}
+
+// LOCKS_REQUIRED(dc.mu)
+func (dc *dirAliasChecker) checkEntry(
+	n dirName,
+	e fuseops.ChildInodeEntry) string {
+	if !e.Attributes.Mode.IsDir() {
+		return ""
+	}
+
+	// A directory can't be its own ancestor. The kernel refuses to splice in
+	// such an entry, failing the lookup with ELOOP, and a tree walker that
+	// didn't go through the kernel would never terminate.
+	if dc.isAncestor(e.Child, n.parent) {
+		return fmt.Sprintf(
+			"directory inode %d returned as %q in its own descendant %d, "+
+				"creating a cycle",
+			e.Child,
+			n.name,
+			n.parent)
+	}
+
+	dc.addName(e.Child, n)
+
+	// Each name of an aliased directory is a link to it, as is its own "."
+	// entry. (Directories that aren't aliased may report an nlink of one, as
+	// some file systems do, meaning that the count isn't maintained.)
+	names := len(dc.names[e.Child])
+	if names > 1 && int(e.Attributes.Nlink) < names+1 {
+		return fmt.Sprintf(
+			"directory inode %d has %d names but reports nlink %d; "+
+				"it should be at least %d",
+			e.Child,
+			names,
+			e.Attributes.Nlink,
+			names+1)
+	}
+
+	return ""
+}
+
+// Is dir an ancestor of (or the same as) id, following every known name of
+// each directory?
+//
+// LOCKS_REQUIRED(dc.mu)
+func (dc *dirAliasChecker) isAncestor(dir, id fuseops.InodeID) bool {
+	seen := make(map[fuseops.InodeID]bool)
+	pending := []fuseops.InodeID{id}
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if id == dir {
+			return true
+		}
+
+		if seen[id] {
+			continue
+		}
+
+		seen[id] = true
+		for n := range dc.names[id] {
+			pending = append(pending, n.parent)
+		}
+	}
+
+	return false
+}
+
+// LOCKS_REQUIRED(dc.mu)
+func (dc *dirAliasChecker) addName(id fuseops.InodeID, n dirName) {
+	if old, ok := dc.byName[n]; ok && old != id {
+		dc.forgetName(n)
+	}
+
+	if dc.names[id] == nil {
+		dc.names[id] = make(map[dirName]struct{})
+	}
+
+	dc.names[id][n] = struct{}{}
+	dc.byName[n] = id
+}
+
+// LOCKS_REQUIRED(dc.mu)
+func (dc *dirAliasChecker) forgetName(n dirName) {
+	id, ok := dc.byName[n]
+	if !ok {
+		return
+	}
+
+	delete(dc.byName, n)
+	delete(dc.names[id], n)
+	if len(dc.names[id]) == 0 {
+		delete(dc.names, id)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Replies from a file system that aliases directory 3 ("b") as "a/alias" and
+// then tries to put it inside itself.
+func TestDirAliasChecker(t *testing.T) {
+	dir := func(id fuseops.InodeID, nlink uint32) fuseops.ChildInodeEntry {
+		return fuseops.ChildInodeEntry{
+			Child: id,
+			Attributes: fuseops.InodeAttributes{
+				Nlink: nlink,
+				Mode:  0755 | os.ModeDir,
+			},
+		}
+	}
+
+	lookUp := func(
+		parent fuseops.InodeID,
+		name string,
+		e fuseops.ChildInodeEntry) *fuseops.LookUpInodeOp {
+		return &fuseops.LookUpInodeOp{Parent: parent, Name: name, Entry: e}
+	}
+
+	testCases := []struct {
+		name string
+		op   interface{}
+		want string
+	}{
+		{"a", lookUp(1, "a", dir(2, 2)), ""},
+		{"b", lookUp(1, "b", dir(3, 3)), ""},
+		{"b/c", lookUp(3, "c", dir(4, 2)), ""},
+		{"repeated", lookUp(1, "b", dir(3, 3)), ""},
+		{"alias", lookUp(2, "alias", dir(3, 3)), ""},
+		{
+			"alias with nlink not counting it",
+			lookUp(2, "alias", dir(3, 2)),
+			"directory inode 3 has 2 names but reports nlink 2",
+		},
+		{
+			"file",
+			lookUp(3, "file", fuseops.ChildInodeEntry{Child: 5}),
+			"",
+		},
+		{
+			"inside itself",
+			lookUp(3, "self", dir(3, 4)),
+			"directory inode 3 returned as \"self\" in its own descendant 3",
+		},
+		{
+			"inside its child",
+			lookUp(4, "up", dir(3, 4)),
+			"directory inode 3 returned as \"up\" in its own descendant 4",
+		},
+		{
+			"inside its alias's parent",
+			lookUp(2, "up", dir(3, 4)),
+			"",
+		},
+		{
+			"alias's parent inside it",
+			lookUp(3, "a", dir(2, 3)),
+			"directory inode 2 returned as \"a\" in its own descendant 3",
+		},
+		{
+			"renamed",
+			&fuseops.RenameOp{
+				OldParent: 2, OldName: "up",
+				NewParent: 1, NewName: "c",
+			},
+			"",
+		},
+		{"alias removed", &fuseops.RmDirOp{Parent: 2, Name: "alias"}, ""},
+		{"alias's parent inside it", lookUp(3, "a", dir(2, 3)), ""},
+		{"old name", lookUp(2, "up", dir(6, 2)), ""},
+	}
+
+	dc := newDirAliasChecker()
+	for _, c := range testCases {
+		got := dc.check(c.op)
+		if c.want == "" && got != "" || !strings.HasPrefix(got, c.want) {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system in which directory "b" is also reachable as "a/alias", and
+// erroneously as "b/self", which would make it its own child.
+type dirAliasFS struct {
+	minimalFS
+}
+
+const (
+	dirAliasAID = fuseops.RootInodeID + 1 + iota
+	dirAliasBID
+	dirAliasFileID
+)
+
+func (fs *dirAliasFS) attributes(
+	inode fuseops.InodeID) (fuseops.InodeAttributes, error) {
+	switch inode {
+	case fuseops.RootInodeID, dirAliasAID:
+		return fuseops.InodeAttributes{Nlink: 2, Mode: 0555 | os.ModeDir}, nil
+
+	case dirAliasBID:
+		// One link for each of "b" and "a/alias", plus ".".
+		return fuseops.InodeAttributes{Nlink: 3, Mode: 0555 | os.ModeDir}, nil
+
+	case dirAliasFileID:
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0444}, nil
+
+	default:
+		return fuseops.InodeAttributes{}, fuse.ENOENT
+	}
+}
+
+// The children of each directory, by name.
+var dirAliasChildren = map[fuseops.InodeID]map[string]fuseops.InodeID{
+	fuseops.RootInodeID: {"a": dirAliasAID, "b": dirAliasBID},
+	dirAliasAID:         {"alias": dirAliasBID},
+	dirAliasBID:         {"file": dirAliasFileID, "self": dirAliasBID},
+}
+
+func (fs *dirAliasFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	child, ok := dirAliasChildren[op.Parent][op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = child
+	op.Entry.Attributes, _ = fs.attributes(child)
+	return nil
+}
+
+func (fs *dirAliasFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	var err error
+	op.Attributes, err = fs.attributes(op.Inode)
+	return err
+}
+
+func (fs *dirAliasFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *dirAliasFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	// Leave out "b/self", so that a walk of the tree doesn't trip over it.
+	var names []string
+	for name := range dirAliasChildren[op.Inode] {
+		if name != "self" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for i := int(op.Offset); i < len(names); i++ {
+		child := dirAliasChildren[op.Inode][names[i]]
+		typ := fuseutil.DT_Directory
+		if child == dirAliasFileID {
+			typ = fuseutil.DT_File
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  child,
+			Name:   names[i],
+			Type:   typ,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *dirAliasFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func TestDirectoryAlias(t *testing.T) {
+	dir := mountFS(
+		t,
+		&dirAliasFS{},
+		&fuse.MountConfig{EnableDirectoryAliasCheck: true}).Dir()
+
+	// Walk the tree, which visits the aliased directory by both paths. The walk
+	// must finish, having seen the file within it twice.
+	var got []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, p)
+		got = append(got, rel)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	want := []string{".", "a", "a/alias", "a/alias/file", "b", "b/file"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk: got %v, want %v", got, want)
+	}
+
+	// Both paths name the same directory.
+	fa, err := os.Stat(path.Join(dir, "a/alias"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	fb, err := os.Stat(path.Join(dir, "b"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if !os.SameFile(fa, fb) {
+		t.Errorf("a/alias and b are different files")
+	}
+
+	// The kernel refuses to make a directory its own child, rather than
+	// looping.
+	if _, err := os.Stat(path.Join(dir, "b/self/self/file")); err == nil {
+		t.Errorf("Stat of b/self/self/file succeeded")
+	}
+}
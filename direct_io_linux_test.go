@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Return a buffer of the given size whose address is aligned to the page size,
+// as O_DIRECT buffers must be on most file systems.
+func alignedBuffer(size int) []byte {
+	const align = 4096
+	buf := make([]byte, size+align)
+	off := int((align - uintptr(unsafe.Pointer(&buf[0]))%align) % align)
+	return buf[off : off+size]
+}
+
+func TestMisalignedDirectIO(t *testing.T) {
+	// Mount, declaring an alignment for direct IO.
+	fs := newLargeFileFS()
+	mfs := mountFS(t, fs, &fuse.MountConfig{DirectIOAlignment: 512})
+
+	f, err := os.OpenFile(
+		path.Join(mfs.Dir(), "foo"),
+		os.O_RDONLY|syscall.O_DIRECT,
+		0)
+
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	defer f.Close()
+
+	buf := alignedBuffer(4096)
+
+	// Reads at a misaligned offset or of a misaligned size should fail.
+	if _, err := f.ReadAt(buf[:512], 100); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Read at misaligned offset: got %v, want EINVAL", err)
+	}
+
+	if _, err := f.ReadAt(buf[:100], 512); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Read of misaligned size: got %v, want EINVAL", err)
+	}
+
+	// An aligned one should succeed.
+	n, err := f.ReadAt(buf[:1024], 512)
+	if err != nil || n != 1024 {
+		t.Errorf("Aligned read: got (%d, %v)", n, err)
+	}
+
+	// Only the aligned read should have reached the file system.
+	if reads := readSizes(fs); len(reads) != 1 || reads[0] != 1024 {
+		t.Errorf("File system saw reads of sizes %v", reads)
+	}
+}
+
+const unknownSizeContents = "taco"
+
+// Mount a file system with a file that it reports as empty although it has
+// contents, as if they were generated on the fly, and read the whole of the
+// file. Return the contents read and the number of ReadFileOps the file system
+// received.
+func readUnknownSize(t *testing.T, directIO bool) (string, int) {
+	fs := &fileFS{
+		contents: unknownSizeContents,
+		attrs:    fuseops.InodeAttributes{Nlink: 1, Mode: 0444},
+		open: func(op *fuseops.OpenFileOp) {
+			op.UseDirectIO = directIO
+		},
+	}
+
+	mfs := mountFS(t, fs, &fuse.MountConfig{})
+
+	contents, err := ioutil.ReadFile(path.Join(mfs.Dir(), "foo"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	return string(contents), fs.count(&fuseops.ReadFileOp{})
+}
+
+func TestDirectIOReadsPastReportedSize(t *testing.T) {
+	// Through the page cache, the kernel believes the reported size, and never
+	// asks the file system for anything.
+	contents, reads := readUnknownSize(t, false)
+	if contents != "" || reads != 0 {
+		t.Errorf("Without direct IO: read %q in %d ops", contents, reads)
+	}
+
+	// With direct IO, reads go through to the file system until it reports EOF.
+	contents, reads = readUnknownSize(t, true)
+	if contents != unknownSizeContents || reads == 0 {
+		t.Errorf("With direct IO: read %q in %d ops", contents, reads)
+	}
+}
@@ -14,17 +14,76 @@
 
 package fuse
 
-import "syscall"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+)
 
+// Errors corresponding to kernel error numbers. These are passed through to
+// the kernel as is by Connection.Reply, even when wrapped.
+//
+// Error numbers that differ between platforms, such as ENOATTR and ENOTSUP,
+// are defined in errors_linux.go and errors_darwin.go.
 const (
-	// Errors corresponding to kernel error numbers. These may be treated
-	// specially by Connection.Reply.
+	EAGAIN    = syscall.EAGAIN
+	EDQUOT    = syscall.EDQUOT
 	EEXIST    = syscall.EEXIST
 	EINVAL    = syscall.EINVAL
 	EIO       = syscall.EIO
-	ENOATTR   = syscall.ENODATA
 	ENOENT    = syscall.ENOENT
+	ENOSPC    = syscall.ENOSPC
 	ENOSYS    = syscall.ENOSYS
 	ENOTDIR   = syscall.ENOTDIR
 	ENOTEMPTY = syscall.ENOTEMPTY
+	ERANGE    = syscall.ERANGE
+)
+
+// Reasons for the cancellation of the context for an op, as returned by
+// context.Cause. They let a file system tell why it's being asked to give up,
+// e.g. to reply EINTR to an interrupt but EIO to a timeout. (Causes require Go
+// 1.21; with older versions context.Cause isn't available, and the context's
+// Err is all there is to go on.)
+var (
+	// The kernel interrupted the op, usually because the process that made the
+	// request received a signal.
+	ErrInterrupted = errors.New("fuse: op interrupted")
+
+	// The op ran for longer than MountConfig.OpTimeout or OpTimeouts allows.
+	ErrOpTimeout = errors.New("fuse: op timed out")
+
+	// The kernel closed the connection, e.g. because the file system was
+	// unmounted, and will take no reply.
+	ErrShutdown = errors.New("fuse: connection closed")
 )
+
+// ErrNotifyNotSupported is returned by methods of Connection that send
+// notifications to the kernel, such as InvalidateNode, when the kernel doesn't
+// support the notification.
+var ErrNotifyNotSupported = errors.New("fuse: notification not supported by kernel")
+
+// InvalidateEntriesError is returned by Connection.InvalidateEntries when the
+// entries for some of the names couldn't be invalidated, mapping each such
+// name to the error for it.
+type InvalidateEntriesError map[string]error
+
+func (e InvalidateEntriesError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%q: %v", name, e[name]))
+	}
+
+	return fmt.Sprintf(
+		"fuse: invalidating %d entries failed: %s",
+		len(e),
+		strings.Join(parts, ", "))
+}
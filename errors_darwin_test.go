@@ -0,0 +1,40 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestErrnoEncoding(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected int32
+	}{
+		{ENOTSUP, -45},
+		{fmt.Errorf("setting lock: %w", ENOTSUP), -45},
+		{EOPNOTSUPP, -102},
+		{ENOATTR, -93},
+		{EAGAIN, -35},
+		{fmt.Errorf("no errno"), -5},
+	}
+
+	for _, tc := range testCases {
+		if got := encodedError(t, tc.err); got != tc.expected {
+			t.Errorf("%v: encoded as %d, want %d", tc.err, got, tc.expected)
+		}
+	}
+}
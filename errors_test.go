@@ -0,0 +1,54 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// Return the error field of the out header that Connection.Reply would send
+// for an op that failed with the given error.
+func encodedError(t *testing.T, opErr error) int32 {
+	c := &Connection{}
+	m := new(buffer.OutMessage)
+	m.Reset()
+
+	if noResponse := c.kernelResponse(m, 1, &fuseops.GetXattrOp{}, opErr); noResponse {
+		t.Fatalf("Unexpected noResponse for %v", opErr)
+	}
+
+	return m.OutHeader().Error
+}
+
+func TestRoutineXattrErrors(t *testing.T) {
+	// A missing attribute is no cause for alarm on any platform, whatever the
+	// error number for it there.
+	for _, op := range []interface{}{&fuseops.GetXattrOp{}, &fuseops.ListXattrOp{}} {
+		if !isRoutineError(op, ENOATTR) {
+			t.Errorf("%T: ENOATTR not routine", op)
+		}
+
+		if !isRoutineError(op, ERANGE) {
+			t.Errorf("%T: ERANGE not routine", op)
+		}
+
+		if isRoutineError(op, EIO) {
+			t.Errorf("%T: EIO routine", op)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Mounting
+////////////////////////////////////////////////////////////////////////
+
+// Mount the supplied file system with fusetesting.MountForTest.
+func mountFS(
+	t testing.TB,
+	fs fuseutil.FileSystem,
+	cfg *fuse.MountConfig) *fuse.MountedFileSystem {
+	t.Helper()
+	return fusetesting.MountForTest(t, fuseutil.NewFileSystemServer(fs), cfg)
+}
+
+// A Server that hands over the connection it serves before serving it.
+type connectionServer struct {
+	fuse.Server
+	conns chan *fuse.Connection
+}
+
+func (s *connectionServer) ServeOps(c *fuse.Connection) {
+	s.conns <- c
+	s.Server.ServeOps(c)
+}
+
+// Like mountFS, but also return the connection over which the file system is
+// served, e.g. for sending notifications.
+func mountConn(
+	t testing.TB,
+	fs fuseutil.FileSystem,
+	cfg *fuse.MountConfig) (*fuse.MountedFileSystem, *fuse.Connection) {
+	t.Helper()
+
+	server := &connectionServer{
+		Server: fuseutil.NewFileSystemServer(fs),
+		conns:  make(chan *fuse.Connection, 1),
+	}
+
+	mfs := fusetesting.MountForTest(t, server, cfg)
+	return mfs, <-server.conns
+}
+
+////////////////////////////////////////////////////////////////////////
+// fileFS
+////////////////////////////////////////////////////////////////////////
+
+// The inode ID of the file in a fileFS.
+const fileFSFooID = fuseops.RootInodeID + 1
+
+// A minimalFS whose root contains a single file named "foo", with the
+// attributes in attrs. If attrs.Nlink is zero, the file doesn't exist until it
+// is created. Changes to the file's mode and ownership are applied to attrs,
+// but writes are recorded without changing the file.
+//
+// Every op received for the file, other than lookups and requests for its
+// attributes, is recorded for the test to inspect.
+type fileFS struct {
+	minimalFS
+
+	// The file's contents, served by ReadFile unless read is set.
+	contents string
+
+	// How long the kernel may cache the file's entry and attributes.
+	validity time.Duration
+
+	// If set, open is called for each OpenFileOp once it has been given a
+	// handle, and read is called for each ReadFileOp in place of serving
+	// contents.
+	open func(op *fuseops.OpenFileOp)
+	read func(ctx context.Context, op *fuseops.ReadFileOp) error
+
+	mu         sync.Mutex
+	attrs      fuseops.InodeAttributes // GUARDED_BY(mu)
+	ops        []interface{}           // GUARDED_BY(mu)
+	lastHandle fuseops.HandleID        // GUARDED_BY(mu)
+}
+
+// Return the ops recorded so far, each a pointer to a copy of the op as it
+// stood once handled.
+func (fs *fileFS) recorded() []interface{} {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return append([]interface{}(nil), fs.ops...)
+}
+
+// Return the number of recorded ops of the same type as the supplied one,
+// e.g. &fuseops.ReadFileOp{}.
+func (fs *fileFS) count(sample interface{}) int {
+	n := 0
+	for _, op := range fs.recorded() {
+		if reflect.TypeOf(op) == reflect.TypeOf(sample) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileFS) attributes(
+	inode fuseops.InodeID) (fuseops.InodeAttributes, error) {
+	switch {
+	case inode == fuseops.RootInodeID:
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0777 | os.ModeDir,
+		}, nil
+
+	case inode == fileFSFooID && fs.attrs.Nlink != 0:
+		return fs.attrs, nil
+
+	default:
+		return fuseops.InodeAttributes{}, fuse.ENOENT
+	}
+}
+
+func (fs *fileFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	var err error
+	op.Entry.Child = fileFSFooID
+	op.Entry.Attributes, err = fs.attributes(fileFSFooID)
+	op.Entry.AttributesValidity = fs.validity
+	op.Entry.EntryValidity = fs.validity
+	return err
+}
+
+func (fs *fileFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var err error
+	op.Attributes, err = fs.attributes(op.Inode)
+	op.AttributesValidity = fs.validity
+	return err
+}
+
+func (fs *fileFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Mode != nil {
+		fs.attrs.Mode = *op.Mode
+	}
+
+	if op.Uid != nil {
+		fs.attrs.Uid = *op.Uid
+	}
+
+	if op.Gid != nil {
+		fs.attrs.Gid = *op.Gid
+	}
+
+	var err error
+	op.Attributes, err = fs.attributes(op.Inode)
+
+	c := *op
+	fs.ops = append(fs.ops, &c)
+	return err
+}
+
+func (fs *fileFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.EIO
+	}
+
+	if fs.attrs.Nlink != 0 {
+		return fuse.EEXIST
+	}
+
+	fs.attrs = fuseops.InodeAttributes{Nlink: 1, Mode: op.Mode}
+	fs.lastHandle++
+
+	op.Entry.Child = fileFSFooID
+	op.Entry.Attributes, _ = fs.attributes(fileFSFooID)
+	op.Handle = fs.lastHandle
+
+	c := *op
+	fs.ops = append(fs.ops, &c)
+	return nil
+}
+
+func (fs *fileFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lastHandle++
+	op.Handle = fs.lastHandle
+	if fs.open != nil {
+		fs.open(op)
+	}
+
+	c := *op
+	fs.ops = append(fs.ops, &c)
+	return nil
+}
+
+func (fs *fileFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	var err error
+	if fs.read != nil {
+		err = fs.read(ctx, op)
+	} else if op.Offset < int64(len(fs.contents)) {
+		op.BytesRead = copy(op.Dst, fs.contents[op.Offset:])
+	}
+
+	// The buffer belongs to the kernel's message.
+	c := *op
+	c.Dst = nil
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ops = append(fs.ops, &c)
+	return err
+}
+
+func (fs *fileFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	// The data belongs to the kernel's message.
+	c := *op
+	c.Data = append([]byte(nil), op.Data...)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ops = append(fs.ops, &c)
+	return nil
+}
+
+func (fs *fileFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	c := *op
+	fs.ops = append(fs.ops, &c)
+	return nil
+}
+
+func (fs *fileFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	c := *op
+	fs.ops = append(fs.ops, &c)
+	return nil
+}
@@ -17,6 +17,8 @@ package fuseops
 import (
 	"os"
 	"time"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
 ////////////////////////////////////////////////////////////////////////
@@ -29,6 +31,14 @@ type OpContext struct {
 	// PID of the process that is invoking the operation.
 	// Not filled in case of a writepage operation.
 	Pid uint32
+
+	// UID of the process that is invoking the operation.
+	// Not filled in case of a writepage operation.
+	Uid uint32
+
+	// GID of the process that is invoking the operation.
+	// Not filled in case of a writepage operation.
+	Gid uint32
 }
 
 // Return statistics about the file system's capacity and available resources.
@@ -49,7 +59,12 @@ type OpContext struct {
 // This op is particularly important on OS X: if you don't implement it, the
 // file system will not successfully mount. If you don't model a sane amount of
 // free space, the Finder will refuse to copy files into the file system.
+//
+// All of the fields below other than OpContext are set by the file system.
 type StatFSOp struct {
+	// Set by fuse: information about the process that called statfs(2).
+	OpContext OpContext
+
 	// The size of the file system's blocks. This may be used, in combination
 	// with the block counts below,  by callers of statfs(2) to infer the file
 	// system's capacity and space availability.
@@ -100,6 +115,18 @@ type StatFSOp struct {
 	// The total number of inodes in the file system, and how many remain free.
 	Inodes     uint64
 	InodesFree uint64
+
+	// The maximum length in bytes of a single path component, excluding the
+	// terminating NUL. A value of zero is treated as 255, which matches
+	// NAME_MAX on Linux.
+	//
+	// On Linux this is surfaced as statfs::f_namelen, which is also what glibc
+	// consults to answer pathconf(2) and fpathconf(2) for _PC_NAME_MAX. Other
+	// pathconf values are not carried by the FUSE protocol: _PC_LINK_MAX is
+	// answered by glibc from a static table keyed on the file system magic
+	// number, and so cannot be influenced here (report per-inode link counts
+	// via InodeAttributes.Nlink instead).
+	MaxNameLength uint32
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -108,6 +135,10 @@ type StatFSOp struct {
 
 // Look up a child by name within a parent directory. The kernel sends this
 // when resolving user paths to dentry structs, which are then cached.
+//
+// The protocol gives no way to return an open handle along with the entry; if
+// the user is opening the child the kernel follows up with an OpenFileOp. See
+// CreateFileOp for the atomic create-and-open path.
 type LookUpInodeOp struct {
 	// The ID of the directory inode to which the child belongs.
 	Parent InodeID
@@ -123,7 +154,7 @@ type LookUpInodeOp struct {
 	// the parent foo/.
 	Name string
 
-	// The resulting entry. Must be filled out by the file system.
+	// Set by the file system: the resulting entry.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
 	// ForgetInodeOp for more information.
@@ -139,18 +170,54 @@ type GetInodeAttributesOp struct {
 	// The inode of interest.
 	Inode InodeID
 
+	// If set, the attributes are being requested through an open file handle,
+	// as with fstat(2), rather than by path, as with stat(2). File systems that
+	// keep per-handle state (e.g. a snapshot taken when the file was opened)
+	// may use this to return attributes consistent with the handle's view.
+	Handle *HandleID
+
 	// Set by the file system: attributes for the inode, and the time at which
 	// they should expire. See notes on ChildInodeEntry.AttributesExpiration for
 	// more.
 	Attributes           InodeAttributes
 	AttributesExpiration time.Time
-	OpContext            OpContext
+
+	// Set by the file system: if non-zero, this takes precedence over
+	// AttributesExpiration. See notes on ChildInodeEntry.AttributesValidity.
+	AttributesValidity time.Duration
+	OpContext          OpContext
+}
+
+// Return the flags of an inode, of the sort set with chattr(1). On Linux the
+// kernel sends this when a process asks for them through an open file with the
+// FS_IOC_GETFLAGS ioctl, as lsattr(1) does. If the file system doesn't
+// implement it, the caller sees ENOTTY, as on file systems without flags.
+//
+// The flags are reported only: the kernel enforces neither Immutable nor
+// AppendOnly for FUSE file systems, and doesn't pass any of them on in
+// stx_attributes of statx(2).
+type GetInodeFlagsOp struct {
+	// The inode of interest, and the handle through which it's being asked.
+	Inode  InodeID
+	Handle HandleID
+
+	// Set by the file system.
+	Flags     InodeFlags
+	OpContext OpContext
 }
 
 // Change attributes for an inode.
 //
 // The kernel sends this for obvious cases like chmod(2), and for less obvious
 // cases like ftrunctate(2).
+//
+// A single op may change several attributes at once, and the file system
+// should apply all of them together, so that no one ever observes the inode
+// with only some of them changed. Separate system calls (e.g. the chmod(2) and
+// chown(2) made by install(1)) arrive as separate ops, but the kernel does
+// combine changes made by one call: chown(2) sends the new owner and group
+// together, along with a new mode when the change of ownership must clear the
+// setuid and setgid bits.
 type SetInodeAttributesOp struct {
 	// The inode of interest.
 	Inode InodeID
@@ -161,15 +228,26 @@ type SetInodeAttributesOp struct {
 	// The attributes to modify, or nil for attributes that don't need a change.
 	Size  *uint64
 	Mode  *os.FileMode
+	Uid   *uint32
+	Gid   *uint32
 	Atime *time.Time
 	Mtime *time.Time
 
+	// Set when the file is being truncated by a user without CAP_FSETID, if
+	// Capabilities.HandleKillPrivV2 is in effect: the file system should clear
+	// the setuid bit, and the setgid bit if the file is group-executable.
+	KillSuidgid bool
+
 	// Set by the file system: the new attributes for the inode, and the time at
 	// which they should expire. See notes on
 	// ChildInodeEntry.AttributesExpiration for more.
 	Attributes           InodeAttributes
 	AttributesExpiration time.Time
-	OpContext            OpContext
+
+	// Set by the file system: if non-zero, this takes precedence over
+	// AttributesExpiration. See notes on ChildInodeEntry.AttributesValidity.
+	AttributesValidity time.Duration
+	OpContext          OpContext
 }
 
 // Decrement the reference count for an inode ID previously issued by the file
@@ -220,6 +298,30 @@ type ForgetInodeOp struct {
 	OpContext OpContext
 }
 
+// One inode's worth of a BatchForgetOp.
+type BatchForgetEntry struct {
+	// The inode whose reference count should be decremented.
+	Inode InodeID
+
+	// The amount to decrement the reference count.
+	N uint64
+}
+
+// Decrement the reference counts of several inodes at once. This is
+// equivalent to a ForgetInodeOp for each entry, in order, and is sent instead
+// when the kernel has a backlog of forgets to deliver, e.g. while evicting a
+// directory tree from its cache. The kernel does so whenever the negotiated
+// protocol allows it (7.16 and later), which is always the case with this
+// package.
+//
+// fuseutil.NotImplementedFileSystem does not implement this op, in which case
+// fuseutil.NewFileSystemServer falls back to calling ForgetInode for each
+// entry.
+type BatchForgetOp struct {
+	Entries   []BatchForgetEntry
+	OpContext OpContext
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Inode creation
 ////////////////////////////////////////////////////////////////////////
@@ -268,9 +370,19 @@ type MkNodeOp struct {
 	Parent InodeID
 
 	// The name of the child to create, and the mode with which to create it.
+	//
+	// The mode's type bits say what kind of inode to create: a regular file (no
+	// type bits), a character device (os.ModeDevice|os.ModeCharDevice), a block
+	// device (os.ModeDevice), a FIFO (os.ModeNamedPipe) or a socket
+	// (os.ModeSocket). The file system should return the same type in
+	// Entry.Attributes.
 	Name string
 	Mode os.FileMode
 
+	// For device nodes, the device number, to be returned in
+	// Entry.Attributes.Rdev. Zero otherwise.
+	Rdev uint32
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -289,6 +401,13 @@ type MkNodeOp struct {
 // kernel does anyway.
 //
 // Therefore the file system should return EEXIST if the name already exists.
+//
+// This is the one op that yields both an entry and an open handle, standing in
+// for a LookUpInodeOp followed by an OpenFileOp. The kernel will not send a
+// separate OpenFileOp for the struct file created by this op. The two halves
+// have independent lifetimes: the lookup count taken for Entry is dropped by a
+// later ForgetInodeOp, and Handle is released by a later
+// ReleaseFileHandleOp, in either order.
 type CreateFileOp struct {
 	// The ID of parent directory inode within which to create the child file.
 	Parent InodeID
@@ -297,6 +416,10 @@ type CreateFileOp struct {
 	Name string
 	Mode os.FileMode
 
+	// Set if the name turns out to exist and is opened with O_TRUNC by a user
+	// without CAP_FSETID, as for OpenFileOp.KillSuidgid.
+	KillSuidgid bool
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -349,7 +472,12 @@ type CreateLinkOp struct {
 	// The ID of the target inode.
 	Target InodeID
 
-	// Set by the file system: information about the inode that was created.
+	// Set by the file system: information about the inode that was linked.
+	//
+	// No new inode is created: Entry.Child must be Target, and the attributes
+	// must reflect the new link, with Nlink one greater than before. The kernel
+	// trusts this reply for the link count it shows under both names until the
+	// attributes expire.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
 	// ForgetInodeOp for more information.
@@ -540,6 +668,11 @@ type ReadDirOp struct {
 	// Each entry returned exposes a directory offset to the user that may later
 	// show up in ReadDirRequest.Offset. See notes on that field for more
 	// information.
+	//
+	// Entries written this way carry no attributes and don't increment the
+	// kernel's lookup count for their inodes, so listing an entry never
+	// obligates a later ForgetInodeOp; the kernel issues a LookUpInodeOp first
+	// if it needs the inode. See ReadDirPlusOp for entries that do.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst.
@@ -553,6 +686,50 @@ type ReadDirOp struct {
 	// FUSE_DIRENT_ALIGN (http://goo.gl/UziWvH) is less than the read size of
 	// PAGE_SIZE used by fuse_readdir (cf. https://goo.gl/VajtS2).
 	BytesRead int
+
+	// How the user asked for the directory's access time to be maintained. See
+	// the notes on ReadFileOp.Atime.
+	Atime     AtimeMode
+	OpContext OpContext
+}
+
+// Read entries from a directory previously opened with OpenDir, along with the
+// inode each names, as for a LookUpInodeOp of every entry. This saves the
+// kernel a LookUpInodeOp per entry when the user stats each entry it lists, as
+// ls -l does.
+//
+// This is sent in place of ReadDirOp only if fuse.Capabilities.Readdirplus
+// is in effect. The kernel then decides which to send for each read, using this one
+// for the first read of a directory and for later ones if the entries already
+// listed have since been looked up.
+type ReadDirPlusOp struct {
+	// The directory inode that we are reading, and the handle previously
+	// returned by OpenDir when opening that inode.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset within the directory at which to read. See the notes on
+	// ReadDirOp.Offset; offsets are shared between the two ops, which may be
+	// mixed in the reading of a single handle.
+	Offset DirOffset
+
+	// The destination buffer, whose length gives the size of the read.
+	//
+	// Use fuseutil.WriteDirentPlus to fill it in. Each entry whose
+	// ChildInodeEntry has a non-zero Child increments the kernel's lookup count
+	// for that inode, just as if it had been returned by LookUpInodeOp, except
+	// for the entries named "." and "..", which the kernel ignores. An entry
+	// with a zero Child is listed without telling the kernel anything about its
+	// inode, as with ReadDirOp.
+	Dst []byte
+
+	// Set by the file system: the number of bytes read into Dst. See the notes
+	// on ReadDirOp.BytesRead.
+	BytesRead int
+
+	// How the user asked for the directory's access time to be maintained. See
+	// the notes on ReadFileOp.Atime.
+	Atime     AtimeMode
 	OpContext OpContext
 }
 
@@ -586,15 +763,35 @@ type OpenFileOp struct {
 	// The ID of the inode to be opened.
 	Inode InodeID
 
-	// An opaque ID that will be echoed in follow-up calls for this file using
-	// the same struct file in the kernel. In practice this usually means
-	// follow-up calls using the file descriptor returned by open(2).
+	// The flags with which the file is being opened, as passed to open(2). The
+	// kernel handles O_CREAT, O_EXCL, and O_NOCTTY itself, so these are never
+	// set.
+	//
+	// If O_NONBLOCK is set (see OpenFlags.IsNonblock), a file system serving
+	// pipe-like files may return EAGAIN from this op or from ReadFileOp rather
+	// than waiting for data, and the error is passed on to the caller. Such
+	// files should also set UseDirectIO, so that reads aren't served from or
+	// rounded up to fill the page cache.
+	OpenFlags fusekernel.OpenFlags
+
+	// Set when the file is being truncated by the open (see
+	// Capabilities.AtomicTrunc) by a user without CAP_FSETID, if
+	// Capabilities.HandleKillPrivV2 is in effect: the file system should clear
+	// the setuid bit, and the setgid bit if the file is group-executable.
+	KillSuidgid bool
+
+	// Set by the file system: an opaque ID that will be echoed in follow-up
+	// calls for this file using the same struct file in the kernel. In practice
+	// this usually means follow-up calls using the file descriptor returned by
+	// open(2).
 	//
 	// The handle may be supplied in future ops like ReadFileOp that contain a
 	// file handle. The file system must ensure this ID remains valid until a
 	// later call to ReleaseFileHandle.
 	Handle HandleID
 
+	// Set by the file system: whether to keep the kernel's page cache.
+	//
 	// By default, fuse invalidates the kernel's page cache for an inode when a
 	// new file handle is opened for that inode (cf. https://goo.gl/2rZ9uk). The
 	// intent appears to be to allow users to "see" content that has changed
@@ -604,6 +801,12 @@ type OpenFileOp struct {
 	// a particular inode go through the kernel, set this field to true to
 	// disable this behavior.
 	//
+	// The cached contents then persist across opens until they are evicted
+	// under memory pressure, or the file system drops them with
+	// fuse.Connection.InvalidateNode, e.g. when it learns of a change made
+	// elsewhere. A change of mtime reported in the attributes doesn't drop them;
+	// without writeback caching, a change of size does.
+	//
 	// (More discussion: http://goo.gl/cafzWF)
 	//
 	// Note that on OS X it appears that the behavior is always as if this field
@@ -611,15 +814,39 @@ type OpenFileOp struct {
 	// same mode. (Cf. https://github.com/osxfuse/osxfuse/issues/223)
 	KeepPageCache bool
 
-	// Whether to use direct IO for this file handle. By default, the kernel
-	// suppresses what it sees as redundant operations (including reads beyond
-	// the precomputed EOF).
+	// Set by the file system: whether to use direct IO for this file handle. By
+	// default, the kernel suppresses what it sees as redundant operations
+	// (including reads beyond the precomputed EOF).
 	//
 	// Enabling direct IO ensures that all client operations reach the fuse
 	// layer. This allows for filesystems whose file sizes are not known in
-	// advance, for example, because contents are generated on the fly.
+	// advance, for example, because contents are generated on the fly: reads
+	// through the handle aren't cut short at the size last reported for the
+	// inode, and end only where ReadFileOp.BytesRead says they do. Nor is
+	// anything read through the handle cached, so it suits contents that change
+	// underneath the kernel, such as a log being appended to.
+	//
+	// Since reads bypass the page cache, direct IO also stops the kernel reading
+	// ahead through the handle: the file system sees each read as issued by the
+	// user, and nothing speculative. The protocol has no other per-handle
+	// control of read-ahead, so this is the way to avoid wasted reads of a file
+	// that is accessed at random.
+	//
+	// There is no equivalent for OpenDirOp: the kernel sends every read of a
+	// directory through to the file system regardless.
 	UseDirectIO bool
 
+	// Linux only.
+	//
+	// Set by the file system to tell the kernel not to send FlushFileOp when a
+	// file descriptor using this handle is closed, for a handle that the file
+	// system knows will have nothing to flush, e.g. because it buffers no state
+	// for it. This is a
+	// per-handle version of fuse.MountConfig.EnableReadOnlyNoFlush, and has the
+	// same limitations: it requires Linux >= 5.16, and is ignored by the kernel
+	// when writeback caching is enabled.
+	NoFlush bool
+
 	OpContext OpContext
 }
 
@@ -637,7 +864,22 @@ type ReadFileOp struct {
 	// The offset within the file at which to read.
 	Offset int64
 
+	// The flags of the struct file through which the read is made. These start
+	// out as the flags with which the file was opened (see
+	// OpenFileOp.OpenFlags), but O_NONBLOCK may since have been changed with
+	// fcntl(2).
+	OpenFlags fusekernel.OpenFlags
+
 	// The destination buffer, whose length gives the size of the read.
+	//
+	// The protocol doesn't tell the file system about the kernel's read-ahead
+	// window, but it shows in the size of reads: when a file is read
+	// sequentially through the page cache, the kernel reads whole windows ahead
+	// of the reader, growing them as it ramps up read-ahead until they reach the
+	// limit on the size of a single request. A file system that prefetches from
+	// a backend may therefore take len(Dst) as an advisory hint of how much more
+	// is about to be read following this read. Reads through handles that use
+	// direct IO are instead sized by the reader.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read.
@@ -651,6 +893,10 @@ type ReadFileOp struct {
 	//
 	// If direct IO is enabled, semantics should match those of read(2).
 	BytesRead int
+
+	// How the user asked for the inode's access time to be maintained. File
+	// systems that update atime on reads may skip doing so for AtimeNone.
+	Atime     AtimeMode
 	OpContext OpContext
 }
 
@@ -669,6 +915,11 @@ type ReadFileOp struct {
 //  *  (http://goo.gl/RqYIxY) fuse_writepage_locked makes a write request to
 //     the userspace server.
 //
+// With writeback caching, writes are thus page-aligned, and several small
+// writes by the user may arrive as one op; the kernel then also maintains the
+// file's mtime itself, sending it with SetInodeAttributesOp. Without it, each
+// write(2) is sent through as the user made it.
+//
 // Note that the kernel *will* ensure that writes are received and acknowledged
 // by the file system before sending a FlushFileOp when closing the file
 // descriptor to which they were written. Cf. the notes on
@@ -702,8 +953,32 @@ type WriteFileOp struct {
 	// *   If the offset is greater than the current size, extend the file
 	//     with null bytes until it is not, then do the above.
 	//
+	// For writes through a file opened with O_APPEND (see OpenFlags), this is
+	// the size of the file as last known to the kernel. See OpenFlags.
 	Offset int64
 
+	// The flags of the struct file through which the write is made, as for
+	// ReadFileOp.OpenFlags.
+	//
+	// If O_APPEND is set (see OpenFlags.IsAppend), the data should be placed at
+	// the end of the file as the file system sees it when serving the op,
+	// ignoring Offset. The kernel serializes appends through a single mount,
+	// but its idea of the file's size may be stale if the file has been changed
+	// by other means, or if the file was opened with UseDirectIO and the size
+	// reported by the file system hasn't caught up. A file system that finds
+	// the end of the file and writes there under a single lock therefore never
+	// loses or overwrites data from concurrent appenders. (With writeback
+	// caching the kernel, not the file system, resolves the offset, and the
+	// flag should be ignored.)
+	OpenFlags fusekernel.OpenFlags
+
+	// Set when the write is made by a user without CAP_FSETID, if
+	// Capabilities.HandleKillPrivV2 is in effect: the file system should clear
+	// the setuid bit, and the setgid bit if the file is group-executable. (With
+	// writeback caching, the kernel sends such writes straight through rather
+	// than buffering them, so that the flag isn't lost.)
+	KillSuidgid bool
+
 	// The data to write.
 	//
 	// The FUSE documentation requires that exactly the number of bytes supplied
@@ -828,8 +1103,8 @@ type ReadSymlinkOp struct {
 
 // Remove an extended attribute.
 //
-// This is sent in response to removexattr(2). Return ENOATTR if the
-// extended attribute does not exist.
+// This is sent in response to removexattr(2). Return ENOATTR (ENODATA on
+// Linux) if the extended attribute does not exist.
 type RemoveXattrOp struct {
 	// The inode that we are removing an extended attribute from.
 	Inode InodeID
@@ -842,7 +1117,8 @@ type RemoveXattrOp struct {
 // Get an extended attribute.
 //
 // This is sent in response to getxattr(2). Return ENOATTR if the
-// extended attribute does not exist.
+// extended attribute does not exist. (fuse.ENOATTR is ENODATA on Linux, which
+// has no ENOATTR, so the same value may be returned on both platforms.)
 type GetXattrOp struct {
 	// The inode whose extended attribute we are reading.
 	Inode InodeID
@@ -852,6 +1128,10 @@ type GetXattrOp struct {
 
 	// The destination buffer.  If the size is too small for the
 	// value, the ERANGE error should be sent.
+	//
+	// If Dst is empty, the caller is asking only for the size of the value, as
+	// getxattr(2) does when passed a zero size: set BytesRead to it and return
+	// success, without ERANGE.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
@@ -872,7 +1152,10 @@ type ListXattrOp struct {
 	// value, the ERANGE error should be sent.
 	//
 	// The output data should consist of a sequence of NUL-terminated strings,
-	// one for each xattr.
+	// one for each xattr. fuseutil.WriteXattrNames produces this.
+	//
+	// As with GetXattrOp, an empty Dst asks only for the size of the list: set
+	// BytesRead to it and return success, without ERANGE.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
@@ -893,17 +1176,119 @@ type SetXattrOp struct {
 	// The name of the extended attribute
 	Name string
 
-	// The value to for the extened attribute.
+	// The value to for the extened attribute. This may be empty.
+	//
+	// Values may be large, so this refers directly to the message received
+	// from the kernel, and is valid only until the op is replied to. File
+	// systems that keep the value must copy it.
 	Value []byte
 
-	// If Flags is 0x1, and the attribute exists already, EEXIST should be returned.
-	// If Flags is 0x2, and the attribute does not exist, ENOATTR should be returned.
+	// If Flags is 0x1 (XATTR_CREATE), and the attribute exists already, EEXIST
+	// should be returned.
+	// If Flags is 0x2 (XATTR_REPLACE), and the attribute does not exist,
+	// ENOATTR should be returned.
 	// If Flags is 0x0, the extended attribute will be created if need be, or will
 	// simply replace the value if the attribute exists.
-	Flags     uint32
+	Flags uint32
+
+	// Set when the attribute is a POSIX access ACL (system.posix_acl_access)
+	// whose setting must also clear the setgid bit of the file, because the
+	// caller is not in the file's group and lacks CAP_FSETID. The kernel
+	// reports this only if Capabilities.SetxattrExt is in effect.
+	KillSgid bool
+
 	OpContext OpContext
 }
 
+////////////////////////////////////////////////////////////////////////
+// Locks
+////////////////////////////////////////////////////////////////////////
+
+// FileLock describes a POSIX byte-range lock, as set with fcntl(2).
+type FileLock struct {
+	// The range of bytes covered, inclusive at both ends. An End of
+	// math.MaxUint64 means the lock extends to the end of the file, however
+	// large it grows.
+	Start uint64
+	End   uint64
+
+	// The kind of lock: syscall.F_RDLCK for a shared lock, syscall.F_WRLCK for
+	// an exclusive one, or syscall.F_UNLCK for none (to release a range with
+	// SetLkOp, or in GetLkOp's reply to say there's no conflict).
+	Type uint32
+
+	// The process holding the lock, reported to the caller of fcntl(F_GETLK).
+	PID uint32
+}
+
+// Test for a POSIX lock that would conflict with the one described, as for
+// fcntl(F_GETLK). The kernel sends this only if Capabilities.PosixLocks is in
+// effect; otherwise it handles locks itself, locally to the machine.
+type GetLkOp struct {
+	// The file being locked, and the handle through which it's being done.
+	Inode  InodeID
+	Handle HandleID
+
+	// An opaque identifier for the owner of the lock: locks with the same
+	// owner never conflict.
+	Owner uint64
+
+	// The lock to test for. Set by the file system to one that conflicts with
+	// it, or to a lock of Type syscall.F_UNLCK if there is none.
+	Lock      FileLock
+	OpContext OpContext
+}
+
+// Acquire, change or release a POSIX lock without waiting, as for
+// fcntl(F_SETLK). Return EAGAIN if a conflicting lock is held. The kernel
+// sends this only if Capabilities.PosixLocks is in effect.
+//
+// Locks are held until released with a Type of syscall.F_UNLCK, which the
+// kernel also sends on the owner's behalf when it closes the file.
+type SetLkOp struct {
+	// The file being locked, and the handle through which it's being done.
+	Inode  InodeID
+	Handle HandleID
+
+	// An opaque identifier for the owner of the lock. A new lock replaces any
+	// that the owner already holds on the same range.
+	Owner uint64
+
+	// The lock to set, or the range to release if Type is syscall.F_UNLCK.
+	Lock      FileLock
+	OpContext OpContext
+}
+
+// Like SetLkOp, but for fcntl(F_SETLKW): wait for conflicting locks to be
+// released rather than failing.
+//
+// The wait may be long, so the file system must give up when the op's context
+// is canceled, as it is when the kernel sends an interrupt (e.g. because the
+// waiting process received a signal), and return EINTR.
+type SetLkwOp struct {
+	// The file being locked, and the handle through which it's being done.
+	Inode  InodeID
+	Handle HandleID
+
+	// An opaque identifier for the owner of the lock. A new lock replaces any
+	// that the owner already holds on the same range.
+	Owner uint64
+
+	// The lock to set.
+	Lock      FileLock
+	OpContext OpContext
+}
+
+// Allocate or deallocate space for a range of a file, as for fallocate(2).
+//
+// Return EOPNOTSUPP for modes that the file system doesn't support, e.g. a
+// file system that can preallocate but not punch holes. Returning ENOSYS
+// instead makes the kernel fail every later fallocate(2) on the mount with
+// EOPNOTSUPP without sending the op, whatever its mode.
+//
+// A file system that supports sparse files must reflect the allocation in
+// InodeAttributes.Blocks in later attributes, so that du(1) shows the space
+// gained or freed; see fuseutil.Allocation.
 type FallocateOp struct {
 	// The inode and handle we are fallocating
 	Inode  InodeID
@@ -915,11 +1300,53 @@ type FallocateOp struct {
 	// Length of the byte range
 	Length uint64
 
-	// If Mode is 0x0, allocate disk space within the range specified
-	// If Mode has 0x1, allocate the space but don't increase the file size
-	// If Mode has 0x2, deallocate space within the range specified
-	// If Mode has 0x2, it sbould also have 0x1 (deallocate should not increase
+	// If Mode is 0x0, allocate disk space within the range specified, and
+	// increase the file size if the range extends past the end of the file.
+	// The file system must report the new size in later attributes.
+	// If Mode has 0x1 (FALLOC_FL_KEEP_SIZE), allocate the space but don't
+	// increase the file size
+	// If Mode has 0x2 (FALLOC_FL_PUNCH_HOLE), deallocate space within the range
+	// specified, so that it reads back as zeroes
+	// If Mode has 0x2, it should also have 0x1 (deallocate should not increase
 	// file size)
 	Mode      uint32
 	OpContext OpContext
 }
+
+// Copy a range of bytes from one open file to another, as for
+// copy_file_range(2), without passing the data through user space (Linux >=
+// 4.20).
+//
+// Return EOPNOTSUPP (or EXDEV) to decline a particular copy, e.g. one between
+// files that live in different backing stores: the kernel then copies the data
+// itself with ReadFileOp and WriteFileOp, and sends this op again for later
+// copies. Returning ENOSYS instead tells the kernel the op is never supported,
+// and it falls back that way for every later copy on the mount without asking.
+//
+// The file system must report any change to the destination's size or mtime
+// in later attributes, as for WriteFileOp.
+type CopyFileRangeOp struct {
+	// The source file and the offset within it at which to start reading.
+	InodeIn  InodeID
+	HandleIn HandleID
+	OffsetIn uint64
+
+	// The destination file and the offset within it at which to start writing.
+	InodeOut  InodeID
+	HandleOut HandleID
+	OffsetOut uint64
+
+	// The number of bytes to copy, and the flags passed to copy_file_range(2),
+	// which are currently always zero. Length is at most math.MaxUint32, since
+	// the kernel can't be told of more bytes copied than that: a larger
+	// copy_file_range(2) returns a short count, and the caller copies the rest
+	// with another call.
+	Length uint64
+	Flags  uint64
+
+	// Set by the file system: the number of bytes actually copied, which may be
+	// fewer than Length, e.g. at the end of the source file. It mustn't be more
+	// than Length; it's reported to the kernel as at most math.MaxUint32.
+	BytesCopied uint64
+	OpContext   OpContext
+}
@@ -61,7 +61,25 @@ func init() {
 type InodeAttributes struct {
 	Size uint64
 
+	// The number of 512-byte blocks allocated to the inode, as reported in
+	// st_blocks and by du(1). If zero and BlocksValid is unset, it is derived
+	// from Size as if the file were not sparse.
+	//
+	// A file system that deallocates ranges of files (see FallocateOp) should
+	// keep this up to date so that freed space shows, and set BlocksValid so
+	// that a file with no blocks allocated at all reports zero;
+	// fuseutil.Allocation helps with that.
+	Blocks      uint64
+	BlocksValid bool
+
 	// The number of incoming hard links to this inode.
+	//
+	// For a directory this is by convention two plus the number of its
+	// subdirectories, counting its entry in its parent, its own "." entry, and
+	// the ".." entry of each subdirectory. Tools such as find(1) rely on this to
+	// skip looking for subdirectories in a directory whose count is two. A
+	// directory whose count isn't known cheaply should report one, which these
+	// tools take to mean that it must be read in full. See fuseutil.DirNlink.
 	Nlink uint32
 
 	// The mode of the inode. This is exposed to the user in e.g. the result of
@@ -96,6 +114,20 @@ type InodeAttributes struct {
 	// Ownership information
 	Uid uint32
 	Gid uint32
+
+	// The device number, for character and block device inodes (those whose
+	// Mode has os.ModeDevice set), in the encoding of the st_rdev field of
+	// stat(2), e.g. as produced by unix.Mkdev.
+	Rdev uint32
+}
+
+// InodeFlags are the flags of an inode. See GetInodeFlagsOp.
+type InodeFlags struct {
+	Compressed bool // Compressed transparently by the file system ('c')
+	Encrypted  bool // Encrypted by the file system ('E')
+	Immutable  bool // Not to be modified, deleted, or renamed ('i')
+	AppendOnly bool // Only to be opened for appending ('a')
+	NoDump     bool // Not to be backed up by dump(8) ('d')
 }
 
 func (a *InodeAttributes) DebugString() string {
@@ -108,11 +140,41 @@ func (a *InodeAttributes) DebugString() string {
 		a.Gid)
 }
 
+// AtimeMode describes how the user asked for inode access times to be
+// maintained when mounting the file system, by way of the noatime, relatime,
+// and strictatime mount options.
+//
+// The kernel leaves it to FUSE file systems to update atime when reading, so a
+// file system whose access times live in a backend may use this to avoid
+// writes that the user has said they don't care about.
+type AtimeMode int
+
+const (
+	// Update atime only if it is earlier than mtime or ctime, or more than a
+	// day old. This is the kernel's default.
+	AtimeRelative AtimeMode = iota
+
+	// Don't update atime at all.
+	AtimeNone
+
+	// Update atime on every access.
+	AtimeStrict
+)
+
 // GenerationNumber represents a generation of an inode. It is irrelevant for
 // file systems that won't be exported over NFS. For those that will and that
 // reuse inode IDs when they become free, the generation number must change
 // when an ID is reused.
 //
+// Zero is a valid generation number, and a file system that never reuses inode
+// IDs may leave it at zero throughout. But once an ID has been forgotten (see
+// ForgetInodeOp) and is returned again for a different inode, the generation
+// must be greater than any with which the ID was previously returned, or NFS
+// clients holding a handle for the old inode may be given the new one. When
+// debug logging is enabled, the connection logs a warning if it sees an ID
+// reused for a newly created inode, or one of a different type, without such
+// an increase.
+//
 // This corresponds to struct inode::i_generation in the VFS layer.
 // (Cf. http://goo.gl/tvYyQt)
 //
@@ -143,6 +205,17 @@ type DirOffset uint64
 type ChildInodeEntry struct {
 	// The ID of the child inode. The file system must ensure that the returned
 	// inode ID remains valid until a later ForgetInodeOp.
+	//
+	// A file system may return the ID of a directory that it has already
+	// returned under another name, aliasing it as a hard link or bind mount
+	// would. The kernel keeps only one dentry for a directory, so it moves the
+	// existing one to the new name: the directory is reachable by either path,
+	// but the kernel's notion of its parent (e.g. for "..") follows whichever
+	// was looked up last. The file system must report the same attributes under
+	// every name, with an nlink that counts each of them, and must never return
+	// a directory inside itself or one of its descendants; the kernel fails
+	// such a lookup with ELOOP. MountConfig.EnableDirectoryAliasCheck warns
+	// about violations.
 	Child InodeID
 
 	// A generation number for this incarnation of the inode with the given ID.
@@ -190,12 +263,19 @@ type ChildInodeEntry struct {
 	//
 	// This field controls when the attributes returned in this response and
 	// stashed in the struct inode should be re-queried. Leave at the zero value
-	// to disable caching.
+	// to disable caching, so that every stat(2) of the inode leads to a
+	// GetInodeAttributesOp (cf. fuseutil.UncachedAttributesTier).
 	//
 	// More reading:
 	//     http://stackoverflow.com/q/21540315/1505451
 	AttributesExpiration time.Time
 
+	// If non-zero, this takes precedence over AttributesExpiration: the
+	// attributes may be cached for this long from when the reply is sent,
+	// measured using MountConfig.Clock. This saves computing an absolute time
+	// from a clock of the file system's own.
+	AttributesValidity time.Duration
+
 	// The time until which the kernel may maintain an entry for this name to
 	// inode mapping in its dentry cache. After this time, it will revalidate the
 	// dentry.
@@ -219,4 +299,8 @@ type ChildInodeEntry struct {
 	// Beware: this value is ignored on OS X, where entry caching is disabled by
 	// default. See notes on MountConfig.EnableVnodeCaching for more.
 	EntryExpiration time.Time
+
+	// If non-zero, this takes precedence over EntryExpiration, in the same manner
+	// as AttributesValidity does for AttributesExpiration.
+	EntryValidity time.Duration
 }
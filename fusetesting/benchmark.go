@@ -0,0 +1,322 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The size reported for every file in a file system returned by NewNullFS.
+const NullFSFileSize = 1 << 40
+
+const nullFSFileID = fuseops.RootInodeID + 1
+
+// NewNullFS returns a file system that answers ops as quickly as possible,
+// without doing any work, so that benchmarks run against it measure the
+// overhead of this package and the kernel rather than that of a backend.
+//
+// Every name in the root directory is a regular file of NullFSFileSize bytes,
+// all of them the same inode. Reads return zeros, and writes are discarded.
+// Nothing is cached by the kernel: entries and attributes expire immediately,
+// and files are opened with direct I/O, so that every lookup, read and write
+// reaches the file system.
+func NewNullFS() fuseutil.FileSystem {
+	return &nullFS{}
+}
+
+type nullFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func nullFSAttributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Nlink: 2, Mode: 0777 | os.ModeDir}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0666, Size: NullFSFileSize}
+}
+
+func (fs *nullFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *nullFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = nullFSFileID
+	op.Entry.Attributes = nullFSAttributes(nullFSFileID)
+	return nil
+}
+
+func (fs *nullFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = nullFSAttributes(op.Inode)
+	return nil
+}
+
+func (fs *nullFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	op.Attributes = nullFSAttributes(op.Inode)
+	return nil
+}
+
+func (fs *nullFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *nullFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fs *nullFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	// Dst may hold whatever was last in the buffer, so clear it.
+	for i := range op.Dst {
+		op.Dst[i] = 0
+	}
+
+	op.BytesRead = len(op.Dst)
+	return nil
+}
+
+func (fs *nullFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func (fs *nullFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *nullFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+// BenchmarkConfig describes a run of one of the Benchmark functions.
+type BenchmarkConfig struct {
+	// How long to run for. If zero, one second is used.
+	Duration time.Duration
+
+	// The number of goroutines issuing syscalls concurrently. If zero, one is
+	// used.
+	Workers int
+
+	// The size of each read or write. If zero, 4 KiB is used.
+	BlockSize int
+}
+
+func (cfg *BenchmarkConfig) duration() time.Duration {
+	if cfg.Duration == 0 {
+		return time.Second
+	}
+
+	return cfg.Duration
+}
+
+func (cfg *BenchmarkConfig) workers() int {
+	if cfg.Workers == 0 {
+		return 1
+	}
+
+	return cfg.Workers
+}
+
+func (cfg *BenchmarkConfig) blockSize() int {
+	if cfg.BlockSize == 0 {
+		return 4096
+	}
+
+	return cfg.BlockSize
+}
+
+// BenchmarkResult reports what a run of one of the Benchmark functions
+// achieved.
+type BenchmarkResult struct {
+	// The number of syscalls that completed, and the number of bytes they
+	// transferred.
+	Ops   int64
+	Bytes int64
+
+	// How long the run took.
+	Elapsed time.Duration
+}
+
+// OpsPerSecond returns the rate at which syscalls completed.
+func (r BenchmarkResult) OpsPerSecond() float64 {
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+// BytesPerSecond returns the rate at which data was transferred.
+func (r BenchmarkResult) BytesPerSecond() float64 {
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+func (r BenchmarkResult) String() string {
+	return fmt.Sprintf(
+		"%d ops in %v (%.0f ops/s, %.1f MiB/s)",
+		r.Ops,
+		r.Elapsed,
+		r.OpsPerSecond(),
+		r.BytesPerSecond()/(1<<20))
+}
+
+// Call op repeatedly from the configured number of workers until the
+// configured duration has passed. op is given the worker's index and the
+// number of calls it has made before, and returns the number of bytes it
+// transferred.
+func runBenchmark(
+	cfg BenchmarkConfig,
+	op func(worker int, i int64) (int, error)) (BenchmarkResult, error) {
+	var ops, bytes int64
+	var firstErr error
+	var errOnce sync.Once
+	var stop int32
+
+	start := time.Now()
+	deadline := start.Add(cfg.duration())
+
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.workers(); w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := int64(0); atomic.LoadInt32(&stop) == 0; i++ {
+				n, err := op(w, i)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					atomic.StoreInt32(&stop, 1)
+					return
+				}
+
+				atomic.AddInt64(&ops, 1)
+				atomic.AddInt64(&bytes, int64(n))
+
+				if time.Now().After(deadline) {
+					atomic.StoreInt32(&stop, 1)
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	r := BenchmarkResult{
+		Ops:     ops,
+		Bytes:   bytes,
+		Elapsed: time.Since(start),
+	}
+
+	return r, firstErr
+}
+
+// Open the file with the given name in dir once for each worker, then run op
+// against the files.
+func runFileBenchmark(
+	dir string,
+	name string,
+	flag int,
+	cfg BenchmarkConfig,
+	op func(f *os.File, buf []byte, off int64) (int, error)) (BenchmarkResult, error) {
+	files := make([]*os.File, cfg.workers())
+	for w := range files {
+		f, err := os.OpenFile(path.Join(dir, name), flag, 0)
+		if err != nil {
+			return BenchmarkResult{}, err
+		}
+
+		defer f.Close()
+		files[w] = f
+	}
+
+	bufs := make([][]byte, len(files))
+	for w := range bufs {
+		bufs[w] = make([]byte, cfg.blockSize())
+	}
+
+	// Keep each worker to its own region of the file, wrapping around well
+	// before the end.
+	const region = NullFSFileSize / 1024
+	return runBenchmark(cfg, func(w int, i int64) (int, error) {
+		off := int64(w)*region + (i*int64(cfg.blockSize()))%region
+		return op(files[w], bufs[w], off)
+	})
+}
+
+// BenchmarkReads issues reads of cfg.BlockSize bytes against the file with
+// the given name in dir, which should be the mount point of a file system
+// returned by NewNullFS (or one like it), for cfg.Duration.
+func BenchmarkReads(
+	dir string,
+	cfg BenchmarkConfig) (BenchmarkResult, error) {
+	return runFileBenchmark(
+		dir,
+		"read",
+		os.O_RDONLY,
+		cfg,
+		func(f *os.File, buf []byte, off int64) (int, error) {
+			return f.ReadAt(buf, off)
+		})
+}
+
+// BenchmarkWrites is like BenchmarkReads, but issues writes.
+func BenchmarkWrites(
+	dir string,
+	cfg BenchmarkConfig) (BenchmarkResult, error) {
+	return runFileBenchmark(
+		dir,
+		"write",
+		os.O_WRONLY,
+		cfg,
+		func(f *os.File, buf []byte, off int64) (int, error) {
+			return f.WriteAt(buf, off)
+		})
+}
+
+// BenchmarkLookUps stats distinct names in dir, which should be the mount
+// point of a file system returned by NewNullFS (or one like it), for
+// cfg.Duration. Each stat costs a lookup, since the null file system doesn't
+// let the kernel cache entries.
+func BenchmarkLookUps(
+	dir string,
+	cfg BenchmarkConfig) (BenchmarkResult, error) {
+	return runBenchmark(cfg, func(w int, i int64) (int, error) {
+		_, err := os.Lstat(path.Join(dir, fmt.Sprintf("%d-%d", w, i)))
+		return 0, err
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestNullFS(t *testing.T) {
+	ctx := context.Background()
+	fs := fusetesting.NewNullFS()
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "taco"}
+	if err := fs.LookUpInode(ctx, lookUp); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	attrs := lookUp.Entry.Attributes
+	if !attrs.Mode.IsRegular() || attrs.Size != fusetesting.NullFSFileSize {
+		t.Errorf("Attributes: %+v", attrs)
+	}
+
+	// Nothing may be cached, or benchmarks wouldn't reach the file system.
+	if lookUp.Entry.EntryValidity != 0 || lookUp.Entry.AttributesValidity != 0 {
+		t.Errorf("Entry is cached: %+v", lookUp.Entry)
+	}
+
+	open := &fuseops.OpenFileOp{Inode: lookUp.Entry.Child}
+	if err := fs.OpenFile(ctx, open); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	if !open.UseDirectIO {
+		t.Errorf("UseDirectIO not set")
+	}
+
+	read := &fuseops.ReadFileOp{Dst: []byte("burrito")}
+	if err := fs.ReadFile(ctx, read); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if read.BytesRead != 7 || string(read.Dst) != "\x00\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("ReadFile: %d bytes, %q", read.BytesRead, read.Dst)
+	}
+
+	write := &fuseops.WriteFileOp{Data: []byte("enchilada")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestBenchmarkResult(t *testing.T) {
+	r := fusetesting.BenchmarkResult{
+		Ops:     500,
+		Bytes:   1 << 21,
+		Elapsed: 2 * time.Second,
+	}
+
+	if got := r.OpsPerSecond(); got != 250 {
+		t.Errorf("OpsPerSecond: %v", got)
+	}
+
+	if got := r.BytesPerSecond(); got != 1<<20 {
+		t.Errorf("BytesPerSecond: %v", got)
+	}
+}
+
+// Run one of the Benchmark functions against a null file system, reporting
+// the throughput it achieved.
+func runNullFSBenchmark(
+	b *testing.B,
+	f func(string, fusetesting.BenchmarkConfig) (fusetesting.BenchmarkResult, error)) {
+	dir := fusetesting.MountForTest(
+		b,
+		fuseutil.NewFileSystemServer(fusetesting.NewNullFS()),
+		&fuse.MountConfig{}).Dir()
+
+	var total fusetesting.BenchmarkResult
+	for i := 0; i < b.N; i++ {
+		r, err := f(dir, fusetesting.BenchmarkConfig{Duration: 100 * time.Millisecond})
+		if err != nil {
+			b.Fatalf("Benchmark: %v", err)
+		}
+
+		total.Ops += r.Ops
+		total.Bytes += r.Bytes
+		total.Elapsed += r.Elapsed
+	}
+
+	b.ReportMetric(total.OpsPerSecond(), "ops/s")
+}
+
+func BenchmarkNullFS_Reads(b *testing.B) {
+	runNullFSBenchmark(b, fusetesting.BenchmarkReads)
+}
+
+func BenchmarkNullFS_Writes(b *testing.B) {
+	runNullFSBenchmark(b, fusetesting.BenchmarkWrites)
+}
+
+func BenchmarkNullFS_LookUps(b *testing.B) {
+	runNullFSBenchmark(b, fusetesting.BenchmarkLookUps)
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// FaultConfig describes the faults injected by a file system returned by
+// NewFaultInjector. The zero value injects none.
+type FaultConfig struct {
+	// The seed for the source of randomness deciding which ops fail, so that a
+	// given sequence of ops always sees the same faults.
+	Seed int64
+
+	// The probability, from zero to one, that a ReadFileOp fails with EIO
+	// without reaching the wrapped file system.
+	ReadErrorRate float64
+
+	// A delay before passing on each WriteFileOp. The op fails with EINTR if
+	// it is interrupted in the meantime.
+	WriteDelay time.Duration
+
+	// If non-zero, the total number of bytes that WriteFileOps may write. A
+	// write that would take the total past this fails with ENOSPC, as does
+	// every write after it.
+	WriteLimit int64
+}
+
+// NewFaultInjector wraps the supplied file system, passing ops on to it but
+// injecting faults as configured, for testing how users of a file system
+// cope with it misbehaving.
+func NewFaultInjector(
+	fs fuseutil.FileSystem,
+	cfg FaultConfig) fuseutil.FileSystem {
+	return &faultInjector{
+		FileSystem: fs,
+		cfg:        cfg,
+		rand:       rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+type faultInjector struct {
+	fuseutil.FileSystem
+	cfg FaultConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	rand    *rand.Rand
+	written int64
+	full    bool
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *faultInjector) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	fail := fs.cfg.ReadErrorRate > 0 && fs.rand.Float64() < fs.cfg.ReadErrorRate
+	fs.mu.Unlock()
+
+	if fail {
+		return fuse.EIO
+	}
+
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *faultInjector) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if fs.cfg.WriteDelay > 0 {
+		select {
+		case <-time.After(fs.cfg.WriteDelay):
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+
+	if fs.cfg.WriteLimit > 0 {
+		fs.mu.Lock()
+		if fs.written+int64(len(op.Data)) > fs.cfg.WriteLimit {
+			fs.full = true
+		}
+
+		full := fs.full
+		if !full {
+			fs.written += int64(len(op.Data))
+		}
+
+		fs.mu.Unlock()
+
+		if full {
+			return fuse.ENOSPC
+		}
+	}
+
+	return fs.FileSystem.WriteFile(ctx, op)
+}
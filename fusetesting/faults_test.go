@@ -0,0 +1,175 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system whose reads and writes always succeed, counting them.
+type countingFS struct {
+	fuseutil.NotImplementedFileSystem
+	reads  int
+	writes int
+}
+
+func (fs *countingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.reads++
+	op.BytesRead = copy(op.Dst, "taco")
+	return nil
+}
+
+func (fs *countingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.writes++
+	return nil
+}
+
+// Issue the given number of reads, returning the errors.
+func readN(fs fuseutil.FileSystem, n int) (errs []error) {
+	for i := 0; i < n; i++ {
+		op := &fuseops.ReadFileOp{Dst: make([]byte, 4)}
+		errs = append(errs, fs.ReadFile(context.Background(), op))
+	}
+
+	return
+}
+
+func TestFaultInjector_ReadErrorRate(t *testing.T) {
+	const n = 10000
+	wrapped := &countingFS{}
+	fs := fusetesting.NewFaultInjector(
+		wrapped,
+		fusetesting.FaultConfig{Seed: 17, ReadErrorRate: 0.25})
+
+	errs := readN(fs, n)
+	failures := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+		case fuse.EIO:
+			failures++
+		default:
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if rate := float64(failures) / n; rate < 0.23 || rate > 0.27 {
+		t.Errorf("Error rate: %v", rate)
+	}
+
+	if wrapped.reads != n-failures {
+		t.Errorf("%d reads passed on; expected %d", wrapped.reads, n-failures)
+	}
+
+	// The same seed should give the same faults.
+	fs = fusetesting.NewFaultInjector(
+		&countingFS{},
+		fusetesting.FaultConfig{Seed: 17, ReadErrorRate: 0.25})
+
+	for i, err := range readN(fs, n) {
+		if err != errs[i] {
+			t.Fatalf("Read %d: %v, previously %v", i, err, errs[i])
+		}
+	}
+}
+
+func TestFaultInjector_Writes(t *testing.T) {
+	ctx := context.Background()
+	const delay = 10 * time.Millisecond
+
+	wrapped := &countingFS{}
+	fs := fusetesting.NewFaultInjector(
+		wrapped,
+		fusetesting.FaultConfig{WriteDelay: delay, WriteLimit: 250})
+
+	// The first two writes fit; the third and all after it don't.
+	for i, expected := range []error{nil, nil, fuse.ENOSPC, fuse.ENOSPC} {
+		start := time.Now()
+		err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Data: make([]byte, 100)})
+		if err != expected {
+			t.Errorf("Write %d: %v", i, err)
+		}
+
+		if elapsed := time.Since(start); elapsed < delay {
+			t.Errorf("Write %d took %v", i, elapsed)
+		}
+	}
+
+	if wrapped.writes != 2 {
+		t.Errorf("%d writes passed on", wrapped.writes)
+	}
+}
+
+func TestFaultInjector_InterruptedWrite(t *testing.T) {
+	wrapped := &countingFS{}
+	fs := fusetesting.NewFaultInjector(
+		wrapped,
+		fusetesting.FaultConfig{WriteDelay: time.Hour})
+
+	// An interrupted write should fail as the interrupted system call did,
+	// rather than with an error that would reach the caller as EIO.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Data: make([]byte, 100)})
+	if err != syscall.EINTR {
+		t.Errorf("Got error %v, want EINTR", err)
+	}
+
+	if wrapped.writes != 0 {
+		t.Errorf("%d writes passed on", wrapped.writes)
+	}
+}
+
+func TestFaultInjector_NoFaults(t *testing.T) {
+	const n = 1000
+	wrapped := &countingFS{}
+	fs := fusetesting.NewFaultInjector(wrapped, fusetesting.FaultConfig{})
+
+	for i, err := range readN(fs, n) {
+		if err != nil {
+			t.Fatalf("Read %d: %v", i, err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		op := &fuseops.WriteFileOp{Data: make([]byte, 1<<20)}
+		if err := fs.WriteFile(context.Background(), op); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+
+	if wrapped.reads != n || wrapped.writes != n {
+		t.Errorf("%d reads and %d writes passed on", wrapped.reads, wrapped.writes)
+	}
+
+	// Other ops should reach the wrapped file system untouched.
+	err := fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{})
+	if err != fuse.ENOSYS {
+		t.Errorf("LookUpInode: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Assert that an op issued against a mounted file system can be interrupted
+// end to end: the thread issuing it receives SIGINT, the kernel sends
+// FUSE_INTERRUPT, the op's context is canceled, and the syscall fails with
+// EINTR.
+//
+// mount mounts the file system under test, returning the mount point and a
+// channel on which the file system sends the context of the op once its
+// handler has started blocking. The handler must then wait for the context to
+// be canceled and reply with EINTR, as described for fuse.Connection.ReadOp.
+//
+// opFactory returns the op to issue against the mount point, which is called on
+// a thread of its own so that the signal can be aimed at it. The op must make
+// the blocking syscall directly, e.g. with syscall.Read rather than
+// os.File.Read, since the os package retries syscalls that fail with EINTR.
+func AssertInterruptible(
+	t testing.TB,
+	mount func(testing.TB) (dir string, blocked <-chan context.Context),
+	opFactory func(dir string) func() error) {
+	t.Helper()
+	const timeout = 10 * time.Second
+
+	dir, blocked := mount(t)
+	op := opFactory(dir)
+
+	// Don't let the signal terminate the test.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	// Issue the op on a thread of its own, noting which.
+	tids := make(chan int, 1)
+	opErr := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		tids <- unix.Gettid()
+		opErr <- op()
+	}()
+
+	tid := <-tids
+
+	// Wait for the op to reach the file system.
+	var ctx context.Context
+	select {
+	case ctx = <-blocked:
+
+	case err := <-opErr:
+		t.Fatalf("Op returned before blocking, with error: %v", err)
+
+	case <-time.After(timeout):
+		t.Fatalf("Timed out waiting for the op to block")
+	}
+
+	// Send SIGINT to the thread issuing the op.
+	if err := unix.Tgkill(unix.Getpid(), tid, unix.SIGINT); err != nil {
+		t.Fatalf("Tgkill: %v", err)
+	}
+
+	// The op's context should be canceled.
+	select {
+	case <-ctx.Done():
+
+	case <-time.After(timeout):
+		t.Fatalf("Timed out waiting for the op's context to be canceled")
+	}
+
+	// The syscall should have failed with EINTR.
+	select {
+	case err := <-opErr:
+		if !errors.Is(err, syscall.EINTR) {
+			t.Errorf("Op returned %v, want EINTR", err)
+		}
+
+	case <-time.After(timeout):
+		t.Fatalf("Timed out waiting for the op to return")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+)
+
+// Mount the supplied server at a new temporary directory for the duration of
+// a test or benchmark, failing it if that isn't possible. When the test
+// finishes the file system is unmounted, the server is joined, and the
+// directory is removed. A test may unmount and join the file system itself
+// first, in which case only the directory is removed.
+func MountForTest(
+	tb testing.TB,
+	server fuse.Server,
+	cfg *fuse.MountConfig) *fuse.MountedFileSystem {
+	tb.Helper()
+	return mountForTest(tb, func(dir string) (*fuse.MountedFileSystem, error) {
+		return fuse.Mount(dir, server, cfg)
+	})
+}
+
+// Create a temporary directory, call mount to mount a file system on it, and
+// arrange to clean up as described for MountForTest.
+func mountForTest(
+	tb testing.TB,
+	mount func(dir string) (*fuse.MountedFileSystem, error)) *fuse.MountedFileSystem {
+	tb.Helper()
+
+	dir, err := ioutil.TempDir("", "fusetesting")
+	if err != nil {
+		tb.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	mfs, err := mount(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatalf("Mounting: %v", err)
+	}
+
+	tb.Cleanup(func() {
+		defer os.RemoveAll(dir)
+
+		// Joining would hang if the file system is still mounted. It isn't if
+		// the test has unmounted it or its mount point has been lost.
+		if mfs.Health() != fuse.Dead {
+			if err := fuse.Unmount(dir); err != nil {
+				tb.Errorf("fuse.Unmount: %v", err)
+				return
+			}
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			tb.Errorf("Join: %v", err)
+		}
+	})
+
+	return mfs
+}
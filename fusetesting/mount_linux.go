@@ -0,0 +1,52 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// Like MountForTest, but mount with fuse.MountAt onto the temporary directory
+// opened with O_PATH. The file is kept open until the file system has been
+// joined, since MountConfig.OnMountpointLost looks the mount up through it.
+//
+// Linux only.
+func MountAtForTest(
+	tb testing.TB,
+	server fuse.Server,
+	cfg *fuse.MountConfig) *fuse.MountedFileSystem {
+	tb.Helper()
+	return mountForTest(tb, func(dir string) (*fuse.MountedFileSystem, error) {
+		fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		f := os.NewFile(uintptr(fd), dir)
+		mfs, err := fuse.MountAt(f, server, cfg)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// Cleanups run last-in first-out, so this runs after joining.
+		tb.Cleanup(func() { f.Close() })
+		return mfs, nil
+	})
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// RawRequest is a single message as read from /dev/fuse, header included.
+type RawRequest []byte
+
+// RawResponse is a single message as written to /dev/fuse, header included.
+type RawResponse []byte
+
+// NewSocketConnection creates a connection that speaks to a socket standing in
+// for /dev/fuse, which preserves message boundaries as the device does, once
+// the supplied init request has been written to the other end of the socket.
+// It returns the connection, the end of the socket that it uses, and the other
+// end, through which to play the kernel's part; the connection's reply to the
+// init request is waiting to be read from the latter.
+//
+// Closing kernel hangs up, after which serving the connection finishes. The
+// caller must then close dev.
+func NewSocketConnection(
+	cfg *fuse.MountConfig,
+	init RawRequest) (c *fuse.Connection, dev, kernel *os.File, err error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		err = fmt.Errorf("Socketpair: %v", err)
+		return
+	}
+
+	dev = os.NewFile(uintptr(fds[0]), "dev")
+	kernel = os.NewFile(uintptr(fds[1]), "kernel")
+
+	if _, err = kernel.Write(init); err != nil {
+		err = fmt.Errorf("Writing init: %v", err)
+	} else if c, err = fuse.NewConnection(cfg, dev); err != nil {
+		err = fmt.Errorf("NewConnection: %v", err)
+	}
+
+	if err != nil {
+		dev.Close()
+		kernel.Close()
+	}
+
+	return
+}
+
+// ReplayTrace feeds a captured sequence of requests to the supplied file
+// system, through the same dispatch path used for a real mount but without
+// mounting anything, and returns the responses it writes. This allows turning
+// captures from the field into deterministic regression tests.
+//
+// The first request must be the FUSE_INIT request that begins every session.
+// Requests to which the kernel expects no response (forgets and interrupts)
+// contribute nothing to the result. Each request is sent only once the
+// response to the previous one has been received, so ops are processed one at
+// a time and in order.
+func ReplayTrace(
+	fs fuseutil.FileSystem,
+	trace []RawRequest) ([]RawResponse, error) {
+	if len(trace) == 0 {
+		return nil, fmt.Errorf("Empty trace")
+	}
+
+	c, dev, kernel, err := NewSocketConnection(&fuse.MountConfig{}, trace[0])
+	if err != nil {
+		return nil, err
+	}
+
+	defer dev.Close()
+	defer kernel.Close()
+
+	var responses []RawResponse
+	buf := make([]byte, 1<<21)
+	receive := func() error {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			return fmt.Errorf("Read: %v", err)
+		}
+
+		responses = append(responses, append(RawResponse(nil), buf[:n]...))
+		return nil
+	}
+
+	if err := receive(); err != nil {
+		return nil, fmt.Errorf("Receiving init response: %v", err)
+	}
+
+	// Serve the rest.
+	done := make(chan struct{})
+	go func() {
+		fuseutil.NewFileSystemServer(fs).ServeOps(c)
+		close(done)
+	}()
+
+	for i, req := range trace[1:] {
+		if _, err = kernel.Write(req); err != nil {
+			err = fmt.Errorf("Request %d: Write: %v", i+1, err)
+			break
+		}
+
+		if !expectsResponse(req) {
+			continue
+		}
+
+		if err = receive(); err != nil {
+			err = fmt.Errorf("Request %d: %v", i+1, err)
+			break
+		}
+	}
+
+	// Hang up, and wait for the server to finish.
+	kernel.Close()
+	<-done
+
+	return responses, err
+}
+
+// Does the kernel expect a response to the supplied request?
+func expectsResponse(req RawRequest) bool {
+	if uintptr(len(req)) < unsafe.Sizeof(fusekernel.InHeader{}) {
+		return true
+	}
+
+	h := (*fusekernel.InHeader)(unsafe.Pointer(&req[0]))
+	switch h.Opcode {
+	case fusekernel.OpForget, fusekernel.OpBatchForget, fusekernel.OpInterrupt:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system containing a single file named "foo".
+type replayFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+const replayFooID = fuseops.RootInodeID + 1
+
+func (fs *replayFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = replayFooID
+	op.Entry.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0444, Size: 17}
+	return nil
+}
+
+// Build a request in the format read from /dev/fuse.
+func request(unique uint64, opcode uint32, nodeid uint64, body []byte) []byte {
+	h := fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + len(body)),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: nodeid,
+		Pid:    1,
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// Record the requests made by a lookup of "foo" followed by one of "bar",
+// then a forget of the former.
+func recordTrace() []fusetesting.RawRequest {
+	var init bytes.Buffer
+	binary.Write(&init, binary.LittleEndian, fusekernel.InitIn{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	})
+
+	var forget bytes.Buffer
+	binary.Write(&forget, binary.LittleEndian, fusekernel.ForgetIn{Nlookup: 1})
+
+	return []fusetesting.RawRequest{
+		request(1, fusekernel.OpInit, 0, init.Bytes()),
+		request(2, fusekernel.OpLookup, fuseops.RootInodeID, []byte("foo\x00")),
+		request(3, fusekernel.OpLookup, fuseops.RootInodeID, []byte("bar\x00")),
+		request(4, fusekernel.OpForget, replayFooID, forget.Bytes()),
+	}
+}
+
+func TestReplayTrace(t *testing.T) {
+	trace := recordTrace()
+
+	responses, err := fusetesting.ReplayTrace(&replayFS{}, trace)
+	if err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+
+	// The forget gets no response.
+	if len(responses) != 3 {
+		t.Fatalf("Got %d responses", len(responses))
+	}
+
+	// Each response begins with fuse_out_header: len, error, unique.
+	header := func(r fusetesting.RawResponse) (int32, uint64) {
+		return int32(binary.LittleEndian.Uint32(r[4:])),
+			binary.LittleEndian.Uint64(r[8:])
+	}
+
+	for i, r := range responses {
+		if _, unique := header(r); unique != uint64(i+1) {
+			t.Errorf("Response %d: unique %d", i, unique)
+		}
+	}
+
+	// The first lookup succeeds, yielding fuse_entry_out with the node ID first.
+	if errno, _ := header(responses[1]); errno != 0 {
+		t.Errorf("Lookup of foo: error %d", errno)
+	}
+
+	if id := binary.LittleEndian.Uint64(responses[1][16:]); id != replayFooID {
+		t.Errorf("Lookup of foo: node ID %d", id)
+	}
+
+	// The second fails.
+	if errno, _ := header(responses[2]); errno != -int32(syscall.ENOENT) {
+		t.Errorf("Lookup of bar: error %d", errno)
+	}
+
+	// Replaying again yields identical responses.
+	again, err := fusetesting.ReplayTrace(&replayFS{}, trace)
+	if err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+
+	for i := range responses {
+		if !bytes.Equal(responses[i], again[i]) {
+			t.Errorf("Response %d differs on replay", i)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/jacobsa/oglematchers"
+	"golang.org/x/sys/unix"
 )
 
 // Match os.FileInfo values that specify an mtime equal to the given time.
@@ -39,20 +40,80 @@ func MtimeIsWithin(expected time.Time, d time.Duration) oglematchers.Matcher {
 }
 
 func mtimeIsWithin(c interface{}, expected time.Time, d time.Duration) error {
+	return timeIsWithin(c, "mtime", func(fi os.FileInfo) (time.Time, bool) {
+		return fi.ModTime(), true
+	}, expected, d)
+}
+
+// Match os.FileInfo values that specify an atime equal to the given time. On
+// platforms where there is no atime available, match all os.FileInfo values.
+func AtimeIs(expected time.Time) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return atimeIsWithin(c, expected, 0) },
+		fmt.Sprintf("atime is %v", expected))
+}
+
+// Like AtimeIs, but allows for a tolerance.
+func AtimeIsWithin(expected time.Time, d time.Duration) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return atimeIsWithin(c, expected, d) },
+		fmt.Sprintf("atime is within %v of %v", d, expected))
+}
+
+func atimeIsWithin(c interface{}, expected time.Time, d time.Duration) error {
+	return timeIsWithin(c, "atime", func(fi os.FileInfo) (time.Time, bool) {
+		return extractAtime(fi.Sys())
+	}, expected, d)
+}
+
+// Match os.FileInfo values that specify a ctime equal to the given time. On
+// platforms where there is no ctime available, match all os.FileInfo values.
+func CtimeIs(expected time.Time) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return ctimeIsWithin(c, expected, 0) },
+		fmt.Sprintf("ctime is %v", expected))
+}
+
+// Like CtimeIs, but allows for a tolerance.
+func CtimeIsWithin(expected time.Time, d time.Duration) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return ctimeIsWithin(c, expected, d) },
+		fmt.Sprintf("ctime is within %v of %v", d, expected))
+}
+
+func ctimeIsWithin(c interface{}, expected time.Time, d time.Duration) error {
+	return timeIsWithin(c, "ctime", func(fi os.FileInfo) (time.Time, bool) {
+		return extractCtime(fi.Sys())
+	}, expected, d)
+}
+
+// Check that the time extracted from the supplied os.FileInfo is within d of
+// the expected time, inclusive, so that a tolerance of zero demands an exact
+// match. If there is no time to extract, anything matches.
+func timeIsWithin(
+	c interface{},
+	desc string,
+	extract func(os.FileInfo) (time.Time, bool),
+	expected time.Time,
+	d time.Duration) error {
 	fi, ok := c.(os.FileInfo)
 	if !ok {
 		return fmt.Errorf("which is of type %v", reflect.TypeOf(c))
 	}
 
-	// Check ModTime().
-	diff := fi.ModTime().Sub(expected)
+	t, ok := extract(fi)
+	if !ok {
+		return nil
+	}
+
+	diff := t.Sub(expected)
 	absDiff := diff
 	if absDiff < 0 {
 		absDiff = -absDiff
 	}
 
-	if !(absDiff < d) {
-		return fmt.Errorf("which has mtime %v, off by %v", fi.ModTime(), diff)
+	if absDiff > d {
+		return fmt.Errorf("which has %s %v, off by %v", desc, t, diff)
 	}
 
 	return nil
@@ -123,3 +184,137 @@ func nlinkIs(c interface{}, expected uint64) error {
 
 	return nil
 }
+
+// Match os.FileInfo values that specify a device number (st_rdev) equal to the
+// given one, as set with fuseops.InodeAttributes.Rdev. On platforms where there
+// is no rdev field available, match all os.FileInfo values.
+func RdevIs(expected uint32) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return rdevIs(c, expected) },
+		fmt.Sprintf("rdev is %s", describeDev(uint64(expected))))
+}
+
+func rdevIs(c interface{}, expected uint32) error {
+	fi, ok := c.(os.FileInfo)
+	if !ok {
+		return fmt.Errorf("which is of type %v", reflect.TypeOf(c))
+	}
+
+	if actual, ok := extractRdev(fi.Sys()); ok && actual != uint64(expected) {
+		return fmt.Errorf("which has rdev == %s", describeDev(actual))
+	}
+
+	return nil
+}
+
+// Describe a device number along with its major and minor numbers.
+func describeDev(dev uint64) string {
+	return fmt.Sprintf("%#x (major %d, minor %d)", dev, unix.Major(dev), unix.Minor(dev))
+}
+
+// Match os.FileInfo values that specify an owner with the given user ID. On
+// platforms where there is no uid field available, match all os.FileInfo
+// values.
+func UIDIs(expected uint32) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return idIs(c, "uid", extractUid, expected) },
+		fmt.Sprintf("uid is %v", expected))
+}
+
+// Like UIDIs, for the group ID.
+func GIDIs(expected uint32) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return idIs(c, "gid", extractGid, expected) },
+		fmt.Sprintf("gid is %v", expected))
+}
+
+func idIs(
+	c interface{},
+	desc string,
+	extract func(interface{}) (uint32, bool),
+	expected uint32) error {
+	fi, ok := c.(os.FileInfo)
+	if !ok {
+		return fmt.Errorf("which is of type %v", reflect.TypeOf(c))
+	}
+
+	if actual, ok := extract(fi.Sys()); ok && actual != expected {
+		return fmt.Errorf("which has %s == %v", desc, actual)
+	}
+
+	return nil
+}
+
+// Match os.FileInfo values whose mode, including both the file type and the
+// permission bits, is equal to the given one.
+func ModeIs(expected os.FileMode) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return modeIs(c, expected, ^os.FileMode(0)) },
+		fmt.Sprintf("mode is %v", expected))
+}
+
+// The bits of a mode compared by PermissionsAre.
+const permissionBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Like ModeIs, but compares only the permission bits, including setuid, setgid,
+// and sticky, ignoring the file type.
+func PermissionsAre(perm os.FileMode) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return modeIs(c, perm, permissionBits) },
+		fmt.Sprintf("permissions are %v", perm&permissionBits))
+}
+
+func modeIs(c interface{}, expected os.FileMode, mask os.FileMode) error {
+	fi, ok := c.(os.FileInfo)
+	if !ok {
+		return fmt.Errorf("which is of type %v", reflect.TypeOf(c))
+	}
+
+	if fi.Mode()&mask != expected&mask {
+		return fmt.Errorf("which has mode %v", fi.Mode())
+	}
+
+	return nil
+}
+
+// Match os.FileInfo values that specify a size equal to the given one.
+func SizeIs(expected int64) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return sizeIs(c, expected) },
+		fmt.Sprintf("size is %v", expected))
+}
+
+func sizeIs(c interface{}, expected int64) error {
+	fi, ok := c.(os.FileInfo)
+	if !ok {
+		return fmt.Errorf("which is of type %v", reflect.TypeOf(c))
+	}
+
+	if fi.Size() != expected {
+		return fmt.Errorf("which has size %v", fi.Size())
+	}
+
+	return nil
+}
+
+// Match os.FileInfo values that specify a number of allocated 512-byte blocks
+// (st_blocks) equal to the given number. On platforms where there is no such
+// field available, match all os.FileInfo values.
+func BlocksIs(expected uint64) oglematchers.Matcher {
+	return oglematchers.NewMatcher(
+		func(c interface{}) error { return blocksIs(c, expected) },
+		fmt.Sprintf("blocks is %v", expected))
+}
+
+func blocksIs(c interface{}, expected uint64) error {
+	fi, ok := c.(os.FileInfo)
+	if !ok {
+		return fmt.Errorf("which is of type %v", reflect.TypeOf(c))
+	}
+
+	if actual, ok := extractBlocks(fi.Sys()); ok && actual != expected {
+		return fmt.Errorf("which has blocks == %v", actual)
+	}
+
+	return nil
+}
@@ -27,10 +27,64 @@ func extractBirthtime(sys interface{}) (birthtime time.Time, ok bool) {
 	return time.Unix(sys.(*syscall.Stat_t).Birthtimespec.Unix()), true
 }
 
+func extractAtime(sys interface{}) (atime time.Time, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(stat.Atimespec.Unix()), true
+}
+
+func extractCtime(sys interface{}) (ctime time.Time, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(stat.Ctimespec.Unix()), true
+}
+
 func extractNlink(sys interface{}) (nlink uint64, ok bool) {
 	return uint64(sys.(*syscall.Stat_t).Nlink), true
 }
 
+func extractUid(sys interface{}) (uid uint32, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return stat.Uid, true
+}
+
+func extractGid(sys interface{}) (gid uint32, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return stat.Gid, true
+}
+
+func extractRdev(sys interface{}) (rdev uint64, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return uint64(uint32(stat.Rdev)), true
+}
+
+func extractBlocks(sys interface{}) (blocks uint64, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return uint64(stat.Blocks), true
+}
+
 func getTimes(stat *syscall.Stat_t) (atime, ctime, mtime time.Time) {
 	atime = time.Unix(stat.Atimespec.Unix())
 	ctime = time.Unix(stat.Ctimespec.Unix())
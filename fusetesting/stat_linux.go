@@ -27,10 +27,64 @@ func extractBirthtime(sys interface{}) (birthtime time.Time, ok bool) {
 	return time.Time{}, false
 }
 
+func extractAtime(sys interface{}) (atime time.Time, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(stat.Atim.Unix()), true
+}
+
+func extractCtime(sys interface{}) (ctime time.Time, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(stat.Ctim.Unix()), true
+}
+
 func extractNlink(sys interface{}) (nlink uint64, ok bool) {
 	return sys.(*syscall.Stat_t).Nlink, true
 }
 
+func extractUid(sys interface{}) (uid uint32, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return stat.Uid, true
+}
+
+func extractGid(sys interface{}) (gid uint32, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return stat.Gid, true
+}
+
+func extractRdev(sys interface{}) (rdev uint64, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return uint64(stat.Rdev), true
+}
+
+func extractBlocks(sys interface{}) (blocks uint64, ok bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return uint64(stat.Blocks), true
+}
+
 func getTimes(stat *syscall.Stat_t) (atime, ctime, mtime time.Time) {
 	atime = time.Unix(stat.Atim.Unix())
 	ctime = time.Unix(stat.Ctim.Unix())
@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/oglematchers"
+	"golang.org/x/sys/unix"
+)
+
+// An os.FileInfo with the given times.
+func timesInfo(atime, mtime, ctime time.Time) os.FileInfo {
+	return timedInfo{
+		mtime: mtime,
+		stat: &syscall.Stat_t{
+			Atim: syscall.NsecToTimespec(atime.UnixNano()),
+			Ctim: syscall.NsecToTimespec(ctime.UnixNano()),
+		},
+	}
+}
+
+type timedInfo struct {
+	modeInfo
+	mtime time.Time
+	stat  *syscall.Stat_t
+}
+
+func (fi timedInfo) ModTime() time.Time { return fi.mtime }
+func (fi timedInfo) Sys() interface{}   { return fi.stat }
+
+func TestTimeMatchers(t *testing.T) {
+	base := time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local)
+	atime, mtime, ctime := base, base.Add(time.Second), base.Add(2*time.Second+500)
+	fi := timesInfo(atime, mtime, ctime)
+
+	testCases := []struct {
+		matcher oglematchers.Matcher
+		err     string
+	}{
+		{fusetesting.MtimeIs(base.Add(time.Second)), ""},
+		{fusetesting.MtimeIs(base), fmt.Sprintf("which has mtime %v, off by 1s", mtime)},
+
+		{fusetesting.AtimeIs(base), ""},
+		{fusetesting.AtimeIs(base.Add(1)), fmt.Sprintf("which has atime %v, off by -1ns", atime)},
+		{fusetesting.AtimeIsWithin(base.Add(time.Millisecond), time.Millisecond), ""},
+		{fusetesting.AtimeIsWithin(base.Add(time.Second), time.Millisecond), fmt.Sprintf("which has atime %v, off by -1s", atime)},
+
+		// Sub-second differences count.
+		{fusetesting.CtimeIs(base.Add(2*time.Second + 500)), ""},
+		{fusetesting.CtimeIs(base.Add(2 * time.Second)), fmt.Sprintf("which has ctime %v, off by 500ns", ctime)},
+		{fusetesting.CtimeIsWithin(base.Add(2*time.Second), 500), ""},
+		{fusetesting.CtimeIsWithin(base.Add(2*time.Second), 499), fmt.Sprintf("which has ctime %v, off by 500ns", ctime)},
+	}
+
+	for _, tc := range testCases {
+		var got string
+		if err := tc.matcher.Matches(fi); err != nil {
+			got = err.Error()
+		}
+
+		if got != tc.err {
+			t.Errorf("%s: got %q, want %q", tc.matcher.Description(), got, tc.err)
+		}
+	}
+
+	// Values without the times match anything.
+	if err := fusetesting.AtimeIs(base).Matches(modeInfo(0644)); err != nil {
+		t.Errorf("AtimeIs without st_atime: %v", err)
+	}
+
+	if err := fusetesting.CtimeIs(base).Matches(modeInfo(0644)); err != nil {
+		t.Errorf("CtimeIs without st_ctime: %v", err)
+	}
+}
+
+func TestRdevIs(t *testing.T) {
+	dev := unix.Mkdev(4, 300)
+	fi := timedInfo{stat: &syscall.Stat_t{Rdev: dev}}
+
+	if err := fusetesting.RdevIs(uint32(dev)).Matches(fi); err != nil {
+		t.Errorf("RdevIs(%#x): %v", dev, err)
+	}
+
+	other := uint32(unix.Mkdev(4, 301))
+	want := fmt.Sprintf("which has rdev == %#x (major 4, minor 300)", dev)
+	if err := fusetesting.RdevIs(other).Matches(fi); err == nil || err.Error() != want {
+		t.Errorf("RdevIs(%#x): got %v, want %q", other, err, want)
+	}
+
+	// Values without st_rdev match anything.
+	if err := fusetesting.RdevIs(other).Matches(modeInfo(0644)); err != nil {
+		t.Errorf("RdevIs without st_rdev: %v", err)
+	}
+}
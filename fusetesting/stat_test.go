@@ -0,0 +1,165 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/oglematchers"
+)
+
+// An os.FileInfo with nothing but a mode.
+type modeInfo os.FileMode
+
+func (fi modeInfo) Name() string       { return "foo" }
+func (fi modeInfo) Size() int64        { return 0 }
+func (fi modeInfo) Mode() os.FileMode  { return os.FileMode(fi) }
+func (fi modeInfo) ModTime() time.Time { return time.Time{} }
+func (fi modeInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi modeInfo) Sys() interface{}   { return nil }
+
+func TestModeMatchers(t *testing.T) {
+	testCases := []struct {
+		matcher oglematchers.Matcher
+		mode    os.FileMode
+		err     string
+	}{
+		{fusetesting.ModeIs(0644), 0644, ""},
+		{fusetesting.ModeIs(0644), 0600, "which has mode -rw-------"},
+		{fusetesting.ModeIs(0644), os.ModeDir | 0644, "which has mode drw-r--r--"},
+		{fusetesting.ModeIs(os.ModeSymlink | 0777), os.ModeSymlink | 0777, ""},
+
+		{fusetesting.PermissionsAre(0644), 0644, ""},
+		{fusetesting.PermissionsAre(0644), os.ModeDir | 0644, ""},
+		{fusetesting.PermissionsAre(os.ModeDir | 0644), 0644, ""},
+		{fusetesting.PermissionsAre(0644), os.ModeDir | 0755, "which has mode drwxr-xr-x"},
+		{fusetesting.PermissionsAre(0755), os.ModeSetuid | 0755, "which has mode urwxr-xr-x"},
+		{fusetesting.PermissionsAre(os.ModeSticky | 0777), os.ModeDir | os.ModeSticky | 0777, ""},
+	}
+
+	for _, tc := range testCases {
+		var got string
+		if err := tc.matcher.Matches(modeInfo(tc.mode)); err != nil {
+			got = err.Error()
+		}
+
+		if got != tc.err {
+			t.Errorf("%s, given %v: got %q, want %q", tc.matcher.Description(), tc.mode, got, tc.err)
+		}
+	}
+
+	if err := fusetesting.ModeIs(0644).Matches(17); err == nil || err.Error() != "which is of type int" {
+		t.Errorf("Given an int: got %v", err)
+	}
+}
+
+func TestSizeAndBlocksMatchers(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(make([]byte, 8192)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if err := fusetesting.SizeIs(8192).Matches(fi); err != nil {
+		t.Errorf("SizeIs(8192): %v", err)
+	}
+
+	if err := fusetesting.SizeIs(17).Matches(fi); err == nil || err.Error() != "which has size 8192" {
+		t.Errorf("SizeIs(17): got %v", err)
+	}
+
+	// The number of blocks depends on the file system holding the file, so
+	// take it from the file itself.
+	blocks := uint64(fi.Sys().(*syscall.Stat_t).Blocks)
+	if err := fusetesting.BlocksIs(blocks).Matches(fi); err != nil {
+		t.Errorf("BlocksIs(%v): %v", blocks, err)
+	}
+
+	want := fmt.Sprintf("which has blocks == %v", blocks)
+	if err := fusetesting.BlocksIs(blocks + 1).Matches(fi); err == nil || err.Error() != want {
+		t.Errorf("BlocksIs(%v): got %v", blocks+1, err)
+	}
+
+	// Values without st_blocks match anything.
+	if err := fusetesting.BlocksIs(17).Matches(modeInfo(0644)); err != nil {
+		t.Errorf("BlocksIs without st_blocks: %v", err)
+	}
+}
+
+func TestOwnerMatchers(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	uid := uint32(os.Getuid())
+	gid := fi.Sys().(*syscall.Stat_t).Gid
+
+	if err := fusetesting.UIDIs(uid).Matches(fi); err != nil {
+		t.Errorf("UIDIs(%v): %v", uid, err)
+	}
+
+	want := fmt.Sprintf("which has uid == %v", uid)
+	if err := fusetesting.UIDIs(uid + 1).Matches(fi); err == nil || err.Error() != want {
+		t.Errorf("UIDIs(%v): got %v", uid+1, err)
+	}
+
+	if err := fusetesting.GIDIs(gid).Matches(fi); err != nil {
+		t.Errorf("GIDIs(%v): %v", gid, err)
+	}
+
+	want = fmt.Sprintf("which has gid == %v", gid)
+	if err := fusetesting.GIDIs(gid + 1).Matches(fi); err == nil || err.Error() != want {
+		t.Errorf("GIDIs(%v): got %v", gid+1, err)
+	}
+
+	// Values without ownership match anything.
+	if err := fusetesting.UIDIs(17).Matches(modeInfo(0644)); err != nil {
+		t.Errorf("UIDIs without st_uid: %v", err)
+	}
+
+	if err := fusetesting.GIDIs(17).Matches(modeInfo(0644)); err != nil {
+		t.Errorf("GIDIs without st_gid: %v", err)
+	}
+}
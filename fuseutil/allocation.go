@@ -0,0 +1,138 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import "math"
+
+// Allocation tracks which byte ranges of a sparse file have storage allocated
+// to them, so that a file system can report InodeAttributes.Blocks
+// consistently with its FallocateOp, WriteFileOp and SetInodeAttributesOp
+// handlers: writing or preallocating (fallocate with mode zero or
+// FALLOC_FL_KEEP_SIZE) allocates, and punching a hole (FALLOC_FL_PUNCH_HOLE) or
+// truncating deallocates.
+//
+// The zero value is an empty allocation. External synchronization is required.
+type Allocation struct {
+	// The allocated ranges, sorted, non-empty, and neither overlapping nor
+	// touching.
+	extents []extent
+}
+
+// A half-open byte range [start, end).
+type extent struct {
+	start uint64
+	end   uint64
+}
+
+// Return the extent of the given range, clamped to the largest offset rather
+// than wrapping around if it extends past it.
+func newExtent(offset uint64, length uint64) extent {
+	end := offset + length
+	if end < offset {
+		end = math.MaxUint64
+	}
+
+	return extent{offset, end}
+}
+
+// Allocate marks the given range as allocated. A range extending past the
+// largest offset is clamped to it.
+func (a *Allocation) Allocate(offset uint64, length uint64) {
+	if length == 0 {
+		return
+	}
+
+	// Merge the new range with those that it overlaps or touches.
+	n := newExtent(offset, length)
+	var out []extent
+	inserted := false
+	for _, e := range a.extents {
+		switch {
+		case e.end < n.start:
+			out = append(out, e)
+
+		case n.end < e.start:
+			if !inserted {
+				out = append(out, n)
+				inserted = true
+			}
+
+			out = append(out, e)
+
+		default:
+			if e.start < n.start {
+				n.start = e.start
+			}
+
+			if e.end > n.end {
+				n.end = e.end
+			}
+		}
+	}
+
+	if !inserted {
+		out = append(out, n)
+	}
+
+	a.extents = out
+}
+
+// Deallocate marks the given range as unallocated, as when punching a hole. A
+// range extending past the largest offset is clamped to it.
+func (a *Allocation) Deallocate(offset uint64, length uint64) {
+	if length == 0 {
+		return
+	}
+
+	end := newExtent(offset, length).end
+	var out []extent
+	for _, e := range a.extents {
+		if e.end <= offset || end <= e.start {
+			out = append(out, e)
+			continue
+		}
+
+		if e.start < offset {
+			out = append(out, extent{e.start, offset})
+		}
+
+		if end < e.end {
+			out = append(out, extent{end, e.end})
+		}
+	}
+
+	a.extents = out
+}
+
+// Truncate deallocates everything at or beyond size, as when the file is
+// truncated to that size.
+func (a *Allocation) Truncate(size uint64) {
+	a.Deallocate(size, ^uint64(0)-size)
+}
+
+// Bytes returns the number of bytes allocated.
+func (a *Allocation) Bytes() (n uint64) {
+	for _, e := range a.extents {
+		n += e.end - e.start
+	}
+
+	return n
+}
+
+// Blocks returns the number of 512-byte blocks allocated, rounding up, as
+// reported in InodeAttributes.Blocks and st_blocks.
+func (a *Allocation) Blocks() uint64 {
+	return (a.Bytes() + 511) / 512
+}
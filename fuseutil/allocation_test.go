@@ -0,0 +1,79 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestAllocation(t *testing.T) {
+	var a fuseutil.Allocation
+	check := func(desc string, bytes uint64, blocks uint64) {
+		t.Helper()
+		if got := a.Bytes(); got != bytes {
+			t.Errorf("%s: Bytes() = %d, want %d", desc, got, bytes)
+		}
+
+		if got := a.Blocks(); got != blocks {
+			t.Errorf("%s: Blocks() = %d, want %d", desc, got, blocks)
+		}
+	}
+
+	check("empty", 0, 0)
+
+	// Preallocate a MiB, in overlapping and adjacent pieces.
+	a.Allocate(0, 1<<19)
+	a.Allocate(1<<18, 1<<18)
+	a.Allocate(1<<19, 1<<19)
+	check("preallocated", 1<<20, 2048)
+
+	// Punch a hole in the middle, then another overlapping it.
+	a.Deallocate(1<<18, 1<<17)
+	a.Deallocate(3<<17, 1<<17)
+	check("punched", 3<<18, 1536)
+
+	// Punching a hole that's already there changes nothing.
+	a.Deallocate(1<<18, 1<<18)
+	check("punched again", 3<<18, 1536)
+
+	// A partial block still counts as a block.
+	a.Allocate(1<<18, 1)
+	check("one byte written", 3<<18+1, 1537)
+
+	// Filling the hole merges everything back into one range.
+	a.Allocate(1<<18, 1<<18)
+	check("hole filled", 1<<20, 2048)
+
+	// Preallocating beyond the end of the file, then truncating.
+	a.Allocate(2<<20, 1<<20)
+	check("preallocated past EOF", 2<<20, 4096)
+
+	a.Truncate(1 << 19)
+	check("truncated", 1<<19, 1024)
+
+	a.Truncate(0)
+	check("truncated to zero", 0, 0)
+
+	// A range running past the largest offset is clamped rather than wrapping
+	// around to one that ends before it starts.
+	a.Allocate(math.MaxUint64-1023, 2048)
+	check("allocated past the largest offset", 1023, 2)
+
+	a.Deallocate(math.MaxUint64-511, 1024)
+	check("deallocated past the largest offset", 512, 1)
+}
@@ -0,0 +1,605 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ArchiveFormat identifies the format of an archive given to
+// NewArchiveFileSystem.
+type ArchiveFormat int
+
+const (
+	ArchiveZip ArchiveFormat = iota
+	ArchiveTar
+)
+
+// How long the kernel may cache entries and attributes. The archive never
+// changes, so this can be long.
+const archiveCacheValidity = time.Hour
+
+// NewArchiveFileSystem returns a read-only file system exposing the contents of
+// the zip or tar archive stored in the first size bytes of r. The archive's
+// index is read up front; member contents are read from r only as they are
+// read from the file system, and compressed members are decompressed lazily.
+//
+// Directories are synthesized for every path prefix of a member, whether or
+// not the archive contains an entry for them. Members other than regular
+// files, directories and symlinks are skipped, and paths that would escape the
+// root are confined to it.
+//
+// Mount the result with MountConfig.ReadOnly set; ops that would modify the
+// file system fail with ENOSYS.
+func NewArchiveFileSystem(
+	r io.ReaderAt,
+	size int64,
+	format ArchiveFormat) (FileSystem, error) {
+	fs := &archiveFS{
+		r:       r,
+		handles: make(map[fuseops.HandleID]*archiveHandle),
+	}
+
+	// Set up the root.
+	fs.inodes = append(fs.inodes, nil, nil)
+	fs.inodes[fuseops.RootInodeID] = newArchiveDir(time.Time{})
+
+	var err error
+	switch format {
+	case ArchiveZip:
+		err = fs.indexZip(size)
+
+	case ArchiveTar:
+		err = fs.indexTar(size)
+
+	default:
+		err = fmt.Errorf("Unknown archive format: %v", format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort directory listings.
+	for _, in := range fs.inodes {
+		if in != nil && in.children != nil {
+			sort.Strings(in.names)
+		}
+	}
+
+	return fs, nil
+}
+
+type archiveFS struct {
+	NotImplementedFileSystem
+
+	// The archive.
+	r io.ReaderAt
+
+	// All inodes, indexed by ID. Constant after construction.
+	inodes []*archiveInode
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles    map[fuseops.HandleID]*archiveHandle
+	nextHandle fuseops.HandleID
+}
+
+type archiveInode struct {
+	attrs fuseops.InodeAttributes
+
+	// For directories: children by name, and their names in order.
+	children map[string]fuseops.InodeID
+	names    []string
+
+	// For symlinks: the target.
+	target string
+
+	// For regular files: a function returning a reader for the contents from the
+	// start. For members stored without compression this is also an
+	// io.ReaderAt, allowing random access.
+	open func() (io.Reader, error)
+}
+
+// An open file handle. Compressed data can only be read sequentially, so we
+// keep a reader and its position, starting again when a read goes backwards.
+type archiveHandle struct {
+	mu sync.Mutex
+
+	inode *archiveInode
+	rd    io.Reader // GUARDED_BY(mu)
+	pos   int64     // GUARDED_BY(mu)
+}
+
+// Close the member reader, if any, and forget it.
+//
+// LOCKS_REQUIRED(h.mu)
+func (h *archiveHandle) closeReader() {
+	if c, ok := h.rd.(io.Closer); ok {
+		c.Close()
+	}
+
+	h.rd = nil
+	h.pos = 0
+}
+
+func newArchiveDir(mtime time.Time) *archiveInode {
+	return &archiveInode{
+		attrs: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0555,
+			Atime: mtime,
+			Mtime: mtime,
+			Ctime: mtime,
+		},
+		children: make(map[string]fuseops.InodeID),
+	}
+}
+
+func (fs *archiveFS) indexZip(size int64) error {
+	zr, err := zip.NewReader(fs.r, size)
+	if err != nil {
+		return fmt.Errorf("zip.NewReader: %v", err)
+	}
+
+	for _, f := range zr.File {
+		f := f
+		fi := f.FileInfo()
+
+		var in *archiveInode
+		switch {
+		case fi.IsDir():
+			fs.addDir(f.Name, f.Modified)
+			continue
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("Opening %q: %v", f.Name, err)
+			}
+
+			target, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("Reading %q: %v", f.Name, err)
+			}
+
+			in = &archiveInode{target: string(target)}
+
+		case fi.Mode().IsRegular():
+			in = &archiveInode{}
+			if f.Method == zip.Store {
+				offset, err := f.DataOffset()
+				if err != nil {
+					return fmt.Errorf("DataOffset for %q: %v", f.Name, err)
+				}
+
+				n := int64(f.UncompressedSize64)
+				in.open = func() (io.Reader, error) {
+					return io.NewSectionReader(fs.r, offset, n), nil
+				}
+			} else {
+				in.open = func() (io.Reader, error) {
+					return f.Open()
+				}
+			}
+
+		default:
+			continue
+		}
+
+		in.attrs = fuseops.InodeAttributes{
+			Size:  f.UncompressedSize64,
+			Nlink: 1,
+			Mode:  fi.Mode() &^ 0222,
+			Atime: f.Modified,
+			Mtime: f.Modified,
+			Ctime: f.Modified,
+		}
+
+		fs.addMember(f.Name, in)
+	}
+
+	return nil
+}
+
+// Counts the bytes read through it, so that we can learn where in a tar
+// archive the data for each member starts.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (fs *archiveFS) indexTar(size int64) error {
+	cr := &countingReader{r: io.NewSectionReader(fs.r, 0, size)}
+	tr := tar.NewReader(cr)
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("tar.Reader.Next: %v", err)
+		}
+
+		var in *archiveInode
+		switch h.Typeflag {
+		case tar.TypeDir:
+			fs.addDir(h.Name, h.ModTime)
+			continue
+
+		case tar.TypeSymlink:
+			in = &archiveInode{target: h.Linkname}
+
+		case tar.TypeReg, tar.TypeRegA:
+			// The reader has consumed the header blocks, and the data follows.
+			offset := cr.n
+			n := h.Size
+			in = &archiveInode{
+				open: func() (io.Reader, error) {
+					return io.NewSectionReader(fs.r, offset, n), nil
+				},
+			}
+
+		default:
+			continue
+		}
+
+		in.attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  h.FileInfo().Mode() &^ 0222,
+			Atime: h.ModTime,
+			Mtime: h.ModTime,
+			Ctime: h.ModTime,
+			Uid:   uint32(h.Uid),
+			Gid:   uint32(h.Gid),
+		}
+
+		if h.Typeflag != tar.TypeSymlink {
+			in.attrs.Size = uint64(h.Size)
+		} else {
+			in.attrs.Size = uint64(len(h.Linkname))
+		}
+
+		fs.addMember(h.Name, in)
+	}
+
+	return nil
+}
+
+// Split a member name into clean path components relative to the root,
+// returning nil if it names the root itself.
+func archivePath(name string) []string {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return nil
+	}
+
+	return strings.Split(p[1:], "/")
+}
+
+// Find or create the directory with the given path components, returning its
+// ID.
+func (fs *archiveFS) mkdirAll(components []string) fuseops.InodeID {
+	id := fuseops.InodeID(fuseops.RootInodeID)
+	for _, name := range components {
+		parent := fs.inodes[id]
+		child, ok := parent.children[name]
+		if !ok || fs.inodes[child].children == nil {
+			child = fs.add(parent, name, newArchiveDir(time.Time{}))
+		}
+
+		id = child
+	}
+
+	return id
+}
+
+// Add a directory entry named in the archive.
+func (fs *archiveFS) addDir(name string, mtime time.Time) {
+	components := archivePath(name)
+	if components == nil {
+		return
+	}
+
+	d := fs.inodes[fs.mkdirAll(components)]
+	d.attrs.Atime = mtime
+	d.attrs.Mtime = mtime
+	d.attrs.Ctime = mtime
+}
+
+// Add a file or symlink named in the archive.
+func (fs *archiveFS) addMember(name string, in *archiveInode) {
+	components := archivePath(name)
+	if components == nil {
+		return
+	}
+
+	parent := fs.inodes[fs.mkdirAll(components[:len(components)-1])]
+	fs.add(parent, components[len(components)-1], in)
+}
+
+// Link a new inode into the parent, replacing any existing entry of the same
+// name (as when a tar archive contains a later version of a member).
+func (fs *archiveFS) add(
+	parent *archiveInode,
+	name string,
+	in *archiveInode) fuseops.InodeID {
+	id := fuseops.InodeID(len(fs.inodes))
+	fs.inodes = append(fs.inodes, in)
+
+	if _, ok := parent.children[name]; !ok {
+		parent.names = append(parent.names, name)
+	}
+
+	parent.children[name] = id
+	return id
+}
+
+func (fs *archiveFS) getInode(id fuseops.InodeID) (*archiveInode, error) {
+	if int(id) >= len(fs.inodes) || fs.inodes[id] == nil {
+		return nil, fuse.EINVAL
+	}
+
+	return fs.inodes[id], nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *archiveFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *archiveFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.getInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	child, ok := parent.children[op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = child
+	op.Entry.Attributes = fs.inodes[child].attrs
+	op.Entry.AttributesValidity = archiveCacheValidity
+	op.Entry.EntryValidity = archiveCacheValidity
+
+	return nil
+}
+
+func (fs *archiveFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	in, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes = in.attrs
+	op.AttributesValidity = archiveCacheValidity
+
+	return nil
+}
+
+func (fs *archiveFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	// Inodes live as long as the file system.
+	return nil
+}
+
+func (fs *archiveFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	in, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if in.children == nil {
+		return fuse.ENOTDIR
+	}
+
+	return nil
+}
+
+func (fs *archiveFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	in, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Offset > fuseops.DirOffset(len(in.names)) {
+		return fuse.EINVAL
+	}
+
+	for i := int(op.Offset); i < len(in.names); i++ {
+		name := in.names[i]
+		child := in.children[name]
+
+		t := DT_File
+		switch mode := fs.inodes[child].attrs.Mode; {
+		case mode.IsDir():
+			t = DT_Directory
+
+		case mode&os.ModeSymlink != 0:
+			t = DT_Link
+		}
+
+		n := WriteDirent(op.Dst[op.BytesRead:], Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  child,
+			Name:   name,
+			Type:   t,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *archiveFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *archiveFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	in, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if in.open == nil {
+		return fuse.EINVAL
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.nextHandle++
+	fs.handles[fs.nextHandle] = &archiveHandle{inode: in}
+
+	op.Handle = fs.nextHandle
+	op.KeepPageCache = true
+
+	return nil
+}
+
+func (fs *archiveFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	h, ok := fs.handles[op.Handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Random access is cheap for members stored without compression.
+	if h.rd == nil || op.Offset < h.pos {
+		h.closeReader()
+		rd, err := h.inode.open()
+		if err != nil {
+			return err
+		}
+
+		h.rd = rd
+	}
+
+	if ra, ok := h.rd.(io.ReaderAt); ok {
+		n, err := ra.ReadAt(op.Dst, op.Offset)
+		op.BytesRead = n
+		if err == io.EOF {
+			err = nil
+		}
+
+		return err
+	}
+
+	// Otherwise skip forward to the offset and read sequentially.
+	if _, err := io.CopyN(ioutil.Discard, h.rd, op.Offset-h.pos); err != nil {
+		h.closeReader()
+		if err == io.EOF {
+			return nil
+		}
+
+		return err
+	}
+
+	h.pos = op.Offset
+	n, err := io.ReadFull(h.rd, op.Dst)
+	op.BytesRead = n
+	h.pos += int64(n)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return err
+}
+
+func (fs *archiveFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	h, ok := fs.handles[op.Handle]
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	if ok {
+		h.mu.Lock()
+		h.closeReader()
+		h.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (fs *archiveFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	in, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Target = in.target
+	return nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Members of the archives used in these tests, keyed by name. Only the
+// deepest directory has an entry of its own.
+var archiveMembers = map[string]string{
+	"top.txt":       "taco",
+	"a/b/":          "",
+	"a/b/c.txt":     strings.Repeat("burrito", 10000),
+	"a/d.txt":       "enchilada",
+	"./a/e/f/g.txt": "queso",
+}
+
+func makeZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, contents := range archiveMembers {
+		// Store small members, so that both paths for reading are exercised.
+		method := zip.Deflate
+		if len(contents) < 10 {
+			method = zip.Store
+		}
+
+		f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatalf("CreateHeader: %v", err)
+		}
+
+		if _, err := f.Write([]byte(contents)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func makeTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for name, contents := range archiveMembers {
+		h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}
+		if strings.HasSuffix(name, "/") {
+			h.Typeflag = tar.TypeDir
+			h.Mode = 0755
+		}
+
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// Look up the inode at the given slash-separated path.
+func lookUpPath(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	p string) fuseops.ChildInodeEntry {
+	var e fuseops.ChildInodeEntry
+	e.Child = fuseops.RootInodeID
+	for _, name := range strings.Split(p, "/") {
+		op := &fuseops.LookUpInodeOp{Parent: e.Child, Name: name}
+		if err := fs.LookUpInode(context.Background(), op); err != nil {
+			t.Fatalf("LookUpInode(%q): %v", p, err)
+		}
+
+		e = op.Entry
+	}
+
+	return e
+}
+
+// Read the named file in pieces of the given size.
+func readArchiveFile(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	p string,
+	pieceSize int) string {
+	ctx := context.Background()
+	e := lookUpPath(t, fs, p)
+
+	openOp := &fuseops.OpenFileOp{Inode: e.Child}
+	if err := fs.OpenFile(ctx, openOp); err != nil {
+		t.Fatalf("OpenFile(%q): %v", p, err)
+	}
+
+	defer fs.ReleaseFileHandle(
+		ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	var contents []byte
+	for {
+		op := &fuseops.ReadFileOp{
+			Inode:  e.Child,
+			Handle: openOp.Handle,
+			Offset: int64(len(contents)),
+			Dst:    make([]byte, pieceSize),
+		}
+
+		if err := fs.ReadFile(ctx, op); err != nil {
+			t.Fatalf("ReadFile(%q): %v", p, err)
+		}
+
+		if op.BytesRead == 0 {
+			break
+		}
+
+		contents = append(contents, op.Dst[:op.BytesRead]...)
+	}
+
+	return string(contents)
+}
+
+func checkArchiveFileSystem(t *testing.T, fs fuseutil.FileSystem) {
+	// Each file should have the right size and contents.
+	files := map[string]string{
+		"top.txt":     archiveMembers["top.txt"],
+		"a/b/c.txt":   archiveMembers["a/b/c.txt"],
+		"a/d.txt":     archiveMembers["a/d.txt"],
+		"a/e/f/g.txt": archiveMembers["./a/e/f/g.txt"],
+	}
+
+	for p, expected := range files {
+		e := lookUpPath(t, fs, p)
+		if e.Attributes.Size != uint64(len(expected)) {
+			t.Errorf("%q: size %d", p, e.Attributes.Size)
+		}
+
+		if e.Attributes.Mode.Perm()&0222 != 0 {
+			t.Errorf("%q: writable mode %v", p, e.Attributes.Mode)
+		}
+
+		if got := readArchiveFile(t, fs, p, 4096); got != expected {
+			t.Errorf("%q: got %d bytes of contents", p, len(got))
+		}
+	}
+
+	// Directories should have been synthesized.
+	for _, p := range []string{"a", "a/b", "a/e", "a/e/f"} {
+		if e := lookUpPath(t, fs, p); !e.Attributes.Mode.IsDir() {
+			t.Errorf("%q: mode %v", p, e.Attributes.Mode)
+		}
+	}
+
+	// A read that goes backwards should still work.
+	ctx := context.Background()
+	e := lookUpPath(t, fs, "a/b/c.txt")
+	openOp := &fuseops.OpenFileOp{Inode: e.Child}
+	if err := fs.OpenFile(ctx, openOp); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	for _, offset := range []int64{7000, 14} {
+		op := &fuseops.ReadFileOp{
+			Inode:  e.Child,
+			Handle: openOp.Handle,
+			Offset: offset,
+			Dst:    make([]byte, 7),
+		}
+
+		if err := fs.ReadFile(ctx, op); err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+
+		if got := string(op.Dst[:op.BytesRead]); got != "burrito" {
+			t.Errorf("Offset %d: %q", offset, got)
+		}
+	}
+}
+
+func TestArchiveFileSystem_Zip(t *testing.T) {
+	b := makeZip(t)
+	fs, err := fuseutil.NewArchiveFileSystem(
+		bytes.NewReader(b),
+		int64(len(b)),
+		fuseutil.ArchiveZip)
+
+	if err != nil {
+		t.Fatalf("NewArchiveFileSystem: %v", err)
+	}
+
+	checkArchiveFileSystem(t, fs)
+}
+
+func TestArchiveFileSystem_Tar(t *testing.T) {
+	b := makeTar(t)
+	fs, err := fuseutil.NewArchiveFileSystem(
+		bytes.NewReader(b),
+		int64(len(b)),
+		fuseutil.ArchiveTar)
+
+	if err != nil {
+		t.Fatalf("NewArchiveFileSystem: %v", err)
+	}
+
+	checkArchiveFileSystem(t, fs)
+}
+
+func TestArchiveFileSystem_Mounted(t *testing.T) {
+	b := makeZip(t)
+	fs, err := fuseutil.NewArchiveFileSystem(
+		bytes.NewReader(b),
+		int64(len(b)),
+		fuseutil.ArchiveZip)
+
+	if err != nil {
+		t.Fatalf("NewArchiveFileSystem: %v", err)
+	}
+
+	dir := fusetesting.MountForTest(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{ReadOnly: true}).Dir()
+
+	// Read a nested member.
+	contents, err := ioutil.ReadFile(path.Join(dir, "a/b/c.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(contents) != archiveMembers["a/b/c.txt"] {
+		t.Errorf("Got %d bytes of contents", len(contents))
+	}
+
+	// List a synthesized directory.
+	entries, err := ioutil.ReadDir(path.Join(dir, "a"))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var names []string
+	for _, fi := range entries {
+		names = append(names, fi.Name())
+	}
+
+	sort.Strings(names)
+	if want := []string{"b", "d.txt", "e"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Got names %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// AuditRecord describes a mutating op handled by a file system wrapped with
+// NewAuditingFileSystem.
+type AuditRecord struct {
+	// When the op finished.
+	Time time.Time
+
+	// The op, e.g. "WriteFileOp".
+	Op fuse.OpType
+
+	// The process that asked for the op. Writes of dirty pages with writeback
+	// caching are made by the kernel on nobody's behalf, and have a zero Pid
+	// and Uid.
+	Context fuseops.OpContext
+
+	// The inode modified, or for ops on a name within a directory (creating,
+	// removing, and renaming), the directory and the name.
+	Inode fuseops.InodeID
+	Name  string
+
+	// A human-readable description of the change, e.g. "mode -rw-r--r--" or
+	// "4096 bytes at offset 0".
+	Detail string
+
+	// The error returned by the file system, or nil if the op succeeded. Ops
+	// refused with EACCES or EPERM are thus recorded as denied attempts.
+	Err error
+}
+
+// String formats the record as a single line for an audit log.
+func (r AuditRecord) String() string {
+	var b strings.Builder
+	fmt.Fprintf(
+		&b,
+		"%s uid=%d pid=%d %s inode=%d",
+		r.Time.Format(time.RFC3339Nano),
+		r.Context.Uid,
+		r.Context.Pid,
+		r.Op,
+		r.Inode)
+
+	if r.Name != "" {
+		fmt.Fprintf(&b, " name=%q", r.Name)
+	}
+
+	if r.Detail != "" {
+		fmt.Fprintf(&b, " (%s)", r.Detail)
+	}
+
+	if r.Err != nil {
+		fmt.Fprintf(&b, ": %v", r.Err)
+	} else {
+		b.WriteString(": ok")
+	}
+
+	return b.String()
+}
+
+// AuditSink receives the records of an auditing file system. Record may be
+// called concurrently, and blocks the op being recorded until it returns.
+type AuditSink interface {
+	Record(AuditRecord)
+}
+
+// NewAuditingFileSystem wraps the supplied file system, recording each op that
+// modifies it to the supplied sink once the op has finished: the ops that
+// create, remove, and rename names, write and allocate file contents, change
+// attributes (chmod, chown, truncate, and utimes), and set and remove
+// extended attributes. Ops that only read are passed through unrecorded.
+//
+// Ops that fail are recorded too, with their error. An op finished later with
+// ReplyLater is recorded when it is completed, with its real outcome.
+func NewAuditingFileSystem(fs FileSystem, sink AuditSink) FileSystem {
+	return &auditingFileSystem{
+		FileSystem: fs,
+		sink:       sink,
+	}
+}
+
+type auditingFileSystem struct {
+	// The wrapped file system, to which ops that aren't recorded go directly.
+	FileSystem
+
+	sink AuditSink
+}
+
+// Call f to handle the supplied op, and record the op's outcome once it has
+// finished, which may be after f returns if it uses ReplyLater. describe is
+// called with the outcome to supply the record's detail.
+func (fs *auditingFileSystem) audit(
+	ctx context.Context,
+	op interface{},
+	opCtx fuseops.OpContext,
+	inode fuseops.InodeID,
+	name string,
+	f func(context.Context) error,
+	describe func(err error) string) error {
+	return whenFinished(ctx, f, func(err error) {
+		fs.sink.Record(AuditRecord{
+			Time:    time.Now(),
+			Op:      fuse.OpTypeOf(op),
+			Context: opCtx,
+			Inode:   inode,
+			Name:    name,
+			Detail:  describe(err),
+			Err:     err,
+		})
+	})
+}
+
+// Return a describe function for audit that ignores the outcome, formatting
+// the detail now.
+func describeFixed(format string, args ...interface{}) func(error) string {
+	d := fmt.Sprintf(format, args...)
+	return func(error) string { return d }
+}
+
+// Describe the child created by an op, if it succeeded.
+func describeCreated(
+	detail string,
+	entry *fuseops.ChildInodeEntry) func(error) string {
+	return func(err error) string {
+		if err != nil {
+			return detail
+		}
+
+		return fmt.Sprintf("%s, inode %d", detail, entry.Child)
+	}
+}
+
+func (fs *auditingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	var changes []string
+	if op.Size != nil {
+		changes = append(changes, fmt.Sprintf("size %d", *op.Size))
+	}
+
+	if op.Mode != nil {
+		changes = append(changes, fmt.Sprintf("mode %v", *op.Mode))
+	}
+
+	if op.Uid != nil {
+		changes = append(changes, fmt.Sprintf("uid %d", *op.Uid))
+	}
+
+	if op.Gid != nil {
+		changes = append(changes, fmt.Sprintf("gid %d", *op.Gid))
+	}
+
+	if op.Atime != nil {
+		changes = append(changes, fmt.Sprintf("atime %v", op.Atime.Format(time.RFC3339Nano)))
+	}
+
+	if op.Mtime != nil {
+		changes = append(changes, fmt.Sprintf("mtime %v", op.Mtime.Format(time.RFC3339Nano)))
+	}
+
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Inode,
+		"",
+		func(ctx context.Context) error { return fs.FileSystem.SetInodeAttributes(ctx, op) },
+		describeFixed("%s", strings.Join(changes, ", ")))
+}
+
+func (fs *auditingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Parent,
+		op.Name,
+		func(ctx context.Context) error { return fs.FileSystem.MkDir(ctx, op) },
+		describeCreated(fmt.Sprintf("mode %v", op.Mode), &op.Entry))
+}
+
+func (fs *auditingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Parent,
+		op.Name,
+		func(ctx context.Context) error { return fs.FileSystem.MkNode(ctx, op) },
+		describeCreated(fmt.Sprintf("mode %v, rdev %#x", op.Mode, op.Rdev), &op.Entry))
+}
+
+func (fs *auditingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Parent,
+		op.Name,
+		func(ctx context.Context) error { return fs.FileSystem.CreateFile(ctx, op) },
+		describeCreated(fmt.Sprintf("mode %v", op.Mode), &op.Entry))
+}
+
+func (fs *auditingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Parent,
+		op.Name,
+		func(ctx context.Context) error { return fs.FileSystem.CreateLink(ctx, op) },
+		describeFixed("target inode %d", op.Target))
+}
+
+func (fs *auditingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Parent,
+		op.Name,
+		func(ctx context.Context) error { return fs.FileSystem.CreateSymlink(ctx, op) },
+		describeCreated(fmt.Sprintf("target %q", op.Target), &op.Entry))
+}
+
+func (fs *auditingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.OldParent,
+		op.OldName,
+		func(ctx context.Context) error { return fs.FileSystem.Rename(ctx, op) },
+		describeFixed("to %q in inode %d", op.NewName, op.NewParent))
+}
+
+func (fs *auditingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Parent,
+		op.Name,
+		func(ctx context.Context) error { return fs.FileSystem.RmDir(ctx, op) },
+		describeFixed(""))
+}
+
+func (fs *auditingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Parent,
+		op.Name,
+		func(ctx context.Context) error { return fs.FileSystem.Unlink(ctx, op) },
+		describeFixed(""))
+}
+
+func (fs *auditingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	// The data refers to the kernel's message, which may be reused once the
+	// op is replied to, so describe it first.
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Inode,
+		"",
+		func(ctx context.Context) error { return fs.FileSystem.WriteFile(ctx, op) },
+		describeFixed("%d bytes at offset %d", len(op.Data), op.Offset))
+}
+
+func (fs *auditingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Inode,
+		"",
+		func(ctx context.Context) error { return fs.FileSystem.SetXattr(ctx, op) },
+		describeFixed("xattr %q, %d bytes", op.Name, len(op.Value)))
+}
+
+func (fs *auditingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Inode,
+		"",
+		func(ctx context.Context) error { return fs.FileSystem.RemoveXattr(ctx, op) },
+		describeFixed("xattr %q", op.Name))
+}
+
+func (fs *auditingFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.Inode,
+		"",
+		func(ctx context.Context) error { return fs.FileSystem.Fallocate(ctx, op) },
+		describeFixed("mode %#x, %d bytes at offset %d", op.Mode, op.Length, op.Offset))
+}
+
+func (fs *auditingFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fs.audit(
+		ctx,
+		op,
+		op.OpContext,
+		op.InodeIn,
+		"",
+		func(ctx context.Context) error { return fs.FileSystem.CopyFileRange(ctx, op) },
+		func(error) string {
+			return fmt.Sprintf(
+				"%d of %d bytes at offset %d to inode %d at offset %d",
+				op.BytesCopied, op.Length, op.OffsetIn, op.InodeOut, op.OffsetOut)
+		})
+}
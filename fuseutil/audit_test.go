@@ -0,0 +1,262 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// auditedFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that answers reads, writes, and creations, and refuses to
+// remove anything.
+type auditedFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *auditedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 3
+	return nil
+}
+
+func (fs *auditedFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return nil
+}
+
+func (fs *auditedFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func (fs *auditedFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	op.Entry.Child = 4
+	return nil
+}
+
+func (fs *auditedFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return nil
+}
+
+func (fs *auditedFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return syscall.EACCES
+}
+
+// A file system whose writes are completed later, failing with ENOSPC once
+// release is closed.
+type asyncWriteFS struct {
+	fuseutil.NotImplementedFileSystem
+	release chan struct{}
+}
+
+func (fs *asyncWriteFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	complete := fuseutil.ReplyLater(ctx)
+	go func() {
+		<-fs.release
+		complete(syscall.ENOSPC)
+	}()
+
+	return fuseutil.ErrPending
+}
+
+////////////////////////////////////////////////////////////////////////
+// sliceSink
+////////////////////////////////////////////////////////////////////////
+
+type sliceSink struct {
+	mu      sync.Mutex
+	records []fuseutil.AuditRecord
+}
+
+func (s *sliceSink) Record(r fuseutil.AuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+}
+
+func (s *sliceSink) snapshot() []fuseutil.AuditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fuseutil.AuditRecord(nil), s.records...)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestAuditingFileSystem(t *testing.T) {
+	sink := &sliceSink{}
+	fs := fuseutil.NewAuditingFileSystem(&auditedFS{}, sink)
+	ctx := context.Background()
+
+	alice := fuseops.OpContext{Pid: 100, Uid: 1000}
+	bob := fuseops.OpContext{Pid: 200, Uid: 1001}
+	mode := os.FileMode(0600)
+
+	start := time.Now()
+	calls := []func() error{
+		func() error {
+			return fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{
+				Parent: 1, Name: "foo", OpContext: alice})
+		},
+		func() error {
+			return fs.CreateFile(ctx, &fuseops.CreateFileOp{
+				Parent: 1, Name: "bar", Mode: 0644, OpContext: alice})
+		},
+		func() error {
+			return fs.ReadFile(ctx, &fuseops.ReadFileOp{
+				Inode: 4, OpContext: bob})
+		},
+		func() error {
+			return fs.WriteFile(ctx, &fuseops.WriteFileOp{
+				Inode: 4, Offset: 512, Data: make([]byte, 11), OpContext: alice})
+		},
+		func() error {
+			return fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{
+				Inode: 4, Mode: &mode, OpContext: bob})
+		},
+		func() error {
+			return fs.Unlink(ctx, &fuseops.UnlinkOp{
+				Parent: 1, Name: "foo", OpContext: bob})
+		},
+	}
+
+	for _, call := range calls {
+		call()
+	}
+	end := time.Now()
+
+	type expected struct {
+		op      fuse.OpType
+		opCtx   fuseops.OpContext
+		inode   fuseops.InodeID
+		name    string
+		detail  string
+		errored bool
+	}
+
+	want := []expected{
+		{"CreateFileOp", alice, 1, "bar", "mode -rw-r--r--, inode 4", false},
+		{"WriteFileOp", alice, 4, "", "11 bytes at offset 512", false},
+		{"SetInodeAttributesOp", bob, 4, "", "mode -rw-------", false},
+		{"UnlinkOp", bob, 1, "foo", "", true},
+	}
+
+	if len(sink.records) != len(want) {
+		t.Fatalf("Got %d records, want %d: %v", len(sink.records), len(want), sink.records)
+	}
+
+	for i, w := range want {
+		r := sink.records[i]
+		if r.Op != w.op ||
+			r.Context != w.opCtx ||
+			r.Inode != w.inode ||
+			r.Name != w.name ||
+			r.Detail != w.detail {
+			t.Errorf("Record %d: got %v, want %+v", i, r, w)
+		}
+
+		if (r.Err != nil) != w.errored {
+			t.Errorf("Record %d: got error %v, want error: %v", i, r.Err, w.errored)
+		}
+
+		if r.Time.Before(start) || r.Time.After(end) {
+			t.Errorf("Record %d: time %v not within [%v, %v]", i, r.Time, start, end)
+		}
+	}
+
+	if err := sink.records[3].Err; err != syscall.EACCES {
+		t.Errorf("Got error %v, want EACCES", err)
+	}
+}
+
+func TestAuditingFileSystem_ReplyLater(t *testing.T) {
+	sink := &sliceSink{}
+	fs := &asyncWriteFS{release: make(chan struct{})}
+	kernel, hangUp := serveOverSocket(t, fuseutil.NewAuditingFileSystem(fs, sink))
+	defer hangUp()
+
+	req := rawRequest(
+		2,
+		fusekernel.OpWrite,
+		4,
+		fusekernel.WriteIn{Offset: 512, Size: 11},
+		make([]byte, 11))
+
+	if _, err := kernel.Write(req); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// Nothing should be recorded until the write has been completed.
+	time.Sleep(10 * time.Millisecond)
+	if records := sink.snapshot(); len(records) != 0 {
+		t.Fatalf("Recorded before completion: %v", records)
+	}
+
+	close(fs.release)
+
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	var h fusekernel.OutHeader
+	binary.Read(bytes.NewReader(buf[:n]), binary.LittleEndian, &h)
+	if h.Unique != 2 || h.Error != -int32(syscall.ENOSPC) {
+		t.Errorf("Unexpected response: %+v", h)
+	}
+
+	// The record is made before the reply, with the write's real outcome.
+	records := sink.snapshot()
+	if len(records) != 1 {
+		t.Fatalf("Got %d records, want 1: %v", len(records), records)
+	}
+
+	r := records[0]
+	if r.Op != "WriteFileOp" || r.Inode != 4 || r.Detail != "11 bytes at offset 512" {
+		t.Errorf("Unexpected record: %v", r)
+	}
+
+	if r.Err != syscall.ENOSPC {
+		t.Errorf("Got error %v, want ENOSPC", r.Err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// Cache is a concurrency-safe cache of bounded size whose entries expire, for
+// file systems that cache lookups, attributes, directory listings, and the
+// like from a slow backend. When full, the least recently used entry is
+// evicted to make room for a new one.
+//
+// Keys may be of any comparable type, as for map keys, and values of any type.
+// They are held as interface{} rather than as type parameters because this
+// module supports Go versions that predate generics, so callers type-assert
+// the values they get back.
+type Cache struct {
+	capacity int
+	clock    timeutil.Clock
+
+	mu sync.Mutex
+
+	// The entries, with the most recently used at the front of the list, and an
+	// index into the list by key.
+	//
+	// INVARIANT: len(index) == entries.Len() <= capacity
+	//
+	// GUARDED_BY(mu)
+	entries *list.List
+	index   map[interface{}]*list.Element
+}
+
+type cacheEntry struct {
+	key        interface{}
+	value      interface{}
+	expiration time.Time
+}
+
+// NewCache returns an empty cache holding at most the given number of
+// entries, which must be positive. Expiry is judged using the supplied clock,
+// or the real clock if it is nil.
+func NewCache(capacity int, clock timeutil.Clock) *Cache {
+	if capacity <= 0 {
+		panic("NewCache: capacity must be positive")
+	}
+
+	if clock == nil {
+		clock = timeutil.RealClock()
+	}
+
+	return &Cache{
+		capacity: capacity,
+		clock:    clock,
+		entries:  list.New(),
+		index:    make(map[interface{}]*list.Element),
+	}
+}
+
+// Get returns the value for the supplied key, if present and not expired,
+// marking it as recently used.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if !c.clock.Now().Before(entry.expiration) {
+		c.remove(e)
+		return nil, false
+	}
+
+	c.entries.MoveToFront(e)
+	return entry.value, true
+}
+
+// Set stores the value for the supplied key, to expire after the given time,
+// evicting the least recently used entry if the cache is full. As with the
+// cache expirations in fuseops, a non-positive TTL means not to cache: any
+// existing entry for the key is removed instead.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Cache) Set(key interface{}, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.index[key]
+	if ttl <= 0 {
+		if ok {
+			c.remove(e)
+		}
+
+		return
+	}
+
+	entry := &cacheEntry{
+		key:        key,
+		value:      value,
+		expiration: c.clock.Now().Add(ttl),
+	}
+
+	if ok {
+		e.Value = entry
+		c.entries.MoveToFront(e)
+		return
+	}
+
+	if c.entries.Len() >= c.capacity {
+		c.remove(c.entries.Back())
+	}
+
+	c.index[key] = c.entries.PushFront(entry)
+}
+
+// Delete removes any entry for the supplied key.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Cache) Delete(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.index[key]; ok {
+		c.remove(e)
+	}
+}
+
+// Len returns the number of entries in the cache, including any that have
+// expired but not yet been removed.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.entries.Len()
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) remove(e *list.Element) {
+	c.entries.Remove(e)
+	delete(c.index, e.Value.(*cacheEntry).key)
+}
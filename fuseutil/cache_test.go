@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCache_Expiry(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	c := fuseutil.NewCache(10, clock)
+	c.Set("taco", 1, time.Second)
+	c.Set("burrito", 2, time.Minute)
+	c.Set("enchilada", 3, 0)
+
+	if v, ok := c.Get("taco"); !ok || v != 1 {
+		t.Errorf("taco: %v, %v", v, ok)
+	}
+
+	if _, ok := c.Get("enchilada"); ok {
+		t.Error("Entry with zero TTL was cached")
+	}
+
+	// After a second, only the longer-lived entry should remain.
+	clock.AdvanceTime(time.Second)
+	if _, ok := c.Get("taco"); ok {
+		t.Error("taco didn't expire")
+	}
+
+	if v, ok := c.Get("burrito"); !ok || v != 2 {
+		t.Errorf("burrito: %v, %v", v, ok)
+	}
+
+	// Setting an entry again should extend its life.
+	c.Set("burrito", 4, time.Minute)
+	clock.AdvanceTime(59 * time.Second)
+	if v, ok := c.Get("burrito"); !ok || v != 4 {
+		t.Errorf("burrito after refreshing: %v, %v", v, ok)
+	}
+
+	// Setting it with a zero TTL should remove it.
+	c.Set("burrito", 5, 0)
+	if _, ok := c.Get("burrito"); ok || c.Len() != 0 {
+		t.Errorf("burrito still present; %d entries", c.Len())
+	}
+}
+
+func TestCache_Eviction(t *testing.T) {
+	c := fuseutil.NewCache(3, nil)
+	for _, k := range []string{"a", "b", "c"} {
+		c.Set(k, k, time.Hour)
+	}
+
+	// Use a, making b the least recently used, then add d.
+	c.Get("a")
+	c.Set("d", "d", time.Hour)
+
+	present := func(k string) bool {
+		_, ok := c.Get(k)
+		return ok
+	}
+
+	if present("b") {
+		t.Error("b wasn't evicted")
+	}
+
+	// The order of use is now a, c, d (from least to most recent). Deleting c
+	// makes room without evicting anything.
+	c.Delete("c")
+	c.Set("e", "e", time.Hour)
+	for _, k := range []string{"a", "d", "e"} {
+		if !present(k) {
+			t.Errorf("%s was evicted", k)
+		}
+	}
+
+	// Now a is the least recently used.
+	c.Set("f", "f", time.Hour)
+	if present("a") {
+		t.Error("a wasn't evicted")
+	}
+
+	if c.Len() != 3 {
+		t.Errorf("Len: %d", c.Len())
+	}
+}
+
+func TestCache_Concurrency(t *testing.T) {
+	const (
+		workers  = 16
+		keys     = 100
+		capacity = 50
+	)
+
+	c := fuseutil.NewCache(capacity, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				k := (i*31 + j) % keys
+				switch j % 3 {
+				case 0:
+					c.Set(k, fmt.Sprint(k), time.Hour)
+				case 1:
+					if v, ok := c.Get(k); ok && v != fmt.Sprint(k) {
+						t.Errorf("Key %d: %v", k, v)
+					}
+				case 2:
+					c.Delete(k + 1)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if n := c.Len(); n > capacity {
+		t.Errorf("Len: %d", n)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// How long the kernel may cache inodes in ImmutableTier: long enough to be
+// forever in practice, but not so long as to overflow an expiration time.
+const ImmutableTimeout = 365 * 24 * time.Hour
+
+// A CacheTier says how long the kernel may cache the attributes of an inode,
+// and the directory entries that name it.
+type CacheTier struct {
+	AttributesTimeout time.Duration
+	EntryTimeout      time.Duration
+}
+
+var (
+	// For inodes that may change at any moment by means the kernel doesn't
+	// observe, such as mutable metadata fetched from a backend. Nothing is
+	// cached, so every stat(2) and path lookup reaches the file system.
+	VolatileTier = CacheTier{}
+
+	// For virtual files whose attributes are recomputed on every access, such
+	// as status or metrics files like those in /proc. The name is cached as
+	// usual, but the attributes never are, so that every stat(2) reaches
+	// GetInodeAttributes.
+	//
+	// Each stat of such a file then costs a round trip to the file system, as
+	// does every read that needs the file's size, so reserve this for files
+	// that are actually read that way. Note too that with writeback caching
+	// (see MountConfig.DisableWritebackCaching) the kernel keeps its own size
+	// and mtime for regular files, ignoring those returned; and that a file
+	// whose size isn't known until it is read should be opened with
+	// OpenFileOp.UseDirectIO.
+	UncachedAttributesTier = CacheTier{
+		EntryTimeout: DefaultEntryTimeout,
+	}
+
+	// The timeouts used by NewChildInodeEntry by default.
+	DefaultTier = CacheTier{
+		AttributesTimeout: DefaultAttributesTimeout,
+		EntryTimeout:      DefaultEntryTimeout,
+	}
+
+	// For inodes that never change once they exist, such as content-addressed
+	// blobs. Nothing needs to be looked up again.
+	ImmutableTier = CacheTier{
+		AttributesTimeout: ImmutableTimeout,
+		EntryTimeout:      ImmutableTimeout,
+	}
+)
+
+// WithCacheTier sets both timeouts of the entry built by NewChildInodeEntry
+// from the supplied tier.
+func WithCacheTier(t CacheTier) EntryOption {
+	return func(c *entryConfig) {
+		c.attributesTimeout = t.AttributesTimeout
+		c.entryTimeout = t.EntryTimeout
+	}
+}
+
+// Replace whatever expiration the file system chose for the entry with the
+// tier's timeouts.
+func (t CacheTier) applyToEntry(e *fuseops.ChildInodeEntry) {
+	e.AttributesExpiration = time.Time{}
+	e.AttributesValidity = t.AttributesTimeout
+	e.EntryExpiration = time.Time{}
+	e.EntryValidity = t.EntryTimeout
+}
+
+// Replace whatever expiration the file system chose for the attributes of an
+// op with the tier's attributes timeout.
+func (t CacheTier) applyToAttributes(
+	expiration *time.Time,
+	validity *time.Duration) {
+	*expiration = time.Time{}
+	*validity = t.AttributesTimeout
+}
+
+// NewCacheTieringFileSystem wraps the supplied file system, setting the cache
+// timeouts in each successful reply that describes an inode from the tier
+// chosen for it by classify, in place of those set by the wrapped file system.
+// This lets a file system whose inodes differ in how often they change, e.g.
+// one serving both content-addressed blobs (ImmutableTier) and mutable
+// metadata about them (VolatileTier), keep the choice of timeouts in one
+// place rather than in each op that returns attributes or entries.
+//
+// classify is given the inode's attributes as the file system returned them,
+// and may be called concurrently. Entries returned by ReadDirPlus are already
+// serialized, and keep the timeouts the file system gave them.
+func NewCacheTieringFileSystem(
+	fs FileSystem,
+	classify func(fuseops.InodeID, fuseops.InodeAttributes) CacheTier) FileSystem {
+	return &cacheTieringFileSystem{
+		FileSystem: fs,
+		classify:   classify,
+	}
+}
+
+type cacheTieringFileSystem struct {
+	// The wrapped file system, to which ops that don't describe inodes go
+	// directly.
+	FileSystem
+
+	classify func(fuseops.InodeID, fuseops.InodeAttributes) CacheTier
+}
+
+// Set the timeouts for the supplied entry, unless the op that returned it
+// failed.
+func (fs *cacheTieringFileSystem) tierEntry(
+	e *fuseops.ChildInodeEntry,
+	err error) error {
+	// A lookup may also succeed with a zero child ID, caching the absence of
+	// the name, in which case there is no inode to classify and the file
+	// system's choice stands.
+	if err == nil && e.Child != 0 {
+		fs.classify(e.Child, e.Attributes).applyToEntry(e)
+	}
+
+	return err
+}
+
+func (fs *cacheTieringFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.tierEntry(&op.Entry, fs.FileSystem.LookUpInode(ctx, op))
+}
+
+func (fs *cacheTieringFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	err := fs.FileSystem.GetInodeAttributes(ctx, op)
+	if err == nil {
+		fs.classify(op.Inode, op.Attributes).applyToAttributes(
+			&op.AttributesExpiration,
+			&op.AttributesValidity)
+	}
+
+	return err
+}
+
+func (fs *cacheTieringFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	err := fs.FileSystem.SetInodeAttributes(ctx, op)
+	if err == nil {
+		fs.classify(op.Inode, op.Attributes).applyToAttributes(
+			&op.AttributesExpiration,
+			&op.AttributesValidity)
+	}
+
+	return err
+}
+
+func (fs *cacheTieringFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.tierEntry(&op.Entry, fs.FileSystem.MkDir(ctx, op))
+}
+
+func (fs *cacheTieringFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.tierEntry(&op.Entry, fs.FileSystem.MkNode(ctx, op))
+}
+
+func (fs *cacheTieringFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.tierEntry(&op.Entry, fs.FileSystem.CreateFile(ctx, op))
+}
+
+func (fs *cacheTieringFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.tierEntry(&op.Entry, fs.FileSystem.CreateSymlink(ctx, op))
+}
+
+func (fs *cacheTieringFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.tierEntry(&op.Entry, fs.FileSystem.CreateLink(ctx, op))
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// tieredFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system with an immutable file named "blob", a volatile one named
+// "meta", and a status file named "status" in the root, which asks for
+// everything to be cached for a minute.
+type tieredFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu       sync.Mutex
+	getattrs map[fuseops.InodeID]int // GUARDED_BY(mu)
+}
+
+const (
+	tieredBlobID   = fuseops.RootInodeID + 1
+	tieredMetaID   = fuseops.RootInodeID + 2
+	tieredStatusID = fuseops.RootInodeID + 3
+)
+
+func (fs *tieredFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	switch op.Name {
+	case "blob":
+		op.Entry.Child = tieredBlobID
+	case "meta":
+		op.Entry.Child = tieredMetaID
+	case "status":
+		op.Entry.Child = tieredStatusID
+	default:
+		return fuse.ENOENT
+	}
+
+	op.Entry.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0444}
+	op.Entry.AttributesExpiration = time.Now().Add(time.Minute)
+	op.Entry.EntryExpiration = time.Now().Add(time.Minute)
+	return nil
+}
+
+func (fs *tieredFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.getattrs == nil {
+		fs.getattrs = make(map[fuseops.InodeID]int)
+	}
+
+	fs.getattrs[op.Inode]++
+
+	mode := os.FileMode(0444)
+	if op.Inode == fuseops.RootInodeID {
+		mode = os.ModeDir | 0555
+	}
+
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: mode}
+	op.AttributesValidity = time.Minute
+	return nil
+}
+
+func classifyTiered(
+	inode fuseops.InodeID,
+	attrs fuseops.InodeAttributes) fuseutil.CacheTier {
+	switch inode {
+	case tieredBlobID:
+		return fuseutil.ImmutableTier
+	case tieredStatusID:
+		return fuseutil.UncachedAttributesTier
+	}
+
+	return fuseutil.VolatileTier
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestCacheTieringFileSystem(t *testing.T) {
+	fs := fuseutil.NewCacheTieringFileSystem(&tieredFS{}, classifyTiered)
+	trace := []fusetesting.RawRequest{
+		initRequest(),
+		rawRequest(2, fusekernel.OpLookup, uint64(fuseops.RootInodeID), []byte("blob\x00")),
+		rawRequest(3, fusekernel.OpLookup, uint64(fuseops.RootInodeID), []byte("meta\x00")),
+		rawRequest(4, fusekernel.OpLookup, uint64(fuseops.RootInodeID), []byte("status\x00")),
+		rawRequest(5, fusekernel.OpGetattr, uint64(tieredBlobID), fusekernel.GetattrIn{}),
+		rawRequest(6, fusekernel.OpGetattr, uint64(tieredMetaID), fusekernel.GetattrIn{}),
+		rawRequest(7, fusekernel.OpGetattr, uint64(tieredStatusID), fusekernel.GetattrIn{}),
+	}
+
+	responses, err := fusetesting.ReplayTrace(fs, trace)
+	if err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+
+	if len(responses) != len(trace) {
+		t.Fatalf("Got %d responses, want %d", len(responses), len(trace))
+	}
+
+	const hdr = unsafe.Sizeof(fusekernel.OutHeader{})
+	immutable := uint64(fuseutil.ImmutableTimeout / time.Second)
+
+	// Lookups.
+	defaultEntry := uint64(fuseutil.DefaultEntryTimeout / time.Second)
+	for i, want := range []struct{ entry, attrs uint64 }{
+		{immutable, immutable},
+		{0, 0},
+		{defaultEntry, 0},
+	} {
+		resp := responses[1+i]
+		if uintptr(len(resp)) < hdr+unsafe.Sizeof(fusekernel.EntryOut{}) {
+			t.Fatalf("Lookup %d: short response of %d bytes", i, len(resp))
+		}
+
+		out := (*fusekernel.EntryOut)(unsafe.Pointer(&resp[hdr]))
+		if out.EntryValid != want.entry || out.EntryValidNsec != 0 {
+			t.Errorf("Lookup %d: entry valid for %d.%09ds, want %ds", i, out.EntryValid, out.EntryValidNsec, want.entry)
+		}
+
+		if out.AttrValid != want.attrs || out.AttrValidNsec != 0 {
+			t.Errorf("Lookup %d: attributes valid for %d.%09ds, want %ds", i, out.AttrValid, out.AttrValidNsec, want.attrs)
+		}
+	}
+
+	// Getattrs.
+	for i, want := range []uint64{immutable, 0, 0} {
+		resp := responses[4+i]
+		if uintptr(len(resp)) < hdr+unsafe.Sizeof(fusekernel.AttrOut{}) {
+			t.Fatalf("Getattr %d: short response of %d bytes", i, len(resp))
+		}
+
+		out := (*fusekernel.AttrOut)(unsafe.Pointer(&resp[hdr]))
+		if out.AttrValid != want || out.AttrValidNsec != 0 {
+			t.Errorf("Getattr %d: attributes valid for %d.%09ds, want %ds", i, out.AttrValid, out.AttrValidNsec, want)
+		}
+	}
+}
+
+func TestNewChildInodeEntry_CacheTier(t *testing.T) {
+	e, err := fuseutil.NewChildInodeEntry(
+		17,
+		fuseops.InodeAttributes{},
+		fuseutil.WithCacheTier(fuseutil.ImmutableTier))
+
+	if err != nil {
+		t.Fatalf("NewChildInodeEntry: %v", err)
+	}
+
+	if e.AttributesValidity != fuseutil.ImmutableTimeout || e.EntryValidity != fuseutil.ImmutableTimeout {
+		t.Errorf("Validities: %v, %v", e.AttributesValidity, e.EntryValidity)
+	}
+
+	e, err = fuseutil.NewChildInodeEntry(
+		17,
+		fuseops.InodeAttributes{},
+		fuseutil.WithCacheTier(fuseutil.VolatileTier))
+
+	if err != nil {
+		t.Fatalf("NewChildInodeEntry: %v", err)
+	}
+
+	if e.AttributesValidity != 0 || e.EntryValidity != 0 {
+		t.Errorf("Validities: %v, %v", e.AttributesValidity, e.EntryValidity)
+	}
+}
+
+func TestUncachedAttributesTier_Mounted(t *testing.T) {
+	fs := &tieredFS{}
+	dir := fusetesting.MountForTest(
+		t,
+		fuseutil.NewFileSystemServer(
+			fuseutil.NewCacheTieringFileSystem(fs, classifyTiered)),
+		&fuse.MountConfig{}).Dir()
+
+	getattrs := func(inode fuseops.InodeID) int {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return fs.getattrs[inode]
+	}
+
+	// Every stat of the status file reaches the file system, while the blob's
+	// attributes come from the lookup and are cached from then on.
+	for i := 0; i < 5; i++ {
+		before := getattrs(tieredStatusID)
+		if _, err := os.Stat(path.Join(dir, "status")); err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+
+		if getattrs(tieredStatusID) == before {
+			t.Fatalf("Stat %d didn't call GetInodeAttributes", i)
+		}
+
+		if _, err := os.Stat(path.Join(dir, "blob")); err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+	}
+
+	if n := getattrs(tieredBlobID); n != 0 {
+		t.Errorf("GetInodeAttributes called %d times for the blob", n)
+	}
+}
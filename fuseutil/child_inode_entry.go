@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The cache timeouts used by NewChildInodeEntry unless overridden. These match
+// the defaults used by libfuse.
+const (
+	DefaultAttributesTimeout = time.Second
+	DefaultEntryTimeout      = time.Second
+)
+
+// An EntryOption customizes the ChildInodeEntry built by NewChildInodeEntry.
+type EntryOption func(*entryConfig)
+
+type entryConfig struct {
+	generation        fuseops.GenerationNumber
+	attributesTimeout time.Duration
+	entryTimeout      time.Duration
+}
+
+// WithGeneration sets the generation number for the entry. See notes on
+// fuseops.GenerationNumber.
+func WithGeneration(g fuseops.GenerationNumber) EntryOption {
+	return func(c *entryConfig) { c.generation = g }
+}
+
+// WithAttributesTimeout sets how long the kernel may cache the entry's
+// attributes. Zero disables caching.
+func WithAttributesTimeout(d time.Duration) EntryOption {
+	return func(c *entryConfig) { c.attributesTimeout = d }
+}
+
+// WithEntryTimeout sets how long the kernel may cache the name to inode mapping
+// described by the entry. Zero disables caching.
+func WithEntryTimeout(d time.Duration) EntryOption {
+	return func(c *entryConfig) { c.entryTimeout = d }
+}
+
+// NewChildInodeEntry builds a fuseops.ChildInodeEntry for the given child inode
+// and its attributes, filling in the remaining fields consistently.
+//
+// Unless overridden by the supplied options, the generation number is zero and
+// both the attributes and the entry may be cached by the kernel for one second.
+// The timeouts are set as the entry's validity durations, so they are measured
+// from when the reply is sent, using MountConfig.Clock. If attrs.Nlink is zero
+// it is set to one, since a zero link count tells the kernel that the inode
+// has been unlinked.
+//
+// An error is returned if the inode ID is zero, which the kernel reserves, or
+// if either timeout is negative.
+func NewChildInodeEntry(
+	inode fuseops.InodeID,
+	attrs fuseops.InodeAttributes,
+	opts ...EntryOption) (e fuseops.ChildInodeEntry, err error) {
+	cfg := entryConfig{
+		attributesTimeout: DefaultAttributesTimeout,
+		entryTimeout:      DefaultEntryTimeout,
+	}
+
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	// Validate.
+	if inode == 0 {
+		err = errors.New("Inode ID 0 is reserved")
+		return
+	}
+
+	if cfg.attributesTimeout < 0 {
+		err = fmt.Errorf("Negative attributes timeout: %v", cfg.attributesTimeout)
+		return
+	}
+
+	if cfg.entryTimeout < 0 {
+		err = fmt.Errorf("Negative entry timeout: %v", cfg.entryTimeout)
+		return
+	}
+
+	// Fill in the entry.
+	if attrs.Nlink == 0 {
+		attrs.Nlink = 1
+	}
+
+	e = fuseops.ChildInodeEntry{
+		Child:              inode,
+		Generation:         cfg.generation,
+		Attributes:         attrs,
+		AttributesValidity: cfg.attributesTimeout,
+		EntryValidity:      cfg.entryTimeout,
+	}
+
+	return
+}
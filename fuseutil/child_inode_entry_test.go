@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/convert"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+// Convert an entry as it would be for a reply sent at the clock's current
+// time.
+func entryOut(
+	clock timeutil.Clock,
+	e fuseops.ChildInodeEntry) (out fusekernel.EntryOut) {
+	convert.ChildInodeEntry(clock.Now(), &e, &out)
+	return
+}
+
+func TestNewChildInodeEntry_Defaults(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	e, err := fuseutil.NewChildInodeEntry(17, fuseops.InodeAttributes{Size: 19})
+	if err != nil {
+		t.Fatalf("NewChildInodeEntry: %v", err)
+	}
+
+	if e.Child != 17 {
+		t.Errorf("Child: %v", e.Child)
+	}
+
+	if e.Generation != 0 {
+		t.Errorf("Generation: %v", e.Generation)
+	}
+
+	if e.Attributes.Size != 19 || e.Attributes.Nlink != 1 {
+		t.Errorf("Attributes: %s", e.Attributes.DebugString())
+	}
+
+	// Both should be valid for a second from when the reply is sent, however
+	// long after the entry was built that is.
+	clock.AdvanceTime(time.Hour)
+	out := entryOut(&clock, e)
+
+	if out.AttrValid != 1 || out.AttrValidNsec != 0 {
+		t.Errorf("Attributes valid for %d s %d ns", out.AttrValid, out.AttrValidNsec)
+	}
+
+	if out.EntryValid != 1 || out.EntryValidNsec != 0 {
+		t.Errorf("Entry valid for %d s %d ns", out.EntryValid, out.EntryValidNsec)
+	}
+}
+
+func TestNewChildInodeEntry_Options(t *testing.T) {
+	e, err := fuseutil.NewChildInodeEntry(
+		17,
+		fuseops.InodeAttributes{Nlink: 3},
+		fuseutil.WithGeneration(23),
+		fuseutil.WithAttributesTimeout(0),
+		fuseutil.WithEntryTimeout(time.Hour))
+
+	if err != nil {
+		t.Fatalf("NewChildInodeEntry: %v", err)
+	}
+
+	if e.Generation != 23 {
+		t.Errorf("Generation: %v", e.Generation)
+	}
+
+	if e.Attributes.Nlink != 3 {
+		t.Errorf("Nlink: %v", e.Attributes.Nlink)
+	}
+
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	out := entryOut(&clock, e)
+
+	if out.AttrValid != 0 || out.AttrValidNsec != 0 {
+		t.Errorf("Attributes valid for %d s %d ns", out.AttrValid, out.AttrValidNsec)
+	}
+
+	if out.EntryValid != 3600 || out.EntryValidNsec != 0 {
+		t.Errorf("Entry valid for %d s %d ns", out.EntryValid, out.EntryValidNsec)
+	}
+}
+
+func TestNewChildInodeEntry_Invalid(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		inode fuseops.InodeID
+		opts  []fuseutil.EntryOption
+	}{
+		{"zero inode", 0, nil},
+		{"negative attributes timeout", 17, []fuseutil.EntryOption{
+			fuseutil.WithAttributesTimeout(-time.Second),
+		}},
+		{"negative entry timeout", 17, []fuseutil.EntryOption{
+			fuseutil.WithEntryTimeout(-time.Second),
+		}},
+	}
+
+	for _, tc := range testCases {
+		_, err := fuseutil.NewChildInodeEntry(
+			tc.inode,
+			fuseops.InodeAttributes{},
+			tc.opts...)
+
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.desc)
+		}
+	}
+}
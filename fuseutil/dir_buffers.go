@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// DirBuffers serves directory reads for directories whose contents rarely
+// change from a copy of each one's listing serialized in advance, so that a
+// ReadDirOp costs a single copy rather than a call to WriteDirent per entry.
+//
+// The copy for a directory is built the first time it is read, and again
+// whenever it is read with a different version than the copy was built for.
+// A file system thus passes a version that changes whenever the directory
+// does, such as a generation number or the directory's mtime, or calls
+// Invalidate when it modifies the directory.
+//
+// A file system uses it by calling Read from ReadDir. The zero value is ready
+// to use.
+type DirBuffers struct {
+	mu sync.Mutex
+
+	// The serialized listing of each directory read so far.
+	//
+	// GUARDED_BY(mu)
+	dirs map[fuseops.InodeID]*dirBuffer
+}
+
+// The serialized listing of a directory. It is never modified once built.
+type dirBuffer struct {
+	version uint64
+
+	// The entries, serialized by WriteDirent back to back.
+	buf []byte
+
+	// starts[i] is the position in buf of the entry with index i, i.e. the one
+	// following offset i. The final element is len(buf).
+	starts []int
+}
+
+// Read fills op.Dst with entries of the directory op.Inode starting at
+// op.Offset, from the copy built for the given version. If there is no such
+// copy, one is built from the entries returned by list, which should be the
+// full contents of the directory, in the order in which they are to be read.
+// Their Offset fields are ignored; DirBuffers assigns its own.
+//
+// It returns EINVAL if op.Offset is beyond the end of the directory, and
+// otherwise any error from list.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *DirBuffers) Read(
+	op *fuseops.ReadDirOp,
+	version uint64,
+	list func() ([]Dirent, error)) error {
+	b.mu.Lock()
+	d := b.dirs[op.Inode]
+	b.mu.Unlock()
+
+	// Build a new copy if necessary. Concurrent reads may each build one; the
+	// last to finish wins.
+	if d == nil || d.version != version {
+		entries, err := list()
+		if err != nil {
+			return err
+		}
+
+		d = newDirBuffer(version, entries)
+
+		b.mu.Lock()
+		if b.dirs == nil {
+			b.dirs = make(map[fuseops.InodeID]*dirBuffer)
+		}
+
+		b.dirs[op.Inode] = d
+		b.mu.Unlock()
+	}
+
+	// The copy is never modified, so there is no need to hold the lock while
+	// reading from it.
+	if op.Offset > fuseops.DirOffset(len(d.starts)-1) {
+		return fuse.EINVAL
+	}
+
+	// Find the end of the last whole entry that fits.
+	start := d.starts[op.Offset]
+	rest := d.starts[op.Offset+1:]
+	n := sort.Search(len(rest), func(i int) bool { return rest[i]-start > len(op.Dst) })
+	if n == 0 {
+		return nil
+	}
+
+	op.BytesRead = copy(op.Dst, d.buf[start:rest[n-1]])
+	return nil
+}
+
+// Invalidate discards the copy of the listing for the supplied directory, so
+// that the next read builds a new one whatever its version.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *DirBuffers) Invalidate(inode fuseops.InodeID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.dirs, inode)
+}
+
+func newDirBuffer(version uint64, entries []Dirent) *dirBuffer {
+	// Each entry is a 24-byte header followed by its name, padded to a multiple
+	// of eight bytes.
+	size := 0
+	for _, e := range entries {
+		size += (24 + len(e.Name) + 7) &^ 7
+	}
+
+	d := &dirBuffer{
+		version: version,
+		buf:     make([]byte, size),
+		starts:  make([]int, 0, len(entries)+1),
+	}
+
+	pos := 0
+	for i, e := range entries {
+		e.Offset = fuseops.DirOffset(i + 1)
+		d.starts = append(d.starts, pos)
+		pos += WriteDirent(d.buf[pos:], e)
+	}
+
+	d.starts = append(d.starts, pos)
+	return d
+}
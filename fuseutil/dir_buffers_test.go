@@ -0,0 +1,209 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Read the whole of the directory with the supplied inode from b, in reads of
+// the given size, returning the names seen.
+func readAllBuffered(
+	t testing.TB,
+	b *fuseutil.DirBuffers,
+	inode fuseops.InodeID,
+	size int,
+	version uint64,
+	list func() ([]fuseutil.Dirent, error)) (names []string) {
+	var offset fuseops.DirOffset
+	for {
+		op := &fuseops.ReadDirOp{Inode: inode, Offset: offset, Dst: make([]byte, size)}
+		if err := b.Read(op, version, list); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		if op.BytesRead == 0 {
+			return names
+		}
+
+		batch, last := parseDirents(op.Dst[:op.BytesRead])
+		names = append(names, batch...)
+		offset = last
+	}
+}
+
+func TestDirBuffers(t *testing.T) {
+	var b fuseutil.DirBuffers
+
+	calls := 0
+	contents := []string{"a", "b", "long_enough_to_span_two_words", "d"}
+	list := func() ([]fuseutil.Dirent, error) {
+		calls++
+		return dirents(contents...), nil
+	}
+
+	// Read the directory a couple of entries at a time, twice. Only the first
+	// read should list it.
+	for i := 0; i < 2; i++ {
+		names := readAllBuffered(t, &b, fuseops.RootInodeID, 64, 1, list)
+		if !reflect.DeepEqual(names, contents) {
+			t.Errorf("Read %d: got %q, want %q", i, names, contents)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("Listed %d times, want 1", calls)
+	}
+
+	// The buffer should be byte for byte what WriteDirent would produce.
+	op := &fuseops.ReadDirOp{Inode: fuseops.RootInodeID, Dst: make([]byte, 4096)}
+	if err := b.Read(op, 1, list); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	var expected []byte
+	for i, e := range dirents(contents...) {
+		e.Offset = fuseops.DirOffset(i + 1)
+		buf := make([]byte, 64)
+		expected = append(expected, buf[:fuseutil.WriteDirent(buf, e)]...)
+	}
+
+	if got := op.Dst[:op.BytesRead]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Serialized:\n%x\nwant\n%x", got, expected)
+	}
+
+	// A buffer too small for the next entry gets nothing.
+	op = &fuseops.ReadDirOp{Inode: fuseops.RootInodeID, Offset: 2, Dst: make([]byte, 32)}
+	if err := b.Read(op, 1, list); err != nil || op.BytesRead != 0 {
+		t.Errorf("Small read: got (%d, %v)", op.BytesRead, err)
+	}
+
+	// A new version is listed again.
+	contents = []string{"a", "e"}
+	if names := readAllBuffered(t, &b, fuseops.RootInodeID, 64, 2, list); !reflect.DeepEqual(names, contents) {
+		t.Errorf("New version: got %q, want %q", names, contents)
+	}
+
+	if calls != 2 {
+		t.Errorf("Listed %d times, want 2", calls)
+	}
+
+	// As is the same version once invalidated.
+	b.Invalidate(fuseops.RootInodeID)
+	readAllBuffered(t, &b, fuseops.RootInodeID, 64, 2, list)
+	if calls != 3 {
+		t.Errorf("Listed %d times, want 3", calls)
+	}
+
+	// Other directories are separate.
+	readAllBuffered(t, &b, fuseops.RootInodeID+1, 64, 2, list)
+	if calls != 4 {
+		t.Errorf("Listed %d times, want 4", calls)
+	}
+}
+
+func TestDirBuffers_Errors(t *testing.T) {
+	var b fuseutil.DirBuffers
+	list := func() ([]fuseutil.Dirent, error) { return dirents("a", "b"), nil }
+
+	// An offset beyond the end.
+	op := &fuseops.ReadDirOp{Inode: fuseops.RootInodeID, Offset: 3, Dst: make([]byte, 4096)}
+	if err := b.Read(op, 1, list); err != fuse.EINVAL {
+		t.Errorf("Offset beyond end: got %v, want EINVAL", err)
+	}
+
+	// At the end is fine, and empty.
+	op = &fuseops.ReadDirOp{Inode: fuseops.RootInodeID, Offset: 2, Dst: make([]byte, 4096)}
+	if err := b.Read(op, 1, list); err != nil || op.BytesRead != 0 {
+		t.Errorf("Offset at end: got (%d, %v)", op.BytesRead, err)
+	}
+
+	// An error from listing is returned, and nothing is cached.
+	failure := errors.New("taco")
+	op = &fuseops.ReadDirOp{Inode: fuseops.RootInodeID, Dst: make([]byte, 4096)}
+	if err := b.Read(op, 2, func() ([]fuseutil.Dirent, error) { return nil, failure }); err != failure {
+		t.Errorf("Listing error: got %v", err)
+	}
+
+	if err := b.Read(op, 2, list); err != nil || op.BytesRead == 0 {
+		t.Errorf("After listing error: got (%d, %v)", op.BytesRead, err)
+	}
+}
+
+// A large directory that never changes.
+func largeStaticDir() []fuseutil.Dirent {
+	names := make([]string, 10000)
+	for i := range names {
+		names[i] = fmt.Sprintf("file_with_a_moderately_long_name_%05d", i)
+	}
+
+	return dirents(names...)
+}
+
+// Read the whole of a large static directory in page-sized reads, as the
+// kernel does, serializing its entries afresh for each read.
+func BenchmarkReadDir_PerCall(b *testing.B) {
+	entries := largeStaticDir()
+	dst := make([]byte, 4096)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var offset fuseops.DirOffset
+		for int(offset) < len(entries) {
+			n := 0
+			for _, e := range entries[offset:] {
+				e.Offset = offset + 1
+				w := fuseutil.WriteDirent(dst[n:], e)
+				if w == 0 {
+					break
+				}
+
+				n += w
+				offset++
+			}
+		}
+	}
+}
+
+// The same, served from a DirBuffers.
+func BenchmarkReadDir_Buffered(b *testing.B) {
+	entries := largeStaticDir()
+	list := func() ([]fuseutil.Dirent, error) { return entries, nil }
+	dst := make([]byte, 4096)
+
+	var buffers fuseutil.DirBuffers
+	readAllBuffered(b, &buffers, fuseops.RootInodeID, len(dst), 1, list)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var offset fuseops.DirOffset
+		for int(offset) < len(entries) {
+			op := &fuseops.ReadDirOp{Inode: fuseops.RootInodeID, Offset: offset, Dst: dst}
+			if err := buffers.Read(op, 1, list); err != nil {
+				b.Fatalf("Read: %v", err)
+			}
+
+			// Each entry takes 64 bytes.
+			offset += fuseops.DirOffset(op.BytesRead / 64)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// DirPageFetcher fetches one page of the listing of a directory from a backend
+// that paginates its listings. The token is empty for the first page and
+// otherwise a value previously returned as next; next is empty after the last
+// page. The Offset fields of the entries are ignored.
+type DirPageFetcher func(
+	ctx context.Context,
+	dir fuseops.InodeID,
+	token string) (entries []Dirent, next string, err error)
+
+// DirPager serves directory reads from a backend that returns listings a page
+// at a time, when a page holds more entries than fit in the kernel's buffer
+// for a single ReadDirOp. It keeps the most recent page for each open handle
+// and drains it across successive ReadDirOps, fetching the next page only once
+// the kernel has consumed the last. Reading a listing straight through thus
+// fetches each page exactly once.
+//
+// The entries are given offsets counting from one across the whole listing.
+// A read at an offset outside the current page, e.g. after rewinddir(3), starts
+// again from the first page and pages forward to the offset.
+//
+// A file system uses it by calling Open from OpenDir, Read from ReadDir, and
+// Release from ReleaseDirHandle.
+type DirPager struct {
+	fetch DirPageFetcher
+
+	mu sync.Mutex
+
+	// The state of each open handle, and the handle to mint next.
+	//
+	// GUARDED_BY(mu)
+	handles    map[fuseops.HandleID]*dirPage
+	nextHandle fuseops.HandleID
+}
+
+// The state of an open handle of a DirPager.
+type dirPage struct {
+	dir fuseops.InodeID
+
+	// Held while reading, including while fetching. The kernel doesn't read a
+	// single handle concurrently, so this is uncontended in practice.
+	mu sync.Mutex
+
+	// Whether a page has been fetched, the page itself, the offset of the entry
+	// preceding its first, and the token for the following page.
+	//
+	// GUARDED_BY(mu)
+	fetched bool
+	entries []Dirent
+	base    fuseops.DirOffset
+	next    string
+}
+
+// NewDirPager returns a DirPager that fetches pages using the supplied
+// function.
+func NewDirPager(fetch DirPageFetcher) *DirPager {
+	return &DirPager{
+		fetch:   fetch,
+		handles: make(map[fuseops.HandleID]*dirPage),
+	}
+}
+
+// Open sets op.Handle to a new handle for reading the directory op.Inode.
+// Nothing is fetched until the first Read.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *DirPager) Open(op *fuseops.OpenDirOp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextHandle++
+	p.handles[p.nextHandle] = &dirPage{dir: op.Inode}
+	op.Handle = p.nextHandle
+}
+
+// Read fills op.Dst with entries starting at op.Offset, fetching pages as
+// necessary. It returns EINVAL if the handle is unknown, and otherwise any
+// error from fetching.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *DirPager) Read(ctx context.Context, op *fuseops.ReadDirOp) error {
+	p.mu.Lock()
+	d, ok := p.handles[op.Handle]
+	p.mu.Unlock()
+
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Start again from the first page if the offset isn't within or at the end
+	// of the one we have.
+	end := d.base + fuseops.DirOffset(len(d.entries))
+	if !d.fetched || op.Offset < d.base || op.Offset > end {
+		if err := d.fetchPage(ctx, p.fetch, "", 0); err != nil {
+			return err
+		}
+	}
+
+	offset := op.Offset
+	for {
+		// Fetch the following page once this one has been drained, skipping any
+		// empty pages and, after starting again, any before the offset.
+		end = d.base + fuseops.DirOffset(len(d.entries))
+		for offset >= end && d.next != "" {
+			if err := d.fetchPage(ctx, p.fetch, d.next, end); err != nil {
+				return err
+			}
+
+			end = d.base + fuseops.DirOffset(len(d.entries))
+		}
+
+		if offset >= end {
+			return nil
+		}
+
+		e := d.entries[offset-d.base]
+		n := WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			return nil
+		}
+
+		op.BytesRead += n
+		offset = e.Offset
+	}
+}
+
+// Replace the current page with the one for the given token, whose first
+// entry follows the given offset.
+//
+// LOCKS_REQUIRED(d.mu)
+func (d *dirPage) fetchPage(
+	ctx context.Context,
+	fetch DirPageFetcher,
+	token string,
+	base fuseops.DirOffset) error {
+	entries, next, err := fetch(ctx, d.dir, token)
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		entries[i].Offset = base + fuseops.DirOffset(i+1)
+	}
+
+	d.fetched = true
+	d.entries = entries
+	d.base = base
+	d.next = next
+	return nil
+}
+
+// Release discards the state for op.Handle.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *DirPager) Release(op *fuseops.ReleaseDirHandleOp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.handles, op.Handle)
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A backend listing a directory of the given number of entries in pages of
+// the given size, counting the fetches of each page.
+type pagedBackend struct {
+	entries  int
+	pageSize int
+	fetches  map[string]int
+}
+
+func (b *pagedBackend) fetch(
+	ctx context.Context,
+	dir fuseops.InodeID,
+	token string) (entries []fuseutil.Dirent, next string, err error) {
+	b.fetches[token]++
+
+	start := 0
+	if token != "" {
+		if start, err = strconv.Atoi(token); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for i := start; i < b.entries && i < start+b.pageSize; i++ {
+		entries = append(entries, fuseutil.Dirent{
+			Inode: fuseops.InodeID(i + 2),
+			Name:  fmt.Sprintf("entry%04d", i),
+			Type:  fuseutil.DT_File,
+		})
+	}
+
+	if start+b.pageSize < b.entries {
+		next = strconv.Itoa(start + b.pageSize)
+	}
+
+	return
+}
+
+// Read the directory from the given offset to the end, in buffers of the
+// given size.
+func readAllPaged(
+	t *testing.T,
+	p *fuseutil.DirPager,
+	h fuseops.HandleID,
+	offset fuseops.DirOffset,
+	bufSize int) (names []string) {
+	for {
+		op := &fuseops.ReadDirOp{
+			Inode:  fuseops.RootInodeID,
+			Handle: h,
+			Offset: offset,
+			Dst:    make([]byte, bufSize),
+		}
+
+		if err := p.Read(context.Background(), op); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		if op.BytesRead == 0 {
+			return
+		}
+
+		batch, last := parseDirents(op.Dst[:op.BytesRead])
+		names = append(names, batch...)
+		offset = last
+	}
+}
+
+func TestDirPager(t *testing.T) {
+	b := &pagedBackend{
+		entries:  2500,
+		pageSize: 1000,
+		fetches:  make(map[string]int),
+	}
+
+	p := fuseutil.NewDirPager(b.fetch)
+	openOp := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	p.Open(openOp)
+
+	// Read the whole listing, ten entries at a time.
+	names := readAllPaged(t, p, openOp.Handle, 0, 10*40)
+	if len(names) != b.entries {
+		t.Fatalf("Got %d names", len(names))
+	}
+
+	for i, name := range names {
+		if expected := fmt.Sprintf("entry%04d", i); name != expected {
+			t.Fatalf("Name %d: %q", i, name)
+		}
+	}
+
+	// Each page should have been fetched exactly once.
+	expected := map[string]int{"": 1, "1000": 1, "2000": 1}
+	if !reflect.DeepEqual(b.fetches, expected) {
+		t.Errorf("Fetches: %v", b.fetches)
+	}
+
+	// Rewinding should start again from the first page.
+	names = readAllPaged(t, p, openOp.Handle, 0, 4096)
+	if len(names) != b.entries || names[0] != "entry0000" {
+		t.Errorf("After rewinding: %d names", len(names))
+	}
+
+	if b.fetches[""] != 2 {
+		t.Errorf("Fetches after rewinding: %v", b.fetches)
+	}
+
+	// Seeking back into an earlier page should page forward to it from the
+	// start.
+	names = readAllPaged(t, p, openOp.Handle, 500, 4096)
+	if len(names) != 2000 || names[0] != "entry0500" {
+		t.Errorf("After seeking: %d names", len(names))
+	}
+
+	p.Release(&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// DirSnapshots serves directory reads from a snapshot of each directory's
+// contents taken when it was opened, so that a reader iterating over a large
+// directory across several ReadDirOps sees each entry exactly once even if the
+// directory is modified concurrently. This is roughly the stability that POSIX
+// asks of readdir(3) for entries that are neither added nor removed during
+// iteration, extended to all entries.
+//
+// A file system uses it by calling Open from OpenDir, Read from ReadDir, and
+// Release from ReleaseDirHandle. The zero value is ready to use.
+type DirSnapshots struct {
+	mu sync.Mutex
+
+	// The snapshot for each open handle, and the handle to mint next.
+	//
+	// GUARDED_BY(mu)
+	snapshots  map[fuseops.HandleID][]Dirent
+	nextHandle fuseops.HandleID
+}
+
+// Open records a snapshot of the supplied entries, which should be the full
+// contents of the directory op.Inode, and sets op.Handle to a new handle that
+// refers to it. The Offset fields of the entries are ignored; DirSnapshots
+// assigns its own.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirSnapshots) Open(op *fuseops.OpenDirOp, entries []Dirent) {
+	snapshot := make([]Dirent, len(entries))
+	for i, e := range entries {
+		e.Offset = fuseops.DirOffset(i + 1)
+		snapshot[i] = e
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.snapshots == nil {
+		s.snapshots = make(map[fuseops.HandleID][]Dirent)
+	}
+
+	s.nextHandle++
+	s.snapshots[s.nextHandle] = snapshot
+	op.Handle = s.nextHandle
+}
+
+// Read fills op.Dst with entries from the snapshot for op.Handle, starting at
+// op.Offset. It returns EINVAL if the handle is unknown.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirSnapshots) Read(op *fuseops.ReadDirOp) error {
+	s.mu.Lock()
+	snapshot, ok := s.snapshots[op.Handle]
+	s.mu.Unlock()
+
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	// The snapshot is never modified after Open, so there is no need to hold
+	// the lock while copying from it.
+	if op.Offset > fuseops.DirOffset(len(snapshot)) {
+		return fuse.EINVAL
+	}
+
+	for _, e := range snapshot[op.Offset:] {
+		n := WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+// Release discards the snapshot for op.Handle.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirSnapshots) Release(op *fuseops.ReleaseDirHandleOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.snapshots, op.Handle)
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Parse the fuse_dirent structs written by WriteDirent, returning the names
+// and the offset of the last entry.
+func parseDirents(buf []byte) (names []string, last fuseops.DirOffset) {
+	for len(buf) > 0 {
+		off := binary.LittleEndian.Uint64(buf[8:])
+		namelen := int(binary.LittleEndian.Uint32(buf[16:]))
+		names = append(names, string(buf[24:24+namelen]))
+		last = fuseops.DirOffset(off)
+
+		n := (24 + namelen + 7) &^ 7
+		buf = buf[n:]
+	}
+
+	return
+}
+
+func dirents(names ...string) (entries []fuseutil.Dirent) {
+	for i, name := range names {
+		entries = append(entries, fuseutil.Dirent{
+			Inode: fuseops.InodeID(i + 2),
+			Name:  name,
+			Type:  fuseutil.DT_File,
+		})
+	}
+
+	return
+}
+
+func TestDirSnapshots(t *testing.T) {
+	var s fuseutil.DirSnapshots
+
+	// Open the directory and read the first two entries, each of which takes 32
+	// bytes.
+	openA := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	s.Open(openA, dirents("a", "b", "c", "d"))
+
+	readA := &fuseops.ReadDirOp{Handle: openA.Handle, Dst: make([]byte, 64)}
+	if err := s.Read(readA); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	names, last := parseDirents(readA.Dst[:readA.BytesRead])
+	if want := []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("First read: got %q, want %q", names, want)
+	}
+
+	// Modify the directory and open it again.
+	openB := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	s.Open(openB, dirents("a", "b", "d", "e"))
+
+	if openB.Handle == openA.Handle {
+		t.Fatalf("Handles not distinct: %v", openA.Handle)
+	}
+
+	// The first handle should continue to see the original contents.
+	readA = &fuseops.ReadDirOp{
+		Handle: openA.Handle,
+		Offset: last,
+		Dst:    make([]byte, 1024),
+	}
+
+	if err := s.Read(readA); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	names, _ = parseDirents(readA.Dst[:readA.BytesRead])
+	if want := []string{"c", "d"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Second read: got %q, want %q", names, want)
+	}
+
+	// The second handle should see the modified contents.
+	readB := &fuseops.ReadDirOp{Handle: openB.Handle, Dst: make([]byte, 1024)}
+	if err := s.Read(readB); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	names, _ = parseDirents(readB.Dst[:readB.BytesRead])
+	if want := []string{"a", "b", "d", "e"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Read of second handle: got %q, want %q", names, want)
+	}
+
+	// Reading at the end should yield nothing.
+	readA = &fuseops.ReadDirOp{
+		Handle: openA.Handle,
+		Offset: 4,
+		Dst:    make([]byte, 1024),
+	}
+
+	if err := s.Read(readA); err != nil || readA.BytesRead != 0 {
+		t.Errorf("Read at end: %v, %d bytes", err, readA.BytesRead)
+	}
+
+	// Once released, the handle is no longer usable.
+	s.Release(&fuseops.ReleaseDirHandleOp{Handle: openA.Handle})
+
+	readA = &fuseops.ReadDirOp{Handle: openA.Handle, Dst: make([]byte, 1024)}
+	if err := s.Read(readA); err != fuse.EINVAL {
+		t.Errorf("Read after release: %v", err)
+	}
+}
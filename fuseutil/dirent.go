@@ -16,9 +16,12 @@ package fuseutil
 
 import (
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/convert"
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
 type DirentType uint32
@@ -103,3 +106,80 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 
 	return n
 }
+
+// Write the supplied directory entry into the given buffer in the format
+// expected in fuseops.ReadDirPlusOp.Dst, along with the entry for the inode it
+// names, as would be returned by a LookUpInodeOp for the name. Return the
+// number of bytes written, or zero if the entry would not fit.
+//
+// See the notes on ReadDirPlusOp.Dst about lookup counts. The expiration times
+// in e are measured from the current time by the real clock, rather than by
+// fuse.MountConfig.Clock; use the validity fields to avoid the difference.
+func WriteDirentPlus(
+	buf []byte,
+	d Dirent,
+	e fuseops.ChildInodeEntry) (n int) {
+	// The layout is that of fuse_direntplus (http://goo.gl/Kx6nTe): a
+	// fuse_entry_out followed by a fuse_dirent, as written by WriteDirent.
+	// Both are a multiple of 8 bytes, so alignment is preserved.
+	const entryOutSize = unsafe.Sizeof(fusekernel.EntryOut{})
+	const direntAlignment = 8
+	const direntSize = 8 + 8 + 4 + 4
+
+	// Do we have enough room?
+	nameLen := (len(d.Name) + direntAlignment - 1) / direntAlignment * direntAlignment
+	if int(entryOutSize)+direntSize+nameLen > len(buf) {
+		return n
+	}
+
+	var out fusekernel.EntryOut
+	convert.ChildInodeEntry(time.Now(), &e, &out)
+
+	n += copy(buf[n:], (*[entryOutSize]byte)(unsafe.Pointer(&out))[:])
+	n += WriteDirent(buf[n:], d)
+
+	return n
+}
+
+// Parse directory entries in the format written by WriteDirent, e.g. as
+// returned by another file system's ReadDir. A truncated final entry is
+// ignored.
+func parseDirents(buf []byte) (entries []Dirent) {
+	// See WriteDirent for the layout.
+	type fuse_dirent struct {
+		ino     uint64
+		off     uint64
+		namelen uint32
+		type_   uint32
+	}
+
+	const direntAlignment = 8
+	const direntSize = 8 + 8 + 4 + 4
+
+	for len(buf) >= direntSize {
+		var de fuse_dirent
+		copy((*[direntSize]byte)(unsafe.Pointer(&de))[:], buf)
+
+		nameEnd := direntSize + int(de.namelen)
+		if nameEnd > len(buf) {
+			break
+		}
+
+		entries = append(entries, Dirent{
+			Offset: fuseops.DirOffset(de.off),
+			Inode:  fuseops.InodeID(de.ino),
+			Name:   string(buf[direntSize:nameEnd]),
+			Type:   DirentType(de.type_),
+		})
+
+		// Skip the padding.
+		next := (nameEnd + direntAlignment - 1) / direntAlignment * direntAlignment
+		if next > len(buf) {
+			break
+		}
+
+		buf = buf[next:]
+	}
+
+	return entries
+}
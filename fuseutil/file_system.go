@@ -16,6 +16,7 @@ package fuseutil
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"sync"
 
@@ -33,12 +34,32 @@ import (
 //
 // See NotImplementedFileSystem for a convenient way to embed default
 // implementations for methods you don't care about.
+//
+// For some methods, returning ENOSYS tells the kernel that the op is never
+// supported, and it stops sending the op for the rest of the mount:
+//
+//   - CreateFile: the kernel sends MkNode and OpenFile instead.
+//   - FlushFile and SyncFile (for files and directories separately): the
+//     kernel treats them as succeeding.
+//   - GetXattr, ListXattr, SetXattr and RemoveXattr, each separately, and
+//     Fallocate: the kernel fails them with EOPNOTSUPP.
+//   - CopyFileRange: the kernel copies with ReadFile and WriteFile instead.
+//   - OpenFile and OpenDir, with Capabilities.NoOpenSupport and
+//     NoOpendirSupport respectively: the kernel treats them as succeeding
+//     with a zero handle.
+//
+// To decline just the one request while leaving the op enabled, e.g. because
+// only some inodes support extended attributes, return fuse.ENOTSUP instead.
+// For CopyFileRange the kernel then falls back for that copy alone. For all
+// other methods, ENOSYS is passed on to the caller like any other error.
 type FileSystem interface {
 	StatFS(context.Context, *fuseops.StatFSOp) error
 	LookUpInode(context.Context, *fuseops.LookUpInodeOp) error
 	GetInodeAttributes(context.Context, *fuseops.GetInodeAttributesOp) error
+	GetInodeFlags(context.Context, *fuseops.GetInodeFlagsOp) error
 	SetInodeAttributes(context.Context, *fuseops.SetInodeAttributesOp) error
 	ForgetInode(context.Context, *fuseops.ForgetInodeOp) error
+	BatchForget(context.Context, *fuseops.BatchForgetOp) error
 	MkDir(context.Context, *fuseops.MkDirOp) error
 	MkNode(context.Context, *fuseops.MkNodeOp) error
 	CreateFile(context.Context, *fuseops.CreateFileOp) error
@@ -49,6 +70,7 @@ type FileSystem interface {
 	Unlink(context.Context, *fuseops.UnlinkOp) error
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
 	ReadDir(context.Context, *fuseops.ReadDirOp) error
+	ReadDirPlus(context.Context, *fuseops.ReadDirPlusOp) error
 	ReleaseDirHandle(context.Context, *fuseops.ReleaseDirHandleOp) error
 	OpenFile(context.Context, *fuseops.OpenFileOp) error
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
@@ -62,6 +84,10 @@ type FileSystem interface {
 	ListXattr(context.Context, *fuseops.ListXattrOp) error
 	SetXattr(context.Context, *fuseops.SetXattrOp) error
 	Fallocate(context.Context, *fuseops.FallocateOp) error
+	CopyFileRange(context.Context, *fuseops.CopyFileRangeOp) error
+	GetLk(context.Context, *fuseops.GetLkOp) error
+	SetLk(context.Context, *fuseops.SetLkOp) error
+	SetLkw(context.Context, *fuseops.SetLkwOp) error
 
 	// Regard all inodes (including the root inode) as having their lookup counts
 	// decremented to zero, and clean up any resources associated with the file
@@ -73,10 +99,18 @@ type FileSystem interface {
 // method.Respond with the resulting error. Unsupported ops are responded to
 // directly with ENOSYS.
 //
-// Each call to a FileSystem method (except ForgetInode) is made on
-// its own goroutine, and is free to block. ForgetInode may be called
-// synchronously, and should not depend on calls to other methods
-// being received concurrently.
+// Each call to a FileSystem method (except ForgetInode and BatchForget) is
+// made on its own goroutine, and is free to block. ForgetInode and BatchForget
+// may be called synchronously, and should not depend on calls to other
+// methods being received concurrently.
+//
+// If BatchForget returns ENOSYS, as it does for NotImplementedFileSystem,
+// ForgetInode is called for each entry of the op instead. Likewise if
+// ReadDirPlus returns ENOSYS, the op is served by ReadDir, with entries that
+// carry no inodes.
+//
+// A method may instead finish its op after returning, without blocking a
+// goroutine meanwhile; see ReplyLater.
 //
 // (It is safe to naively process ops concurrently because the kernel
 // guarantees to serialize operations that the user expects to happen in order,
@@ -101,6 +135,27 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 		s.fs.Destroy()
 	}()
 
+	// Read from each of the connection's device descriptors in parallel.
+	n := c.ReadConcurrency()
+	if n == 1 {
+		s.readOps(c)
+		return
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer readers.Done()
+			s.readOps(c)
+		}()
+	}
+
+	readers.Wait()
+}
+
+// Read and dispatch ops until EOF.
+func (s *fileSystemServer) readOps(c *fuse.Connection) {
 	for {
 		ctx, op, err := c.ReadOp()
 		if err == io.EOF {
@@ -112,13 +167,15 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 		}
 
 		s.opsInFlight.Add(1)
-		if _, ok := op.(*fuseops.ForgetInodeOp); ok {
+		switch op.(type) {
+		case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
 			// Special case: call in this goroutine for
 			// forget inode ops, which may come in a
 			// flurry from the kernel and are generally
 			// cheap for the file system to handle
 			s.handleOp(c, ctx, op)
-		} else {
+
+		default:
 			go s.handleOp(c, ctx, op)
 		}
 	}
@@ -128,7 +185,15 @@ func (s *fileSystemServer) handleOp(
 	c *fuse.Connection,
 	ctx context.Context,
 	op interface{}) {
-	defer s.opsInFlight.Done()
+	// Arrange for the op to be replied to, now or later. See ReplyLater.
+	p := &pendingReply{
+		reply: func(err error) {
+			c.Reply(ctx, err)
+			s.opsInFlight.Done()
+		},
+	}
+
+	ctx = context.WithValue(ctx, pendingReplyKey{}, p)
 
 	// Dispatch to the appropriate method.
 	var err error
@@ -145,12 +210,21 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.GetInodeAttributesOp:
 		err = s.fs.GetInodeAttributes(ctx, typed)
 
+	case *fuseops.GetInodeFlagsOp:
+		err = s.fs.GetInodeFlags(ctx, typed)
+
 	case *fuseops.SetInodeAttributesOp:
 		err = s.fs.SetInodeAttributes(ctx, typed)
 
 	case *fuseops.ForgetInodeOp:
 		err = s.fs.ForgetInode(ctx, typed)
 
+	case *fuseops.BatchForgetOp:
+		err = s.fs.BatchForget(ctx, typed)
+		if err == fuse.ENOSYS {
+			err = s.forgetEach(ctx, typed)
+		}
+
 	case *fuseops.MkDirOp:
 		err = s.fs.MkDir(ctx, typed)
 
@@ -181,6 +255,12 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.ReadDirOp:
 		err = s.fs.ReadDir(ctx, typed)
 
+	case *fuseops.ReadDirPlusOp:
+		err = s.fs.ReadDirPlus(ctx, typed)
+		if err == fuse.ENOSYS {
+			err = readDirPlusWithReadDir(ctx, s.fs, typed)
+		}
+
 	case *fuseops.ReleaseDirHandleOp:
 		err = s.fs.ReleaseDirHandle(ctx, typed)
 
@@ -219,7 +299,86 @@ func (s *fileSystemServer) handleOp(
 
 	case *fuseops.FallocateOp:
 		err = s.fs.Fallocate(ctx, typed)
+
+	case *fuseops.CopyFileRangeOp:
+		err = s.fs.CopyFileRange(ctx, typed)
+
+	case *fuseops.GetLkOp:
+		err = s.fs.GetLk(ctx, typed)
+
+	case *fuseops.SetLkOp:
+		err = s.fs.SetLk(ctx, typed)
+
+	case *fuseops.SetLkwOp:
+		err = s.fs.SetLkw(ctx, typed)
+	}
+
+	if err == ErrPending {
+		if !p.isDeferred() {
+			panic(fmt.Sprintf("%T returned ErrPending without calling ReplyLater", op))
+		}
+
+		return
+	}
+
+	p.finish(err)
+}
+
+// Handle a BatchForgetOp by calling ForgetInode for each entry, for file
+// systems that don't implement BatchForget. Return the first error.
+func (s *fileSystemServer) forgetEach(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) (err error) {
+	for _, e := range op.Entries {
+		forgetOp := &fuseops.ForgetInodeOp{
+			Inode:     e.Inode,
+			N:         e.N,
+			OpContext: op.OpContext,
+		}
+
+		if forgetErr := s.fs.ForgetInode(ctx, forgetOp); err == nil {
+			err = forgetErr
+		}
+	}
+
+	return err
+}
+
+// Handle a ReadDirPlusOp by calling ReadDir, for file systems that don't
+// implement ReadDirPlus, and writing the entries it returns with no inodes.
+// ReadDir may use ReplyLater as usual.
+func readDirPlusWithReadDir(
+	ctx context.Context,
+	fs FileSystem,
+	op *fuseops.ReadDirPlusOp) error {
+	// Entries are smaller without inodes, so whatever fits in a buffer of the
+	// same size is at least as much as can be returned.
+	readOp := &fuseops.ReadDirOp{
+		Inode:     op.Inode,
+		Handle:    op.Handle,
+		Offset:    op.Offset,
+		Dst:       make([]byte, len(op.Dst)),
+		Atime:     op.Atime,
+		OpContext: op.OpContext,
 	}
 
-	c.Reply(ctx, err)
+	// Copy the entries across once ReadDir has finished, which may be after it
+	// returns.
+	return whenFinished(
+		ctx,
+		func(ctx context.Context) error { return fs.ReadDir(ctx, readOp) },
+		func(err error) {
+			if err != nil {
+				return
+			}
+
+			for _, d := range parseDirents(readOp.Dst[:readOp.BytesRead]) {
+				n := WriteDirentPlus(op.Dst[op.BytesRead:], d, fuseops.ChildInodeEntry{})
+				if n == 0 {
+					break
+				}
+
+				op.BytesRead += n
+			}
+		})
 }
@@ -0,0 +1,31 @@
+//go:build go1.21
+// +build go1.21
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse"
+)
+
+// The cause with which an interrupted op's context is canceled.
+var interruptCause = fuse.ErrInterrupted
+
+func contextCause(ctx context.Context) error {
+	return context.Cause(ctx)
+}
@@ -0,0 +1,602 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Forgets
+////////////////////////////////////////////////////////////////////////
+
+// A file system that records the forgets it receives, optionally implementing
+// BatchForget.
+type forgetFS struct {
+	fuseutil.NotImplementedFileSystem
+	batch bool
+
+	mu      sync.Mutex
+	forgets []fuseops.BatchForgetEntry // GUARDED_BY(mu)
+	batches int                        // GUARDED_BY(mu)
+}
+
+func (fs *forgetFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forgets = append(fs.forgets, fuseops.BatchForgetEntry{
+		Inode: op.Inode,
+		N:     op.N,
+	})
+
+	return nil
+}
+
+func (fs *forgetFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	if !fs.batch {
+		return fs.NotImplementedFileSystem.BatchForget(ctx, op)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.batches++
+	fs.forgets = append(fs.forgets, op.Entries...)
+	return nil
+}
+
+// Build a request in the format read from /dev/fuse.
+func rawRequest(
+	unique uint64,
+	opcode uint32,
+	nodeid uint64,
+	body ...interface{}) fusetesting.RawRequest {
+	var payload bytes.Buffer
+	for _, b := range body {
+		binary.Write(&payload, binary.LittleEndian, b)
+	}
+
+	h := fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + payload.Len()),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: nodeid,
+		Pid:    1,
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	buf.Write(payload.Bytes())
+	return buf.Bytes()
+}
+
+func initRequest() fusetesting.RawRequest {
+	return rawRequest(1, fusekernel.OpInit, 0, fusekernel.InitIn{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	})
+}
+
+// Serve the supplied file system over a socket standing in for /dev/fuse,
+// returning the other end once the init handshake is complete, and a function
+// that hangs up and waits for the server to finish.
+func serveOverSocket(
+	t *testing.T,
+	fs fuseutil.FileSystem) (kernel *os.File, hangUp func()) {
+	c, dev, kernel, err := fusetesting.NewSocketConnection(
+		&fuse.MountConfig{},
+		initRequest())
+
+	if err != nil {
+		t.Fatalf("NewSocketConnection: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		fuseutil.NewFileSystemServer(fs).ServeOps(c)
+		close(done)
+	}()
+
+	hangUp = func() {
+		kernel.Close()
+		<-done
+		dev.Close()
+	}
+
+	return kernel, hangUp
+}
+
+// Build a trace that forgets the supplied entries, with one FUSE_FORGET per
+// inode unless batch is set, in which case with a single FUSE_BATCH_FORGET.
+func forgetTrace(
+	entries []fuseops.BatchForgetEntry,
+	batch bool) []fusetesting.RawRequest {
+	trace := []fusetesting.RawRequest{initRequest()}
+	if !batch {
+		for i, e := range entries {
+			trace = append(trace, rawRequest(
+				uint64(i+2),
+				fusekernel.OpForget,
+				uint64(e.Inode),
+				fusekernel.ForgetIn{Nlookup: e.N}))
+		}
+
+		return trace
+	}
+
+	return append(trace, batchForgetRequest(2, entries))
+}
+
+// Build a FUSE_BATCH_FORGET request for the supplied entries.
+func batchForgetRequest(
+	unique uint64,
+	entries []fuseops.BatchForgetEntry) fusetesting.RawRequest {
+	body := []interface{}{uint32(len(entries)), uint32(0)}
+	for _, e := range entries {
+		body = append(body, fusekernel.ForgetOne{
+			Nodeid:  uint64(e.Inode),
+			Nlookup: e.N,
+		})
+	}
+
+	return rawRequest(unique, fusekernel.OpBatchForget, 0, body...)
+}
+
+// The forgets made when tearing down a directory tree of n inodes.
+func teardownEntries(n int) []fuseops.BatchForgetEntry {
+	entries := make([]fuseops.BatchForgetEntry, n)
+	for i := range entries {
+		entries[i] = fuseops.BatchForgetEntry{
+			Inode: fuseops.RootInodeID + 1 + fuseops.InodeID(i),
+			N:     uint64(1 + i%3),
+		}
+	}
+
+	return entries
+}
+
+func TestBatchForget(t *testing.T) {
+	entries := teardownEntries(3)
+
+	fs := &forgetFS{batch: true}
+	responses, err := fusetesting.ReplayTrace(fs, forgetTrace(entries, true))
+	if err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+
+	// Only the init request gets a response.
+	if len(responses) != 1 {
+		t.Errorf("Got %d responses", len(responses))
+	}
+
+	if fs.batches != 1 {
+		t.Errorf("BatchForget called %d times", fs.batches)
+	}
+
+	if !reflect.DeepEqual(fs.forgets, entries) {
+		t.Errorf("Forgot %v, want %v", fs.forgets, entries)
+	}
+}
+
+func TestBatchForget_FallsBackToForgetInode(t *testing.T) {
+	entries := teardownEntries(3)
+
+	fs := &forgetFS{}
+	responses, err := fusetesting.ReplayTrace(fs, forgetTrace(entries, true))
+	if err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+
+	if len(responses) != 1 {
+		t.Errorf("Got %d responses", len(responses))
+	}
+
+	// Each entry is forgotten in order with ForgetInode.
+	if fs.batches != 0 {
+		t.Errorf("BatchForget called %d times", fs.batches)
+	}
+
+	if !reflect.DeepEqual(fs.forgets, entries) {
+		t.Errorf("Forgot %v, want %v", fs.forgets, entries)
+	}
+}
+
+// Compare forgetting the inodes of a torn-down directory tree one op at a time
+// with forgetting them in batches of the size the kernel uses.
+func benchmarkForget(b *testing.B, batch bool) {
+	const inodes = 4096
+
+	// The kernel fits as many entries into a batch as a single request allows,
+	// which is a page's worth.
+	const perBatch = (4096 - 8) / 16
+
+	entries := teardownEntries(inodes)
+	trace := []fusetesting.RawRequest{initRequest()}
+	if batch {
+		for start := 0; start < inodes; start += perBatch {
+			end := start + perBatch
+			if end > inodes {
+				end = inodes
+			}
+
+			trace = append(
+				trace,
+				batchForgetRequest(uint64(len(trace)+1), entries[start:end]))
+		}
+	} else {
+		trace = forgetTrace(entries, false)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fusetesting.ReplayTrace(&forgetFS{batch: batch}, trace); err != nil {
+			b.Fatalf("ReplayTrace: %v", err)
+		}
+	}
+}
+
+func BenchmarkForget_PerInode(b *testing.B) {
+	benchmarkForget(b, false)
+}
+
+func BenchmarkForget_Batched(b *testing.B) {
+	benchmarkForget(b, true)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Readdirplus
+////////////////////////////////////////////////////////////////////////
+
+// A file system with a single directory containing "foo" and "bar",
+// optionally implementing ReadDirPlus.
+type readDirPlusFS struct {
+	fuseutil.NotImplementedFileSystem
+	plus bool
+
+	mu       sync.Mutex
+	readDirs int // GUARDED_BY(mu)
+}
+
+var readDirPlusEntries = []fuseutil.Dirent{
+	{Offset: 1, Inode: 17, Name: "foo", Type: fuseutil.DT_File},
+	{Offset: 2, Inode: 19, Name: "bar", Type: fuseutil.DT_Directory},
+}
+
+func (fs *readDirPlusFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	fs.readDirs++
+	fs.mu.Unlock()
+
+	for _, d := range readDirPlusEntries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *readDirPlusFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if !fs.plus {
+		return fs.NotImplementedFileSystem.ReadDirPlus(ctx, op)
+	}
+
+	for _, d := range readDirPlusEntries[op.Offset:] {
+		e := fuseops.ChildInodeEntry{Child: d.Inode}
+		n := fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], d, e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+type direntPlus struct {
+	nodeid uint64
+	ino    uint64
+	name   string
+}
+
+// Parse the fuse_direntplus structs written by WriteDirentPlus.
+func parseDirentsPlus(buf []byte) (entries []direntPlus) {
+	const entryOutSize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	for len(buf) > 0 {
+		out := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+		buf = buf[entryOutSize:]
+
+		namelen := int(binary.LittleEndian.Uint32(buf[16:]))
+		entries = append(entries, direntPlus{
+			nodeid: out.Nodeid,
+			ino:    binary.LittleEndian.Uint64(buf),
+			name:   string(buf[24 : 24+namelen]),
+		})
+
+		buf = buf[(24+namelen+7)&^7:]
+	}
+
+	return
+}
+
+// Send a readdirplus request for the directory to the supplied file system,
+// returning the entries of the response.
+func readDirPlus(t *testing.T, fs fuseutil.FileSystem) []direntPlus {
+	trace := []fusetesting.RawRequest{
+		initRequest(),
+		rawRequest(2, fusekernel.OpReaddirplus, 1, fusekernel.ReadIn{Size: 4096}),
+	}
+
+	responses, err := fusetesting.ReplayTrace(fs, trace)
+	if err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+
+	if len(responses) != 2 {
+		t.Fatalf("Got %d responses", len(responses))
+	}
+
+	resp := responses[1]
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&resp[0]))
+	if h.Error != 0 {
+		t.Fatalf("Error %d", h.Error)
+	}
+
+	return parseDirentsPlus(resp[unsafe.Sizeof(fusekernel.OutHeader{}):])
+}
+
+func TestReadDirPlus(t *testing.T) {
+	fs := &readDirPlusFS{plus: true}
+	got := readDirPlus(t, fs)
+
+	expected := []direntPlus{
+		{nodeid: 17, ino: 17, name: "foo"},
+		{nodeid: 19, ino: 19, name: "bar"},
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got %v, want %v", got, expected)
+	}
+
+	if fs.readDirs != 0 {
+		t.Errorf("ReadDir called %d times", fs.readDirs)
+	}
+}
+
+func TestReadDirPlus_FallsBackToReadDir(t *testing.T) {
+	fs := &readDirPlusFS{}
+	got := readDirPlus(t, fs)
+
+	// The entries carry no node ID, so the kernel looks them up as it would
+	// after a plain readdir.
+	expected := []direntPlus{
+		{nodeid: 0, ino: 17, name: "foo"},
+		{nodeid: 0, ino: 19, name: "bar"},
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got %v, want %v", got, expected)
+	}
+
+	if fs.readDirs != 1 {
+		t.Errorf("ReadDir called %d times", fs.readDirs)
+	}
+}
+
+func TestWriteDirentPlus_NoRoom(t *testing.T) {
+	d := readDirPlusEntries[0]
+	e := fuseops.ChildInodeEntry{Child: d.Inode}
+
+	// The entry takes a fuse_entry_out, a 24-byte fuse_dirent, and the name
+	// padded to 8 bytes.
+	size := int(unsafe.Sizeof(fusekernel.EntryOut{})) + 24 + 8
+	if n := fuseutil.WriteDirentPlus(make([]byte, size-1), d, e); n != 0 {
+		t.Errorf("Wrote %d bytes to a short buffer", n)
+	}
+
+	if n := fuseutil.WriteDirentPlus(make([]byte, size), d, e); n != size {
+		t.Errorf("Wrote %d bytes, want %d", n, size)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Asynchronous replies
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose reads are served by a backend that holds them until n
+// are outstanding, then completes them in reverse order. Each byte read is
+// the low byte of its offset.
+type asyncReadFS struct {
+	fuseutil.NotImplementedFileSystem
+	n int
+
+	mu      sync.Mutex
+	pending []func() // GUARDED_BY(mu)
+}
+
+func (fs *asyncReadFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	complete := fuseutil.ReplyLater(ctx)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.pending = append(fs.pending, func() {
+		for i := range op.Dst {
+			op.Dst[i] = byte(op.Offset + int64(i))
+		}
+
+		op.BytesRead = len(op.Dst)
+		complete(nil)
+	})
+
+	if len(fs.pending) == fs.n {
+		for i := len(fs.pending) - 1; i >= 0; i-- {
+			go fs.pending[i]()
+		}
+
+		fs.pending = nil
+	}
+
+	return fuseutil.ErrPending
+}
+
+func TestReplyLater_OutOfOrder(t *testing.T) {
+	const reads = 4
+	const size = 16
+
+	kernel, hangUp := serveOverSocket(t, &asyncReadFS{n: reads})
+	defer hangUp()
+
+	// Issue all of the reads before any is answered, each at its own offset.
+	for i := 0; i < reads; i++ {
+		req := rawRequest(
+			uint64(i+2),
+			fusekernel.OpRead,
+			fuseops.RootInodeID+1,
+			fusekernel.ReadIn{Offset: uint64(i * size), Size: size})
+
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// Each response must carry the data for its own request.
+	buf := make([]byte, 4096)
+	for i := 0; i < reads; i++ {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		var h fusekernel.OutHeader
+		binary.Read(bytes.NewReader(buf[:n]), binary.LittleEndian, &h)
+		if h.Error != 0 || n != int(unsafe.Sizeof(h))+size {
+			t.Fatalf("Unexpected response of %d bytes: %+v", n, h)
+		}
+
+		offset := byte((h.Unique - 2) * size)
+		for j, b := range buf[unsafe.Sizeof(h):n] {
+			if b != offset+byte(j) {
+				t.Fatalf("Response to request %d: byte %d is %d", h.Unique, j, b)
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Interrupts
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose reads block until their context is canceled, then fail
+// with EINTR.
+type blockingReadFS struct {
+	fuseutil.NotImplementedFileSystem
+	started chan struct{}
+
+	mu    sync.Mutex
+	cause error // GUARDED_BY(mu)
+}
+
+func (fs *blockingReadFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	close(fs.started)
+	<-ctx.Done()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.cause = contextCause(ctx)
+	return syscall.EINTR
+}
+
+func TestInterruptCancelsOpContext(t *testing.T) {
+	fs := &blockingReadFS{started: make(chan struct{})}
+	kernel, hangUp := serveOverSocket(t, fs)
+	defer hangUp()
+
+	// Start a read, and interrupt it once the handler is blocked.
+	req := rawRequest(
+		2,
+		fusekernel.OpRead,
+		fuseops.RootInodeID+1,
+		fusekernel.ReadIn{Size: 16})
+
+	if _, err := kernel.Write(req); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	<-fs.started
+
+	req = rawRequest(3, fusekernel.OpInterrupt, 0, fusekernel.InterruptIn{Unique: 2})
+	if _, err := kernel.Write(req); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// The handler gives up, and its error is the reply to the read.
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	var h fusekernel.OutHeader
+	binary.Read(bytes.NewReader(buf[:n]), binary.LittleEndian, &h)
+	if h.Unique != 2 || h.Error != -int32(syscall.EINTR) {
+		t.Errorf("Unexpected response: %+v", h)
+	}
+
+	fs.mu.Lock()
+	cause := fs.cause
+	fs.mu.Unlock()
+
+	if cause != interruptCause {
+		t.Errorf("Cause: got %v, want %v", cause, interruptCause)
+	}
+}
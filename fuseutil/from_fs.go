@@ -0,0 +1,536 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// How many directory entries to fetch from an fs.ReadDirFile at a time.
+const fromFSReadDirBatch = 256
+
+// How long the kernel may cache entries and attributes served by FromFS.
+const fromFSCacheValidity = time.Second
+
+// The inode number reported in directory entries for children that haven't
+// been looked up, and so have no ID yet. This is what libfuse reports when it
+// doesn't know one either.
+const fromFSUnknownInode = fuseops.InodeID(0xffffffff)
+
+// FromFS returns a read-only file system serving the contents of fsys.
+//
+// Directories are read lazily: each open directory handle keeps an open
+// fs.ReadDirFile and fetches entries from it in small batches as the kernel
+// reads, so that listing a huge directory doesn't require holding all of its
+// entries in memory. (Directories that don't implement fs.ReadDirFile are read
+// in full with fs.ReadDir when opened.) Seeking backwards in a directory opens
+// it again and skips forward.
+//
+// io/fs has no notion of symlinks, so they are followed if fsys follows them
+// (as os.DirFS does) and otherwise served however fsys describes them. Mount
+// the result with MountConfig.ReadOnly set; ops that would modify the file
+// system fail with ENOSYS.
+func FromFS(fsys fs.FS) FileSystem {
+	return &fromFS{
+		fsys: fsys,
+		inodes: map[fuseops.InodeID]*fromFSInode{
+			fuseops.RootInodeID: {path: "."},
+		},
+		ids:        map[string]fuseops.InodeID{".": fuseops.RootInodeID},
+		nextID:     fuseops.RootInodeID + 1,
+		dirHandles: make(map[fuseops.HandleID]*fromFSDirHandle),
+		handles:    make(map[fuseops.HandleID]*fromFSFileHandle),
+	}
+}
+
+type fromFS struct {
+	NotImplementedFileSystem
+
+	fsys fs.FS
+
+	mu sync.Mutex
+
+	// The inodes that the kernel knows of, and their IDs by path.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*fromFSInode
+	ids    map[string]fuseops.InodeID
+	nextID fuseops.InodeID
+
+	// GUARDED_BY(mu)
+	dirHandles map[fuseops.HandleID]*fromFSDirHandle
+	handles    map[fuseops.HandleID]*fromFSFileHandle
+	nextHandle fuseops.HandleID
+}
+
+type fromFSInode struct {
+	// The path within fsys, as accepted by fs.ValidPath.
+	path string
+
+	// The kernel's lookup count. The root has none.
+	lookupCount uint64
+}
+
+// An open directory handle. Entries are fetched from dir in batches; buf holds
+// those not yet known to have been consumed by the kernel, the first of which
+// has offset start+1.
+type fromFSDirHandle struct {
+	mu sync.Mutex
+
+	path  string
+	dir   fs.ReadDirFile // GUARDED_BY(mu)
+	buf   []fs.DirEntry  // GUARDED_BY(mu)
+	start fuseops.DirOffset
+	eof   bool // GUARDED_BY(mu)
+}
+
+// An open file handle. Files that can't be read at an offset are read
+// sequentially, starting again when a read goes backwards.
+type fromFSFileHandle struct {
+	mu sync.Mutex
+
+	path string
+	f    fs.File // GUARDED_BY(mu)
+	pos  int64   // GUARDED_BY(mu)
+}
+
+// Convert an error from fsys to one for the kernel. Errors wrapping an errno,
+// as those from os.DirFS do, are passed through as is.
+func fromFSError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fuse.ENOENT
+	}
+
+	return err
+}
+
+func fromFSAttributes(fi fs.FileInfo) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:  uint64(fi.Size()),
+		Nlink: 1,
+		Mode:  fi.Mode(),
+		Atime: fi.ModTime(),
+		Mtime: fi.ModTime(),
+		Ctime: fi.ModTime(),
+	}
+}
+
+func fromFSDirentType(mode fs.FileMode) DirentType {
+	switch {
+	case mode.IsDir():
+		return DT_Directory
+
+	case mode&fs.ModeSymlink != 0:
+		return DT_Link
+
+	case mode&fs.ModeNamedPipe != 0:
+		return DT_FIFO
+
+	case mode&fs.ModeSocket != 0:
+		return DT_Socket
+
+	case mode&fs.ModeCharDevice != 0:
+		return DT_Char
+
+	case mode&fs.ModeDevice != 0:
+		return DT_Block
+	}
+
+	return DT_File
+}
+
+// fs.Stat, for use in methods whose receiver shadows the package name.
+func statFS(fsys fs.FS, name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys, name)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fromFS) getPath(id fuseops.InodeID) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[id]
+	if !ok {
+		return "", fuse.EINVAL
+	}
+
+	return in.path, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fromFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *fromFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.getPath(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	p := path.Join(parent, op.Name)
+	fi, err := statFS(fs.fsys, p)
+	if err != nil {
+		return fromFSError(err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.ids[p]
+	if !ok {
+		id = fs.nextID
+		fs.nextID++
+		fs.ids[p] = id
+		fs.inodes[id] = &fromFSInode{path: p}
+	}
+
+	fs.inodes[id].lookupCount++
+
+	op.Entry.Child = id
+	op.Entry.Attributes = fromFSAttributes(fi)
+	op.Entry.AttributesValidity = fromFSCacheValidity
+	op.Entry.EntryValidity = fromFSCacheValidity
+
+	return nil
+}
+
+func (fs *fromFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	p, err := fs.getPath(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	fi, err := statFS(fs.fsys, p)
+	if err != nil {
+		return fromFSError(err)
+	}
+
+	op.Attributes = fromFSAttributes(fi)
+	op.AttributesValidity = fromFSCacheValidity
+
+	return nil
+}
+
+func (fs *fromFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok || op.Inode == fuseops.RootInodeID {
+		return nil
+	}
+
+	if op.N >= in.lookupCount {
+		delete(fs.inodes, op.Inode)
+		delete(fs.ids, in.path)
+		return nil
+	}
+
+	in.lookupCount -= op.N
+	return nil
+}
+
+func (fs *fromFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	p, err := fs.getPath(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	h := &fromFSDirHandle{path: p}
+	if err := h.open(fs.fsys); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.nextHandle++
+	fs.dirHandles[fs.nextHandle] = h
+	op.Handle = fs.nextHandle
+
+	return nil
+}
+
+// Start reading the directory from the beginning.
+//
+// LOCKS_REQUIRED(h.mu)
+func (h *fromFSDirHandle) open(fsys fs.FS) error {
+	if h.dir != nil {
+		h.dir.Close()
+		h.dir = nil
+	}
+
+	h.buf = nil
+	h.start = 0
+	h.eof = false
+
+	f, err := fsys.Open(h.path)
+	if err != nil {
+		return fromFSError(err)
+	}
+
+	if dir, ok := f.(fs.ReadDirFile); ok {
+		h.dir = dir
+		return nil
+	}
+
+	// We can't page through this one, so read it all now.
+	f.Close()
+
+	entries, err := fs.ReadDir(fsys, h.path)
+	if err != nil {
+		return fromFSError(err)
+	}
+
+	h.buf = entries
+	h.eof = true
+
+	return nil
+}
+
+// Make sure that buf holds the entry with the given offset, if there is one,
+// discarding those before it. Return false if the directory has no more
+// entries.
+//
+// LOCKS_REQUIRED(h.mu)
+func (h *fromFSDirHandle) fill(
+	fsys fs.FS,
+	offset fuseops.DirOffset) (bool, error) {
+	if offset < h.start {
+		if err := h.open(fsys); err != nil {
+			return false, err
+		}
+	}
+
+	for {
+		// Drop the entries before the offset, which the kernel has consumed.
+		if skip := offset - h.start; skip > 0 {
+			if skip > fuseops.DirOffset(len(h.buf)) {
+				skip = fuseops.DirOffset(len(h.buf))
+			}
+
+			h.buf = h.buf[skip:]
+			h.start += skip
+		}
+
+		if offset == h.start && len(h.buf) > 0 {
+			return true, nil
+		}
+
+		if h.eof {
+			return false, nil
+		}
+
+		entries, err := h.dir.ReadDir(fromFSReadDirBatch)
+		h.buf = append(h.buf, entries...)
+
+		switch {
+		case err == io.EOF:
+			h.eof = true
+
+		case err != nil:
+			return false, fromFSError(err)
+		}
+	}
+}
+
+func (fs *fromFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	h, ok := fs.dirHandles[op.Handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for offset := op.Offset; ; offset++ {
+		more, err := h.fill(fs.fsys, offset)
+		if err != nil {
+			return err
+		}
+
+		if !more {
+			break
+		}
+
+		e := h.buf[0]
+
+		fs.mu.Lock()
+		id, ok := fs.ids[path.Join(h.path, e.Name())]
+		fs.mu.Unlock()
+
+		if !ok {
+			id = fromFSUnknownInode
+		}
+
+		n := WriteDirent(op.Dst[op.BytesRead:], Dirent{
+			Offset: offset + 1,
+			Inode:  id,
+			Name:   e.Name(),
+			Type:   fromFSDirentType(e.Type()),
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *fromFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.mu.Lock()
+	h, ok := fs.dirHandles[op.Handle]
+	delete(fs.dirHandles, op.Handle)
+	fs.mu.Unlock()
+
+	if ok {
+		h.mu.Lock()
+		if h.dir != nil {
+			h.dir.Close()
+		}
+		h.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (fs *fromFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	p, err := fs.getPath(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.fsys.Open(p)
+	if err != nil {
+		return fromFSError(err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.nextHandle++
+	fs.handles[fs.nextHandle] = &fromFSFileHandle{path: p, f: f}
+	op.Handle = fs.nextHandle
+
+	return nil
+}
+
+func (fs *fromFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	h, ok := fs.handles[op.Handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if ra, ok := h.f.(io.ReaderAt); ok {
+		n, err := ra.ReadAt(op.Dst, op.Offset)
+		op.BytesRead = n
+		if err == io.EOF {
+			err = nil
+		}
+
+		return err
+	}
+
+	// Otherwise read sequentially, starting again if the read goes backwards.
+	if op.Offset < h.pos {
+		f, err := fs.fsys.Open(h.path)
+		if err != nil {
+			return fromFSError(err)
+		}
+
+		h.f.Close()
+		h.f = f
+		h.pos = 0
+	}
+
+	skipped, err := io.CopyN(ioutil.Discard, h.f, op.Offset-h.pos)
+	h.pos += skipped
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	n, err := io.ReadFull(h.f, op.Dst)
+	op.BytesRead = n
+	h.pos += int64(n)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return err
+}
+
+func (fs *fromFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	h, ok := fs.handles[op.Handle]
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	if ok {
+		h.mu.Lock()
+		h.f.Close()
+		h.mu.Unlock()
+	}
+
+	return nil
+}
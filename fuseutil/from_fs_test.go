@@ -0,0 +1,256 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// An fs.FS whose root is a directory of n generated empty files, which are
+// produced on demand rather than held in memory.
+type hugeDirFS struct {
+	n int
+
+	// The largest count passed to ReadDir, and whether it was ever asked for
+	// everything at once.
+	maxBatch int
+	readAll  bool
+}
+
+func (h *hugeDirFS) Open(name string) (fs.File, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return &hugeDir{fsys: h}, nil
+}
+
+type hugeDir struct {
+	fsys *hugeDirFS
+	next int
+}
+
+func (d *hugeDir) Stat() (fs.FileInfo, error) { return hugeDirEntry("."), nil }
+func (d *hugeDir) Read([]byte) (int, error)   { return 0, io.EOF }
+func (d *hugeDir) Close() error               { return nil }
+
+func (d *hugeDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if count <= 0 {
+		d.fsys.readAll = true
+		count = d.fsys.n
+	}
+
+	if count > d.fsys.maxBatch {
+		d.fsys.maxBatch = count
+	}
+
+	var entries []fs.DirEntry
+	for ; d.next < d.fsys.n && len(entries) < count; d.next++ {
+		entries = append(entries, hugeDirEntry(fmt.Sprintf("f%06d", d.next)))
+	}
+
+	if len(entries) == 0 && count > 0 {
+		return nil, io.EOF
+	}
+
+	return entries, nil
+}
+
+// Both an fs.DirEntry and an fs.FileInfo for an empty file, or the root
+// directory when the name is ".".
+type hugeDirEntry string
+
+func (e hugeDirEntry) Name() string               { return string(e) }
+func (e hugeDirEntry) IsDir() bool                { return e == "." }
+func (e hugeDirEntry) Type() fs.FileMode          { return e.Mode().Type() }
+func (e hugeDirEntry) Info() (fs.FileInfo, error) { return e, nil }
+func (e hugeDirEntry) Size() int64                { return 0 }
+func (e hugeDirEntry) ModTime() time.Time         { return time.Time{} }
+func (e hugeDirEntry) Sys() interface{}           { return nil }
+
+func (e hugeDirEntry) Mode() fs.FileMode {
+	if e.IsDir() {
+		return fs.ModeDir | 0555
+	}
+
+	return 0444
+}
+
+// Read the whole of the directory with the given inode, Dst bytes at a time.
+func readAllDir(
+	t *testing.T,
+	fsys fuseutil.FileSystem,
+	inode fuseops.InodeID,
+	dstSize int) (names []string) {
+	ctx := context.Background()
+
+	openOp := &fuseops.OpenDirOp{Inode: inode}
+	if err := fsys.OpenDir(ctx, openOp); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	defer fsys.ReleaseDirHandle(
+		ctx,
+		&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+
+	var offset fuseops.DirOffset
+	for {
+		op := &fuseops.ReadDirOp{
+			Inode:  inode,
+			Handle: openOp.Handle,
+			Offset: offset,
+			Dst:    make([]byte, dstSize),
+		}
+
+		if err := fsys.ReadDir(ctx, op); err != nil {
+			t.Fatalf("ReadDir at %d: %v", offset, err)
+		}
+
+		if op.BytesRead == 0 {
+			return
+		}
+
+		batch, last := parseDirents(op.Dst[:op.BytesRead])
+		names = append(names, batch...)
+		offset = last
+	}
+}
+
+func TestFromFS_HugeDirectoryIsReadLazily(t *testing.T) {
+	const n = 100000
+	h := &hugeDirFS{n: n}
+	fsys := fuseutil.FromFS(h)
+
+	names := readAllDir(t, fsys, fuseops.RootInodeID, 4096)
+
+	if len(names) != n {
+		t.Fatalf("Got %d names, want %d", len(names), n)
+	}
+
+	for i, name := range names {
+		if want := fmt.Sprintf("f%06d", i); name != want {
+			t.Fatalf("Entry %d: got %q, want %q", i, name, want)
+		}
+	}
+
+	// The directory must have been paged through rather than read in one go.
+	if h.readAll {
+		t.Errorf("ReadDir was asked for every entry at once")
+	}
+
+	if h.maxBatch <= 0 || h.maxBatch > 1024 {
+		t.Errorf("Largest ReadDir batch: %d", h.maxBatch)
+	}
+}
+
+func TestFromFS_ReadDirRewind(t *testing.T) {
+	fsys := fuseutil.FromFS(&hugeDirFS{n: 10})
+	ctx := context.Background()
+
+	openOp := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	if err := fsys.OpenDir(ctx, openOp); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	// Read from the middle, then from the start again.
+	for _, tc := range []struct {
+		offset fuseops.DirOffset
+		first  string
+	}{
+		{7, "f000007"},
+		{2, "f000002"},
+		{0, "f000000"},
+	} {
+		op := &fuseops.ReadDirOp{
+			Handle: openOp.Handle,
+			Offset: tc.offset,
+			Dst:    make([]byte, 4096),
+		}
+
+		if err := fsys.ReadDir(ctx, op); err != nil {
+			t.Fatalf("ReadDir at %d: %v", tc.offset, err)
+		}
+
+		names, _ := parseDirents(op.Dst[:op.BytesRead])
+		if len(names) != 10-int(tc.offset) || names[0] != tc.first {
+			t.Errorf("ReadDir at %d: got %v", tc.offset, names)
+		}
+	}
+}
+
+func TestFromFS_LookUpAndRead(t *testing.T) {
+	fsys := fuseutil.FromFS(fstest.MapFS{
+		"dir/taco.txt": &fstest.MapFile{Data: []byte("burrito"), Mode: 0444},
+	})
+	ctx := context.Background()
+
+	dirOp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "dir"}
+	if err := fsys.LookUpInode(ctx, dirOp); err != nil {
+		t.Fatalf("LookUpInode(dir): %v", err)
+	}
+
+	if !dirOp.Entry.Attributes.Mode.IsDir() {
+		t.Errorf("dir mode: %v", dirOp.Entry.Attributes.Mode)
+	}
+
+	names := readAllDir(t, fsys, dirOp.Entry.Child, 4096)
+	if len(names) != 1 || names[0] != "taco.txt" {
+		t.Errorf("dir contents: %v", names)
+	}
+
+	fileOp := &fuseops.LookUpInodeOp{Parent: dirOp.Entry.Child, Name: "taco.txt"}
+	if err := fsys.LookUpInode(ctx, fileOp); err != nil {
+		t.Fatalf("LookUpInode(taco.txt): %v", err)
+	}
+
+	if got := fileOp.Entry.Attributes.Size; got != 7 {
+		t.Errorf("Size: %d", got)
+	}
+
+	openOp := &fuseops.OpenFileOp{Inode: fileOp.Entry.Child}
+	if err := fsys.OpenFile(ctx, openOp); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:  fileOp.Entry.Child,
+		Handle: openOp.Handle,
+		Offset: 3,
+		Dst:    make([]byte, 100),
+	}
+
+	if err := fsys.ReadFile(ctx, readOp); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got := string(readOp.Dst[:readOp.BytesRead]); got != "rito" {
+		t.Errorf("ReadFile: %q", got)
+	}
+
+	missingOp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "nope"}
+	if err := fsys.LookUpInode(ctx, missingOp); err != fuse.ENOENT {
+		t.Errorf("LookUpInode(nope): %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// HandleStats counts the reads and writes made through an open file handle of
+// a file system wrapped with NewHandleStatsFileSystem.
+type HandleStats struct {
+	// The inode that the handle was opened for.
+	Inode fuseops.InodeID
+
+	// The number of ReadFileOps and WriteFileOps received for the handle,
+	// including those that failed.
+	Reads  uint64
+	Writes uint64
+
+	// The number of bytes successfully read and written through the handle.
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// HandleStatsFileSystem is a FileSystem that keeps HandleStats for each open
+// file handle of the file system it wraps. See NewHandleStatsFileSystem.
+type HandleStatsFileSystem struct {
+	// The wrapped file system, to which ops that aren't counted go directly.
+	FileSystem
+
+	mu    sync.Mutex
+	stats map[fuseops.HandleID]*HandleStats // GUARDED_BY(mu)
+}
+
+// NewHandleStatsFileSystem wraps the supplied file system, counting the reads
+// and writes made through each file handle that it opens or creates until the
+// handle is released, for diagnosing the behavior of a particular open file
+// without instrumenting the whole file system. Copies made with CopyFileRange
+// count as a read of the source handle and a write of the destination. An op
+// finished later with ReplyLater is counted, bytes and all, when it is
+// completed.
+func NewHandleStatsFileSystem(fs FileSystem) *HandleStatsFileSystem {
+	return &HandleStatsFileSystem{
+		FileSystem: fs,
+		stats:      make(map[fuseops.HandleID]*HandleStats),
+	}
+}
+
+// Stats returns the counters for the supplied file handle, or false if the
+// handle isn't open.
+func (fs *HandleStatsFileSystem) Stats(h fuseops.HandleID) (HandleStats, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	s, ok := fs.stats[h]
+	if !ok {
+		return HandleStats{}, false
+	}
+
+	return *s, true
+}
+
+// Begin counting for a newly opened handle.
+func (fs *HandleStatsFileSystem) open(h fuseops.HandleID, inode fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.stats[h] = &HandleStats{Inode: inode}
+}
+
+// Apply f to the counters for the supplied handle, if it's open.
+func (fs *HandleStatsFileSystem) update(h fuseops.HandleID, f func(*HandleStats)) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if s, ok := fs.stats[h]; ok {
+		f(s)
+	}
+}
+
+func (fs *HandleStatsFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	err := fs.FileSystem.CreateFile(ctx, op)
+	if err == nil {
+		fs.open(op.Handle, op.Entry.Child)
+	}
+
+	return err
+}
+
+func (fs *HandleStatsFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	err := fs.FileSystem.OpenFile(ctx, op)
+	if err == nil {
+		fs.open(op.Handle, op.Inode)
+	}
+
+	return err
+}
+
+func (fs *HandleStatsFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return whenFinished(
+		ctx,
+		func(ctx context.Context) error { return fs.FileSystem.ReadFile(ctx, op) },
+		func(err error) {
+			fs.update(op.Handle, func(s *HandleStats) {
+				s.Reads++
+				if err == nil {
+					s.BytesRead += uint64(op.BytesRead)
+				}
+			})
+		})
+}
+
+func (fs *HandleStatsFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return whenFinished(
+		ctx,
+		func(ctx context.Context) error { return fs.FileSystem.WriteFile(ctx, op) },
+		func(err error) {
+			fs.update(op.Handle, func(s *HandleStats) {
+				s.Writes++
+				if err == nil {
+					s.BytesWritten += uint64(len(op.Data))
+				}
+			})
+		})
+}
+
+func (fs *HandleStatsFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return whenFinished(
+		ctx,
+		func(ctx context.Context) error { return fs.FileSystem.CopyFileRange(ctx, op) },
+		func(err error) {
+			fs.update(op.HandleIn, func(s *HandleStats) {
+				s.Reads++
+				if err == nil {
+					s.BytesRead += op.BytesCopied
+				}
+			})
+
+			fs.update(op.HandleOut, func(s *HandleStats) {
+				s.Writes++
+				if err == nil {
+					s.BytesWritten += op.BytesCopied
+				}
+			})
+		})
+}
+
+func (fs *HandleStatsFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	delete(fs.stats, op.Handle)
+	fs.mu.Unlock()
+
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
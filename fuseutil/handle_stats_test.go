@@ -0,0 +1,234 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system whose files read as 100 bytes of zeroes, accept any write,
+// and fail reads and writes past a megabyte.
+type statsFS struct {
+	fuseutil.NotImplementedFileSystem
+	nextHandle fuseops.HandleID
+}
+
+func (fs *statsFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.nextHandle++
+	op.Handle = fs.nextHandle
+	return nil
+}
+
+func (fs *statsFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if op.Offset >= 1<<20 {
+		return fuse.EIO
+	}
+
+	if op.Offset < 100 {
+		op.BytesRead = len(op.Dst)
+		if remaining := 100 - int(op.Offset); op.BytesRead > remaining {
+			op.BytesRead = remaining
+		}
+	}
+
+	return nil
+}
+
+func (fs *statsFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if op.Offset >= 1<<20 {
+		return fuse.EIO
+	}
+
+	return nil
+}
+
+func (fs *statsFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+// Like statsFS, but completing reads and writes later with ReplyLater.
+type asyncStatsFS struct {
+	statsFS
+}
+
+func (fs *asyncStatsFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	complete := fuseutil.ReplyLater(ctx)
+	go func() { complete(fs.statsFS.ReadFile(ctx, op)) }()
+	return fuseutil.ErrPending
+}
+
+func (fs *asyncStatsFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	complete := fuseutil.ReplyLater(ctx)
+	go func() { complete(fs.statsFS.WriteFile(ctx, op)) }()
+	return fuseutil.ErrPending
+}
+
+func TestHandleStatsFileSystem(t *testing.T) {
+	fs := fuseutil.NewHandleStatsFileSystem(&statsFS{})
+	ctx := context.Background()
+
+	// Open the same inode twice, and another once.
+	var handles []fuseops.HandleID
+	for _, inode := range []fuseops.InodeID{2, 2, 3} {
+		op := &fuseops.OpenFileOp{Inode: inode}
+		if err := fs.OpenFile(ctx, op); err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+
+		handles = append(handles, op.Handle)
+	}
+
+	read := func(h fuseops.HandleID, offset int64, size int) {
+		fs.ReadFile(ctx, &fuseops.ReadFileOp{
+			Inode:  2,
+			Handle: h,
+			Offset: offset,
+			Dst:    make([]byte, size),
+		})
+	}
+
+	write := func(h fuseops.HandleID, offset int64, size int) {
+		fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Inode:  2,
+			Handle: h,
+			Offset: offset,
+			Data:   make([]byte, size),
+		})
+	}
+
+	// The first handle reads the whole file in pieces, the last of them short,
+	// and then fails to read past a megabyte.
+	read(handles[0], 0, 40)
+	read(handles[0], 40, 40)
+	read(handles[0], 80, 40)
+	read(handles[0], 1<<20, 40)
+
+	// The second writes, failing once.
+	write(handles[1], 0, 10)
+	write(handles[1], 10, 7)
+	write(handles[1], 1<<20, 5)
+
+	// The third tries to copy from the first, which the file system doesn't
+	// support. Both handles count the op, but no bytes.
+	fs.CopyFileRange(ctx, &fuseops.CopyFileRangeOp{
+		InodeIn:   2,
+		HandleIn:  handles[0],
+		InodeOut:  3,
+		HandleOut: handles[2],
+		Length:    0,
+	})
+
+	want := []fuseutil.HandleStats{
+		{Inode: 2, Reads: 5, BytesRead: 100},
+		{Inode: 2, Writes: 3, BytesWritten: 17},
+		{Inode: 3, Writes: 1},
+	}
+
+	for i, h := range handles {
+		got, ok := fs.Stats(h)
+		if !ok {
+			t.Fatalf("Stats(%d): not found", h)
+		}
+
+		if got != want[i] {
+			t.Errorf("Stats(%d): got %+v, want %+v", h, got, want[i])
+		}
+	}
+
+	// Once released, a handle has no stats.
+	err := fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+		Handle: handles[0],
+	})
+
+	if err != nil {
+		t.Fatalf("ReleaseFileHandle: %v", err)
+	}
+
+	if s, ok := fs.Stats(handles[0]); ok {
+		t.Errorf("Stats after release: got %+v", s)
+	}
+
+	if _, ok := fs.Stats(handles[1]); !ok {
+		t.Errorf("Stats for unreleased handle: not found")
+	}
+}
+
+func TestHandleStatsFileSystem_ReplyLater(t *testing.T) {
+	fs := fuseutil.NewHandleStatsFileSystem(&asyncStatsFS{})
+
+	op := &fuseops.OpenFileOp{Inode: 2}
+	if err := fs.OpenFile(context.Background(), op); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	h := op.Handle
+	kernel, hangUp := serveOverSocket(t, fs)
+	defer hangUp()
+
+	// Read 40 bytes, and write 10, one at a time.
+	reqs := []fusetesting.RawRequest{
+		rawRequest(2, fusekernel.OpRead, 2, fusekernel.ReadIn{Fh: uint64(h), Size: 40}),
+		rawRequest(
+			3,
+			fusekernel.OpWrite,
+			2,
+			fusekernel.WriteIn{Fh: uint64(h), Size: 10},
+			make([]byte, 10)),
+	}
+
+	buf := make([]byte, 4096)
+	for _, req := range reqs {
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		if _, err := kernel.Read(buf); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+
+	// Both should have been counted, with their bytes, by the time they were
+	// replied to.
+	want := fuseutil.HandleStats{
+		Inode:        2,
+		Reads:        1,
+		Writes:       1,
+		BytesRead:    40,
+		BytesWritten: 10,
+	}
+
+	if got, _ := fs.Stats(h); got != want {
+		t.Errorf("Stats: got %+v, want %+v", got, want)
+	}
+}
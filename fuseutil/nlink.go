@@ -0,0 +1,37 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+// DirNlink returns the link count that a directory with the given number of
+// subdirectories should report: two plus that number, for the directory's
+// entry in its parent, its own "." entry, and the ".." entry of each
+// subdirectory. See the notes on fuseops.InodeAttributes.Nlink.
+func DirNlink(subdirs int) uint32 {
+	return 2 + uint32(subdirs)
+}
+
+// DirNlinkOf is like DirNlink, counting the subdirectories among the supplied
+// entries of the directory. Entries for "." and "..", if present, are not
+// counted.
+func DirNlinkOf(entries []Dirent) uint32 {
+	var subdirs int
+	for _, e := range entries {
+		if e.Type == DT_Directory && e.Name != "." && e.Name != ".." {
+			subdirs++
+		}
+	}
+
+	return DirNlink(subdirs)
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system whose root directory allows making empty subdirectories,
+// reporting its link count with DirNlinkOf.
+type mkdirFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	entries []fuseutil.Dirent // GUARDED_BY(mu)
+}
+
+func (fs *mkdirFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes = fuseops.InodeAttributes{Mode: os.ModeDir | 0755}
+	if op.Inode == fuseops.RootInodeID {
+		op.Attributes.Nlink = fuseutil.DirNlinkOf(fs.entries)
+	} else {
+		op.Attributes.Nlink = fuseutil.DirNlink(0)
+	}
+
+	return nil
+}
+
+func (fs *mkdirFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d := fuseutil.Dirent{
+		Offset: fuseops.DirOffset(len(fs.entries) + 1),
+		Inode:  fuseops.RootInodeID + 1 + fuseops.InodeID(len(fs.entries)),
+		Name:   op.Name,
+		Type:   fuseutil.DT_Directory,
+	}
+
+	fs.entries = append(fs.entries, d)
+	op.Entry.Child = d.Inode
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Nlink: fuseutil.DirNlink(0),
+		Mode:  os.ModeDir | 0755,
+	}
+
+	return nil
+}
+
+func TestDirNlink(t *testing.T) {
+	for _, n := range []int{0, 1, 5} {
+		// Make n subdirectories of the root, then stat it.
+		trace := []fusetesting.RawRequest{initRequest()}
+		for i := 0; i < n; i++ {
+			trace = append(trace, rawRequest(
+				uint64(len(trace)+1),
+				fusekernel.OpMkdir,
+				uint64(fuseops.RootInodeID),
+				fusekernel.MkdirIn{Mode: 0755},
+				[]byte(fmt.Sprintf("sub%d\x00", i))))
+		}
+
+		trace = append(trace, rawRequest(
+			uint64(len(trace)+1),
+			fusekernel.OpGetattr,
+			uint64(fuseops.RootInodeID),
+			fusekernel.GetattrIn{}))
+
+		responses, err := fusetesting.ReplayTrace(&mkdirFS{}, trace)
+		if err != nil {
+			t.Fatalf("ReplayTrace: %v", err)
+		}
+
+		if len(responses) != len(trace) {
+			t.Fatalf("Got %d responses", len(responses))
+		}
+
+		resp := responses[len(responses)-1]
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&resp[0]))
+		if h.Error != 0 {
+			t.Fatalf("GetInodeAttributes: error %d", h.Error)
+		}
+
+		out := (*fusekernel.AttrOut)(unsafe.Pointer(&resp[unsafe.Sizeof(*h)]))
+		if out.Attr.Nlink != uint32(n+2) {
+			t.Errorf("%d subdirectories: Nlink %d, want %d", n, out.Attr.Nlink, n+2)
+		}
+	}
+}
+
+func TestDirNlinkOf(t *testing.T) {
+	// Files and the "." and ".." entries don't count.
+	entries := []fuseutil.Dirent{
+		{Name: ".", Type: fuseutil.DT_Directory},
+		{Name: "..", Type: fuseutil.DT_Directory},
+		{Name: "foo", Type: fuseutil.DT_File},
+		{Name: "bar", Type: fuseutil.DT_Directory},
+		{Name: "baz", Type: fuseutil.DT_Link},
+		{Name: "qux", Type: fuseutil.DT_Directory},
+	}
+
+	if got := fuseutil.DirNlinkOf(entries); got != 4 {
+		t.Errorf("DirNlinkOf: %d, want 4", got)
+	}
+}
@@ -0,0 +1,1289 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The size of the pieces in which file contents are copied up.
+const overlayCopyChunkSize = 1 << 17
+
+// NewOverlayFileSystem returns a file system presenting the union of two
+// others: a lower layer that is only ever read from, and an upper layer to
+// which all changes are made.
+//
+// Names are looked up in the upper layer first, and a directory present in
+// both layers lists the entries of both. An inode that exists only in the
+// lower layer is copied up to the upper layer, along with any of its parent
+// directories that aren't there yet, the first time it is modified: when it
+// is opened for writing, or by WriteFile, SetInodeAttributes, or CreateLink.
+// From then on the upper copy is used for everything, including reads through
+// handles opened before the copy. New inodes are created in the upper layer.
+//
+// Removing and renaming entries is not supported, since hiding entries of the
+// lower layer would require whiteouts; these ops, and others not mentioned
+// here, fail with ENOSYS. Hard links within the lower layer are broken by
+// copying up, and the inode numbers in directory listings are those of the
+// layers rather than those reported by stat(2).
+//
+// The layers are called without any lock held, so ops on the overlay run
+// concurrently, and the layers must be safe for concurrent use. A node is
+// copied up only once, however many ops need it copied at the same time; the
+// others wait for that copy to finish.
+func NewOverlayFileSystem(lower, upper FileSystem) FileSystem {
+	root := &overlayNode{
+		id:       fuseops.RootInodeID,
+		lower:    fuseops.RootInodeID,
+		upper:    fuseops.RootInodeID,
+		children: make(map[string]*overlayNode),
+	}
+
+	return &overlayFS{
+		lower:      lower,
+		upper:      upper,
+		nodes:      map[fuseops.InodeID]*overlayNode{root.id: root},
+		upperNodes: map[fuseops.InodeID]*overlayNode{root.upper: root},
+		nextID:     fuseops.RootInodeID + 1,
+		handles:    make(map[fuseops.HandleID]*overlayHandle),
+	}
+}
+
+type overlayFS struct {
+	NotImplementedFileSystem
+
+	lower FileSystem
+	upper FileSystem
+
+	// Snapshots of merged directory listings, for open directory handles.
+	dirs DirSnapshots
+
+	mu sync.Mutex
+
+	// The inodes known to the kernel, indexed by overlay inode ID and by the ID
+	// of their inode in the upper layer, if any. IDs are never reused.
+	//
+	// GUARDED_BY(mu)
+	nodes      map[fuseops.InodeID]*overlayNode
+	upperNodes map[fuseops.InodeID]*overlayNode
+	nextID     fuseops.InodeID
+
+	// Open file handles.
+	//
+	// GUARDED_BY(mu)
+	handles    map[fuseops.HandleID]*overlayHandle
+	nextHandle fuseops.HandleID
+
+	// Layer inodes to let go of once mu is released.
+	//
+	// GUARDED_BY(mu)
+	staleInodes []staleInode
+}
+
+type staleInode struct {
+	layer FileSystem
+	inode fuseops.InodeID
+	n     uint64
+}
+
+type overlayNode struct {
+	id fuseops.InodeID
+
+	// The node's parent and name within it, used to find the parent directory
+	// when copying up. Nil for the root.
+	parent *overlayNode
+	name   string
+
+	// The node's inode in each layer, or zero if it doesn't exist there, and the
+	// number of lookups of each that must eventually be forgotten.
+	lower        fuseops.InodeID
+	upper        fuseops.InodeID
+	lowerLookups uint64
+	upperLookups uint64
+
+	// The kernel's lookup count for the node.
+	lookupCount uint64
+
+	// Children that have been looked up, by name.
+	children map[string]*overlayNode
+
+	// Non-nil while the node is being copied up, and closed once it has been.
+	copying chan struct{}
+
+	// The number of copy-ups of children begun, so that lookups can tell
+	// whether one overlapped them.
+	childCopyUps uint64
+}
+
+type overlayHandle struct {
+	node  *overlayNode
+	flags fusekernel.OpenFlags
+
+	// Held shared while the layer handle is in use, and exclusively to switch
+	// it to the upper layer.
+	mu sync.RWMutex
+
+	// The handle in the upper layer if upper is set, otherwise in the lower.
+	//
+	// GUARDED_BY(mu)
+	upper  bool
+	handle fuseops.HandleID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *overlayFS) getNode(id fuseops.InodeID) (*overlayNode, error) {
+	n, ok := fs.nodes[id]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	return n, nil
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *overlayFS) getHandle(id fuseops.HandleID) (*overlayHandle, error) {
+	h, ok := fs.handles[id]
+	if !ok {
+		return nil, fuse.EINVAL
+	}
+
+	return h, nil
+}
+
+// Return the layer in which the node's current version lives, and its inode
+// there.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *overlayFS) layerFor(n *overlayNode) (FileSystem, fuseops.InodeID) {
+	if n.upper != 0 {
+		return fs.upper, n.upper
+	}
+
+	return fs.lower, n.lower
+}
+
+// Look up the node with the given ID and return the layer in which its current
+// version lives, and its inode there.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *overlayFS) lookUpLayer(
+	id fuseops.InodeID) (FileSystem, fuseops.InodeID, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.getNode(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	layer, inode := fs.layerFor(n)
+	return layer, inode, nil
+}
+
+// Record a lookup of an inode in the upper layer on behalf of the node.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *overlayFS) addUpper(n *overlayNode, inode fuseops.InodeID) {
+	n.upper = inode
+	n.upperLookups++
+	fs.upperNodes[inode] = n
+}
+
+// Find or create the node for the named child of the parent, given its inode
+// in each layer (zero where absent), and return an entry for it based on the
+// supplied one from one of the layers. The kernel's lookup count for the node
+// is incremented. Release fs.mu with unlock afterward.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *overlayFS) childEntry(
+	ctx context.Context,
+	parent *overlayNode,
+	name string,
+	lower fuseops.InodeID,
+	upper fuseops.InodeID,
+	e fuseops.ChildInodeEntry) fuseops.ChildInodeEntry {
+	// Prefer the node already associated with the upper inode, so that hard
+	// links share a node. Otherwise use the node last seen with this name, if
+	// it's still alive.
+	n := fs.upperNodes[upper]
+	if n == nil {
+		if c := parent.children[name]; c != nil && fs.nodes[c.id] == c {
+			n = c
+		}
+	}
+
+	if n == nil {
+		n = &overlayNode{
+			id:       fs.nextID,
+			parent:   parent,
+			name:     name,
+			children: make(map[string]*overlayNode),
+		}
+
+		fs.nextID++
+		fs.nodes[n.id] = n
+		parent.children[name] = n
+	}
+
+	// Account for the lookups in the layers. If a layer now gives a different
+	// inode for the node than before, something was changed beneath us; let go
+	// of the old one.
+	if lower != 0 {
+		if n.lower != 0 && n.lower != lower {
+			fs.staleInodes = append(
+				fs.staleInodes,
+				staleInode{fs.lower, n.lower, n.lowerLookups})
+			n.lowerLookups = 0
+		}
+
+		n.lower = lower
+		n.lowerLookups++
+	}
+
+	if upper != 0 {
+		if n.upper != 0 && n.upper != upper {
+			fs.staleInodes = append(
+				fs.staleInodes,
+				staleInode{fs.upper, n.upper, n.upperLookups})
+			delete(fs.upperNodes, n.upper)
+			n.upperLookups = 0
+		}
+
+		fs.addUpper(n, upper)
+	}
+
+	n.lookupCount++
+
+	e.Child = n.id
+	e.Generation = 0
+	return e
+}
+
+// Release fs.mu, then let go of any layer inodes found to be stale while it
+// was held.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *overlayFS) unlock(ctx context.Context) {
+	stale := fs.staleInodes
+	fs.staleInodes = nil
+	fs.mu.Unlock()
+
+	for _, s := range stale {
+		fs.forgetLayer(ctx, s.layer, s.inode, s.n)
+	}
+}
+
+func (fs *overlayFS) forgetLayer(
+	ctx context.Context,
+	layer FileSystem,
+	inode fuseops.InodeID,
+	n uint64) {
+	if inode == 0 || n == 0 {
+		return
+	}
+
+	layer.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: inode, N: n})
+}
+
+// Look up a name within a directory in one layer, returning a zero entry if it
+// doesn't exist.
+func lookUpInLayer(
+	ctx context.Context,
+	layer FileSystem,
+	parent fuseops.InodeID,
+	name string,
+	opCtx fuseops.OpContext) (fuseops.ChildInodeEntry, error) {
+	if parent == 0 {
+		return fuseops.ChildInodeEntry{}, nil
+	}
+
+	op := &fuseops.LookUpInodeOp{
+		Parent:    parent,
+		Name:      name,
+		OpContext: opCtx,
+	}
+
+	err := layer.LookUpInode(ctx, op)
+	if err == fuse.ENOENT {
+		return fuseops.ChildInodeEntry{}, nil
+	}
+
+	return op.Entry, err
+}
+
+// Wait for any copy-up of the node that is in progress to finish. n may be
+// nil. fs.mu is released while waiting.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *overlayFS) waitForCopyUp(
+	ctx context.Context,
+	n *overlayNode) error {
+	for n != nil && n.copying != nil {
+		copying := n.copying
+		fs.mu.Unlock()
+
+		select {
+		case <-copying:
+		case <-ctx.Done():
+			fs.mu.Lock()
+			return ctx.Err()
+		}
+
+		fs.mu.Lock()
+	}
+
+	return nil
+}
+
+// Make sure that the node exists in the upper layer, copying it up from the
+// lower layer if necessary. fs.mu is released while the layers are called, and
+// other ops that need the node copied up meanwhile wait for this copy rather
+// than making their own.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *overlayFS) copyUp(
+	ctx context.Context,
+	n *overlayNode,
+	opCtx fuseops.OpContext) error {
+	// The parent must be copied up first. (The root exists in both layers, so
+	// this terminates.) Start over afterward, since another op may have copied
+	// up the node while the lock was released.
+	for {
+		if err := fs.waitForCopyUp(ctx, n); err != nil {
+			return err
+		}
+
+		if n.upper != 0 {
+			return nil
+		}
+
+		if n.parent.upper != 0 {
+			break
+		}
+
+		if err := fs.copyUp(ctx, n.parent, opCtx); err != nil {
+			return err
+		}
+	}
+
+	copying := make(chan struct{})
+	n.copying = copying
+	n.parent.childCopyUps++
+	lower := n.lower
+	parent := n.parent.upper
+
+	fs.mu.Unlock()
+	upper, err := fs.copyUpLayers(ctx, lower, parent, n.name, opCtx)
+	fs.mu.Lock()
+
+	n.copying = nil
+	close(copying)
+
+	if upper != 0 {
+		fs.addUpper(n, upper)
+	}
+
+	return err
+}
+
+// Look up the node with the given ID and make sure that it exists in the upper
+// layer, returning it and its inode there.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *overlayFS) copyUpNode(
+	ctx context.Context,
+	id fuseops.InodeID,
+	opCtx fuseops.OpContext) (*overlayNode, fuseops.InodeID, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.getNode(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := fs.copyUp(ctx, n, opCtx); err != nil {
+		return nil, 0, err
+	}
+
+	return n, n.upper, nil
+}
+
+// Copy the lower layer's inode to an inode with the given name in the given
+// directory of the upper layer, returning the new inode. The inode is returned
+// even if its attributes couldn't be set, but a partial copy of a file's
+// contents is removed.
+func (fs *overlayFS) copyUpLayers(
+	ctx context.Context,
+	lower fuseops.InodeID,
+	parent fuseops.InodeID,
+	name string,
+	opCtx fuseops.OpContext) (fuseops.InodeID, error) {
+	getAttrs := &fuseops.GetInodeAttributesOp{Inode: lower, OpContext: opCtx}
+	if err := fs.lower.GetInodeAttributes(ctx, getAttrs); err != nil {
+		return 0, err
+	}
+
+	attrs := getAttrs.Attributes
+
+	// Create the inode in the upper layer.
+	var entry fuseops.ChildInodeEntry
+	switch {
+	case attrs.Mode.IsDir():
+		op := &fuseops.MkDirOp{
+			Parent:    parent,
+			Name:      name,
+			Mode:      attrs.Mode,
+			OpContext: opCtx,
+		}
+
+		if err := fs.upper.MkDir(ctx, op); err != nil {
+			return 0, err
+		}
+
+		entry = op.Entry
+
+	case attrs.Mode&os.ModeSymlink != 0:
+		readOp := &fuseops.ReadSymlinkOp{Inode: lower, OpContext: opCtx}
+		if err := fs.lower.ReadSymlink(ctx, readOp); err != nil {
+			return 0, err
+		}
+
+		op := &fuseops.CreateSymlinkOp{
+			Parent:    parent,
+			Name:      name,
+			Target:    readOp.Target,
+			OpContext: opCtx,
+		}
+
+		if err := fs.upper.CreateSymlink(ctx, op); err != nil {
+			return 0, err
+		}
+
+		entry = op.Entry
+
+	case attrs.Mode.IsRegular():
+		op := &fuseops.CreateFileOp{
+			Parent:    parent,
+			Name:      name,
+			Mode:      attrs.Mode,
+			OpContext: opCtx,
+		}
+
+		if err := fs.upper.CreateFile(ctx, op); err != nil {
+			return 0, err
+		}
+
+		entry = op.Entry
+		err := fs.copyContents(ctx, lower, entry.Child, op.Handle, opCtx)
+		fs.upper.ReleaseFileHandle(
+			ctx,
+			&fuseops.ReleaseFileHandleOp{Handle: op.Handle, OpContext: opCtx})
+
+		// Don't leave a partial copy behind to hide the lower file, and to get
+		// in the way of trying again.
+		if err != nil {
+			fs.upper.Unlink(ctx, &fuseops.UnlinkOp{
+				Parent:    parent,
+				Name:      name,
+				OpContext: opCtx,
+			})
+
+			fs.forgetLayer(ctx, fs.upper, entry.Child, 1)
+			return 0, err
+		}
+
+	default:
+		op := &fuseops.MkNodeOp{
+			Parent:    parent,
+			Name:      name,
+			Mode:      attrs.Mode,
+			OpContext: opCtx,
+		}
+
+		if err := fs.upper.MkNode(ctx, op); err != nil {
+			return 0, err
+		}
+
+		entry = op.Entry
+	}
+
+	// Preserve times, and ownership where it differs from what the upper layer
+	// chose. Symlinks can't be changed.
+	if attrs.Mode&os.ModeSymlink != 0 {
+		return entry.Child, nil
+	}
+
+	setAttrs := &fuseops.SetInodeAttributesOp{
+		Inode:     entry.Child,
+		Atime:     &attrs.Atime,
+		Mtime:     &attrs.Mtime,
+		OpContext: opCtx,
+	}
+
+	if attrs.Uid != entry.Attributes.Uid {
+		setAttrs.Uid = &attrs.Uid
+	}
+
+	if attrs.Gid != entry.Attributes.Gid {
+		setAttrs.Gid = &attrs.Gid
+	}
+
+	return entry.Child, fs.upper.SetInodeAttributes(ctx, setAttrs)
+}
+
+// Copy the contents of a file in the lower layer to one in the upper layer,
+// open with the supplied handle.
+func (fs *overlayFS) copyContents(
+	ctx context.Context,
+	lower fuseops.InodeID,
+	upper fuseops.InodeID,
+	upperHandle fuseops.HandleID,
+	opCtx fuseops.OpContext) error {
+	openOp := &fuseops.OpenFileOp{
+		Inode:     lower,
+		OpenFlags: fusekernel.OpenReadOnly,
+		OpContext: opCtx,
+	}
+
+	if err := fs.lower.OpenFile(ctx, openOp); err != nil {
+		return err
+	}
+
+	defer fs.lower.ReleaseFileHandle(
+		ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle, OpContext: opCtx})
+
+	buf := make([]byte, overlayCopyChunkSize)
+	for offset := int64(0); ; {
+		readOp := &fuseops.ReadFileOp{
+			Inode:     lower,
+			Handle:    openOp.Handle,
+			Offset:    offset,
+			Dst:       buf,
+			OpContext: opCtx,
+		}
+
+		if err := fs.lower.ReadFile(ctx, readOp); err != nil {
+			return err
+		}
+
+		if readOp.BytesRead == 0 {
+			return nil
+		}
+
+		writeOp := &fuseops.WriteFileOp{
+			Inode:     upper,
+			Handle:    upperHandle,
+			Offset:    offset,
+			Data:      buf[:readOp.BytesRead],
+			OpContext: opCtx,
+		}
+
+		if err := fs.upper.WriteFile(ctx, writeOp); err != nil {
+			return err
+		}
+
+		offset += int64(readOp.BytesRead)
+	}
+}
+
+// Look up a handle, taking fs.mu to do so.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *overlayFS) lookUpHandle(id fuseops.HandleID) (*overlayHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.getHandle(id)
+}
+
+// Make sure that the handle refers to the upper layer if the node has been
+// copied up. If copy is set, copy the node up first.
+//
+// LOCKS_EXCLUDED(fs.mu, h.mu)
+func (fs *overlayFS) refreshHandle(
+	ctx context.Context,
+	h *overlayHandle,
+	copy bool,
+	opCtx fuseops.OpContext) error {
+	fs.mu.Lock()
+	var err error
+	if copy {
+		err = fs.copyUp(ctx, h.node, opCtx)
+	}
+
+	upper := h.node.upper
+	fs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if upper == 0 {
+		return nil
+	}
+
+	h.mu.RLock()
+	switched := h.upper
+	h.mu.RUnlock()
+
+	if switched {
+		return nil
+	}
+
+	// Switch to a handle for the upper copy, unless another op has beaten us
+	// to it. Holding h.mu exclusively waits out ops still using the lower
+	// layer's handle before it is released.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.upper {
+		return nil
+	}
+
+	openOp := &fuseops.OpenFileOp{
+		Inode:     upper,
+		OpenFlags: h.flags,
+		OpContext: opCtx,
+	}
+
+	if err := fs.upper.OpenFile(ctx, openOp); err != nil {
+		return err
+	}
+
+	fs.lower.ReleaseFileHandle(
+		ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: h.handle, OpContext: opCtx})
+
+	h.upper = true
+	h.handle = openOp.Handle
+	return nil
+}
+
+// Return the layer, inode, and layer handle to use for an op on the handle.
+//
+// LOCKS_REQUIRED(h.mu)
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *overlayFS) handleLayer(
+	h *overlayHandle) (FileSystem, fuseops.InodeID, fuseops.HandleID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if h.upper {
+		return fs.upper, h.node.upper, h.handle
+	}
+
+	return fs.lower, h.node.lower, h.handle
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *overlayFS) newHandle(h *overlayHandle) fuseops.HandleID {
+	fs.nextHandle++
+	fs.handles[fs.nextHandle] = h
+	return fs.nextHandle
+}
+
+// Read all of the entries in a directory in one layer.
+func readAllDirents(
+	ctx context.Context,
+	layer FileSystem,
+	inode fuseops.InodeID,
+	opCtx fuseops.OpContext) ([]Dirent, error) {
+	openOp := &fuseops.OpenDirOp{Inode: inode, OpContext: opCtx}
+	if err := layer.OpenDir(ctx, openOp); err != nil {
+		return nil, err
+	}
+
+	defer layer.ReleaseDirHandle(
+		ctx,
+		&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle, OpContext: opCtx})
+
+	var entries []Dirent
+	buf := make([]byte, 1<<16)
+	for offset := fuseops.DirOffset(0); ; {
+		readOp := &fuseops.ReadDirOp{
+			Inode:     inode,
+			Handle:    openOp.Handle,
+			Offset:    offset,
+			Dst:       buf,
+			OpContext: opCtx,
+		}
+
+		if err := layer.ReadDir(ctx, readOp); err != nil {
+			return nil, err
+		}
+
+		batch := parseDirents(buf[:readOp.BytesRead])
+		if len(batch) == 0 {
+			return entries, nil
+		}
+
+		entries = append(entries, batch...)
+		offset = batch[len(batch)-1].Offset
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *overlayFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.upper.StatFS(ctx, op)
+}
+
+func (fs *overlayFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.unlock(ctx)
+
+	parent, err := fs.getNode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// Don't look while the child is being copied up, since the upper layer
+		// may hold a partial copy.
+		if err := fs.waitForCopyUp(ctx, parent.children[op.Name]); err != nil {
+			return err
+		}
+
+		copyUps := parent.childCopyUps
+		lowerParent := parent.lower
+		upperParent := parent.upper
+
+		fs.mu.Unlock()
+		lower, upper, err := fs.lookUpInLayers(
+			ctx,
+			lowerParent,
+			upperParent,
+			op.Name,
+			op.OpContext)
+		fs.mu.Lock()
+
+		if err != nil {
+			return err
+		}
+
+		if parent.childCopyUps == copyUps {
+			switch {
+			case upper.Child != 0:
+				op.Entry = fs.childEntry(ctx, parent, op.Name, lower.Child, upper.Child, upper)
+
+			case lower.Child != 0:
+				op.Entry = fs.childEntry(ctx, parent, op.Name, lower.Child, 0, lower)
+
+			default:
+				return fuse.ENOENT
+			}
+
+			return nil
+		}
+
+		// A child began to be copied up meanwhile, and if it was this one the
+		// upper layer may have been caught mid-copy. Look again.
+		fs.mu.Unlock()
+		fs.forgetLayer(ctx, fs.lower, lower.Child, 1)
+		fs.forgetLayer(ctx, fs.upper, upper.Child, 1)
+		fs.mu.Lock()
+	}
+}
+
+// Look up a name in the given directory of each layer (zero where absent). The
+// entry for the lower layer is zero if the upper layer's takes precedence.
+func (fs *overlayFS) lookUpInLayers(
+	ctx context.Context,
+	lowerParent fuseops.InodeID,
+	upperParent fuseops.InodeID,
+	name string,
+	opCtx fuseops.OpContext) (lower, upper fuseops.ChildInodeEntry, err error) {
+	upper, err = lookUpInLayer(ctx, fs.upper, upperParent, name, opCtx)
+	if err != nil {
+		return
+	}
+
+	// The lower layer matters only if the upper layer has nothing with this
+	// name, or if both have a directory with it.
+	if upper.Child == 0 || upper.Attributes.Mode.IsDir() {
+		lower, err = lookUpInLayer(ctx, fs.lower, lowerParent, name, opCtx)
+		if err != nil {
+			return
+		}
+
+		if upper.Child != 0 && lower.Child != 0 && !lower.Attributes.Mode.IsDir() {
+			fs.forgetLayer(ctx, fs.lower, lower.Child, 1)
+			lower = fuseops.ChildInodeEntry{}
+		}
+	}
+
+	return
+}
+
+func (fs *overlayFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	layer, inode, err := fs.lookUpLayer(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	layerOp := *op
+	layerOp.Inode = inode
+	layerOp.Handle = nil
+	if err := layer.GetInodeAttributes(ctx, &layerOp); err != nil {
+		return err
+	}
+
+	op.Attributes = layerOp.Attributes
+	op.AttributesExpiration = layerOp.AttributesExpiration
+	op.AttributesValidity = layerOp.AttributesValidity
+	return nil
+}
+
+func (fs *overlayFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	layerOp := *op
+	if op.Handle != nil {
+		h, err := fs.lookUpHandle(*op.Handle)
+		if err != nil {
+			return err
+		}
+
+		if err := fs.refreshHandle(ctx, h, true, op.OpContext); err != nil {
+			return err
+		}
+
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+
+		var handle fuseops.HandleID
+		_, layerOp.Inode, handle = fs.handleLayer(h)
+		layerOp.Handle = &handle
+	} else {
+		_, upper, err := fs.copyUpNode(ctx, op.Inode, op.OpContext)
+		if err != nil {
+			return err
+		}
+
+		layerOp.Inode = upper
+	}
+
+	if err := fs.upper.SetInodeAttributes(ctx, &layerOp); err != nil {
+		return err
+	}
+
+	op.Attributes = layerOp.Attributes
+	op.AttributesExpiration = layerOp.AttributesExpiration
+	op.AttributesValidity = layerOp.AttributesValidity
+	return nil
+}
+
+func (fs *overlayFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	n, err := fs.getNode(op.Inode)
+	if err != nil || n.id == fuseops.RootInodeID {
+		fs.mu.Unlock()
+		return err
+	}
+
+	if op.N < n.lookupCount {
+		n.lookupCount -= op.N
+		fs.mu.Unlock()
+		return nil
+	}
+
+	delete(fs.nodes, n.id)
+	if fs.upperNodes[n.upper] == n {
+		delete(fs.upperNodes, n.upper)
+	}
+
+	if n.parent.children[n.name] == n {
+		delete(n.parent.children, n.name)
+	}
+
+	fs.mu.Unlock()
+
+	// Let go of the node's inodes in the layers. Nothing else can reach the
+	// node now.
+	fs.forgetLayer(ctx, fs.lower, n.lower, n.lowerLookups)
+	fs.forgetLayer(ctx, fs.upper, n.upper, n.upperLookups)
+	return nil
+}
+
+func (fs *overlayFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	parent, upper, err := fs.copyUpNode(ctx, op.Parent, op.OpContext)
+	if err != nil {
+		return err
+	}
+
+	layerOp := *op
+	layerOp.Parent = upper
+	if err := fs.upper.MkDir(ctx, &layerOp); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.unlock(ctx)
+
+	e := layerOp.Entry
+	op.Entry = fs.childEntry(ctx, parent, op.Name, 0, e.Child, e)
+	return nil
+}
+
+func (fs *overlayFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	parent, upper, err := fs.copyUpNode(ctx, op.Parent, op.OpContext)
+	if err != nil {
+		return err
+	}
+
+	layerOp := *op
+	layerOp.Parent = upper
+	if err := fs.upper.MkNode(ctx, &layerOp); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.unlock(ctx)
+
+	e := layerOp.Entry
+	op.Entry = fs.childEntry(ctx, parent, op.Name, 0, e.Child, e)
+	return nil
+}
+
+func (fs *overlayFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	parent, upper, err := fs.copyUpNode(ctx, op.Parent, op.OpContext)
+	if err != nil {
+		return err
+	}
+
+	layerOp := *op
+	layerOp.Parent = upper
+	if err := fs.upper.CreateFile(ctx, &layerOp); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.unlock(ctx)
+
+	e := layerOp.Entry
+	op.Entry = fs.childEntry(ctx, parent, op.Name, 0, e.Child, e)
+	op.Handle = fs.newHandle(&overlayHandle{
+		node:   fs.nodes[op.Entry.Child],
+		flags:  fusekernel.OpenReadWrite,
+		upper:  true,
+		handle: layerOp.Handle,
+	})
+
+	return nil
+}
+
+func (fs *overlayFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	parent, upper, err := fs.copyUpNode(ctx, op.Parent, op.OpContext)
+	if err != nil {
+		return err
+	}
+
+	layerOp := *op
+	layerOp.Parent = upper
+	if err := fs.upper.CreateSymlink(ctx, &layerOp); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.unlock(ctx)
+
+	e := layerOp.Entry
+	op.Entry = fs.childEntry(ctx, parent, op.Name, 0, e.Child, e)
+	return nil
+}
+
+func (fs *overlayFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	parent, upper, err := fs.copyUpNode(ctx, op.Parent, op.OpContext)
+	if err != nil {
+		return err
+	}
+
+	_, target, err := fs.copyUpNode(ctx, op.Target, op.OpContext)
+	if err != nil {
+		return err
+	}
+
+	layerOp := *op
+	layerOp.Parent = upper
+	layerOp.Target = target
+	if err := fs.upper.CreateLink(ctx, &layerOp); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.unlock(ctx)
+
+	// The upper inode belongs to the target's node, which is reused.
+	e := layerOp.Entry
+	op.Entry = fs.childEntry(ctx, parent, op.Name, 0, e.Child, e)
+	return nil
+}
+
+func (fs *overlayFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.mu.Lock()
+	n, err := fs.getNode(op.Inode)
+	if err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+
+	upper := n.upper
+	lower := n.lower
+	fs.mu.Unlock()
+
+	// Merge the listings, with the upper layer's entries taking precedence.
+	var entries []Dirent
+	seen := make(map[string]bool)
+	for _, l := range []struct {
+		layer FileSystem
+		inode fuseops.InodeID
+	}{
+		{fs.upper, upper},
+		{fs.lower, lower},
+	} {
+		if l.inode == 0 {
+			continue
+		}
+
+		layerEntries, err := readAllDirents(ctx, l.layer, l.inode, op.OpContext)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range layerEntries {
+			if !seen[e.Name] {
+				seen[e.Name] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	fs.dirs.Open(op, entries)
+	return nil
+}
+
+func (fs *overlayFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.dirs.Read(op)
+}
+
+func (fs *overlayFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.dirs.Release(op)
+	return nil
+}
+
+func (fs *overlayFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	// Copy up before opening for writing.
+	if !op.OpenFlags.IsReadOnly() {
+		if _, _, err := fs.copyUpNode(ctx, op.Inode, op.OpContext); err != nil {
+			return err
+		}
+	}
+
+	fs.mu.Lock()
+	n, err := fs.getNode(op.Inode)
+	if err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+
+	layer, inode := fs.layerFor(n)
+	upper := n.upper != 0
+	fs.mu.Unlock()
+
+	layerOp := *op
+	layerOp.Inode = inode
+	if err := layer.OpenFile(ctx, &layerOp); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	*op = layerOp
+	op.Inode = n.id
+	op.Handle = fs.newHandle(&overlayHandle{
+		node:   n,
+		flags:  op.OpenFlags,
+		upper:  upper,
+		handle: layerOp.Handle,
+	})
+
+	return nil
+}
+
+func (fs *overlayFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	h, err := fs.lookUpHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// Read the upper copy if there is one by now.
+	if err := fs.refreshHandle(ctx, h, false, op.OpContext); err != nil {
+		return err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	layer, inode, handle := fs.handleLayer(h)
+	layerOp := *op
+	layerOp.Inode = inode
+	layerOp.Handle = handle
+	err = layer.ReadFile(ctx, &layerOp)
+	op.BytesRead = layerOp.BytesRead
+
+	return err
+}
+
+func (fs *overlayFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	h, err := fs.lookUpHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.refreshHandle(ctx, h, true, op.OpContext); err != nil {
+		return err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, inode, handle := fs.handleLayer(h)
+	layerOp := *op
+	layerOp.Inode = inode
+	layerOp.Handle = handle
+	return fs.upper.WriteFile(ctx, &layerOp)
+}
+
+func (fs *overlayFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	h, err := fs.lookUpHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	layer, inode, handle := fs.handleLayer(h)
+	layerOp := *op
+	layerOp.Inode = inode
+	layerOp.Handle = handle
+	return layer.SyncFile(ctx, &layerOp)
+}
+
+func (fs *overlayFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	h, err := fs.lookUpHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	layer, inode, handle := fs.handleLayer(h)
+	layerOp := *op
+	layerOp.Inode = inode
+	layerOp.Handle = handle
+	return layer.FlushFile(ctx, &layerOp)
+}
+
+func (fs *overlayFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	h, err := fs.getHandle(op.Handle)
+	if err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	// Wait for any switch to the upper layer to finish.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	layer, _, handle := fs.handleLayer(h)
+	layerOp := *op
+	layerOp.Handle = handle
+	return layer.ReleaseFileHandle(ctx, &layerOp)
+}
+
+func (fs *overlayFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	layer, inode, err := fs.lookUpLayer(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	layerOp := *op
+	layerOp.Inode = inode
+	if err := layer.ReadSymlink(ctx, &layerOp); err != nil {
+		return err
+	}
+
+	op.Target = layerOp.Target
+	return nil
+}
@@ -0,0 +1,578 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// memfs insists on a pid for every op.
+var overlayOpCtx = fuseops.OpContext{Pid: 1}
+
+// Look up the inode at the given slash-separated path.
+func overlayLookUp(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	p string) fuseops.ChildInodeEntry {
+	var e fuseops.ChildInodeEntry
+	e.Child = fuseops.RootInodeID
+	for _, name := range strings.Split(p, "/") {
+		op := &fuseops.LookUpInodeOp{
+			Parent:    e.Child,
+			Name:      name,
+			OpContext: overlayOpCtx,
+		}
+
+		if err := fs.LookUpInode(context.Background(), op); err != nil {
+			t.Fatalf("LookUpInode(%q): %v", p, err)
+		}
+
+		e = op.Entry
+	}
+
+	return e
+}
+
+func overlayOpen(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	inode fuseops.InodeID,
+	flags fusekernel.OpenFlags) fuseops.HandleID {
+	op := &fuseops.OpenFileOp{
+		Inode:     inode,
+		OpenFlags: flags,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.OpenFile(context.Background(), op); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	return op.Handle
+}
+
+func overlayRead(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	inode fuseops.InodeID,
+	h fuseops.HandleID) string {
+	op := &fuseops.ReadFileOp{
+		Inode:     inode,
+		Handle:    h,
+		Dst:       make([]byte, 1024),
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.ReadFile(context.Background(), op); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	return string(op.Dst[:op.BytesRead])
+}
+
+// Read the whole file at the given path.
+func overlayReadPath(t *testing.T, fs fuseutil.FileSystem, p string) string {
+	e := overlayLookUp(t, fs, p)
+	h := overlayOpen(t, fs, e.Child, fusekernel.OpenReadOnly)
+	defer fs.ReleaseFileHandle(
+		context.Background(),
+		&fuseops.ReleaseFileHandleOp{Handle: h, OpContext: overlayOpCtx})
+
+	return overlayRead(t, fs, e.Child, h)
+}
+
+// Create a lower layer containing dir/foo.txt and top.txt, and an empty upper
+// layer.
+func makeOverlayLayers(t *testing.T) (lower, upper fuseutil.FileSystem) {
+	ctx := context.Background()
+	lower = memfs.NewFileSystem(0, 0)
+	upper = memfs.NewFileSystem(0, 0)
+
+	mkDir := &fuseops.MkDirOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "dir",
+		Mode:      0755 | os.ModeDir,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := lower.MkDir(ctx, mkDir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	for _, f := range []struct {
+		parent   fuseops.InodeID
+		name     string
+		contents string
+	}{
+		{mkDir.Entry.Child, "foo.txt", "taco"},
+		{fuseops.RootInodeID, "top.txt", "burrito"},
+	} {
+		create := &fuseops.CreateFileOp{
+			Parent:    f.parent,
+			Name:      f.name,
+			Mode:      0644,
+			OpContext: overlayOpCtx,
+		}
+
+		if err := lower.CreateFile(ctx, create); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+
+		write := &fuseops.WriteFileOp{
+			Inode:     create.Entry.Child,
+			Handle:    create.Handle,
+			Data:      []byte(f.contents),
+			OpContext: overlayOpCtx,
+		}
+
+		if err := lower.WriteFile(ctx, write); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	return lower, upper
+}
+
+func TestOverlayFileSystem_WriteCopiesUp(t *testing.T) {
+	ctx := context.Background()
+	lower, upper := makeOverlayLayers(t)
+	fs := fuseutil.NewOverlayFileSystem(lower, upper)
+
+	// Open the lower file for reading before anything is copied up.
+	e := overlayLookUp(t, fs, "dir/foo.txt")
+	readHandle := overlayOpen(t, fs, e.Child, fusekernel.OpenReadOnly)
+	if got := overlayRead(t, fs, e.Child, readHandle); got != "taco" {
+		t.Fatalf("Before writing: %q", got)
+	}
+
+	// Nothing should be in the upper layer yet.
+	op := &fuseops.LookUpInodeOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "dir",
+		OpContext: overlayOpCtx,
+	}
+
+	if err := upper.LookUpInode(ctx, op); err != fuse.ENOENT {
+		t.Fatalf("Upper LookUpInode: %v", err)
+	}
+
+	// Write through a handle opened for writing.
+	writeHandle := overlayOpen(t, fs, e.Child, fusekernel.OpenWriteOnly)
+	write := &fuseops.WriteFileOp{
+		Inode:     e.Child,
+		Handle:    writeHandle,
+		Offset:    4,
+		Data:      []byte("burrito"),
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// The upper layer should now have a modified copy, and the lower layer
+	// should be untouched.
+	if got := overlayReadPath(t, upper, "dir/foo.txt"); got != "tacoburrito" {
+		t.Errorf("Upper layer: %q", got)
+	}
+
+	if got := overlayReadPath(t, lower, "dir/foo.txt"); got != "taco" {
+		t.Errorf("Lower layer: %q", got)
+	}
+
+	// Reads through the overlay should see the upper copy, including those
+	// through the handle opened beforehand.
+	if got := overlayRead(t, fs, e.Child, readHandle); got != "tacoburrito" {
+		t.Errorf("Existing handle: %q", got)
+	}
+
+	if got := overlayReadPath(t, fs, "dir/foo.txt"); got != "tacoburrito" {
+		t.Errorf("New handle: %q", got)
+	}
+
+	// The size should be reported from the upper copy.
+	getAttrs := &fuseops.GetInodeAttributesOp{
+		Inode:     e.Child,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.GetInodeAttributes(ctx, getAttrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if getAttrs.Attributes.Size != uint64(len("tacoburrito")) {
+		t.Errorf("Size: %d", getAttrs.Attributes.Size)
+	}
+}
+
+// A layer whose reads fail past the start of a file, while failReads is set.
+type failingReadsFS struct {
+	fuseutil.FileSystem
+	failReads bool
+}
+
+func (fs *failingReadsFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if fs.failReads && op.Offset > 0 {
+		return fuse.EIO
+	}
+
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+func TestOverlayFileSystem_FailedCopyUp(t *testing.T) {
+	ctx := context.Background()
+	lower, upper := makeOverlayLayers(t)
+
+	// A lower file too large to copy in one read.
+	contents := strings.Repeat("taco", 1<<18)
+	create := &fuseops.CreateFileOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "big.txt",
+		Mode:      0644,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := lower.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	write := &fuseops.WriteFileOp{
+		Inode:     create.Entry.Child,
+		Handle:    create.Handle,
+		Data:      []byte(contents),
+		OpContext: overlayOpCtx,
+	}
+
+	if err := lower.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	failing := &failingReadsFS{FileSystem: lower, failReads: true}
+	fs := fuseutil.NewOverlayFileSystem(failing, upper)
+
+	// Opening the file for writing copies it up, which fails midway.
+	e := overlayLookUp(t, fs, "big.txt")
+	open := &fuseops.OpenFileOp{
+		Inode:     e.Child,
+		OpenFlags: fusekernel.OpenWriteOnly,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.OpenFile(ctx, open); err != fuse.EIO {
+		t.Fatalf("OpenFile with failing reads: got %v, want EIO", err)
+	}
+
+	// No partial copy should be left in the upper layer.
+	lookUp := &fuseops.LookUpInodeOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "big.txt",
+		OpContext: overlayOpCtx,
+	}
+
+	if err := upper.LookUpInode(ctx, lookUp); err != fuse.ENOENT {
+		t.Fatalf("Upper LookUpInode: %v", err)
+	}
+
+	// So trying again should succeed once the lower layer recovers, and the
+	// copy should be complete.
+	failing.failReads = false
+	h := overlayOpen(t, fs, e.Child, fusekernel.OpenWriteOnly)
+	fs.ReleaseFileHandle(
+		ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: h, OpContext: overlayOpCtx})
+
+	getAttrs := &fuseops.GetInodeAttributesOp{
+		Inode:     e.Child,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.GetInodeAttributes(ctx, getAttrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if getAttrs.Attributes.Size != uint64(len(contents)) {
+		t.Errorf("Size after copying up: %d, want %d", getAttrs.Attributes.Size, len(contents))
+	}
+}
+
+// A layer whose reads block until release is closed, signalling reading the
+// first time one starts.
+type blockingReadsFS struct {
+	fuseutil.FileSystem
+	once    sync.Once
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockingReadsFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.once.Do(func() { close(fs.reading) })
+	<-fs.release
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+// A layer that counts the files created in it.
+type countingCreatesFS struct {
+	fuseutil.FileSystem
+	creates int32
+}
+
+func (fs *countingCreatesFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	atomic.AddInt32(&fs.creates, 1)
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func TestOverlayFileSystem_ConcurrentCopyUp(t *testing.T) {
+	ctx := context.Background()
+	lower, upper := makeOverlayLayers(t)
+	blocking := &blockingReadsFS{
+		FileSystem: lower,
+		reading:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+
+	counting := &countingCreatesFS{FileSystem: upper}
+	fs := fuseutil.NewOverlayFileSystem(blocking, counting)
+
+	// Open the file for writing from several goroutines at once. The first to
+	// get there starts copying it up, which blocks reading the lower file.
+	e := overlayLookUp(t, fs, "dir/foo.txt")
+	const n = 4
+	errs := make(chan error, n)
+	open := func() {
+		op := &fuseops.OpenFileOp{
+			Inode:     e.Child,
+			OpenFlags: fusekernel.OpenWriteOnly,
+			OpContext: overlayOpCtx,
+		}
+
+		errs <- fs.OpenFile(ctx, op)
+	}
+
+	go open()
+	<-blocking.reading
+	for i := 1; i < n; i++ {
+		go open()
+	}
+
+	// Other ops shouldn't wait for the copy.
+	getAttrs := &fuseops.GetInodeAttributesOp{
+		Inode:     overlayLookUp(t, fs, "top.txt").Child,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.GetInodeAttributes(ctx, getAttrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	close(blocking.release)
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("OpenFile: %v", err)
+		}
+	}
+
+	// The file should have been copied up once, completely.
+	if got := atomic.LoadInt32(&counting.creates); got != 1 {
+		t.Errorf("Files created in the upper layer: %d, want 1", got)
+	}
+
+	if got := overlayReadPath(t, upper, "dir/foo.txt"); got != "taco" {
+		t.Errorf("Upper layer: %q", got)
+	}
+}
+
+func TestOverlayFileSystem_SetAttributesCopiesUp(t *testing.T) {
+	ctx := context.Background()
+	lower, upper := makeOverlayLayers(t)
+	fs := fuseutil.NewOverlayFileSystem(lower, upper)
+
+	e := overlayLookUp(t, fs, "top.txt")
+	size := uint64(0)
+	mode := os.FileMode(0600)
+	op := &fuseops.SetInodeAttributesOp{
+		Inode:     e.Child,
+		Size:      &size,
+		Mode:      &mode,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.SetInodeAttributes(ctx, op); err != nil {
+		t.Fatalf("SetInodeAttributes: %v", err)
+	}
+
+	if op.Attributes.Size != 0 || op.Attributes.Mode.Perm() != 0600 {
+		t.Errorf("Attributes: %s", op.Attributes.DebugString())
+	}
+
+	if got := overlayReadPath(t, fs, "top.txt"); got != "" {
+		t.Errorf("Overlay: %q", got)
+	}
+
+	if got := overlayLookUp(t, lower, "top.txt"); got.Attributes.Mode.Perm() != 0644 {
+		t.Errorf("Lower mode: %v", got.Attributes.Mode)
+	}
+
+	if got := overlayReadPath(t, lower, "top.txt"); got != "burrito" {
+		t.Errorf("Lower layer: %q", got)
+	}
+}
+
+func TestOverlayFileSystem_CreateLinkCopiesUp(t *testing.T) {
+	ctx := context.Background()
+	lower, upper := makeOverlayLayers(t)
+	fs := fuseutil.NewOverlayFileSystem(lower, upper)
+
+	target := overlayLookUp(t, fs, "dir/foo.txt")
+	op := &fuseops.CreateLinkOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "link.txt",
+		Target:    target.Child,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.CreateLink(ctx, op); err != nil {
+		t.Fatalf("CreateLink: %v", err)
+	}
+
+	// The link is to the upper copy, so it shares the target's inode.
+	if op.Entry.Child != target.Child {
+		t.Errorf("Link inode %d, target %d", op.Entry.Child, target.Child)
+	}
+
+	if op.Entry.Attributes.Nlink != 2 {
+		t.Errorf("Nlink: %d", op.Entry.Attributes.Nlink)
+	}
+
+	if got := overlayReadPath(t, upper, "link.txt"); got != "taco" {
+		t.Errorf("Upper link: %q", got)
+	}
+
+	if got := overlayReadPath(t, upper, "dir/foo.txt"); got != "taco" {
+		t.Errorf("Upper target: %q", got)
+	}
+}
+
+func TestOverlayFileSystem_ReadDirMerges(t *testing.T) {
+	ctx := context.Background()
+	lower, upper := makeOverlayLayers(t)
+	fs := fuseutil.NewOverlayFileSystem(lower, upper)
+
+	// Create a file in the upper layer alongside the lower one. This copies up
+	// the directory.
+	dir := overlayLookUp(t, fs, "dir")
+	create := &fuseops.CreateFileOp{
+		Parent:    dir.Child,
+		Name:      "bar.txt",
+		Mode:      0644,
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	openOp := &fuseops.OpenDirOp{Inode: dir.Child, OpContext: overlayOpCtx}
+	if err := fs.OpenDir(ctx, openOp); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:     dir.Child,
+		Handle:    openOp.Handle,
+		Dst:       make([]byte, 4096),
+		OpContext: overlayOpCtx,
+	}
+
+	if err := fs.ReadDir(ctx, readOp); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	names, _ := parseDirents(readOp.Dst[:readOp.BytesRead])
+	sort.Strings(names)
+	if expected := []string{"bar.txt", "foo.txt"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Names: %v", names)
+	}
+
+	// The lower file shouldn't have been copied up.
+	lookUp := &fuseops.LookUpInodeOp{
+		Parent:    overlayLookUp(t, upper, "dir").Child,
+		Name:      "foo.txt",
+		OpContext: overlayOpCtx,
+	}
+
+	if err := upper.LookUpInode(ctx, lookUp); err != fuse.ENOENT {
+		t.Errorf("Upper LookUpInode: %v", err)
+	}
+}
+
+func TestOverlayFileSystem_Mounted(t *testing.T) {
+	lower, upper := makeOverlayLayers(t)
+	fs := fuseutil.NewOverlayFileSystem(lower, upper)
+
+	dir := fusetesting.MountForTest(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{}).Dir()
+
+	// Append to the lower file.
+	p := path.Join(dir, "dir/foo.txt")
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	if _, err := f.WriteString("burrito"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(contents) != "tacoburrito" {
+		t.Errorf("Contents: %q", contents)
+	}
+
+	if got := overlayReadPath(t, lower, "dir/foo.txt"); got != "taco" {
+		t.Errorf("Lower layer: %q", got)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrPending is returned by a FileSystem method that has called ReplyLater,
+// to tell the server that the op will be completed later rather than on
+// return.
+var ErrPending = errors.New("fuseutil: reply pending")
+
+// ReplyLater lets a FileSystem method served by NewFileSystemServer finish its
+// op after returning, so that no goroutine need block for the op's duration.
+// This suits backends with high latency that deliver results by callback,
+// e.g. for ReadFileOp. The method must call ReplyLater with the context it was
+// given before returning, and then return ErrPending. The op is replied to
+// when the returned function is called with the op's result, from any
+// goroutine; until then the op's fields (such as ReadFileOp.Dst) remain valid
+// and may be filled in.
+//
+// complete must be called exactly once; later calls are ignored. If the method
+// returns an error other than ErrPending after all, the op is replied to with
+// that error immediately and complete does nothing, so the op must not be
+// touched after returning.
+//
+// ReplyLater panics if ctx is not one passed to a FileSystem method by
+// NewFileSystemServer.
+func ReplyLater(ctx context.Context) (complete func(error)) {
+	p, ok := ctx.Value(pendingReplyKey{}).(*pendingReply)
+	if !ok {
+		panic("ReplyLater called with a context not from NewFileSystemServer")
+	}
+
+	p.mu.Lock()
+	p.deferred = true
+	p.mu.Unlock()
+
+	return p.finish
+}
+
+type pendingReplyKey struct{}
+
+// The state of the reply to an op being handled by a fileSystemServer.
+type pendingReply struct {
+	mu sync.Mutex
+
+	// Whether ReplyLater has been called for the op.
+	//
+	// GUARDED_BY(mu)
+	deferred bool
+
+	once  sync.Once
+	reply func(error)
+}
+
+// Reply to the op, if that hasn't already been done.
+func (p *pendingReply) finish(err error) {
+	p.once.Do(func() { p.reply(err) })
+}
+
+// Has ReplyLater been called for the op?
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *pendingReply) isDeferred() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.deferred
+}
+
+// Call f, which handles an op, with a context derived from the supplied one,
+// and call done with the op's result once it has finished: when f returns, or
+// if f uses ReplyLater, when the op is completed, just before the reply. This
+// lets a wrapper act on the outcome of ops that its wrapped file system
+// finishes later. done is called exactly once, unless f returns ErrPending
+// without having called ReplyLater.
+//
+// If ctx is not from NewFileSystemServer, f is simply called with it.
+func whenFinished(
+	ctx context.Context,
+	f func(context.Context) error,
+	done func(error)) error {
+	outer, ok := ctx.Value(pendingReplyKey{}).(*pendingReply)
+	if !ok {
+		err := f(ctx)
+		done(err)
+		return err
+	}
+
+	inner := &pendingReply{
+		reply: func(err error) {
+			done(err)
+			outer.finish(err)
+		},
+	}
+
+	err := f(context.WithValue(ctx, pendingReplyKey{}, inner))
+	if err == ErrPending {
+		if inner.isDeferred() {
+			ReplyLater(ctx)
+		}
+
+		return ErrPending
+	}
+
+	// The op finished on returning, so nothing must come of a later call to the
+	// function returned by ReplyLater.
+	inner.once.Do(func() {})
+	done(err)
+	return err
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// DefaultMaxSymlinks is the number of symlinks ResolvePath follows by default
+// before giving up, the same as the kernel's limit for a path walk
+// (MAXSYMLINKS on Linux).
+const DefaultMaxSymlinks = 40
+
+// PathResolver is the view of a file system that ResolvePath needs.
+type PathResolver interface {
+	// Return the child with the given name in the supplied directory, and
+	// whether it is a symlink. The name is never empty or ".", but may be "..".
+	LookUp(
+		ctx context.Context,
+		parent fuseops.InodeID,
+		name string) (child fuseops.InodeID, isSymlink bool, err error)
+
+	// Return the target of the supplied symlink.
+	ReadSymlink(
+		ctx context.Context,
+		inode fuseops.InodeID) (target string, err error)
+}
+
+// ResolvePath resolves a slash-separated path within a file system to the
+// inode it refers to, following symlinks along the way, including one in the
+// final component. A relative path is resolved starting from dir, and an
+// absolute one, or the target of a symlink that is absolute, starting from
+// root.
+//
+// At most maxSymlinks symlinks are followed in total, or DefaultMaxSymlinks if
+// maxSymlinks isn't positive; beyond that, ELOOP is returned. This bounds the
+// work done for a cycle of symlinks, or a chain too long to be useful.
+//
+// Handlers of ordinary ops don't need this: the kernel walks paths one
+// component at a time, sending a LookUpInodeOp for each and a ReadSymlinkOp
+// for each symlink it meets, and applies its own limit. It is for file systems
+// that resolve paths themselves rather than leaving it to the kernel, such as
+// one that finds the inode for a path stored in its backend (e.g. a hard link
+// in an archive, or the location recorded for an export with
+// Capabilities.ExportSupport), where a cycle in the links would otherwise
+// hang the handler.
+func ResolvePath(
+	ctx context.Context,
+	r PathResolver,
+	root fuseops.InodeID,
+	dir fuseops.InodeID,
+	p string,
+	maxSymlinks int) (fuseops.InodeID, error) {
+	if maxSymlinks <= 0 {
+		maxSymlinks = DefaultMaxSymlinks
+	}
+
+	cur := dir
+	if strings.HasPrefix(p, "/") {
+		cur = root
+	}
+
+	// The components still to be resolved. Following a symlink replaces it with
+	// the components of its target.
+	remaining := strings.Split(p, "/")
+	followed := 0
+	for len(remaining) > 0 {
+		name := remaining[0]
+		remaining = remaining[1:]
+
+		if name == "" || name == "." {
+			continue
+		}
+
+		child, isSymlink, err := r.LookUp(ctx, cur, name)
+		if err != nil {
+			return 0, err
+		}
+
+		if !isSymlink {
+			cur = child
+			continue
+		}
+
+		followed++
+		if followed > maxSymlinks {
+			return 0, syscall.ELOOP
+		}
+
+		target, err := r.ReadSymlink(ctx, child)
+		if err != nil {
+			return 0, err
+		}
+
+		// A relative target is resolved from the directory containing the
+		// symlink, which cur still refers to.
+		if strings.HasPrefix(target, "/") {
+			cur = root
+		}
+
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	return cur, nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A tree of inodes described by the paths of its entries, where each symlink
+// maps to its target and everything else to the empty string.
+type pathTree struct {
+	entries map[string]string
+	ids     map[string]fuseops.InodeID
+	paths   map[fuseops.InodeID]string
+}
+
+func newPathTree(entries map[string]string) *pathTree {
+	t := &pathTree{
+		entries: entries,
+		ids:     map[string]fuseops.InodeID{"": fuseops.RootInodeID},
+		paths:   map[fuseops.InodeID]string{fuseops.RootInodeID: ""},
+	}
+
+	for p := range entries {
+		id := fuseops.InodeID(len(t.paths) + 1)
+		t.ids[p] = id
+		t.paths[id] = p
+	}
+
+	return t
+}
+
+func (t *pathTree) LookUp(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string) (fuseops.InodeID, bool, error) {
+	p := t.paths[parent]
+	switch {
+	case name == "..":
+		if i := strings.LastIndex(p, "/"); i >= 0 {
+			p = p[:i]
+		} else {
+			p = ""
+		}
+
+	case p == "":
+		p = name
+
+	default:
+		p = p + "/" + name
+	}
+
+	id, ok := t.ids[p]
+	if !ok {
+		return 0, false, syscall.ENOENT
+	}
+
+	return id, t.entries[p] != "", nil
+}
+
+func (t *pathTree) ReadSymlink(
+	ctx context.Context,
+	inode fuseops.InodeID) (string, error) {
+	return t.entries[t.paths[inode]], nil
+}
+
+func TestResolvePath(t *testing.T) {
+	tree := newPathTree(map[string]string{
+		"dir":           "",
+		"dir/file":      "",
+		"dir/sub":       "",
+		"dir/sub/up":    "../file",
+		"dir/abs":       "/dir/file",
+		"dir/to_sub":    "sub",
+		"link_to_dir":   "dir",
+		"link_to_link":  "link_to_dir/to_sub/up",
+		"dangling":      "nowhere",
+		"cycle_a":       "cycle_b",
+		"cycle_b":       "cycle_a",
+		"self":          "./self",
+		"dir/sub/cycle": "../../dir/sub/cycle",
+	})
+
+	testCases := []struct {
+		dir      string
+		p        string
+		expected string
+		err      error
+	}{
+		{"", "dir/file", "dir/file", nil},
+		{"", "/dir/./file", "dir/file", nil},
+		{"dir/sub", "../file", "dir/file", nil},
+		{"dir/sub", "/dir", "dir", nil},
+		{"", "dir/sub/up", "dir/file", nil},
+		{"", "dir/abs", "dir/file", nil},
+		{"", "link_to_dir/to_sub", "dir/sub", nil},
+		{"", "link_to_link", "dir/file", nil},
+		{"dir", "to_sub/up", "dir/file", nil},
+		{"", "dangling", "", syscall.ENOENT},
+		{"", "cycle_a", "", syscall.ELOOP},
+		{"", "self", "", syscall.ELOOP},
+		{"", "dir/sub/cycle", "", syscall.ELOOP},
+	}
+
+	for _, tc := range testCases {
+		id, err := fuseutil.ResolvePath(
+			context.Background(),
+			tree,
+			fuseops.RootInodeID,
+			tree.ids[tc.dir],
+			tc.p,
+			0)
+
+		if err != tc.err {
+			t.Errorf("ResolvePath(%q, %q): got error %v, want %v", tc.dir, tc.p, err, tc.err)
+			continue
+		}
+
+		if err == nil && tree.paths[id] != tc.expected {
+			t.Errorf("ResolvePath(%q, %q): got %q, want %q", tc.dir, tc.p, tree.paths[id], tc.expected)
+		}
+	}
+}
+
+func TestResolvePath_MaxSymlinks(t *testing.T) {
+	// A chain of five symlinks, each to the next, ending at a file.
+	const n = 5
+	entries := map[string]string{"file": ""}
+	for i := 0; i < n; i++ {
+		target := fmt.Sprintf("link%d", i+1)
+		if i == n-1 {
+			target = "file"
+		}
+
+		entries[fmt.Sprintf("link%d", i)] = target
+	}
+
+	tree := newPathTree(entries)
+	resolve := func(maxSymlinks int) (fuseops.InodeID, error) {
+		return fuseutil.ResolvePath(
+			context.Background(),
+			tree,
+			fuseops.RootInodeID,
+			fuseops.RootInodeID,
+			"link0",
+			maxSymlinks)
+	}
+
+	// Following all of them is fine.
+	if id, err := resolve(n); err != nil || id != tree.ids["file"] {
+		t.Errorf("With a limit of %d: got (%v, %v)", n, id, err)
+	}
+
+	// One fewer isn't enough.
+	if _, err := resolve(n - 1); err != syscall.ELOOP {
+		t.Errorf("With a limit of %d: got %v, want ELOOP", n-1, err)
+	}
+
+	// A cycle fails after following exactly as many symlinks as allowed.
+	cycle := &countingResolver{PathResolver: newPathTree(map[string]string{
+		"a": "b",
+		"b": "a",
+	})}
+
+	const limit = 7
+	_, err := fuseutil.ResolvePath(context.Background(), cycle, fuseops.RootInodeID, fuseops.RootInodeID, "a", limit)
+	if err != syscall.ELOOP {
+		t.Errorf("Cycle: got %v, want ELOOP", err)
+	}
+
+	if cycle.readSymlinks != limit {
+		t.Errorf("Cycle: read %d symlinks, want %d", cycle.readSymlinks, limit)
+	}
+}
+
+// A PathResolver that counts the symlinks read through it.
+type countingResolver struct {
+	fuseutil.PathResolver
+	readSymlinks int
+}
+
+func (r *countingResolver) ReadSymlink(
+	ctx context.Context,
+	inode fuseops.InodeID) (string, error) {
+	r.readSymlinks++
+	return r.PathResolver.ReadSymlink(ctx, inode)
+}
@@ -0,0 +1,489 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewPerUserThrottle wraps the supplied file system, limiting the rate at which
+// ops are passed through to it separately for each requesting user, as
+// identified by OpContext.Uid. This prevents a single user on a shared mount
+// from monopolizing the wrapped file system.
+//
+// The limits function is consulted for each op, and returns the maximum
+// sustained number of ops per second permitted for the given uid. A
+// non-positive limit means the user's ops are not throttled. The limit is a
+// float64, the type underlying golang.org/x/time/rate.Limit, so that a
+// rate.Limit converts directly without this package depending on that module.
+//
+// An op that must wait for its turn does so until the op's context is
+// cancelled, e.g. because the op was interrupted, in which case EINTR is
+// returned without calling the wrapped file system, and the op's turn is given
+// back. ForgetInodeOp and BatchForgetOp, which are delivered synchronously by
+// NewFileSystemServer, are never throttled, and nor are FlushFileOp,
+// ReleaseDirHandleOp and ReleaseFileHandleOp, which release resources that
+// would leak if the op gave up: the kernel doesn't send releases again.
+func NewPerUserThrottle(
+	fs FileSystem,
+	limits func(uid uint32) float64) FileSystem {
+	return &perUserThrottle{
+		wrapped: fs,
+		limits:  limits,
+		next:    make(map[uint32]time.Time),
+		sweepAt: minThrottleSweep,
+	}
+}
+
+// The number of users tracked by a per-user throttle at which it first forgets
+// those that no longer need tracking.
+const minThrottleSweep = 64
+
+type perUserThrottle struct {
+	wrapped FileSystem
+	limits  func(uid uint32) float64
+
+	mu sync.Mutex
+
+	// For each uid that has been seen recently, the earliest time at which its
+	// next op may proceed. A uid whose time has passed is equivalent to one
+	// that is missing, and is removed once the map has grown to sweepAt
+	// entries, so that the map doesn't grow with every user ever seen.
+	//
+	// GUARDED_BY(mu)
+	next    map[uint32]time.Time
+	sweepAt int
+}
+
+// Wait until the user that sent the op with the supplied context may proceed,
+// or until ctx is cancelled.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *perUserThrottle) wait(
+	ctx context.Context,
+	opCtx fuseops.OpContext) error {
+	limit := t.limits(opCtx.Uid)
+	if limit <= 0 {
+		return nil
+	}
+
+	// Reserve the next available slot for this user.
+	interval := time.Duration(float64(time.Second) / limit)
+
+	t.mu.Lock()
+	now := time.Now()
+	start := t.next[opCtx.Uid]
+	if start.Before(now) {
+		start = now
+	}
+
+	t.next[opCtx.Uid] = start.Add(interval)
+	if len(t.next) >= t.sweepAt {
+		t.sweep(now)
+	}
+	t.mu.Unlock()
+
+	// Wait for it to arrive.
+	d := start.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+
+	case <-ctx.Done():
+		// Give the slot back, so that a burst of interrupted ops doesn't push
+		// the user's later ops ever further out. That's only possible if no op
+		// has reserved a later slot since; otherwise the next op would be given
+		// the one that op holds.
+		t.mu.Lock()
+		if end := start.Add(interval); t.next[opCtx.Uid].Equal(end) {
+			t.next[opCtx.Uid] = start
+		}
+		t.mu.Unlock()
+
+		return syscall.EINTR
+	}
+}
+
+// Forget the users whose next op may proceed at once, then wait for the map to
+// double in size before doing so again, so that sweeping costs constant time
+// per op on average.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *perUserThrottle) sweep(now time.Time) {
+	for uid, next := range t.next {
+		if !next.After(now) {
+			delete(t.next, uid)
+		}
+	}
+
+	t.sweepAt = 2 * len(t.next)
+	if t.sweepAt < minThrottleSweep {
+		t.sweepAt = minThrottleSweep
+	}
+}
+
+func (t *perUserThrottle) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.StatFS(ctx, op)
+}
+
+func (t *perUserThrottle) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return t.wrapped.ForgetInode(ctx, op)
+}
+
+func (t *perUserThrottle) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return t.wrapped.BatchForget(ctx, op)
+}
+
+func (t *perUserThrottle) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.LookUpInode(ctx, op)
+}
+
+func (t *perUserThrottle) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.GetInodeAttributes(ctx, op)
+}
+
+func (t *perUserThrottle) GetInodeFlags(
+	ctx context.Context,
+	op *fuseops.GetInodeFlagsOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.GetInodeFlags(ctx, op)
+}
+
+func (t *perUserThrottle) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.SetInodeAttributes(ctx, op)
+}
+
+func (t *perUserThrottle) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.MkDir(ctx, op)
+}
+
+func (t *perUserThrottle) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.MkNode(ctx, op)
+}
+
+func (t *perUserThrottle) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.CreateFile(ctx, op)
+}
+
+func (t *perUserThrottle) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.CreateLink(ctx, op)
+}
+
+func (t *perUserThrottle) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.CreateSymlink(ctx, op)
+}
+
+func (t *perUserThrottle) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.Rename(ctx, op)
+}
+
+func (t *perUserThrottle) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.RmDir(ctx, op)
+}
+
+func (t *perUserThrottle) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.Unlink(ctx, op)
+}
+
+func (t *perUserThrottle) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.OpenDir(ctx, op)
+}
+
+func (t *perUserThrottle) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.ReadDir(ctx, op)
+}
+
+func (t *perUserThrottle) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	// Fall back here rather than in the server, which would charge for the op
+	// again when calling ReadDir.
+	err := t.wrapped.ReadDirPlus(ctx, op)
+	if err == fuse.ENOSYS {
+		err = readDirPlusWithReadDir(ctx, t.wrapped, op)
+	}
+
+	return err
+}
+
+func (t *perUserThrottle) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return t.wrapped.ReleaseDirHandle(ctx, op)
+}
+
+func (t *perUserThrottle) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.OpenFile(ctx, op)
+}
+
+func (t *perUserThrottle) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.ReadFile(ctx, op)
+}
+
+func (t *perUserThrottle) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.WriteFile(ctx, op)
+}
+
+func (t *perUserThrottle) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.SyncFile(ctx, op)
+}
+
+func (t *perUserThrottle) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return t.wrapped.FlushFile(ctx, op)
+}
+
+func (t *perUserThrottle) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return t.wrapped.ReleaseFileHandle(ctx, op)
+}
+
+func (t *perUserThrottle) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.ReadSymlink(ctx, op)
+}
+
+func (t *perUserThrottle) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.RemoveXattr(ctx, op)
+}
+
+func (t *perUserThrottle) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.GetXattr(ctx, op)
+}
+
+func (t *perUserThrottle) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.ListXattr(ctx, op)
+}
+
+func (t *perUserThrottle) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.SetXattr(ctx, op)
+}
+
+func (t *perUserThrottle) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.Fallocate(ctx, op)
+}
+
+func (t *perUserThrottle) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.CopyFileRange(ctx, op)
+}
+
+func (t *perUserThrottle) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.GetLk(ctx, op)
+}
+
+func (t *perUserThrottle) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.SetLk(ctx, op)
+}
+
+func (t *perUserThrottle) SetLkw(
+	ctx context.Context,
+	op *fuseops.SetLkwOp) error {
+	if err := t.wait(ctx, op.OpContext); err != nil {
+		return err
+	}
+
+	return t.wrapped.SetLkw(ctx, op)
+}
+
+func (t *perUserThrottle) Destroy() {
+	t.wrapped.Destroy()
+}
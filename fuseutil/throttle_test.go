@@ -0,0 +1,248 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// countingFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that successfully answers every GetInodeAttributesOp,
+// FlushFileOp and ReleaseFileHandleOp.
+type countingFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *countingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return nil
+}
+
+func (fs *countingFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *countingFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+const (
+	limitedUid   = 17
+	unlimitedUid = 19
+)
+
+func throttleLimits(uid uint32) float64 {
+	if uid == limitedUid {
+		return 20
+	}
+
+	return 0
+}
+
+// Issue n GetInodeAttributesOps for the given uid, returning the time taken.
+func getAttrs(
+	t *testing.T,
+	ctx context.Context,
+	fs fuseutil.FileSystem,
+	uid uint32,
+	n int) time.Duration {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		op := &fuseops.GetInodeAttributesOp{
+			Inode:     fuseops.RootInodeID,
+			OpContext: fuseops.OpContext{Uid: uid},
+		}
+
+		if err := fs.GetInodeAttributes(ctx, op); err != nil {
+			t.Fatalf("GetInodeAttributes: %v", err)
+		}
+	}
+
+	return time.Since(start)
+}
+
+func TestPerUserThrottle(t *testing.T) {
+	ctx := context.Background()
+	fs := fuseutil.NewPerUserThrottle(&countingFS{}, throttleLimits)
+
+	// The limited user should be held to its rate: the first op proceeds
+	// immediately and each of the remaining ten waits 50ms.
+	if d := getAttrs(t, ctx, fs, limitedUid, 11); d < 450*time.Millisecond {
+		t.Errorf("Limited user took only %v", d)
+	}
+
+	// Meanwhile the other user is unaffected.
+	if d := getAttrs(t, ctx, fs, unlimitedUid, 11); d > 100*time.Millisecond {
+		t.Errorf("Unlimited user took %v", d)
+	}
+}
+
+func TestPerUserThrottle_Cancellation(t *testing.T) {
+	fs := fuseutil.NewPerUserThrottle(&countingFS{}, throttleLimits)
+
+	// Use up the limited user's allowance.
+	getAttrs(t, context.Background(), fs, limitedUid, 1)
+
+	// An op whose context is cancelled while waiting should give up, as if
+	// interrupted. Many doing so shouldn't delay the user's later ops.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	opCtx := fuseops.OpContext{Uid: limitedUid}
+	for i := 0; i < 20; i++ {
+		op := &fuseops.GetInodeAttributesOp{
+			Inode:     fuseops.RootInodeID,
+			OpContext: opCtx,
+		}
+
+		if err := fs.GetInodeAttributes(ctx, op); err != syscall.EINTR {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if d := getAttrs(t, context.Background(), fs, limitedUid, 1); d > 200*time.Millisecond {
+		t.Errorf("Op after cancellations took %v", d)
+	}
+
+	// Flushes and releases aren't throttled, so must not give up.
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{OpContext: opCtx}); err != nil {
+		t.Errorf("FlushFile: %v", err)
+	}
+
+	err := fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{OpContext: opCtx})
+	if err != nil {
+		t.Errorf("ReleaseFileHandle: %v", err)
+	}
+}
+
+func TestPerUserThrottle_CancellationKeepsLaterSlots(t *testing.T) {
+	fs := fuseutil.NewPerUserThrottle(&countingFS{}, throttleLimits)
+
+	// Use up the limited user's allowance, so that the next slots are 50ms and
+	// 100ms from now.
+	start := time.Now()
+	getAttrs(t, context.Background(), fs, limitedUid, 1)
+
+	// Take the first of them with an op that will be cancelled, and the second
+	// with one that won't.
+	getAttr := func(ctx context.Context, result chan<- error) {
+		op := &fuseops.GetInodeAttributesOp{
+			Inode:     fuseops.RootInodeID,
+			OpContext: fuseops.OpContext{Uid: limitedUid},
+		}
+
+		result <- fs.GetInodeAttributes(ctx, op)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go getAttr(ctx, cancelled)
+	time.Sleep(10 * time.Millisecond)
+
+	waited := make(chan error, 1)
+	go getAttr(context.Background(), waited)
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	if err := <-cancelled; err != syscall.EINTR {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The cancelled op's slot can't be given back, since the op after it holds
+	// the following one. The next op must wait for the slot after that.
+	getAttrs(t, context.Background(), fs, limitedUid, 1)
+	if d := time.Since(start); d < 140*time.Millisecond {
+		t.Errorf("Op after cancellation proceeded after only %v", d)
+	}
+
+	if err := <-waited; err != nil {
+		t.Errorf("GetInodeAttributes: %v", err)
+	}
+}
+
+func TestPerUserThrottle_ManyUsers(t *testing.T) {
+	ctx := context.Background()
+
+	// Hold one user to the usual rate, and let the others through so quickly
+	// that their slots have passed by the time the next op arrives.
+	fs := fuseutil.NewPerUserThrottle(&countingFS{}, func(uid uint32) float64 {
+		if uid == limitedUid {
+			return 20
+		}
+
+		return 1e9
+	})
+
+	// The limited user takes its first slot.
+	getAttrs(t, ctx, fs, limitedUid, 1)
+
+	// Many other users come and go, enough for the throttle to forget about
+	// them several times over.
+	for uid := uint32(1000); uid < 2000; uid++ {
+		getAttrs(t, ctx, fs, uid, 1)
+	}
+
+	// The limited user's next slot must not have been forgotten along with
+	// them.
+	if d := getAttrs(t, ctx, fs, limitedUid, 1); d < 25*time.Millisecond {
+		t.Errorf("Limited user's second op took only %v", d)
+	}
+}
+
+func TestPerUserThrottle_ReadDirPlusFallsBackToReadDir(t *testing.T) {
+	fs := fuseutil.NewPerUserThrottle(&readDirPlusFS{}, throttleLimits)
+
+	// With a context not from NewFileSystemServer, ReadDir should be called
+	// synchronously rather than arranging to reply later.
+	op := &fuseops.ReadDirPlusOp{
+		Inode:     fuseops.RootInodeID,
+		Dst:       make([]byte, 4096),
+		OpContext: fuseops.OpContext{Uid: unlimitedUid},
+	}
+
+	if err := fs.ReadDirPlus(context.Background(), op); err != nil {
+		t.Fatalf("ReadDirPlus: %v", err)
+	}
+
+	var expected int
+	for _, d := range readDirPlusEntries {
+		expected += fuseutil.WriteDirentPlus(
+			make([]byte, 4096),
+			d,
+			fuseops.ChildInodeEntry{})
+	}
+
+	if op.BytesRead != expected {
+		t.Errorf("BytesRead: %d, want %d", op.BytesRead, expected)
+	}
+}
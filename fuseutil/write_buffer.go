@@ -0,0 +1,208 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// WriteBuffer accumulates data written to a file handle before the file system
+// commits it elsewhere, e.g. as an object uploaded when the handle is flushed.
+// Data is kept in memory up to a limit, beyond which the whole buffer is
+// spilled to an anonymous temporary file so that large writes don't exhaust
+// memory. Either way the contents are presented through ReadAt.
+//
+// Writes may arrive at any offset, as with fuseops.WriteFileOp; gaps read as
+// zeroes. A WriteBuffer is safe for concurrent use.
+//
+// Must be created with NewWriteBuffer, and closed when no longer needed.
+type WriteBuffer struct {
+	// Constant data
+	limit int64
+	dir   string
+
+	mu sync.Mutex
+
+	// The contents of the buffer. Exactly one of mem and file is in use,
+	// starting with mem.
+	//
+	// GUARDED_BY(mu)
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+var _ io.ReaderAt = &WriteBuffer{}
+var _ io.WriterAt = &WriteBuffer{}
+
+// NewWriteBuffer creates an empty buffer that holds up to limit bytes in
+// memory, spilling beyond that to a temporary file in dir (or the default
+// directory for temporary files, if dir is empty).
+func NewWriteBuffer(limit int64, dir string) *WriteBuffer {
+	return &WriteBuffer{
+		limit: limit,
+		dir:   dir,
+	}
+}
+
+// WriteAt writes p at the given offset, extending the buffer if necessary.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *WriteBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset: %d", off)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	end := off + int64(len(p))
+	if b.file == nil && end > b.limit {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	if end > b.size {
+		b.size = end
+	}
+
+	if b.file != nil {
+		return b.file.WriteAt(p, off)
+	}
+
+	if end > int64(len(b.mem)) {
+		grown := make([]byte, end, 2*end)
+		copy(grown, b.mem)
+		b.mem = grown
+	}
+
+	return copy(b.mem[off:], p), nil
+}
+
+// ReadAt reads from the buffer's contents, with the semantics of
+// io.ReaderAt.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *WriteBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset: %d", off)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if off >= b.size {
+		return 0, io.EOF
+	}
+
+	// Don't read past the end of the data, which for the file may be followed
+	// by garbage from a write that failed part way through.
+	var err error
+	if avail := b.size - off; int64(len(p)) > avail {
+		p = p[:avail]
+		err = io.EOF
+	}
+
+	var n int
+	if b.file != nil {
+		var readErr error
+		n, readErr = b.file.ReadAt(p, off)
+		if readErr != nil && readErr != io.EOF {
+			return n, readErr
+		}
+
+		// Zeroes not yet materialized in the file.
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+
+		n = len(p)
+	} else {
+		n = copy(p, b.mem[off:b.size])
+	}
+
+	return n, err
+}
+
+// Size returns the number of bytes in the buffer: one past the greatest offset
+// written to.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *WriteBuffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.size
+}
+
+// Spilled reports whether the buffer has exceeded its in-memory limit and is
+// now backed by a temporary file.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *WriteBuffer) Spilled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.file != nil
+}
+
+// Close releases the memory or temporary file used by the buffer.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *WriteBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.mem = nil
+	b.size = 0
+	if b.file == nil {
+		return nil
+	}
+
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+// Move the contents of the buffer from memory to a temporary file.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *WriteBuffer) spill() error {
+	f, err := ioutil.TempFile(b.dir, "write_buffer")
+	if err != nil {
+		return fmt.Errorf("TempFile: %v", err)
+	}
+
+	// Unlink the file straight away, so that it disappears once closed even if
+	// we crash.
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return fmt.Errorf("Remove: %v", err)
+	}
+
+	if _, err := f.WriteAt(b.mem[:b.size], 0); err != nil {
+		f.Close()
+		return fmt.Errorf("WriteAt: %v", err)
+	}
+
+	b.file = f
+	b.mem = nil
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestWriteBuffer_InMemory(t *testing.T) {
+	b := fuseutil.NewWriteBuffer(1024, "")
+	defer b.Close()
+
+	// Write out of order, leaving a gap.
+	if _, err := b.WriteAt([]byte("taco"), 8); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+
+	if _, err := b.WriteAt([]byte("burrito"), 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+
+	if b.Spilled() {
+		t.Error("Spilled unexpectedly")
+	}
+
+	if b.Size() != 12 {
+		t.Errorf("Size: %d", b.Size())
+	}
+
+	got, err := ioutil.ReadAll(io.NewSectionReader(b, 0, b.Size()))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	if string(got) != "burrito\x00taco" {
+		t.Errorf("Contents: %q", got)
+	}
+}
+
+func TestWriteBuffer_Spill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write_buffer_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	const limit = 4096
+	b := fuseutil.NewWriteBuffer(limit, dir)
+	defer b.Close()
+
+	// Write several times the limit, in chunks that don't line up with it, and
+	// with a hole in the middle.
+	var expected []byte
+	chunk := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		for j := range chunk {
+			chunk[j] = byte(i*7 + j)
+		}
+
+		off := int64(len(expected))
+		if i == 10 {
+			expected = append(expected, make([]byte, 500)...)
+			off += 500
+		}
+
+		if _, err := b.WriteAt(chunk, off); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+
+		expected = append(expected, chunk...)
+	}
+
+	if !b.Spilled() {
+		t.Error("Expected the buffer to have spilled")
+	}
+
+	if b.Size() != int64(len(expected)) {
+		t.Errorf("Size: %d, want %d", b.Size(), len(expected))
+	}
+
+	// Overwrite some data that was written before the spill.
+	if _, err := b.WriteAt([]byte("taco"), 10); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+
+	copy(expected[10:], "taco")
+
+	// Read everything back.
+	got := make([]byte, len(expected))
+	if n, err := b.ReadAt(got, 0); n != len(got) || err != nil {
+		t.Fatalf("ReadAt: %d, %v", n, err)
+	}
+
+	if !bytes.Equal(got, expected) {
+		t.Error("Contents differ after spilling")
+	}
+
+	// Reading past the end yields a short read.
+	n, err := b.ReadAt(make([]byte, 100), int64(len(expected)-10))
+	if n != 10 || err != io.EOF {
+		t.Errorf("ReadAt at end: %d, %v", n, err)
+	}
+
+	// The temporary file is anonymous.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("Unexpected directory entries: %v", entries)
+	}
+}
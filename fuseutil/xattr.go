@@ -0,0 +1,52 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"github.com/jacobsa/fuse"
+)
+
+// Write the supplied extended attribute names into the given buffer in the
+// format expected in fuseops.ListXattrOp.Dst, a sequence of NUL-terminated
+// strings, returning the number of bytes the list takes up.
+//
+// If buf is empty the caller is asking only for the size, so nothing is
+// written. Otherwise if the list would not fit, ERANGE is returned along with
+// the size. Either way the result is suitable for ListXattrOp.BytesRead:
+//
+//	op.BytesRead, err = fuseutil.WriteXattrNames(op.Dst, names)
+//	return err
+func WriteXattrNames(buf []byte, names []string) (n int, err error) {
+	for _, name := range names {
+		n += len(name) + 1
+	}
+
+	switch {
+	case len(buf) == 0:
+		return n, nil
+
+	case n > len(buf):
+		return n, fuse.ERANGE
+	}
+
+	off := 0
+	for _, name := range names {
+		off += copy(buf[off:], name)
+		buf[off] = 0
+		off++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestWriteXattrNames(t *testing.T) {
+	names := []string{"user.foo", "user.taco", "security.bar"}
+	const want = "user.foo\x00user.taco\x00security.bar\x00"
+
+	testCases := []struct {
+		name    string
+		bufSize int
+		wantErr error
+		wantBuf string
+	}{
+		{"size probe", 0, nil, ""},
+		{"too small", len(want) - 1, fuse.ERANGE, ""},
+		{"exact", len(want), nil, want},
+		{"larger", len(want) + 10, nil, want},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Fill the buffer with junk, to check that the NULs are written rather
+			// than assumed.
+			buf := make([]byte, tc.bufSize)
+			for i := range buf {
+				buf[i] = 'x'
+			}
+
+			n, err := fuseutil.WriteXattrNames(buf, names)
+			if n != len(want) {
+				t.Errorf("n: got %d, want %d", n, len(want))
+			}
+
+			if err != tc.wantErr {
+				t.Errorf("err: got %v, want %v", err, tc.wantErr)
+			}
+
+			if tc.wantBuf != "" && string(buf[:n]) != tc.wantBuf {
+				t.Errorf("buf: got %q, want %q", buf[:n], tc.wantBuf)
+			}
+		})
+	}
+
+	// An empty list is written as nothing at all.
+	if n, err := fuseutil.WriteXattrNames(make([]byte, 8), nil); n != 0 || err != nil {
+		t.Errorf("Empty list: got (%d, %v)", n, err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A generationChecker tracks the kernel's lookup count for each inode, and
+// notices when the file system reuses the ID of an inode that the kernel has
+// forgotten without bumping its generation number. Such reuse goes unnoticed
+// by the kernel itself, but can cause NFS clients holding a file handle for
+// the old inode to silently see the new one. See fuseops.GenerationNumber.
+//
+// Reuse can't be told apart from a repeat lookup of the same inode in general,
+// so this only complains when an ID is returned for an inode that is evidently
+// a new one: one minted by an op that creates an inode, or one of a different
+// type.
+type generationChecker struct {
+	mu sync.Mutex
+
+	// The state of each inode ID ever returned to the kernel, other than the
+	// root. This grows without bound, which is acceptable only when debugging.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*generationState
+}
+
+type generationState struct {
+	// The kernel's lookup count for the inode.
+	lookupCount uint64
+
+	// The generation and file type with which the ID was last returned.
+	generation fuseops.GenerationNumber
+	fileType   os.FileMode
+}
+
+func newGenerationChecker() *generationChecker {
+	return &generationChecker{
+		inodes: make(map[fuseops.InodeID]*generationState),
+	}
+}
+
+// Inspect the reply to the supplied op, returning a description of any
+// generation number problem found or the empty string if none.
+//
+// LOCKS_EXCLUDED(gc.mu)
+func (gc *generationChecker) check(op interface{}, opErr error) string {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	// Failed ops return no entry. But the kernel has dropped its references by
+	// the time it sends a forget, whatever the file system replies.
+	if opErr != nil && !isForgetOp(op) {
+		return ""
+	}
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return gc.checkEntry(o.Entry, false)
+
+	case *fuseops.CreateLinkOp:
+		return gc.checkEntry(o.Entry, false)
+
+	case *fuseops.MkDirOp:
+		return gc.checkEntry(o.Entry, true)
+
+	case *fuseops.MkNodeOp:
+		return gc.checkEntry(o.Entry, true)
+
+	case *fuseops.CreateFileOp:
+		return gc.checkEntry(o.Entry, true)
+
+	case *fuseops.CreateSymlinkOp:
+		return gc.checkEntry(o.Entry, true)
+
+	case *fuseops.ForgetInodeOp:
+		gc.forget(o.Inode, o.N)
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range o.Entries {
+			gc.forget(e.Inode, e.N)
+		}
+	}
+
+	return ""
+}
+
+// Decrement the lookup count for the supplied inode.
+//
+// LOCKS_REQUIRED(gc.mu)
+func (gc *generationChecker) forget(id fuseops.InodeID, n uint64) {
+	if s, ok := gc.inodes[id]; ok {
+		if n > s.lookupCount {
+			s.lookupCount = 0
+		} else {
+			s.lookupCount -= n
+		}
+	}
+}
+
+// Record that the kernel has been given the supplied entry, which names an
+// inode that was just created if created is true.
+//
+// LOCKS_REQUIRED(gc.mu)
+func (gc *generationChecker) checkEntry(
+	e fuseops.ChildInodeEntry,
+	created bool) (msg string) {
+	if e.Child == fuseops.RootInodeID {
+		return ""
+	}
+
+	fileType := e.Attributes.Mode & os.ModeType
+	s, ok := gc.inodes[e.Child]
+	if !ok {
+		gc.inodes[e.Child] = &generationState{
+			lookupCount: 1,
+			generation:  e.Generation,
+			fileType:    fileType,
+		}
+
+		return ""
+	}
+
+	// Is this a different inode reusing the ID of one that the kernel has
+	// forgotten, with a generation number no newer than the old one's?
+	reused := s.lookupCount == 0 && (created || fileType != s.fileType)
+	if reused && e.Generation <= s.generation {
+		msg = fmt.Sprintf(
+			"inode %d reused with generation %d after a forget (previously %d); "+
+				"the generation must be increased",
+			e.Child,
+			e.Generation,
+			s.generation)
+	}
+
+	s.lookupCount++
+	s.generation = e.Generation
+	s.fileType = fileType
+
+	return msg
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func checkerEntry(
+	id fuseops.InodeID,
+	gen fuseops.GenerationNumber,
+	mode os.FileMode) fuseops.ChildInodeEntry {
+	return fuseops.ChildInodeEntry{
+		Child:      id,
+		Generation: gen,
+		Attributes: fuseops.InodeAttributes{Mode: mode},
+	}
+}
+
+func TestGenerationChecker(t *testing.T) {
+	testCases := []struct {
+		name string
+
+		// The op that reuses inode 17 after it has been looked up with
+		// generation 0 and then forgotten.
+		reuse interface{}
+
+		// Whether a warning is expected.
+		warn bool
+	}{
+		{
+			"same inode looked up again",
+			&fuseops.LookUpInodeOp{Entry: checkerEntry(17, 0, 0644)},
+			false,
+		},
+		{
+			"created without bumping the generation",
+			&fuseops.CreateFileOp{Entry: checkerEntry(17, 0, 0644)},
+			true,
+		},
+		{
+			"created with a bumped generation",
+			&fuseops.CreateFileOp{Entry: checkerEntry(17, 1, 0644)},
+			false,
+		},
+		{
+			"different type without bumping the generation",
+			&fuseops.LookUpInodeOp{Entry: checkerEntry(17, 0, 0755|os.ModeDir)},
+			true,
+		},
+		{
+			"different type with a bumped generation",
+			&fuseops.MkDirOp{Entry: checkerEntry(17, 2, 0755|os.ModeDir)},
+			false,
+		},
+	}
+
+	for _, tc := range testCases {
+		gc := newGenerationChecker()
+
+		// Look up the inode twice, and have the kernel forget both references.
+		gc.check(&fuseops.LookUpInodeOp{Entry: checkerEntry(17, 0, 0644)}, nil)
+		gc.check(&fuseops.LookUpInodeOp{Entry: checkerEntry(17, 0, 0644)}, nil)
+		gc.check(&fuseops.ForgetInodeOp{Inode: 17, N: 2}, ENOSYS)
+
+		msg := gc.check(tc.reuse, nil)
+		if tc.warn && !strings.Contains(msg, "inode 17 reused") {
+			t.Errorf("%s: unexpected message %q", tc.name, msg)
+		}
+
+		if !tc.warn && msg != "" {
+			t.Errorf("%s: unexpected warning %q", tc.name, msg)
+		}
+	}
+}
+
+func TestGenerationChecker_NotForgotten(t *testing.T) {
+	gc := newGenerationChecker()
+
+	// While the kernel still holds a reference, the inode can't have been
+	// reused.
+	gc.check(&fuseops.LookUpInodeOp{Entry: checkerEntry(17, 0, 0644)}, nil)
+	gc.check(&fuseops.LookUpInodeOp{Entry: checkerEntry(17, 0, 0644)}, nil)
+	gc.check(&fuseops.ForgetInodeOp{Inode: 17, N: 1}, nil)
+
+	if msg := gc.check(&fuseops.CreateLinkOp{Entry: checkerEntry(17, 0, 0644)}, nil); msg != "" {
+		t.Errorf("Unexpected warning: %q", msg)
+	}
+}
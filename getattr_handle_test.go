@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A fileFS whose file appears to be one byte long when statted by path but two
+// bytes long when statted through an open handle.
+type handleAttrsFS struct {
+	fileFS
+}
+
+func newHandleAttrsFS() *handleAttrsFS {
+	fs := &handleAttrsFS{}
+	fs.attrs = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0777,
+		Size:  1,
+	}
+
+	return fs
+}
+
+func (fs *handleAttrsFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.fileFS.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	if op.Inode == fileFSFooID && op.Handle != nil {
+		op.Attributes.Size = 2
+	}
+
+	return nil
+}
+
+func TestGetInodeAttributesWithHandle(t *testing.T) {
+	// Mount. Writeback caching would cause the kernel to disregard the sizes
+	// returned by the file system after the first.
+	mfs := mountFS(
+		t,
+		newHandleAttrsFS(),
+		&fuse.MountConfig{DisableWritebackCaching: true})
+
+	// stat(2) by path.
+	p := path.Join(mfs.Dir(), "foo")
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if fi.Size() != 1 {
+		t.Errorf("Unexpected size from stat: %d", fi.Size())
+	}
+
+	// fstat(2) through a handle.
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	fi, err = f.Stat()
+	if err != nil {
+		t.Fatalf("Fstat: %v", err)
+	}
+
+	if fi.Size() != 2 {
+		t.Errorf("Unexpected size from fstat: %d", fi.Size())
+	}
+}
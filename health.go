@@ -0,0 +1,154 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync"
+	"time"
+)
+
+// HealthStatus summarizes whether a connection is serving ops as it should. See
+// MountedFileSystem.Health.
+type HealthStatus int
+
+const (
+	// Ops are being answered in a timely manner, and mostly without unexpected
+	// errors.
+	Healthy HealthStatus = iota
+
+	// The connection is alive, but some op has been outstanding for longer than
+	// MountConfig.StuckOpThreshold, or many recent ops have failed with
+	// unexpected errors.
+	Degraded
+
+	// The connection to the kernel has been lost, e.g. because the file system
+	// was unmounted.
+	Dead
+)
+
+func (s HealthStatus) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Dead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// The stuck op threshold used when MountConfig.StuckOpThreshold is zero.
+	defaultStuckOpThreshold = time.Minute
+
+	// The number of recent replies considered when computing the error rate.
+	// The connection is degraded if at least half of them were unexpected
+	// errors.
+	healthWindow = 64
+)
+
+// healthTracker records the information needed to compute a HealthStatus.
+type healthTracker struct {
+	mu sync.Mutex
+
+	// The time at which each in-flight op was read, keyed by fuse request ID.
+	// Forget ops, which are not replied to, are not included.
+	//
+	// GUARDED_BY(mu)
+	opStartTimes map[uint64]time.Time
+
+	// Whether each of the most recent replies was an unexpected error, as a
+	// ring buffer indexed by the number of replies modulo healthWindow, and the
+	// number of true entries.
+	//
+	// GUARDED_BY(mu)
+	recentErrors [healthWindow]bool
+	replies      uint64
+	errors       int
+
+	// Set when reading from the kernel has failed for good.
+	//
+	// GUARDED_BY(mu)
+	dead bool
+}
+
+// LOCKS_EXCLUDED(h.mu)
+func (h *healthTracker) opStarted(fuseID uint64, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.opStartTimes == nil {
+		h.opStartTimes = make(map[uint64]time.Time)
+	}
+
+	h.opStartTimes[fuseID] = now
+}
+
+// Record that the op with the given request ID has been replied to, with an
+// unexpected error if failed is true.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *healthTracker) opFinished(fuseID uint64, failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.opStartTimes, fuseID)
+
+	i := h.replies % healthWindow
+	if h.recentErrors[i] {
+		h.errors--
+	}
+
+	h.recentErrors[i] = failed
+	if failed {
+		h.errors++
+	}
+
+	h.replies++
+}
+
+// LOCKS_EXCLUDED(h.mu)
+func (h *healthTracker) markDead() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.dead = true
+}
+
+// LOCKS_EXCLUDED(h.mu)
+func (h *healthTracker) status(
+	now time.Time,
+	stuckOpThreshold time.Duration) HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.dead {
+		return Dead
+	}
+
+	if h.errors >= healthWindow/2 {
+		return Degraded
+	}
+
+	for _, start := range h.opStartTimes {
+		if now.Sub(start) >= stuckOpThreshold {
+			return Degraded
+		}
+	}
+
+	return Healthy
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A file system with a single file named "wedge" in the root, whose lookups
+// block until unwedge is closed.
+type wedgedFS struct {
+	minimalFS
+	unwedge chan struct{}
+}
+
+func (fs *wedgedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "wedge" {
+		return fuse.ENOENT
+	}
+
+	<-fs.unwedge
+
+	op.Entry.Child = fuseops.RootInodeID + 1
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+	}
+
+	return nil
+}
+
+func TestHealthDegradedByStuckOp(t *testing.T) {
+	ctx := context.Background()
+
+	// Mount.
+	const threshold = 100 * time.Millisecond
+	fs := &wedgedFS{unwedge: make(chan struct{})}
+	mfs := mountFS(t, fs, &fuse.MountConfig{StuckOpThreshold: threshold})
+
+	if s := mfs.Health(); s != fuse.Healthy {
+		t.Errorf("After mounting: %v", s)
+	}
+
+	// Wedge a lookup.
+	statErr := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(path.Join(mfs.Dir(), "wedge"))
+		statErr <- err
+	}()
+
+	// The mount should become degraded once the op has been stuck for long
+	// enough.
+	deadline := time.Now().Add(5 * time.Second)
+	for mfs.Health() != fuse.Degraded && time.Now().Before(deadline) {
+		time.Sleep(threshold / 10)
+	}
+
+	if s := mfs.Health(); s != fuse.Degraded {
+		t.Errorf("With a stuck op: %v", s)
+	}
+
+	// Unwedge it, after which we should be healthy again.
+	close(fs.unwedge)
+	if err := <-statErr; err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+
+	if s := mfs.Health(); s != fuse.Healthy {
+		t.Errorf("After unwedging: %v", s)
+	}
+
+	// Once unmounted, the connection is dead.
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Errorf("Joining: %v", err)
+	}
+
+	if s := mfs.Health(); s != fuse.Dead {
+		t.Errorf("After unmounting: %v", s)
+	}
+}
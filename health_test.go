@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestHealthStatus(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	c := &Connection{
+		cfg: MountConfig{
+			OpContext:        context.Background(),
+			Clock:            &clock,
+			StuckOpThreshold: time.Second,
+		},
+		cancelFuncs: make(map[uint64]func(error)),
+	}
+
+	if s := c.Health(); s != Healthy {
+		t.Errorf("Initially %v", s)
+	}
+
+	// An op that has been outstanding for too long degrades the connection.
+	c.beginOp(fusekernel.OpGetattr, 17, 0)
+	clock.AdvanceTime(500 * time.Millisecond)
+	if s := c.Health(); s != Healthy {
+		t.Errorf("After 500 ms: %v", s)
+	}
+
+	clock.AdvanceTime(500 * time.Millisecond)
+	if s := c.Health(); s != Degraded {
+		t.Errorf("After 1 s: %v", s)
+	}
+
+	c.finishOp(fusekernel.OpGetattr, 17)
+	c.health.opFinished(17, false)
+	if s := c.Health(); s != Healthy {
+		t.Errorf("After reply: %v", s)
+	}
+
+	// So does a high rate of unexpected errors, until it subsides.
+	for i := 0; i < healthWindow; i++ {
+		c.health.opFinished(uint64(i), i%2 == 0)
+	}
+
+	if s := c.Health(); s != Degraded {
+		t.Errorf("With errors: %v", s)
+	}
+
+	c.health.opFinished(100, false)
+	if s := c.Health(); s != Healthy {
+		t.Errorf("With fewer errors: %v", s)
+	}
+
+	// Losing the connection trumps everything.
+	c.health.markDead()
+	if s := c.Health(); s != Dead {
+		t.Errorf("After losing the connection: %v", s)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// A fileFS whose file has the flags in flags.
+type flagsFS struct {
+	fileFS
+	flags fuseops.InodeFlags
+}
+
+func (fs *flagsFS) GetInodeFlags(
+	ctx context.Context,
+	op *fuseops.GetInodeFlagsOp) error {
+	if op.Inode != fileFSFooID {
+		return fuse.ENOENT
+	}
+
+	op.Flags = fs.flags
+	return nil
+}
+
+func TestInodeFlags(t *testing.T) {
+	fs := &flagsFS{
+		fileFS: fileFS{attrs: fuseops.InodeAttributes{Nlink: 1, Mode: 0666}},
+		flags:  fuseops.InodeFlags{Encrypted: true, NoDump: true},
+	}
+
+	mfs := mountFS(t, fs, &fuse.MountConfig{})
+
+	f, err := os.Open(path.Join(mfs.Dir(), "foo"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	// Ask for the flags as lsattr(1) does.
+	cmd := uint(fusekernel.IoctlGetFlags)
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		cmd = fusekernel.IoctlGetFlags32
+	}
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), cmd)
+	if err != nil {
+		t.Fatalf("FS_IOC_GETFLAGS: %v", err)
+	}
+
+	want := fusekernel.InodeEncrypted | fusekernel.InodeNoDump
+	if fusekernel.InodeFlags(flags) != want {
+		t.Errorf("Flags: got %#x, want %#x", flags, want)
+	}
+}
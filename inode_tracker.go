@@ -0,0 +1,179 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// An inodeTracker follows the kernel's lookup count for each inode, as
+// implicitly incremented by the ops that return an entry and decremented by
+// ForgetInodeOp. See MountConfig.EnableInodeLifecycleTracing.
+type inodeTracker struct {
+	mu sync.Mutex
+
+	// The lookup count of each inode that the kernel currently holds. Inodes
+	// are removed once their count drops to zero.
+	//
+	// GUARDED_BY(mu)
+	counts map[fuseops.InodeID]int64
+}
+
+func newInodeTracker() *inodeTracker {
+	return &inodeTracker{
+		counts: make(map[fuseops.InodeID]int64),
+	}
+}
+
+// A change to the lookup count of an inode, and the resulting count.
+type lookupCountChange struct {
+	id    fuseops.InodeID
+	delta int64
+	count int64
+}
+
+// Update the lookup counts for the reply to the supplied op, returning the
+// changes made.
+//
+// LOCKS_EXCLUDED(it.mu)
+func (it *inodeTracker) record(
+	op interface{},
+	opErr error) (changes []lookupCountChange) {
+	// The kernel has dropped its references by the time it sends a forget,
+	// whatever the file system replies.
+	switch o := op.(type) {
+	case *fuseops.ForgetInodeOp:
+		changes = []lookupCountChange{{id: o.Inode, delta: -int64(o.N)}}
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range o.Entries {
+			changes = append(changes, lookupCountChange{id: e.Inode, delta: -int64(e.N)})
+		}
+
+	case *fuseops.ReadDirPlusOp:
+		if opErr != nil || o.BytesRead > len(o.Dst) {
+			return nil
+		}
+
+		for _, id := range direntPlusChildren(o.Dst[:o.BytesRead]) {
+			changes = append(changes, lookupCountChange{id: id, delta: 1})
+		}
+
+	default:
+		// Failed ops return no entry.
+		e := entryForOp(op)
+		if e == nil || opErr != nil || e.Child == 0 {
+			return nil
+		}
+
+		changes = []lookupCountChange{{id: e.Child, delta: 1}}
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	for i := range changes {
+		ch := &changes[i]
+		ch.count = it.counts[ch.id] + ch.delta
+		if ch.count == 0 {
+			delete(it.counts, ch.id)
+		} else {
+			it.counts[ch.id] = ch.count
+		}
+	}
+
+	return changes
+}
+
+// Return a copy of the current lookup counts.
+//
+// LOCKS_EXCLUDED(it.mu)
+func (it *inodeTracker) snapshot() map[fuseops.InodeID]int64 {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	counts := make(map[fuseops.InodeID]int64, len(it.counts))
+	for id, n := range it.counts {
+		counts[id] = n
+	}
+
+	return counts
+}
+
+// Return the entry that the reply to the supplied op gives the kernel, and so
+// for whose inode it implicitly increments the lookup count, or nil if none.
+func entryForOp(op interface{}) *fuseops.ChildInodeEntry {
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return &o.Entry
+
+	case *fuseops.MkDirOp:
+		return &o.Entry
+
+	case *fuseops.MkNodeOp:
+		return &o.Entry
+
+	case *fuseops.CreateFileOp:
+		return &o.Entry
+
+	case *fuseops.CreateSymlinkOp:
+		return &o.Entry
+
+	case *fuseops.CreateLinkOp:
+		return &o.Entry
+	}
+
+	return nil
+}
+
+// Return the inodes of the entries in the supplied ReadDirPlusOp data, as
+// written by fuseutil.WriteDirentPlus, for which the kernel increments the
+// lookup count: those with a non-zero ID, other than "." and "..". A truncated
+// final entry is ignored.
+func direntPlusChildren(buf []byte) (ids []fuseops.InodeID) {
+	// See fuseutil.WriteDirentPlus for the layout.
+	const entryOutSize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	const direntAlignment = 8
+	const direntSize = fusekernel.DirentSize
+	const namelenOffset = int(unsafe.Offsetof(fusekernel.Dirent{}.Namelen))
+
+	for len(buf) >= entryOutSize+direntSize {
+		out := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+		namelen := int(*(*uint32)(unsafe.Pointer(&buf[entryOutSize+namelenOffset])))
+
+		nameStart := entryOutSize + direntSize
+		if nameStart+namelen > len(buf) {
+			break
+		}
+
+		name := string(buf[nameStart : nameStart+namelen])
+		if out.Nodeid != 0 && name != "." && name != ".." {
+			ids = append(ids, fuseops.InodeID(out.Nodeid))
+		}
+
+		size := nameStart + (namelen+direntAlignment-1)/direntAlignment*direntAlignment
+		if size > len(buf) {
+			break
+		}
+
+		buf = buf[size:]
+	}
+
+	return ids
+}
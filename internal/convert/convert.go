@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package convert converts the types of package fuseops to the forms in which
+// they are sent to the kernel, for the parts of this module that serialize
+// replies.
+package convert
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Time converts a time to seconds and nanoseconds since the epoch.
+func Time(t time.Time) (secs uint64, nsec uint32) {
+	totalNano := t.UnixNano()
+	secs = uint64(totalNano / 1e9)
+	nsec = uint32(totalNano % 1e9)
+	return secs, nsec
+}
+
+// Attributes converts the attributes of the given inode.
+func Attributes(
+	inodeID fuseops.InodeID,
+	in *fuseops.InodeAttributes,
+	out *fusekernel.Attr) {
+	out.Ino = uint64(inodeID)
+	out.Size = in.Size
+	out.Atime, out.AtimeNsec = Time(in.Atime)
+	out.Mtime, out.MtimeNsec = Time(in.Mtime)
+	out.Ctime, out.CtimeNsec = Time(in.Ctime)
+	out.SetCrtime(Time(in.Crtime))
+	out.Nlink = in.Nlink
+	out.Uid = in.Uid
+	out.Gid = in.Gid
+	out.Rdev = in.Rdev
+	out.Blocks = in.Blocks
+	if out.Blocks == 0 && !in.BlocksValid {
+		// round up to the nearest 512 boundary
+		out.Blocks = (in.Size + 512 - 1) / 512
+	}
+
+	// Set the mode.
+	out.Mode = uint32(in.Mode) & 0777
+	switch {
+	default:
+		out.Mode |= syscall.S_IFREG
+	case in.Mode&os.ModeDir != 0:
+		out.Mode |= syscall.S_IFDIR
+	case in.Mode&os.ModeDevice != 0:
+		if in.Mode&os.ModeCharDevice != 0 {
+			out.Mode |= syscall.S_IFCHR
+		} else {
+			out.Mode |= syscall.S_IFBLK
+		}
+	case in.Mode&os.ModeNamedPipe != 0:
+		out.Mode |= syscall.S_IFIFO
+	case in.Mode&os.ModeSymlink != 0:
+		out.Mode |= syscall.S_IFLNK
+	case in.Mode&os.ModeSocket != 0:
+		out.Mode |= syscall.S_IFSOCK
+	}
+	if in.Mode&os.ModeSetuid != 0 {
+		out.Mode |= syscall.S_ISUID
+	}
+}
+
+// Expiration converts an expiration time, or a validity duration that takes
+// precedence over it if non-zero, to the duration from now expected by the
+// kernel.
+func Expiration(
+	now time.Time,
+	t time.Time,
+	validity time.Duration) (secs uint64, nsecs uint32) {
+	// Fuse represents durations as unsigned 64-bit counts of seconds and 32-bit
+	// counts of nanoseconds (cf. http://goo.gl/EJupJV). So negative durations
+	// are right out. There is no need to cap the positive magnitude, because
+	// 2^64 seconds is well longer than the 2^63 ns range of time.Duration.
+	d := validity
+	if d == 0 {
+		d = t.Sub(now)
+	}
+
+	if d > 0 {
+		secs = uint64(d / time.Second)
+		nsecs = uint32((d % time.Second) / time.Nanosecond)
+	}
+
+	return secs, nsecs
+}
+
+// ChildInodeEntry converts an entry, measuring its expiration times from now.
+func ChildInodeEntry(
+	now time.Time,
+	in *fuseops.ChildInodeEntry,
+	out *fusekernel.EntryOut) {
+	out.Nodeid = uint64(in.Child)
+	out.Generation = uint64(in.Generation)
+	out.EntryValid, out.EntryValidNsec = Expiration(
+		now,
+		in.EntryExpiration,
+		in.EntryValidity)
+	out.AttrValid, out.AttrValidNsec = Expiration(
+		now,
+		in.AttributesExpiration,
+		in.AttributesValidity)
+
+	Attributes(in.Child, &in.Attributes, &out.Attr)
+}
+
+// Flags converts an inode's flags to those returned by FS_IOC_GETFLAGS.
+func Flags(in *fuseops.InodeFlags) (out fusekernel.InodeFlags) {
+	if in.Compressed {
+		out |= fusekernel.InodeCompressed
+	}
+
+	if in.Encrypted {
+		out |= fusekernel.InodeEncrypted
+	}
+
+	if in.Immutable {
+		out |= fusekernel.InodeImmutable
+	}
+
+	if in.AppendOnly {
+		out |= fusekernel.InodeAppend
+	}
+
+	if in.NoDump {
+		out |= fusekernel.InodeNoDump
+	}
+
+	return out
+}
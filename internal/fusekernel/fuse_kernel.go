@@ -107,6 +107,9 @@ const (
 	SetattrMtimeNow  SetattrValid = 1 << 8
 	SetattrLockOwner SetattrValid = 1 << 9 // http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
 
+	// Linux only, with InitHandleKillprivV2
+	SetattrKillSuidgid SetattrValid = 1 << 11
+
 	// OS X only
 	SetattrCrtime   SetattrValid = 1 << 28
 	SetattrChgtime  SetattrValid = 1 << 29
@@ -114,20 +117,21 @@ const (
 	SetattrFlags    SetattrValid = 1 << 31
 )
 
-func (fl SetattrValid) Mode() bool      { return fl&SetattrMode != 0 }
-func (fl SetattrValid) Uid() bool       { return fl&SetattrUid != 0 }
-func (fl SetattrValid) Gid() bool       { return fl&SetattrGid != 0 }
-func (fl SetattrValid) Size() bool      { return fl&SetattrSize != 0 }
-func (fl SetattrValid) Atime() bool     { return fl&SetattrAtime != 0 }
-func (fl SetattrValid) Mtime() bool     { return fl&SetattrMtime != 0 }
-func (fl SetattrValid) Handle() bool    { return fl&SetattrHandle != 0 }
-func (fl SetattrValid) AtimeNow() bool  { return fl&SetattrAtimeNow != 0 }
-func (fl SetattrValid) MtimeNow() bool  { return fl&SetattrMtimeNow != 0 }
-func (fl SetattrValid) LockOwner() bool { return fl&SetattrLockOwner != 0 }
-func (fl SetattrValid) Crtime() bool    { return fl&SetattrCrtime != 0 }
-func (fl SetattrValid) Chgtime() bool   { return fl&SetattrChgtime != 0 }
-func (fl SetattrValid) Bkuptime() bool  { return fl&SetattrBkuptime != 0 }
-func (fl SetattrValid) Flags() bool     { return fl&SetattrFlags != 0 }
+func (fl SetattrValid) Mode() bool        { return fl&SetattrMode != 0 }
+func (fl SetattrValid) Uid() bool         { return fl&SetattrUid != 0 }
+func (fl SetattrValid) Gid() bool         { return fl&SetattrGid != 0 }
+func (fl SetattrValid) Size() bool        { return fl&SetattrSize != 0 }
+func (fl SetattrValid) Atime() bool       { return fl&SetattrAtime != 0 }
+func (fl SetattrValid) Mtime() bool       { return fl&SetattrMtime != 0 }
+func (fl SetattrValid) Handle() bool      { return fl&SetattrHandle != 0 }
+func (fl SetattrValid) AtimeNow() bool    { return fl&SetattrAtimeNow != 0 }
+func (fl SetattrValid) MtimeNow() bool    { return fl&SetattrMtimeNow != 0 }
+func (fl SetattrValid) LockOwner() bool   { return fl&SetattrLockOwner != 0 }
+func (fl SetattrValid) KillSuidgid() bool { return fl&SetattrKillSuidgid != 0 }
+func (fl SetattrValid) Crtime() bool      { return fl&SetattrCrtime != 0 }
+func (fl SetattrValid) Chgtime() bool     { return fl&SetattrChgtime != 0 }
+func (fl SetattrValid) Bkuptime() bool    { return fl&SetattrBkuptime != 0 }
+func (fl SetattrValid) Flags() bool       { return fl&SetattrFlags != 0 }
 
 func (fl SetattrValid) String() string {
 	return flagString(uint32(fl), setattrValidNames)
@@ -144,6 +148,7 @@ var setattrValidNames = []flagName{
 	{uint32(SetattrAtimeNow), "SetattrAtimeNow"},
 	{uint32(SetattrMtimeNow), "SetattrMtimeNow"},
 	{uint32(SetattrLockOwner), "SetattrLockOwner"},
+	{uint32(SetattrKillSuidgid), "SetattrKillSuidgid"},
 	{uint32(SetattrCrtime), "SetattrCrtime"},
 	{uint32(SetattrChgtime), "SetattrChgtime"},
 	{uint32(SetattrBkuptime), "SetattrBkuptime"},
@@ -164,6 +169,7 @@ const (
 	OpenExclusive OpenFlags = syscall.O_EXCL
 	OpenSync      OpenFlags = syscall.O_SYNC
 	OpenTruncate  OpenFlags = syscall.O_TRUNC
+	OpenNonblock  OpenFlags = syscall.O_NONBLOCK
 )
 
 // OpenAccessModeMask is a bitmask that separates the access mode
@@ -199,6 +205,21 @@ func (fl OpenFlags) IsReadWrite() bool {
 	return fl&OpenAccessModeMask == OpenReadWrite
 }
 
+// Return true if OpenAppend is set.
+func (fl OpenFlags) IsAppend() bool {
+	return fl&OpenAppend != 0
+}
+
+// Return true if OpenNonblock is set.
+func (fl OpenFlags) IsNonblock() bool {
+	return fl&OpenNonblock != 0
+}
+
+// Return true if OpenDirect is set.
+func (fl OpenFlags) IsDirect() bool {
+	return fl&OpenDirect != 0
+}
+
 func accModeName(flags OpenFlags) string {
 	switch flags {
 	case OpenReadOnly:
@@ -218,6 +239,8 @@ var openFlagNames = []flagName{
 	{uint32(OpenTruncate), "OpenTruncate"},
 	{uint32(OpenAppend), "OpenAppend"},
 	{uint32(OpenSync), "OpenSync"},
+	{uint32(OpenNonblock), "OpenNonblock"},
+	{uint32(OpenDirect), "OpenDirect"},
 }
 
 // The OpenResponseFlags are returned in the OpenResponse.
@@ -227,6 +250,7 @@ const (
 	OpenDirectIO    OpenResponseFlags = 1 << 0 // bypass page cache for this open file
 	OpenKeepCache   OpenResponseFlags = 1 << 1 // don't invalidate the data cache on open
 	OpenNonSeekable OpenResponseFlags = 1 << 2 // mark the file as non-seekable (not supported on OS X)
+	OpenNoFlush     OpenResponseFlags = 1 << 5 // don't send flush requests on close (Linux >= 5.16)
 
 	OpenPurgeAttr OpenResponseFlags = 1 << 30 // OS X
 	OpenPurgeUBC  OpenResponseFlags = 1 << 31 // OS X
@@ -240,6 +264,7 @@ var openResponseFlagNames = []flagName{
 	{uint32(OpenDirectIO), "OpenDirectIO"},
 	{uint32(OpenKeepCache), "OpenKeepCache"},
 	{uint32(OpenNonSeekable), "OpenNonSeekable"},
+	{uint32(OpenNoFlush), "OpenNoFlush"},
 	{uint32(OpenPurgeAttr), "OpenPurgeAttr"},
 	{uint32(OpenPurgeUBC), "OpenPurgeUBC"},
 }
@@ -266,9 +291,19 @@ const (
 	InitAsyncDIO         InitFlags = 1 << 15
 	InitWritebackCache   InitFlags = 1 << 16
 	InitNoOpenSupport    InitFlags = 1 << 17
+	InitParallelDirops   InitFlags = 1 << 18
 	InitMaxPages         InitFlags = 1 << 22
 	InitCacheSymlinks    InitFlags = 1 << 23
 	InitNoOpendirSupport InitFlags = 1 << 24
+	InitHandleKillprivV2 InitFlags = 1 << 28
+
+	// Linux only, protocol >= 7.33: SetxattrIn is replaced by SetxattrExtIn.
+	// This bit means InitCaseSensitive on OS X.
+	InitSetxattrExt InitFlags = 1 << 29
+
+	// Linux only, protocol >= 7.36: the flags continue in the Flags2 fields of
+	// InitIn and InitOut. This bit means InitVolRename on OS X.
+	InitInitExt InitFlags = 1 << 30
 
 	InitCaseSensitive InitFlags = 1 << 29 // OS X only
 	InitVolRename     InitFlags = 1 << 30 // OS X only
@@ -300,8 +335,12 @@ var initFlagNames = []flagName{
 	{uint32(InitAsyncDIO), "InitAsyncDIO"},
 	{uint32(InitWritebackCache), "InitWritebackCache"},
 	{uint32(InitNoOpenSupport), "InitNoOpenSupport"},
+	{uint32(InitParallelDirops), "InitParallelDirops"},
 	{uint32(InitCacheSymlinks), "InitCacheSymlinks"},
 	{uint32(InitNoOpendirSupport), "InitNoOpendirSupport"},
+	{uint32(InitHandleKillprivV2), "InitHandleKillprivV2"},
+	{uint32(InitSetxattrExt), "InitSetxattrExt"},
+	{uint32(InitInitExt), "InitInitExt"},
 
 	{uint32(InitCaseSensitive), "InitCaseSensitive"},
 	{uint32(InitVolRename), "InitVolRename"},
@@ -312,6 +351,25 @@ func (fl InitFlags) String() string {
 	return flagString(uint32(fl), initFlagNames)
 }
 
+// The InitFlags2 are the second word of flags used in the Init exchange, valid
+// when InitInitExt is set. Bit n here is bit 32+n of the flags in the kernel's
+// fuse_kernel.h.
+type InitFlags2 uint32
+
+const (
+	InitDirectIOAllowMmap InitFlags2 = 1 << 4 // Linux >= 6.6
+	InitHasResend         InitFlags2 = 1 << 7 // Linux >= 6.9
+)
+
+var initFlags2Names = []flagName{
+	{uint32(InitDirectIOAllowMmap), "InitDirectIOAllowMmap"},
+	{uint32(InitHasResend), "InitHasResend"},
+}
+
+func (fl InitFlags2) String() string {
+	return flagString(uint32(fl), initFlags2Names)
+}
+
 func flagString(f uint32, names []flagName) string {
 	var s string
 
@@ -386,7 +444,11 @@ const (
 	OpDestroy     = 38
 	OpIoctl       = 39 // Linux?
 	OpPoll        = 40 // Linux?
+	OpBatchForget = 42 // no reply
 	OpFallocate   = 43
+	OpReaddirplus = 44
+
+	OpCopyFileRange = 47
 
 	// OS X
 	OpSetvolname = 61
@@ -417,6 +479,16 @@ type ForgetIn struct {
 	Nlookup uint64
 }
 
+type BatchForgetIn struct {
+	Count uint32
+	dummy uint32
+}
+
+type ForgetOne struct {
+	Nodeid  uint64
+	Nlookup uint64
+}
+
 type GetattrIn struct {
 	GetattrFlags uint32
 	dummy        uint32
@@ -515,10 +587,19 @@ type setattrInCommon struct {
 }
 
 type OpenIn struct {
-	Flags  uint32
-	Unused uint32
+	Flags     uint32
+	OpenFlags uint32 // OpenInFlags
 }
 
+// The OpenInFlags are passed in OpenIn and CreateIn.
+type OpenInFlags uint32
+
+const (
+	// The file system should clear the setuid and setgid bits, as for
+	// WriteKillSuidgid (with InitHandleKillprivV2).
+	OpenInKillSuidgid OpenInFlags = 1 << 0
+)
+
 type OpenOut struct {
 	Fh        uint64
 	OpenFlags uint32
@@ -526,10 +607,10 @@ type OpenOut struct {
 }
 
 type CreateIn struct {
-	Flags   uint32
-	Mode    uint32
-	Umask   uint32
-	padding uint32
+	Flags     uint32
+	Mode      uint32
+	Umask     uint32
+	OpenFlags uint32 // OpenInFlags
 }
 
 func CreateInSize(p Protocol) uintptr {
@@ -621,11 +702,15 @@ const (
 	WriteCache WriteFlags = 1 << 0
 	// LockOwner field is valid.
 	WriteLockOwner WriteFlags = 1 << 1
+	// The file system should clear the setuid bit, and the setgid bit if the
+	// file is group-executable (with InitHandleKillprivV2).
+	WriteKillSuidgid WriteFlags = 1 << 2
 )
 
 var writeFlagNames = []flagName{
 	{uint32(WriteCache), "WriteCache"},
 	{uint32(WriteLockOwner), "WriteLockOwner"},
+	{uint32(WriteKillSuidgid), "WriteKillSuidgid"},
 }
 
 func (fl WriteFlags) String() string {
@@ -653,6 +738,24 @@ func (setxattrInCommon) GetPosition() uint32 {
 	return 0
 }
 
+// The extended form of SetxattrIn, sent by Linux once InitSetxattrExt has been
+// negotiated.
+type SetxattrExtIn struct {
+	Size          uint32
+	Flags         uint32
+	SetxattrFlags SetxattrFlags
+	Padding       uint32
+}
+
+// The SetxattrFlags are the flags of a SetxattrExtIn.
+type SetxattrFlags uint32
+
+const (
+	// The setgid bit of the file is to be cleared along with setting the
+	// attribute, which is a POSIX access ACL.
+	SetxattrACLKillSgid SetxattrFlags = 1 << 0
+)
+
 type getxattrInCommon struct {
 	Size    uint32
 	Padding uint32
@@ -680,6 +783,16 @@ type FallocateIn struct {
 	Padding uint32
 }
 
+type CopyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeidOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
 type LkIn struct {
 	Fh      uint64
 	Owner   uint64
@@ -726,7 +839,8 @@ type InitOut struct {
 	TimeGran            uint32
 	MaxPages            uint16
 	MapAlignment        uint16
-	Unused              [8]uint32
+	Flags2              uint32
+	Unused              [7]uint32
 }
 
 type InterruptIn struct {
@@ -743,6 +857,41 @@ type BmapOut struct {
 	Block uint64
 }
 
+type IoctlIn struct {
+	Fh      uint64
+	Flags   uint32
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32
+}
+
+type IoctlOut struct {
+	Result  int32
+	Flags   uint32
+	InIovs  uint32
+	OutIovs uint32
+}
+
+// The FS_IOC_GETFLAGS ioctl, by which lsattr(1) asks for an inode's flags,
+// encoded with the size of a long by 64-bit and 32-bit callers (cf.
+// include/uapi/linux/fs.h). Either way, the flags are returned as 32 bits.
+const (
+	IoctlGetFlags   = 0x80086601
+	IoctlGetFlags32 = 0x80046601
+)
+
+// The flags returned by FS_IOC_GETFLAGS.
+type InodeFlags uint32
+
+const (
+	InodeCompressed InodeFlags = 0x00000004 // FS_COMPR_FL
+	InodeImmutable  InodeFlags = 0x00000010 // FS_IMMUTABLE_FL
+	InodeAppend     InodeFlags = 0x00000020 // FS_APPEND_FL
+	InodeNoDump     InodeFlags = 0x00000040 // FS_NODUMP_FL
+	InodeEncrypted  InodeFlags = 0x00000800 // FS_ENCRYPT_FL
+)
+
 type InHeader struct {
 	Len     uint32
 	Opcode  uint32
@@ -776,14 +925,24 @@ const (
 	NotifyCodePoll       int32 = 1
 	NotifyCodeInvalInode int32 = 2
 	NotifyCodeInvalEntry int32 = 3
+	NotifyCodeResend     int32 = 7
 )
 
+// UniqueResend is set in the unique ID of a request that the kernel sends
+// again in response to NotifyCodeResend. The reply must carry the ID with the
+// bit set.
+const UniqueResend uint64 = 1 << 63
+
 type NotifyInvalInodeOut struct {
 	Ino uint64
 	Off int64
 	Len int64
 }
 
+// The longest name the kernel accepts in a NotifyInvalEntryOut, not counting
+// the terminating NUL (FUSE_NAME_MAX).
+const NotifyNameMax = 1024
+
 type NotifyInvalEntryOut struct {
 	Parent  uint64
 	Namelen uint32
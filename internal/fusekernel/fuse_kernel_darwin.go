@@ -34,6 +34,11 @@ func (a *Attr) SetFlags(f uint32) {
 	a.Flags_ = f
 }
 
+// OS X has no O_DIRECT, so OpenFlags.IsDirect is always false.
+const (
+	OpenDirect OpenFlags = 0
+)
+
 type SetattrIn struct {
 	setattrInCommon
 
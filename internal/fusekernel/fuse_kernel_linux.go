@@ -1,6 +1,9 @@
 package fusekernel
 
-import "time"
+import (
+	"syscall"
+	"time"
+)
 
 type Attr struct {
 	Ino       uint64
@@ -49,6 +52,11 @@ func (in *SetattrIn) Flags() uint32 {
 	return 0
 }
 
+// Flags that can be seen in OpenRequest.Flags on Linux only.
+const (
+	OpenDirect OpenFlags = syscall.O_DIRECT
+)
+
 func openFlags(flags uint32) OpenFlags {
 	// on amd64, the 32-bit O_LARGEFILE flag is always seen;
 	// on i386, the flag probably depends on the app
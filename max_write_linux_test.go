@@ -0,0 +1,128 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A file system containing a single file named "sink", which discards what is
+// written to it and counts the writes it receives.
+type sinkFS struct {
+	minimalFS
+	writes uint64 // Accessed atomically
+}
+
+const sinkID = fuseops.RootInodeID + 1
+
+func (fs *sinkFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	switch op.Inode {
+	case fuseops.RootInodeID:
+		op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0555 | os.ModeDir}
+	case sinkID:
+		op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0666}
+	default:
+		return fuse.ENOENT
+	}
+
+	return nil
+}
+
+func (fs *sinkFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "sink" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = sinkID
+	op.Entry.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0666}
+	return nil
+}
+
+func (fs *sinkFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *sinkFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	atomic.AddUint64(&fs.writes, 1)
+	return nil
+}
+
+func (fs *sinkFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+// Compare streaming a large file in 1 MiB write(2) calls with different
+// values of MountConfig.MaxWrite. The kernel splits each call into requests of
+// at most that size; the writes metric shows the round trips this costs.
+func BenchmarkStreamingWrite(b *testing.B) {
+	for _, maxWrite := range []uint32{128 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("MaxWrite=%dKiB", maxWrite>>10), func(b *testing.B) {
+			benchmarkStreamingWrite(b, maxWrite)
+		})
+	}
+}
+
+func benchmarkStreamingWrite(b *testing.B, maxWrite uint32) {
+	const fileSize = 64 << 20
+	const chunkSize = 1 << 20
+
+	// Mount. Without writeback caching each write(2) goes straight to the file
+	// system, split only by MaxWrite.
+	fs := &sinkFS{}
+	mfs := mountFS(b, fs, &fuse.MountConfig{
+		MaxWrite:                maxWrite,
+		DisableWritebackCaching: true,
+	})
+
+	f, err := os.OpenFile(path.Join(mfs.Dir(), "sink"), os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatalf("OpenFile: %v", err)
+	}
+
+	defer f.Close()
+
+	chunk := make([]byte, chunkSize)
+	b.SetBytes(fileSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for off := int64(0); off < fileSize; off += chunkSize {
+			if _, err := f.WriteAt(chunk, off); err != nil {
+				b.Fatalf("WriteAt: %v", err)
+			}
+		}
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadUint64(&fs.writes))/float64(b.N), "writes/op")
+}
@@ -20,7 +20,9 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"syscall"
+	"time"
 )
 
 // Server is an interface for any type that knows how to serve ops read from a
@@ -53,15 +55,161 @@ func Mount(
 		return nil, fmt.Errorf("Mount point %s is not a directory", dir)
 	}
 
+	return mountAndServe(
+		dir,
+		dir,
+		server,
+		config,
+		func(ready chan<- error) (*os.File, error) {
+			return mount(dir, config, ready)
+		})
+}
+
+// MountAndWait is like Mount, but also waits until the file system is usable,
+// that is until it has responded (successfully or not) to a stat(2) of the
+// mount point. This avoids racing with the kernel when using the mount right
+// away, e.g. in tests.
+//
+// If that doesn't happen within the timeout, an error is returned and the file
+// system is unmounted, either immediately or when mounting finally completes.
+func MountAndWait(
+	dir string,
+	server Server,
+	config *MountConfig,
+	timeout time.Duration) (*MountedFileSystem, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// Mount in the background, since on some systems it can block for a long
+	// time if something is amiss.
+	type mountResult struct {
+		mfs *MountedFileSystem
+		err error
+	}
+
+	mounted := make(chan mountResult, 1)
+	go func() {
+		mfs, err := Mount(dir, server, config)
+		mounted <- mountResult{mfs, err}
+	}()
+
+	var mfs *MountedFileSystem
+	select {
+	case r := <-mounted:
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		mfs = r.mfs
+
+	case <-timer.C:
+		go func() {
+			if r := <-mounted; r.err == nil {
+				Unmount(r.mfs.Dir())
+			}
+		}()
+
+		return nil, fmt.Errorf("Timed out after %v mounting %s", timeout, dir)
+	}
+
+	// Stat the mount point, which the kernel passes on to the file system. Any
+	// error other than the connection being gone comes from the file system
+	// and shows that it is being served.
+	statted := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(dir)
+		if pe, ok := err.(*os.PathError); ok && pe.Err != syscall.ENOTCONN {
+			err = nil
+		}
+
+		statted <- err
+	}()
+
+	var err error
+	select {
+	case err = <-statted:
+		if err == nil {
+			return mfs, nil
+		}
+
+		err = fmt.Errorf("Statting mount point: %v", err)
+
+	case <-timer.C:
+		err = fmt.Errorf("Timed out after %v waiting for %s to respond", timeout, dir)
+	}
+
+	if unmountErr := Unmount(dir); unmountErr != nil {
+		err = fmt.Errorf("%v (and unmounting: %v)", err, unmountErr)
+	}
+
+	return nil, err
+}
+
+// RunUntilSignal mounts a file system as with Mount and serves it until the
+// process receives SIGINT or SIGTERM, then unmounts it and waits for in-flight
+// ops to be responded to. It is intended to make up most of the main function
+// of a simple command-line tool.
+//
+// If the file system is unmounted by other means first, RunUntilSignal returns
+// once it has finished serving. The returned error is that of mounting,
+// unmounting, or MountedFileSystem.Join.
+func RunUntilSignal(
+	dir string,
+	server Server,
+	config *MountConfig) error {
+	// Start listening before mounting, so that a signal that arrives while the
+	// mount is in progress isn't missed.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	mfs, err := Mount(dir, server, config)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-sigs:
+		if err := Unmount(mfs.Dir()); err != nil {
+			return fmt.Errorf("Unmount: %v", err)
+		}
+
+	case <-mfs.joinStatusAvailable:
+	}
+
+	return mfs.Join(context.Background())
+}
+
+// Mount a file system using the supplied function, which behaves like mount,
+// and serve it in the background. dir is the mount point recorded in the
+// returned MountedFileSystem, and target the path through which it is mounted
+// on, from which its entry in the mount table is found.
+func mountAndServe(
+	dir string,
+	target string,
+	server Server,
+	config *MountConfig,
+	mountFn func(ready chan<- error) (*os.File, error)) (*MountedFileSystem, error) {
 	// Initialize the struct.
 	mfs := &MountedFileSystem{
 		dir:                 dir,
 		joinStatusAvailable: make(chan struct{}),
+		mountpointLost:      make(chan struct{}),
+	}
+
+	// Find where the mount will show up in the mount table, if we are to watch
+	// for it disappearing.
+	var tablePath string
+	if config.OnMountpointLost != nil {
+		var err error
+		if tablePath, err = mountTablePath(target); err != nil {
+			return nil, fmt.Errorf("Resolving mount point: %v", err)
+		}
 	}
 
 	// Begin the mounting process, which will continue in the background.
 	ready := make(chan error, 1)
-	dev, err := mount(dir, config, ready)
+	dev, err := mountFn(ready)
 	if err != nil {
 		return nil, fmt.Errorf("mount: %v", err)
 	}
@@ -82,6 +230,8 @@ func Mount(
 		return nil, fmt.Errorf("newConnection: %v", err)
 	}
 
+	mfs.conn = connection
+
 	// Serve the connection in the background. When done, set the join status.
 	go func() {
 		server.ServeOps(connection)
@@ -94,6 +244,10 @@ func Mount(
 		return nil, fmt.Errorf("mount (background): %v", err)
 	}
 
+	if config.OnMountpointLost != nil {
+		go mfs.watchMountpoint(tablePath, config.OnMountpointLost)
+	}
+
 	return mfs, nil
 }
 
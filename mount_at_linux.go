@@ -0,0 +1,294 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// MountAt is like Mount, but mounts onto the directory referred to by the
+// supplied file rather than one named by a path. The file may have been opened
+// with O_PATH. Resolving the mount point once up front means that a process
+// able to rename or replace components of its path (e.g. in another container)
+// cannot redirect the mount elsewhere in the meantime.
+//
+// The file system is created with fsopen(2) and attached to the file with
+// move_mount(2), so no path is resolved when mounting. On kernels without that
+// API (before 5.2), MountAt falls back to handing mount(2) the file's
+// /proc/self/fd magic link. That relies on /proc being mounted, but the kernel
+// still resolves the link to the already open directory.
+//
+// There is no way to do either through fusermount(1), so unlike Mount this
+// requires the CAP_SYS_ADMIN capability. The returned MountedFileSystem reports
+// dir.Name() as its directory. umount2(2) has no file descriptor variant, so
+// Unmount must be given that path, and resolves it again.
+//
+// Linux only.
+func MountAt(
+	dir *os.File,
+	server Server,
+	config *MountConfig) (*MountedFileSystem, error) {
+	// Sanity check: make sure the file is a directory.
+	fi, err := dir.Stat()
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("Statting mount point: %v", err)
+
+	case !fi.IsDir():
+		return nil, fmt.Errorf("Mount point %s is not a directory", dir.Name())
+	}
+
+	// The magic link is also what the mount table entry is looked up by when
+	// config.OnMountpointLost is set.
+	target := fmt.Sprintf("/proc/self/fd/%d", dir.Fd())
+	return mountAndServe(
+		dir.Name(),
+		target,
+		server,
+		config,
+		func(ready chan<- error) (*os.File, error) {
+			// On linux, mounting is never delayed.
+			ready <- nil
+
+			dev, err := fdmount(int(dir.Fd()), config)
+			if err == unix.ENOSYS {
+				dev, err = directmount(target, config)
+				if err == errFallback {
+					err = unix.EPERM
+				}
+			}
+
+			if err == unix.EPERM {
+				return nil, errors.New(
+					"mounting by file descriptor requires CAP_SYS_ADMIN")
+			}
+
+			return dev, err
+		})
+}
+
+// Constants for the file descriptor based mount API, which the version of
+// golang.org/x/sys/unix we depend on does not wrap. See linux/mount.h.
+const (
+	fsopenCloexec        = 0x1
+	fsconfigSetFlag      = 0x0
+	fsconfigSetString    = 0x1
+	fsconfigCmdCreate    = 0x6
+	fsmountCloexec       = 0x1
+	mountAttrRdonly      = 0x1
+	mountAttrNosuid      = 0x2
+	mountAttrNodev       = 0x4
+	mountAttrNoexec      = 0x8
+	mountAttrNoatime     = 0x10
+	mountAttrStrictatime = 0x20
+	moveMountFEmptyPath  = 0x4
+	moveMountTEmptyPath  = 0x40
+)
+
+// The mount(2) flags that fsmount(2) takes as mount attributes. MS_RELATIME
+// is absent because it is the default.
+var mountflagAttrs = map[uintptr]uintptr{
+	unix.MS_RDONLY:      mountAttrRdonly,
+	unix.MS_NOSUID:      mountAttrNosuid,
+	unix.MS_NODEV:       mountAttrNodev,
+	unix.MS_NOEXEC:      mountAttrNoexec,
+	unix.MS_NOATIME:     mountAttrNoatime,
+	unix.MS_STRICTATIME: mountAttrStrictatime,
+}
+
+// The mount(2) flags that fsconfig(2) takes as superblock flags.
+var mountflagSBFlags = map[uintptr]string{
+	unix.MS_RDONLY:      "ro",
+	unix.MS_SYNCHRONOUS: "sync",
+	unix.MS_DIRSYNC:     "dirsync",
+}
+
+// Mount a fuse file system onto the directory referred to by dirfd using
+// fsopen(2), fsconfig(2), fsmount(2) and move_mount(2), returning the
+// connection to the kernel. Returns ENOSYS if the kernel lacks that API.
+func fdmount(dirfd int, cfg *MountConfig) (*os.File, error) {
+	fsfd, err := fsopen("fuse", fsopenCloexec)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fsfd)
+
+	// As in directmount, open in blocking mode.
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Opening /dev/fuse: %v", err)
+	}
+	dev := os.NewFile(uintptr(fd), "/dev/fuse")
+
+	mountflag, subtype, opts := directmountOptions(cfg)
+	opts["fd"] = strconv.Itoa(fd)
+	opts["rootmode"] = "40000"
+	opts["user_id"] = strconv.Itoa(os.Getuid())
+	opts["group_id"] = strconv.Itoa(os.Getgid())
+	if subtype != "" {
+		opts["subtype"] = subtype
+	}
+	if cfg.FSName != "" {
+		opts["source"] = cfg.FSName
+	}
+	for flag, name := range mountflagSBFlags {
+		if mountflag&flag != 0 {
+			opts[name] = ""
+		}
+	}
+
+	var attrs uintptr
+	for flag, attr := range mountflagAttrs {
+		if mountflag&flag != 0 {
+			attrs |= attr
+		}
+	}
+
+	mntfd, err := fdmountCreate(fsfd, opts, attrs)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	defer unix.Close(mntfd)
+
+	err = moveMount(
+		mntfd, "",
+		dirfd, "",
+		moveMountFEmptyPath|moveMountTEmptyPath)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("move_mount: %v", err)
+	}
+
+	return dev, nil
+}
+
+// Configure the file system context fsfd with the supplied options, create the
+// superblock, and return a detached mount of it with the supplied attributes.
+func fdmountCreate(
+	fsfd int,
+	opts map[string]string,
+	attrs uintptr) (int, error) {
+	for k, v := range opts {
+		cmd := fsconfigSetString
+		if v == "" {
+			cmd = fsconfigSetFlag
+		}
+
+		if err := fsconfig(fsfd, cmd, k, v); err != nil {
+			return -1, fmt.Errorf("fsconfig(%q): %v", k, err)
+		}
+	}
+
+	if err := fsconfig(fsfd, fsconfigCmdCreate, "", ""); err != nil {
+		return -1, fmt.Errorf("fsconfig(FSCONFIG_CMD_CREATE): %v", err)
+	}
+
+	r, _, errno := unix.Syscall(
+		unix.SYS_FSMOUNT,
+		uintptr(fsfd),
+		fsmountCloexec,
+		attrs)
+	if errno != 0 {
+		return -1, fmt.Errorf("fsmount: %v", errno)
+	}
+
+	return int(r), nil
+}
+
+func fsopen(fsname string, flags int) (int, error) {
+	p, err := unix.BytePtrFromString(fsname)
+	if err != nil {
+		return -1, err
+	}
+
+	r, _, errno := unix.Syscall(
+		unix.SYS_FSOPEN,
+		uintptr(unsafe.Pointer(p)),
+		uintptr(flags),
+		0)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(r), nil
+}
+
+// Issue an fsconfig(2) command. An empty key or value is passed as NULL.
+func fsconfig(fsfd int, cmd int, key string, value string) error {
+	var kp, vp *byte
+	var err error
+	if key != "" {
+		if kp, err = unix.BytePtrFromString(key); err != nil {
+			return err
+		}
+	}
+
+	if value != "" {
+		if vp, err = unix.BytePtrFromString(value); err != nil {
+			return err
+		}
+	}
+
+	_, _, errno := unix.Syscall6(
+		unix.SYS_FSCONFIG,
+		uintptr(fsfd),
+		uintptr(cmd),
+		uintptr(unsafe.Pointer(kp)),
+		uintptr(unsafe.Pointer(vp)),
+		0,
+		0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func moveMount(
+	fromfd int, frompath string,
+	tofd int, topath string,
+	flags int) error {
+	fp, err := unix.BytePtrFromString(frompath)
+	if err != nil {
+		return err
+	}
+
+	tp, err := unix.BytePtrFromString(topath)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := unix.Syscall6(
+		unix.SYS_MOVE_MOUNT,
+		uintptr(fromfd),
+		uintptr(unsafe.Pointer(fp)),
+		uintptr(tofd),
+		uintptr(unsafe.Pointer(tp)),
+		uintptr(flags),
+		0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
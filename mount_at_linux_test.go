@@ -0,0 +1,47 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestMountAtPathFD(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Mounting by file descriptor requires CAP_SYS_ADMIN")
+	}
+
+	// Mount.
+	mfs := fusetesting.MountAtForTest(
+		t,
+		fuseutil.NewFileSystemServer(newHandleAttrsFS()),
+		&fuse.MountConfig{})
+
+	// The file system should be visible at the directory's path.
+	fi, err := os.Stat(path.Join(mfs.Dir(), "foo"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if fi.Size() != 1 {
+		t.Errorf("Unexpected size: %d", fi.Size())
+	}
+}
@@ -20,12 +20,21 @@ import (
 	"log"
 	"runtime"
 	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/timeutil"
 )
 
 // Optional configuration accepted by Mount.
 type MountConfig struct {
 	// The context from which every op read from the connetion by the sever
 	// should inherit. If nil, context.Background() will be used.
+	//
+	// Values attached to this context (a tenant ID, tracing baggage, and so on)
+	// are visible through the context passed to every op handler, making this a
+	// convenient way to inject dependencies without resorting to globals.
 	OpContext context.Context
 
 	// If non-empty, the name of the file system as displayed by e.g. `mount`.
@@ -36,6 +45,9 @@ type MountConfig struct {
 	// Mount the file system in read-only mode. File modes will appear as normal,
 	// but opening a file for writing and metadata operations like chmod,
 	// chtimes, etc. will fail.
+	//
+	// The kernel enforces this itself: such calls fail with EROFS without the
+	// file system ever seeing the corresponding op.
 	ReadOnly bool
 
 	// A logger to use for logging errors. All errors are logged, with the
@@ -47,6 +59,11 @@ type MountConfig struct {
 	// performed.
 	DebugLogger *log.Logger
 
+	// The optional FUSE features to request from the kernel when mounting. Each
+	// is used only if the kernel offers it too; see Connection.Capabilities for
+	// the outcome, and Capabilities for what each feature means.
+	Capabilities Capabilities
+
 	// Linux only. OS X always behaves as if writeback caching is disabled.
 	//
 	// By default on Linux we allow the kernel to perform writeback caching
@@ -59,6 +76,13 @@ type MountConfig struct {
 	// *   The file system may receive multiple write ops from the kernel
 	//     concurrently if there is a lot of page cache data to flush.
 	//
+	// *   Writes arrive as the kernel flushes dirty pages, not as the user made
+	//     them: a WriteFileOp's offset is page-aligned, and its data spans
+	//     whole pages (up to the end of the file as the kernel knows it), so a
+	//     run of small writes to neighbouring offsets arrives as a single larger
+	//     op. Pages not overwritten in full are first read from the file system
+	//     with ReadFileOp, so that it gets their whole contents back.
+	//
 	// *   Write performance may be significantly improved due to the user and
 	//     the kernel not waiting for serial round trips to the file system. This
 	//     is especially true if the user makes tiny writes.
@@ -70,6 +94,9 @@ type MountConfig struct {
 	// *   Similarly, close(2) causes the kernel to send a setattr request
 	//     filling in the mtime if any dirty pages were flushed, since the time
 	//     at which the pages were written to the file system can't be trusted.
+	//     The kernel owns mtime and ctime for writes: the file system needn't
+	//     update them when serving WriteFileOp, and any update it does make
+	//     is overwritten.
 	//
 	// *   close(2) (and anything else calling f_op->flush) writes out all dirty
 	//     pages, then sends a setattr request with an appropriate mtime for
@@ -102,12 +129,18 @@ type MountConfig struct {
 	//
 	// *   The kernel caches mtime and ctime regardless of whether the file
 	//     system tells it to do so, disregarding the result of further getattr
-	//     requests (cf. https://goo.gl/3ZZMUw, https://goo.gl/7WtQUp). It
-	//     appears this may be true of the file size, too. Writeback caching may
+	//     requests (cf. https://goo.gl/3ZZMUw, https://goo.gl/7WtQUp). The
+	//     same goes for the size of regular files. Writeback caching may
 	//     therefore not be suitable for file systems where these attributes can
 	//     spontaneously change for reasons the kernel doesn't observe. See
 	//     http://goo.gl/V5WQCN for more discussion.
 	//
+	// *   Conversely, the file system need not account for writes that the
+	//     kernel is still buffering. The size it reports from
+	//     GetInodeAttributesOp may be that of the data it has received so far:
+	//     stat(2) of a file with dirty pages reflects the buffered writes
+	//     regardless.
+	//
 	// Setting DisableWritebackCaching disables this behavior. Instead the file
 	// system is called one or more times for each write(2), and the user's
 	// syscall doesn't return until the file system returns.
@@ -128,28 +161,217 @@ type MountConfig struct {
 	// entries will be cached for an arbitrarily long time.
 	EnableVnodeCaching bool
 
+	// Deprecated: Set Capabilities.SymlinkCaching instead.
+	EnableSymlinkCaching bool
+
+	// Deprecated: Set Capabilities.NoOpenSupport instead.
+	EnableNoOpenSupport bool
+
+	// Deprecated: Set Capabilities.NoOpendirSupport instead.
+	EnableNoOpendirSupport bool
+
+	// Deprecated: Set Capabilities.ParallelDirOps instead.
+	EnableParallelDirOps bool
+
+	// Deprecated: Set Capabilities.Readdirplus instead.
+	EnableReaddirplus bool
+
+	// Declare that the file system matches names without regard to case, so
+	// that "foo" and "FOO" name the same child.
+	//
+	// The kernel caches directory entries by exact name and has no notion of
+	// case folding. A cached negative entry for "foo" would therefore keep
+	// hiding the child after it is created as "FOO". With this set, negative
+	// entries returned from LookUpInodeOp (those with a zero Child) are never
+	// cached, whatever their EntryExpiration says.
+	//
+	// The file system is still responsible for folding names itself. Positive
+	// entries for each spelling are cached independently, so an unlink or
+	// rename through one spelling may leave others cached until they expire;
+	// keep EntryExpiration short for such file systems.
+	CaseInsensitive bool
+
+	// Deprecated: Set Capabilities.PosixLocks instead.
+	EnablePosixLocks bool
+
+	// Deprecated: Set Capabilities.AtomicTrunc instead.
+	EnableAtomicTrunc bool
+
+	// Deprecated: Set Capabilities.ExportSupport instead.
+	EnableExportSupport bool
+
 	// Linux only.
 	//
-	// Linux 4.20 introduced caching symlink targets in the page cache:
-	// https://github.com/torvalds/linux/commit/5571f1e65486be025f73fa6aa30fb03725d362a2
+	// Tell the kernel not to send FlushFileOp when closing a file descriptor
+	// that was opened read-only, since there can be nothing to flush for it
+	// (Linux >= 5.16). This cuts the number of ops received by read-heavy file
+	// systems. It applies to all file handles; see the OpenFlags field of
+	// OpenFileOp for the mode in which a handle was opened, and its NoFlush
+	// field for choosing handle by handle.
 	//
-	// This is not enabled by default because the old behavior masked a bug:
-	// file systems could return any size in the inode attributes of
-	// symlinks. After enabling caching, the specified size caps the symlink
-	// target.
-	EnableSymlinkCaching bool
+	// The kernel ignores this when writeback caching is enabled, so it is only
+	// effective in combination with DisableWritebackCaching.
+	EnableReadOnlyNoFlush bool
+
+	// Deprecated: Set Capabilities.HandleKillPrivV2 instead.
+	HandleKillPrivV2 bool
+
+	// Deprecated: Set Capabilities.SetxattrExt instead.
+	EnableSetxattrExt bool
+
+	// Deprecated: Set Capabilities.DirectIOMmap instead.
+	EnableDirectIOMmap bool
 
 	// Linux only.
 	//
-	// Tell the kernel to treat returning -ENOSYS on OpenFile as not needing
-	// OpenFile calls at all (Linux >= 3.16):
-	EnableNoOpenSupport bool
+	// If non-zero, reads and writes through files opened with O_DIRECT fail
+	// with EINVAL, without reaching the file system, unless their offset and
+	// size are multiples of this, as they would on a block device with this
+	// logical block size. The kernel checks no alignment for FUSE file systems
+	// itself, so without this misaligned direct IO succeeds.
+	//
+	// This should be a power of two no larger than the page size, since the
+	// kernel splits large direct IO into requests of whole pages. The alignment
+	// of the caller's buffer can't be enforced, since the kernel doesn't pass
+	// its address on, and the alignment can't be advertised through statx(2).
+	DirectIOAlignment uint32
+
+	// The largest write, in bytes, that the kernel should send in a single
+	// WriteFileOp, splitting larger writes and gathering dirty pages up to this
+	// size. Zero means the largest that this package can receive, 1 MiB; larger
+	// values are clamped to that, and smaller ones to the kernel's minimum of
+	// 4096. The kernel further caps writes at its own limit on the size of a
+	// request. See Connection.MaxWrite for the size in effect.
+	//
+	// On OS X, which ignores the size negotiated at init, this sets the iosize
+	// mount option instead.
+	MaxWrite uint32
 
 	// Linux only.
 	//
-	// Tell the kernel to treat returning -ENOSYS on OpenDir as not needing
-	// OpenDir calls at all (Linux >= 5.1):
-	EnableNoOpendirSupport bool
+	// How far, in bytes, the kernel should read ahead of sequential reads.
+	// Zero means 1 MiB. The kernel reads ahead no further than the limit it
+	// offers at init, which is that of the mount's backing device (128 KiB by
+	// default, cf. read_ahead_kb in sysfs), so larger values are clamped to
+	// that. See Connection.MaxReadahead for the amount in effect.
+	MaxReadahead uint32
+
+	// Linux only.
+	//
+	// The number of additional /dev/fuse descriptors to clone from the
+	// connection's with FUSE_DEV_IOC_CLONE (Linux >= 4.2). The kernel hands each
+	// request to whichever descriptor is read from first, so a server reading
+	// from several goroutines at once, each with its own descriptor, sees less
+	// contention than one funnelling every request through a single descriptor.
+	// See Connection.ReadConcurrency; the server returned by
+	// fuseutil.NewFileSystemServer uses all of the descriptors automatically.
+	//
+	// Mounting fails if cloning is not supported.
+	DeviceClones int
+
+	// The clock used to convert the expiration times in replies to the durations
+	// sent to the kernel, and from which validity durations are measured (see
+	// e.g. ChildInodeEntry.AttributesValidity). If nil, the real clock is used.
+	// Tests may substitute a simulated clock to make replies deterministic.
+	Clock timeutil.Clock
+
+	// Remember the attributes returned for each inode, and log a warning to
+	// ErrorLogger when a later reply for the same inode contradicts them (in
+	// size, mode, or ownership) before the kernel's cached copy has expired.
+	// Such inconsistency, e.g. between LookUpInode and GetInodeAttributes, leaves
+	// the kernel's view of the file depending on which it happened to cache.
+	//
+	// This costs a map lookup under a lock for every reply and is intended for
+	// debugging file systems, not for production use.
+	EnableAttributeConsistencyCheck bool
+
+	// Remember the mtime and ctime returned for each inode, and log a warning to
+	// ErrorLogger when a later reply for the same inode has an earlier one,
+	// except for an mtime just set by the user. Times going backwards, e.g.
+	// because they come from backends whose clocks disagree, confuse tools like
+	// make(1) that compare them.
+	//
+	// Like EnableAttributeConsistencyCheck, this is intended for debugging and
+	// testing file systems, not for production use.
+	EnableTimeMonotonicityCheck bool
+
+	// Remember the names under which each directory inode is returned, and log
+	// a warning to ErrorLogger when a file system that aliases directories
+	// (returns one directory inode under several names, like a hard link or
+	// bind mount) does so in a way the kernel can't handle: by returning a
+	// directory inside itself, which the kernel refuses with ELOOP, or with an
+	// nlink that doesn't count its names. See fuseops.ChildInodeEntry.Child for
+	// the constraints on aliasing.
+	//
+	// Like EnableAttributeConsistencyCheck, this is intended for debugging and
+	// testing file systems, not for production use.
+	EnableDirectoryAliasCheck bool
+
+	// Track the kernel's lookup count for each inode, logging every change to
+	// DebugLogger (if set) and making the counts available from
+	// Connection.InodeRefCounts. A count is incremented by each successful op
+	// that returns an entry (LookUpInodeOp, CreateFileOp, MkDirOp, and so on)
+	// and decremented by ForgetInodeOp. Counts that only ever grow point to
+	// inodes that the kernel holds on to, and for which the file system must
+	// therefore keep state; counts that go negative point to a file system
+	// that returns entries without reporting them in the op.
+	//
+	// Like EnableAttributeConsistencyCheck, this is intended for debugging file
+	// systems, not for production use.
+	EnableInodeLifecycleTracing bool
+
+	// How long an op may go unanswered before MountedFileSystem.Health reports
+	// the mount as degraded. If zero, one minute is used.
+	StuckOpThreshold time.Duration
+
+	// If non-zero, log a warning to ErrorLogger when the kernel has had
+	// requests waiting for at least this long without any being read, because
+	// no goroutine is calling Connection.ReadOp. This happens when a server
+	// handles ops on the goroutine that reads them, as in a single-worker
+	// server (or in ForgetInode and BatchForget with fuseutil's server), and a
+	// handler blocks: every op behind it is starved, whether or not it has
+	// anything to do with the blocked one. A second message is logged once
+	// reading resumes.
+	ReadStallThreshold time.Duration
+
+	// If non-zero, the context for each op carries a deadline this far after
+	// the op is read from the kernel, after which it is cancelled. File systems
+	// that respect cancellation thus fail slow ops rather than leaving the
+	// calling process blocked indefinitely. The context's cause is then
+	// ErrOpTimeout.
+	OpTimeout time.Duration
+
+	// Per-op overrides for OpTimeout, keyed by OpTypeOf. For example, a file
+	// system may give WriteFileOp plenty of time for a large upload while
+	// insisting that LookUpInodeOp be fast. A zero value disables the timeout
+	// for that kind of op.
+	OpTimeouts map[OpType]time.Duration
+
+	// If set, told about each op as it begins and ends so that it may be traced,
+	// e.g. with OpenTelemetry. See OpTracer.
+	OpTracer OpTracer
+
+	// If set, the mount table is checked every second while the file system is
+	// served, and this is called once, on a goroutine of its own, if the file
+	// system is found to be no longer mounted on its directory. This happens
+	// when it is lazily unmounted (e.g. with umount -l), which leaves its
+	// directory free to be removed, or when the mount namespace holding it goes
+	// away.
+	//
+	// The file system can no longer be reached by path, and so can't be
+	// unmounted with Unmount, but the kernel goes on sending ops for files that
+	// were already open. Once the last of those is closed the kernel ends the
+	// connection, and MountedFileSystem.Join returns as for a normal unmount.
+	// MountedFileSystem.Health reports Dead in the meantime.
+	OnMountpointLost func()
+
+	// If set, the attributes with which to answer the kernel's requests for the
+	// attributes of the root inode, which it makes as soon as the file system
+	// is mounted, when the file system doesn't implement GetInodeAttributes
+	// (i.e. returns ENOSYS). File systems that do implement it find each
+	// GetInodeAttributesOp for the root filled in with these attributes to
+	// begin with, and may override them or leave them be.
+	RootAttributes *fuseops.InodeAttributes
 
 	// Disable FUSE default permissions.
 	// This is useful for situations where the backing data store (e.g., S3) doesn't
@@ -159,13 +381,17 @@ type MountConfig struct {
 	// OS X only.
 	//
 	// The name of the mounted volume, as displayed in the Finder. If empty, a
-	// default name involving the string 'osxfuse' is used.
+	// default name involving the string 'osxfuse' is used. On other platforms,
+	// where volumes have no such name, this is ignored.
 	VolumeName string
 
 	// Additional key=value options to pass unadulterated to the underlying mount
 	// command. See `man 8 mount`, the fuse documentation, etc. for
 	// system-specific information.
 	//
+	// The noatime, relatime, and strictatime options are additionally reported
+	// to the file system in ReadFileOp.Atime and ReadDirOp.Atime.
+	//
 	// For expert use only! May invalidate other guarantees made in the
 	// documentation for this package.
 	Options map[string]string
@@ -175,11 +401,19 @@ type MountConfig struct {
 	// If not set, /proc/mounts will show the filesystem type as fuse/fuseblk.
 	Subtype string
 
-	// Flag to enable async reads that are received from
-	// the kernel
+	// Deprecated: Set Capabilities.AsyncRead instead.
 	EnableAsyncReads bool
 }
 
+// Return the timeout to apply to the supplied op, or zero for none.
+func (c *MountConfig) opTimeout(op interface{}) time.Duration {
+	if timeout, ok := c.OpTimeouts[OpTypeOf(op)]; ok {
+		return timeout
+	}
+
+	return c.OpTimeout
+}
+
 // Create a map containing all of the key=value mount options to be given to
 // the mount helper.
 func (c *MountConfig) toMap() (opts map[string]string) {
@@ -250,6 +484,58 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 	return opts
 }
 
+// Return the access time behavior requested by the user in Options. mount(8)
+// lets the last of several conflicting options win, but Options is unordered,
+// so prefer the one that asks for the fewest updates.
+func (c *MountConfig) atimeMode() fuseops.AtimeMode {
+	if _, ok := c.Options["noatime"]; ok {
+		return fuseops.AtimeNone
+	}
+
+	if _, ok := c.Options["relatime"]; ok {
+		return fuseops.AtimeRelative
+	}
+
+	if _, ok := c.Options["strictatime"]; ok {
+		return fuseops.AtimeStrict
+	}
+
+	return fuseops.AtimeRelative
+}
+
+// Return the max_write to send in response to the init op: MaxWrite, or by
+// default the largest write we can receive, clamped to that and to what the
+// kernel accepts.
+func (c *MountConfig) maxWrite() uint32 {
+	n := c.MaxWrite
+	if n == 0 || n > buffer.MaxWriteSize {
+		n = buffer.MaxWriteSize
+	}
+
+	if n < minMaxWrite {
+		n = minMaxWrite
+	}
+
+	return n
+}
+
+// Return the max_readahead to send in response to the init op, given the one
+// the kernel offered: MaxReadahead or our default, clamped to the offer since
+// the kernel takes the smaller of the two anyway. A zero offer is taken to
+// mean no limit.
+func (c *MountConfig) maxReadahead(offered uint32) uint32 {
+	n := c.MaxReadahead
+	if n == 0 {
+		n = defaultMaxReadahead
+	}
+
+	if offered != 0 && n > offered {
+		n = offered
+	}
+
+	return n
+}
+
 func escapeOptionsKey(s string) (res string) {
 	res = s
 	res = strings.Replace(res, `\`, `\\`, -1)
@@ -9,8 +9,6 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
-
-	"github.com/jacobsa/fuse/internal/buffer"
 )
 
 var errNoAvail = errors.New("no available fuse devices")
@@ -130,12 +128,13 @@ func convertMountArgs(daemonVar string, libVar string,
 	}
 	argv := []string{
 		"-o", cfg.toOptionsString(),
-		// Tell osxfuse-kext how large our buffer is. It must split
-		// writes larger than this into multiple writes.
+		// Tell osxfuse-kext how large our buffer is, or the smaller
+		// MountConfig.MaxWrite. It must split writes larger than
+		// this into multiple writes.
 		//
 		// OSXFUSE seems to ignore InitResponse.MaxWrite, and uses
 		// this instead.
-		"-o", "iosize="+strconv.FormatUint(buffer.MaxWriteSize, 10),
+		"-o", "iosize="+strconv.FormatUint(uint64(cfg.maxWrite()), 10),
 	}
 
 	return argv, env, nil
@@ -35,23 +35,45 @@ func disableFunc(flag uintptr) func(uintptr) uintptr {
 
 // As per libfuse/fusermount.c:602: https://bit.ly/2SgtWYM#L602
 var mountflagopts = map[string]func(uintptr) uintptr{
-	"rw":      disableFunc(unix.MS_RDONLY),
-	"ro":      enableFunc(unix.MS_RDONLY),
-	"suid":    disableFunc(unix.MS_NOSUID),
-	"nosuid":  enableFunc(unix.MS_NOSUID),
-	"dev":     disableFunc(unix.MS_NODEV),
-	"nodev":   enableFunc(unix.MS_NODEV),
-	"exec":    disableFunc(unix.MS_NOEXEC),
-	"noexec":  enableFunc(unix.MS_NOEXEC),
-	"async":   disableFunc(unix.MS_SYNCHRONOUS),
-	"sync":    enableFunc(unix.MS_SYNCHRONOUS),
-	"atime":   disableFunc(unix.MS_NOATIME),
-	"noatime": enableFunc(unix.MS_NOATIME),
-	"dirsync": enableFunc(unix.MS_DIRSYNC),
+	"rw":          disableFunc(unix.MS_RDONLY),
+	"ro":          enableFunc(unix.MS_RDONLY),
+	"suid":        disableFunc(unix.MS_NOSUID),
+	"nosuid":      enableFunc(unix.MS_NOSUID),
+	"dev":         disableFunc(unix.MS_NODEV),
+	"nodev":       enableFunc(unix.MS_NODEV),
+	"exec":        disableFunc(unix.MS_NOEXEC),
+	"noexec":      enableFunc(unix.MS_NOEXEC),
+	"async":       disableFunc(unix.MS_SYNCHRONOUS),
+	"sync":        enableFunc(unix.MS_SYNCHRONOUS),
+	"atime":       disableFunc(unix.MS_NOATIME),
+	"noatime":     enableFunc(unix.MS_NOATIME),
+	"relatime":    enableFunc(unix.MS_RELATIME),
+	"strictatime": enableFunc(unix.MS_STRICTATIME),
+	"dirsync":     enableFunc(unix.MS_DIRSYNC),
 }
 
 var errFallback = errors.New("sentinel: fallback to fusermount(1)")
 
+// Split the options in cfg into mount(2) flags, the file system subtype (if
+// any), and the options that remain to be handed to the kernel as data.
+func directmountOptions(cfg *MountConfig) (uintptr, string, map[string]string) {
+	// As per libfuse/fusermount.c:749: https://bit.ly/2SgtWYM#L749
+	mountflag := uintptr(unix.MS_NODEV | unix.MS_NOSUID)
+	opts := cfg.toMap()
+	for k := range opts {
+		fn, ok := mountflagopts[k]
+		if !ok {
+			continue
+		}
+		mountflag = fn(mountflag)
+		delete(opts, k)
+	}
+	delete(opts, "fsname") // handled via the mount source
+	subtype := opts["subtype"]
+	delete(opts, "subtype")
+	return mountflag, subtype, opts
+}
+
 func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	// We use syscall.Open + os.NewFile instead of os.OpenFile so that the file
 	// is opened in blocking mode. When opened in non-blocking mode, the Go
@@ -64,23 +86,11 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	// As per libfuse/fusermount.c:847: https://bit.ly/2SgtWYM#L847
 	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d",
 		dev.Fd(), os.Getuid(), os.Getgid())
-	// As per libfuse/fusermount.c:749: https://bit.ly/2SgtWYM#L749
-	mountflag := uintptr(unix.MS_NODEV | unix.MS_NOSUID)
-	opts := cfg.toMap()
-	for k := range opts {
-		fn, ok := mountflagopts[k]
-		if !ok {
-			continue
-		}
-		mountflag = fn(mountflag)
-		delete(opts, k)
-	}
-	delete(opts, "fsname") // handled via fstype mount(2) parameter
+	mountflag, subtype, opts := directmountOptions(cfg)
 	fstype := "fuse"
-	if subtype, ok := opts["subtype"]; ok {
+	if subtype != "" {
 		fstype += "." + subtype
 	}
-	delete(opts, "subtype")
 	data += "," + mapToOptionsString(opts)
 	if err := unix.Mount(
 		cfg.FSName, // source
@@ -6,7 +6,10 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -93,3 +96,178 @@ func TestNonexistentMountPoint(t *testing.T) {
 		t.Errorf("Unexpected error: %v", got)
 	}
 }
+
+// A minimalFS that counts requests for the root's attributes.
+type rootStatFS struct {
+	minimalFS
+
+	mu    sync.Mutex
+	stats int // GUARDED_BY(mu)
+}
+
+func (fs *rootStatFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.stats++
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0755 | os.ModeDir,
+	}
+
+	return nil
+}
+
+func TestMountAndWait(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &rootStatFS{}
+	mfs, err := fuse.MountAndWait(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{},
+		10*time.Second)
+
+	if err != nil {
+		t.Fatalf("fuse.MountAndWait: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// The file system should already have served a stat.
+	fs.mu.Lock()
+	stats := fs.stats
+	fs.mu.Unlock()
+
+	if stats == 0 {
+		t.Error("No stat served before returning")
+	}
+}
+
+func TestMountAndWait_Failure(t *testing.T) {
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Attempt to mount into a sub-directory that doesn't exist. This should
+	// fail well before the timeout.
+	const timeout = time.Minute
+	start := time.Now()
+	mfs, err := fuse.MountAndWait(
+		path.Join(dir, "foo"),
+		fuseutil.NewFileSystemServer(&minimalFS{}),
+		&fuse.MountConfig{},
+		timeout)
+
+	if err == nil {
+		fuse.Unmount(mfs.Dir())
+		mfs.Join(context.Background())
+		t.Fatal("fuse.MountAndWait returned nil")
+	}
+
+	if elapsed := time.Since(start); elapsed > timeout/2 {
+		t.Errorf("Took %v to fail", elapsed)
+	}
+}
+
+func TestRunUntilSignal(t *testing.T) {
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Serve in the background.
+	fs := &rootStatFS{}
+	done := make(chan error, 1)
+	go func() {
+		done <- fuse.RunUntilSignal(
+			dir,
+			fuseutil.NewFileSystemServer(fs),
+			&fuse.MountConfig{})
+	}()
+
+	// Wait for the file system to serve a stat of the mount point.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			t.Fatalf("RunUntilSignal: %v", err)
+		default:
+		}
+
+		os.Stat(dir)
+
+		fs.mu.Lock()
+		stats := fs.stats
+		fs.mu.Unlock()
+
+		if stats > 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			fuse.Unmount(dir)
+			t.Fatal("Timed out waiting for the file system to be served")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ask it to shut down, as a user hitting Ctrl-C would.
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatalf("Kill: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("RunUntilSignal: %v", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		fuse.Unmount(dir)
+		t.Fatal("Timed out waiting for RunUntilSignal to return")
+	}
+
+	// The mount point should be back to the plain directory, which the file
+	// system no longer sees stats of.
+	fs.mu.Lock()
+	before := fs.stats
+	fs.mu.Unlock()
+
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	fs.mu.Lock()
+	after := fs.stats
+	fs.mu.Unlock()
+
+	if after != before {
+		t.Error("Still mounted after RunUntilSignal returned")
+	}
+}
@@ -21,9 +21,16 @@ import "context"
 type MountedFileSystem struct {
 	dir string
 
+	// The connection being served.
+	conn *Connection
+
 	// The result to return from Join. Not valid until the channel is closed.
 	joinStatus          error
 	joinStatusAvailable chan struct{}
+
+	// Closed when the file system is found to be no longer mounted while still
+	// being served. See MountConfig.OnMountpointLost.
+	mountpointLost chan struct{}
 }
 
 // Dir returns the directory on which the file system is mounted (or where we
@@ -47,3 +54,21 @@ func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 		return ctx.Err()
 	}
 }
+
+// Health reports whether the file system is being served properly, for use
+// e.g. by a health check endpoint. It is Dead once the file system has been
+// unmounted (including lazily, if MountConfig.OnMountpointLost is set) or the
+// connection to the kernel has otherwise been lost, and Degraded while an op
+// has been outstanding for longer than MountConfig.StuckOpThreshold or when
+// many recent ops have failed with unexpected errors (that is, other than e.g.
+// ENOENT from LookUpInode).
+func (mfs *MountedFileSystem) Health() HealthStatus {
+	select {
+	case <-mfs.joinStatusAvailable:
+		return Dead
+	case <-mfs.mountpointLost:
+		return Dead
+	default:
+		return mfs.conn.Health()
+	}
+}
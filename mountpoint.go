@@ -0,0 +1,74 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// How often to check that a file system with MountConfig.OnMountpointLost set
+// is still mounted.
+const mountpointCheckInterval = time.Second
+
+// Return the absolute path of the supplied directory with symlinks resolved,
+// as it would appear in the mount table once mounted on. This must be called
+// before mounting, since afterwards resolving the path would involve the file
+// system itself. A /proc/self/fd link resolves to the directory the file
+// descriptor refers to, wherever that is now.
+func mountTablePath(dir string) (string, error) {
+	p, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(p)
+}
+
+// Check the mount table periodically until the file system mounted at the
+// supplied path is no longer there, or until it has been joined. In the former
+// case, record that and call the callback.
+func (mfs *MountedFileSystem) watchMountpoint(p string, lost func()) {
+	ticker := time.NewTicker(mountpointCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mfs.joinStatusAvailable:
+			return
+
+		case <-ticker.C:
+		}
+
+		// Be conservative about errors reading the mount table, which are
+		// unexpected and say nothing about the mount.
+		if mounted, err := isMounted(p); err != nil || mounted {
+			continue
+		}
+
+		// The mount may be gone because we have been unmounted normally, in which
+		// case the connection is about to end.
+		select {
+		case <-mfs.joinStatusAvailable:
+			return
+
+		case <-time.After(mountpointCheckInterval):
+		}
+
+		close(mfs.mountpointLost)
+		lost()
+		return
+	}
+}
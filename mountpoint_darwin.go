@@ -0,0 +1,62 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Is a FUSE file system mounted at the supplied absolute path, according to
+// getfsstat(2)?
+func isMounted(p string) (bool, error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return false, err
+	}
+
+	stats := make([]unix.Statfs_t, n)
+	if _, err := unix.Getfsstat(stats, unix.MNT_NOWAIT); err != nil {
+		return false, err
+	}
+
+	for _, s := range stats {
+		if cString(s.Mntonname[:]) != p {
+			continue
+		}
+
+		fstype := cString(s.Fstypename[:])
+		if strings.Contains(fstype, "fuse") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Convert a NUL-terminated C string to a Go string.
+func cString(cs []int8) string {
+	b := make([]byte, 0, len(cs))
+	for _, c := range cs {
+		if c == 0 {
+			break
+		}
+
+		b = append(b, byte(c))
+	}
+
+	return string(b)
+}
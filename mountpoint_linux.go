@@ -0,0 +1,85 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Is a FUSE file system mounted at the supplied absolute path, according to
+// /proc/self/mountinfo?
+func isMounted(p string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+
+	return mountinfoHasFUSE(f, p)
+}
+
+// Does the supplied mountinfo listing (see proc(5)) have a FUSE file system
+// mounted at the given path?
+func mountinfoHasFUSE(r io.Reader, p string) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// The mount point is the fifth field. The file system type follows the
+		// optional fields, which are terminated by a lone hyphen.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || unescapeMountinfo(fields[4]) != p {
+			continue
+		}
+
+		for i := 5; i+1 < len(fields); i++ {
+			if fields[i] == "-" {
+				if strings.HasPrefix(fields[i+1], "fuse") {
+					return true, nil
+				}
+
+				break
+			}
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// Undo the octal escaping of spaces, tabs, newlines, and backslashes in paths
+// in mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMountinfoHasFUSE(t *testing.T) {
+	const mountinfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+41 22 0:35 / /tmp/foo rw,nosuid,nodev,relatime shared:20 - fuse.memfs memfs rw,user_id=0,group_id=0
+42 22 0:36 / /tmp/with\040space rw,nosuid,nodev,relatime - fuse /dev/fuse rw,user_id=0,group_id=0
+43 22 0:37 / /tmp/bar rw,relatime shared:21 - tmpfs tmpfs rw
+`
+
+	testCases := []struct {
+		path string
+		want bool
+	}{
+		{"/tmp/foo", true},
+		{"/tmp/with space", true},
+		{"/tmp/bar", false},
+		{"/tmp/baz", false},
+		{"/tmp", false},
+	}
+
+	for _, tc := range testCases {
+		got, err := mountinfoHasFUSE(strings.NewReader(mountinfo), tc.path)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.path, err)
+		}
+
+		if got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestMountTablePathFromFD(t *testing.T) {
+	// Nothing is mounted here, so there is no need for a mount helper; the
+	// testing package removes the directory when the test finishes.
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("EvalSymlinks: %v", err)
+	}
+
+	// Open a directory, then move it. The path resolved from the file
+	// descriptor should follow the directory rather than its old name.
+	dir := filepath.Join(tmp, "dir")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	moved := filepath.Join(tmp, "moved")
+	if err := os.Rename(dir, moved); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	got, err := mountTablePath(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+	if err != nil {
+		t.Fatalf("mountTablePath: %v", err)
+	}
+
+	if got != moved {
+		t.Errorf("got %q, want %q", got, moved)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+func TestMountpointLost(t *testing.T) {
+	fusermount, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if fusermount, err = exec.LookPath("fusermount"); err != nil {
+			t.Skip("No fusermount for a lazy unmount")
+		}
+	}
+
+	// Mount.
+	lost := make(chan struct{})
+	mfs := mountFS(t, &minimalFS{}, &fuse.MountConfig{
+		OnMountpointLost: func() { close(lost) },
+	})
+
+	dir := mfs.Dir()
+
+	// Keep the file system busy with an open directory, so that a lazy unmount
+	// leaves it being served, then detach it and remove the mount point.
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	if output, err := exec.Command(fusermount, "-u", "-z", dir).CombinedOutput(); err != nil {
+		t.Fatalf("fusermount -u -z: %v: %s", err, output)
+	}
+
+	if err := os.Remove(dir); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	// The callback should be called, and the file system reported dead even
+	// though it's still being served.
+	select {
+	case <-lost:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for OnMountpointLost")
+	}
+
+	if h := mfs.Health(); h != fuse.Dead {
+		t.Errorf("Health: %v", h)
+	}
+}
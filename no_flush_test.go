@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestPerHandleNoFlush(t *testing.T) {
+	// Mount a file system that sets the flag on the first handle it opens only.
+	// The kernel ignores the flag with writeback caching.
+	fs := &fileFS{
+		attrs: fuseops.InodeAttributes{Nlink: 1, Mode: 0444},
+		open: func(op *fuseops.OpenFileOp) {
+			op.NoFlush = op.Handle == 1
+		},
+	}
+
+	mfs := mountFS(t, fs, &fuse.MountConfig{DisableWritebackCaching: true})
+
+	// Open and close the file twice.
+	for i := 0; i < 2; i++ {
+		f, err := os.Open(path.Join(mfs.Dir(), "foo"))
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	// Only the handle opened without the flag should have been flushed.
+	var flushes []fuseops.HandleID
+	for _, op := range fs.recorded() {
+		if op, ok := op.(*fuseops.FlushFileOp); ok {
+			flushes = append(flushes, op.Handle)
+		}
+	}
+
+	if len(flushes) != 1 || flushes[0] != 2 {
+		t.Errorf("Unexpected flushes: %v", flushes)
+	}
+}
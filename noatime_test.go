@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestNoatimeMount(t *testing.T) {
+	// Mount with noatime.
+	fs := &fileFS{
+		contents: "a",
+		attrs:    fuseops.InodeAttributes{Nlink: 1, Mode: 0444, Size: 1},
+	}
+
+	mfs := mountFS(t, fs, &fuse.MountConfig{
+		Options: map[string]string{"noatime": ""},
+	})
+
+	// Read the file.
+	contents, err := ioutil.ReadFile(path.Join(mfs.Dir(), "foo"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(contents) != "a" {
+		t.Errorf("Unexpected contents: %q", contents)
+	}
+
+	// The file system should have been told not to bother with atime.
+	if fs.count(&fuseops.ReadFileOp{}) == 0 {
+		t.Fatal("No ReadFile ops received")
+	}
+
+	for _, op := range fs.recorded() {
+		if op, ok := op.(*fuseops.ReadFileOp); ok && op.Atime != fuseops.AtimeNone {
+			t.Errorf("Unexpected atime mode: %v", op.Atime)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestNonblockingReadOfStream(t *testing.T) {
+	// Mount a file system with a pipe-like file, which never has any data
+	// ready.
+	fs := &fileFS{
+		attrs: fuseops.InodeAttributes{Nlink: 1, Mode: 0444},
+		open: func(op *fuseops.OpenFileOp) {
+			op.UseDirectIO = true
+		},
+		read: func(ctx context.Context, op *fuseops.ReadFileOp) error {
+			if op.OpenFlags.IsNonblock() {
+				return fuse.EAGAIN
+			}
+
+			// Wait for data that never comes.
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+
+	mfs := mountFS(t, fs, &fuse.MountConfig{})
+
+	// Reading without blocking should fail straight away with EAGAIN.
+	fd, err := syscall.Open(
+		path.Join(mfs.Dir(), "foo"),
+		syscall.O_RDONLY|syscall.O_NONBLOCK,
+		0)
+
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 16)
+	if _, err := syscall.Read(fd, buf); err != syscall.EAGAIN {
+		t.Errorf("Read: %v, want EAGAIN", err)
+	}
+}
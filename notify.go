@@ -0,0 +1,268 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// NotifyAttrChanged tells the kernel that the attributes of the supplied inode
+// (its mtime, mode, and so on) have changed by means it didn't observe, e.g.
+// in a backend shared with other machines. The kernel discards its cached
+// copy, and sends a GetInodeAttributesOp the next time they are needed, but
+// keeps the file's contents in its page cache.
+//
+// Prefer this to invalidating the inode's contents too when only attributes
+// have changed, since dropping the page cache needlessly forces the data to be
+// read again.
+//
+// Errors are as for InvalidateNode.
+func (c *Connection) NotifyAttrChanged(inode fuseops.InodeID) error {
+	// A negative offset asks for attributes alone to be invalidated. (With an
+	// offset of zero and a length of zero, the kernel drops the whole file from
+	// its page cache too.)
+	return c.notifyInvalInode(inode, -1, 0)
+}
+
+// InvalidateNode tells the kernel that the supplied inode has changed by means
+// it didn't observe, e.g. in a remote store shared with other machines. The
+// kernel discards its cached attributes for the inode, and the contents cached
+// in its page cache for the byte range of the given size starting at offset;
+// a size of zero or less means the rest of the file. A negative offset leaves
+// the page cache alone, as with NotifyAttrChanged.
+//
+// This may be called from any goroutine, concurrently with the serving of
+// ops. But it must not be called from within the handler of an op for the same
+// inode that the kernel holds a lock for while waiting, such as a ReadFileOp
+// or WriteFileOp, since invalidating the page cache waits for that lock.
+//
+// ENOENT is returned if the kernel doesn't currently know of the inode, in
+// which case there is nothing to invalidate. ErrNotifyNotSupported is returned
+// if the kernel doesn't support the notification, and ErrShutdown if the
+// connection to the kernel has been closed.
+func (c *Connection) InvalidateNode(
+	inode fuseops.InodeID,
+	offset int64,
+	size int64) error {
+	return c.notifyInvalInode(inode, offset, size)
+}
+
+// Send the kernel a notification that the attributes of the supplied inode,
+// and the part of its contents given by off and length, are out of date.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) notifyInvalInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) error {
+	if !c.protocol.HasInvalidate() {
+		return ErrNotifyNotSupported
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalInodeOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))))
+	out.Ino = uint64(inode)
+	out.Off = off
+	out.Len = length
+
+	return c.notify(fusekernel.NotifyCodeInvalInode, m)
+}
+
+// InvalidateEntry tells the kernel that the entry with the given name in the
+// supplied parent directory has changed by means it didn't observe, e.g. been
+// renamed or removed by another client of a shared backend. The kernel drops
+// the cached entry, and sends a LookUpInodeOp the next time the name is used.
+//
+// This may be called from any goroutine, concurrently with the serving of
+// ops. But it must not be called from within the handler of an op for the
+// parent directory that the kernel holds a lock for while waiting, such as a
+// LookUpInodeOp or CreateFileOp, since invalidating the entry waits for that
+// lock.
+//
+// syscall.ENAMETOOLONG is returned if the name is longer than the kernel
+// accepts. Other errors are as for InvalidateNode.
+func (c *Connection) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	return c.notifyInvalEntry(parent, name)
+}
+
+// InvalidateEntries is like InvalidateEntry for each of the supplied names in
+// the parent directory, e.g. after its contents have changed wholesale in a
+// bulk sync. The kernel takes one notification per name, but they are all
+// built in the same buffer, and a failure for one name doesn't stop the rest.
+//
+// Names the kernel doesn't currently know of are skipped, since there is
+// nothing to invalidate. If invalidating any other name fails, the error is an
+// InvalidateEntriesError giving the error for each, unless the failure applies
+// to all names (ErrNotifyNotSupported or ErrShutdown), in which case that is
+// returned.
+func (c *Connection) InvalidateEntries(
+	parent fuseops.InodeID,
+	names []string) error {
+	if !c.protocol.HasInvalidate() {
+		return ErrNotifyNotSupported
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	var errs InvalidateEntriesError
+	for _, name := range names {
+		m.Reset()
+		err := c.sendInvalEntry(m, parent, name)
+		switch err {
+		case nil, syscall.ENOENT:
+			continue
+
+		case ErrShutdown:
+			return err
+		}
+
+		if errs == nil {
+			errs = make(InvalidateEntriesError)
+		}
+
+		errs[name] = err
+	}
+
+	if errs != nil {
+		return errs
+	}
+
+	return nil
+}
+
+// Send the kernel a notification that the entry for the supplied name in the
+// given directory is out of date.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) notifyInvalEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	if !c.protocol.HasInvalidate() {
+		return ErrNotifyNotSupported
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	return c.sendInvalEntry(m, parent, name)
+}
+
+// Build the notification for notifyInvalEntry in the empty message m, and send
+// it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) sendInvalEntry(
+	m *buffer.OutMessage,
+	parent fuseops.InodeID,
+	name string) error {
+	// The kernel rejects longer names, and we have no way to tell it where the
+	// name ends other than its length and the NUL that must follow it.
+	if len(name) > fusekernel.NotifyNameMax {
+		return syscall.ENAMETOOLONG
+	}
+
+	out := (*fusekernel.NotifyInvalEntryOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))))
+	out.Parent = uint64(parent)
+	out.Namelen = uint32(len(name))
+
+	m.AppendString(name)
+	m.Append([]byte{0})
+
+	return c.notify(fusekernel.NotifyCodeInvalEntry, m)
+}
+
+// NotifyResend asks the kernel to send again each request that it has sent
+// but had no reply to. This is for a process that has taken over the
+// connection from another, e.g. by receiving its /dev/fuse descriptor, and so
+// cannot know which requests the other read without answering.
+//
+// Requests resent in this way that this connection has already read are not
+// dispatched twice: one still being handled is answered by its op, and one
+// whose reply the kernel refused, having already taken it back, is answered
+// with that reply.
+//
+// ErrNotifyNotSupported is returned if the kernel doesn't support resending
+// (see Capabilities.Resend), and ErrShutdown if the connection to the kernel
+// has been closed.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) NotifyResend() error {
+	if !c.capabilities.Resend {
+		return ErrNotifyNotSupported
+	}
+
+	// Start tracking the IDs with which to answer ops, including those already
+	// outstanding, which are the ones the kernel may resend. Replies still kept
+	// for the resends of an earlier notification, which never came, are
+	// dropped.
+	c.mu.Lock()
+	if !c.resendRequested {
+		c.resendRequested = true
+		c.outstanding = make(map[uint64]*resentRequest)
+		for fuseID := range c.cancelFuncs {
+			c.outstanding[fuseID&^fusekernel.UniqueResend] = nil
+		}
+	}
+
+	c.resendable = make(map[uint64]bool)
+	c.unclaimedReplies = make(map[uint64][]byte)
+	for key := range c.outstanding {
+		c.resendable[key] = true
+	}
+	c.mu.Unlock()
+
+	// The notification has no body.
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	return c.notify(fusekernel.NotifyCodeResend, m)
+}
+
+// Send the kernel the notification with the given code whose body has been
+// written to m. This is the one place notifications are written, and is safe
+// to call concurrently with replies and with closing the connection.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) notify(code int32, m *buffer.OutMessage) error {
+	// Notifications are distinguished from replies by a zero unique ID, with
+	// the notification code in place of the error.
+	h := m.OutHeader()
+	h.Error = code
+	h.Len = uint32(m.Len())
+
+	return notifyError(c.writeMessage(c.dev, m.Bytes()))
+}
+
+// Translate an error from writing a notification to the kernel into one for
+// the caller.
+func notifyError(err error) error {
+	// The kernel refuses writes once the file system has been unmounted, and
+	// the descriptor is invalid once the connection has been closed.
+	if err == syscall.ENODEV || err == syscall.EBADF {
+		return ErrShutdown
+	}
+
+	return err
+}
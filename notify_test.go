@@ -0,0 +1,226 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const attrChangeContents = "taco"
+
+// Return a fileFS containing a file with fixed contents, which the kernel may
+// cache everything about for as long as possible, so that only a notification
+// makes it ask again, and which keeps the page cache when opened.
+func newAttrChangeFS() *fileFS {
+	return &fileFS{
+		contents: attrChangeContents,
+		validity: time.Hour,
+		open: func(op *fuseops.OpenFileOp) {
+			op.KeepPageCache = true
+		},
+		attrs: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0444,
+			Size:  uint64(len(attrChangeContents)),
+			Mtime: time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC),
+		},
+	}
+}
+
+func TestNotifyAttrChanged(t *testing.T) {
+	// Mount. With writeback caching, the kernel would keep its own mtime
+	// regardless.
+	fs := newAttrChangeFS()
+	mfs, c := mountConn(t, fs, &fuse.MountConfig{DisableWritebackCaching: true})
+	p := path.Join(mfs.Dir(), "foo")
+
+	// Read the file, filling the page cache.
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(contents) != attrChangeContents {
+		t.Fatalf("Contents: %q", contents)
+	}
+
+	reads := fs.count(&fuseops.ReadFileOp{})
+
+	// Change the mtime behind the kernel's back, and tell it.
+	newMtime := time.Date(2016, 5, 6, 3, 16, 0, 0, time.UTC)
+
+	fs.mu.Lock()
+	fs.attrs.Mtime = newMtime
+	fs.mu.Unlock()
+
+	if err := c.NotifyAttrChanged(fileFSFooID); err != nil {
+		t.Fatalf("NotifyAttrChanged: %v", err)
+	}
+
+	// The new mtime should be seen.
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if !fi.ModTime().Equal(newMtime) {
+		t.Errorf("ModTime: %v, want %v", fi.ModTime(), newMtime)
+	}
+
+	// But the contents should still come from the page cache.
+	contents, err = ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(contents) != attrChangeContents {
+		t.Errorf("Contents: %q", contents)
+	}
+
+	if n := fs.count(&fuseops.ReadFileOp{}); n != reads {
+		t.Errorf("File read again: %d reads, previously %d", n, reads)
+	}
+}
+
+func TestKeepPageCacheUntilInvalidated(t *testing.T) {
+	fs := newAttrChangeFS()
+	mfs, c := mountConn(t, fs, &fuse.MountConfig{})
+	p := path.Join(mfs.Dir(), "foo")
+
+	// Open, read, and close the file, returning the number of reads the file
+	// system has served afterward.
+	readAll := func() int {
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+
+		if string(contents) != attrChangeContents {
+			t.Fatalf("Contents: %q", contents)
+		}
+
+		return fs.count(&fuseops.ReadFileOp{})
+	}
+
+	// The first open fills the page cache, from which a second is served.
+	first := readAll()
+	if first == 0 {
+		t.Fatal("First read didn't reach the file system")
+	}
+
+	if reads := readAll(); reads != first {
+		t.Errorf("Reads after reopening: %d, want %d", reads, first)
+	}
+
+	// Once the contents are invalidated, they are read again.
+	if err := c.InvalidateNode(fileFSFooID, 0, 0); err != nil {
+		t.Fatalf("InvalidateNode: %v", err)
+	}
+
+	if reads := readAll(); reads == first {
+		t.Errorf("Reads after invalidating: %d, want more than %d", reads, first)
+	}
+}
+
+// A minimalFS whose root contains files named "a", "b" and "c", whose entries
+// may be cached for an hour, and which counts the lookups of each name.
+type entryCountFS struct {
+	minimalFS
+
+	mu      sync.Mutex
+	lookups map[string]int // GUARDED_BY(mu)
+}
+
+var entryCountNames = []string{"a", "b", "c"}
+
+func (fs *entryCountFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lookups[op.Name]++
+	for i, name := range entryCountNames {
+		if op.Parent == fuseops.RootInodeID && op.Name == name {
+			op.Entry.Child = fuseops.RootInodeID + 1 + fuseops.InodeID(i)
+			op.Entry.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0444}
+			op.Entry.AttributesValidity = time.Hour
+			op.Entry.EntryValidity = time.Hour
+			return nil
+		}
+	}
+
+	return fuse.ENOENT
+}
+
+func (fs *entryCountFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0444}
+	if op.Inode == fuseops.RootInodeID {
+		op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0555 | os.ModeDir}
+	}
+
+	op.AttributesValidity = time.Hour
+	return nil
+}
+
+func TestInvalidateEntries(t *testing.T) {
+	fs := &entryCountFS{lookups: make(map[string]int)}
+	mfs, c := mountConn(t, fs, &fuse.MountConfig{})
+
+	// Stat each file twice. The second time, the entries come from the cache.
+	statAll := func() {
+		for _, name := range entryCountNames {
+			if _, err := os.Stat(path.Join(mfs.Dir(), name)); err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+		}
+	}
+
+	expectLookups := func(n int) {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		for _, name := range entryCountNames {
+			if fs.lookups[name] != n {
+				t.Errorf("%q looked up %d times, want %d", name, fs.lookups[name], n)
+			}
+		}
+	}
+
+	statAll()
+	statAll()
+	expectLookups(1)
+
+	// Invalidate them all, along with a name the kernel doesn't know of. Each
+	// is then looked up again.
+	names := append([]string{"nonexistent"}, entryCountNames...)
+	if err := c.InvalidateEntries(fuseops.RootInodeID, names); err != nil {
+		t.Fatalf("InvalidateEntries: %v", err)
+	}
+
+	statAll()
+	expectLookups(2)
+}
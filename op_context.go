@@ -0,0 +1,42 @@
+//go:build go1.21
+// +build go1.21
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"time"
+)
+
+// Return a context for an op, derived from the supplied parent and timing out
+// after the given duration (if non-zero), and a function that cancels it with
+// the supplied cause.
+func newOpContext(
+	parent context.Context,
+	timeout time.Duration) (context.Context, func(error)) {
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancelCause(parent)
+		return ctx, cancel
+	}
+
+	ctx, stop := context.WithTimeoutCause(parent, timeout, ErrOpTimeout)
+	ctx, cancel := context.WithCancelCause(ctx)
+	return ctx, func(cause error) {
+		cancel(cause)
+		stop()
+	}
+}
@@ -0,0 +1,131 @@
+//go:build go1.21
+// +build go1.21
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Start a connection to a fake kernel, discarding its reply to the init
+// request, and send it a getattr request, returning the context for the op.
+func readGetattr(
+	t *testing.T,
+	cfg MountConfig) (c *Connection, kernel *os.File, ctx context.Context) {
+	c, kernel = newSocketConnection(t, latestInit, cfg)
+
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	var in fusekernel.GetattrIn
+	req := makeRequest(
+		fusekernel.OpGetattr,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	if _, err := kernel.Write(req); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	ctx, _, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	return c, kernel, ctx
+}
+
+func TestCancelCause_Interrupted(t *testing.T) {
+	c, kernel, ctx := readGetattr(t, MountConfig{})
+	defer c.close()
+	defer kernel.Close()
+
+	// Interrupt the getattr request, then send another request so that ReadOp
+	// gets past the interrupt, which it handles inline.
+	interrupt := fusekernel.InterruptIn{Unique: 17}
+	for _, req := range [][]byte{
+		makeRequest(
+			fusekernel.OpInterrupt,
+			structBytes(unsafe.Pointer(&interrupt), unsafe.Sizeof(interrupt))),
+		makeRequest(fusekernel.OpLookup, []byte("foo\x00")),
+	} {
+		(*fusekernel.InHeader)(unsafe.Pointer(&req[0])).Unique = 18
+		if _, err := kernel.Write(req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if _, _, err := c.ReadOp(); err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	<-ctx.Done()
+	if got := context.Cause(ctx); got != ErrInterrupted {
+		t.Errorf("Cause: got %v, want %v", got, ErrInterrupted)
+	}
+}
+
+func TestCancelCause_OpTimeout(t *testing.T) {
+	c, kernel, ctx := readGetattr(t, MountConfig{OpTimeout: time.Millisecond})
+	defer c.close()
+	defer kernel.Close()
+
+	<-ctx.Done()
+	if got := context.Cause(ctx); got != ErrOpTimeout {
+		t.Errorf("Cause: got %v, want %v", got, ErrOpTimeout)
+	}
+
+	// The deadline is still reported as such.
+	if _, ok := ctx.Deadline(); !ok || ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("Err: %v", ctx.Err())
+	}
+}
+
+func TestCancelCause_Shutdown(t *testing.T) {
+	c, kernel, ctx := readGetattr(t, MountConfig{})
+	defer c.close()
+
+	// Hang up, as the kernel does when the file system is unmounted.
+	kernel.Close()
+	if _, _, err := c.ReadOp(); err != io.EOF {
+		t.Fatalf("ReadOp: got %v, want EOF", err)
+	}
+
+	<-ctx.Done()
+	if got := context.Cause(ctx); got != ErrShutdown {
+		t.Errorf("Cause: got %v, want %v", got, ErrShutdown)
+	}
+}
+
+func TestCancelCause_Replied(t *testing.T) {
+	c, kernel, ctx := readGetattr(t, MountConfig{})
+	defer c.close()
+	defer kernel.Close()
+
+	c.Reply(ctx, nil)
+	if got := context.Cause(ctx); got != context.Canceled {
+		t.Errorf("Cause: got %v, want %v", got, context.Canceled)
+	}
+}
@@ -15,10 +15,28 @@
 package fuse
 
 import (
+	"reflect"
+
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
+// OpType identifies a kind of op, for configuration that varies by op such as
+// MountConfig.OpTimeouts. It is the name of the op's type in package fuseops,
+// e.g. "WriteFileOp".
+type OpType string
+
+// OpTypeOf returns the OpType for the supplied op, which is a pointer to one of
+// the op structs in package fuseops, e.g. OpTypeOf(&fuseops.LookUpInodeOp{}).
+func OpTypeOf(op interface{}) OpType {
+	t := reflect.TypeOf(op)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return OpType(t.Name())
+}
+
 // A sentinel used for unknown ops. The user is expected to respond with a
 // non-nil error.
 type unknownOp struct {
@@ -37,7 +55,8 @@ type initOp struct {
 	Kernel fusekernel.Protocol
 
 	// In/out
-	Flags fusekernel.InitFlags
+	Flags  fusekernel.InitFlags
+	Flags2 fusekernel.InitFlags2
 
 	// Out
 	Library       fusekernel.Protocol
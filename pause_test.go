@@ -0,0 +1,56 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+func TestPauseDispatch(t *testing.T) {
+	mfs, c := mountConn(t, &rootStatFS{}, &fuse.MountConfig{})
+	dir := mfs.Dir()
+
+	// Pause, and stat the mount point. This should block.
+	c.Pause()
+
+	statted := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(dir)
+		statted <- err
+	}()
+
+	select {
+	case err := <-statted:
+		t.Fatalf("Stat returned while paused: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Resuming should let it complete.
+	c.Resume()
+
+	select {
+	case err := <-statted:
+		if err != nil {
+			t.Errorf("Stat: %v", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for stat after resuming")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The size of the file in a file system returned by newLargeFileFS.
+const largeFileSize = 1 << 24
+
+// Return a fileFS containing a single large file that reads as all 'a's.
+func newLargeFileFS() *fileFS {
+	return &fileFS{
+		attrs: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0444,
+			Size:  largeFileSize,
+		},
+		read: func(ctx context.Context, op *fuseops.ReadFileOp) error {
+			for i := range op.Dst {
+				op.Dst[i] = 'a'
+			}
+
+			op.BytesRead = len(op.Dst)
+			return nil
+		},
+	}
+}
+
+// Return the sizes of the reads the supplied file system has served.
+func readSizes(fs *fileFS) []int {
+	var sizes []int
+	for _, op := range fs.recorded() {
+		if op, ok := op.(*fuseops.ReadFileOp); ok {
+			sizes = append(sizes, op.BytesRead)
+		}
+	}
+
+	return sizes
+}
+
+func TestNoReadAheadWithDirectIO(t *testing.T) {
+	fs := newLargeFileFS()
+	fs.open = func(op *fuseops.OpenFileOp) {
+		op.UseDirectIO = true
+	}
+
+	mfs := mountFS(t, fs, &fuse.MountConfig{})
+
+	// Read a couple of small pieces from the start of the file.
+	f, err := os.Open(path.Join(mfs.Dir(), "foo"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	buf := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatalf("ReadFull: %v", err)
+		}
+	}
+
+	// The file system should have seen exactly those reads, and nothing
+	// speculative.
+	if reads := readSizes(fs); len(reads) != 2 || reads[0] != 4096 || reads[1] != 4096 {
+		t.Errorf("Unexpected reads: %v", reads)
+	}
+}
+
+func TestReadSizesGrowWithReadAhead(t *testing.T) {
+	fs := newLargeFileFS()
+	mfs := mountFS(t, fs, &fuse.MountConfig{})
+
+	// Read the first few MiB of the file sequentially, in small pieces.
+	f, err := os.Open(path.Join(mfs.Dir(), "foo"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	buf := make([]byte, 4096)
+	for i := 0; i < (4<<20)/len(buf); i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatalf("ReadFull: %v", err)
+		}
+	}
+
+	// The kernel should have ramped up read-ahead, with the file system seeing
+	// larger reads than the first.
+	reads := readSizes(fs)
+
+	largest := 0
+	for _, n := range reads {
+		if n > largest {
+			largest = n
+		}
+	}
+
+	if len(reads) == 0 || largest <= reads[0] {
+		t.Errorf("Unexpected reads: %v", reads)
+	}
+}
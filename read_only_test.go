@@ -0,0 +1,65 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestReadOnlyMount(t *testing.T) {
+	fs := &fileFS{attrs: fuseops.InodeAttributes{Nlink: 1, Mode: 0666}}
+	mfs := mountFS(t, fs, &fuse.MountConfig{ReadOnly: true})
+
+	// The file's mode permits writing, but the kernel should refuse to open it
+	// for writing or to change its metadata without asking the file system.
+	p := path.Join(mfs.Dir(), "foo")
+
+	_, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("OpenFile(O_WRONLY): got %v, want EROFS", err)
+	}
+
+	err = os.Chmod(p, 0700)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Chmod: got %v, want EROFS", err)
+	}
+
+	if n := fs.count(&fuseops.OpenFileOp{}); n != 0 {
+		t.Errorf("OpenFile called %d times; want 0", n)
+	}
+
+	if n := fs.count(&fuseops.SetInodeAttributesOp{}); n != 0 {
+		t.Errorf("SetInodeAttributes called %d times; want 0", n)
+	}
+
+	// Opening for reading still reaches the file system.
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	f.Close()
+
+	if n := fs.count(&fuseops.OpenFileOp{}); n != 1 {
+		t.Errorf("OpenFile called %d times after read-only open; want 1", n)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system whose root contains many files, answering both ReadDir and
+// ReadDirPlus and counting the lookups it receives.
+type largeDirFS struct {
+	minimalFS
+	lookups uint64 // Accessed atomically
+}
+
+const largeDirSize = 10000
+
+func (fs *largeDirFS) dirent(i int) fuseutil.Dirent {
+	return fuseutil.Dirent{
+		Offset: fuseops.DirOffset(i + 1),
+		Inode:  fuseops.RootInodeID + 1 + fuseops.InodeID(i),
+		Name:   fmt.Sprintf("%05d", i),
+		Type:   fuseutil.DT_File,
+	}
+}
+
+// Return an entry the kernel may cache for the duration of the benchmark, so
+// that a stat following readdirplus needs no lookup.
+func (fs *largeDirFS) entry(inode fuseops.InodeID) fuseops.ChildInodeEntry {
+	expiration := time.Now().Add(time.Hour)
+	return fuseops.ChildInodeEntry{
+		Child:                inode,
+		Attributes:           fuseops.InodeAttributes{Nlink: 1, Mode: 0444},
+		AttributesExpiration: expiration,
+		EntryExpiration:      expiration,
+	}
+}
+
+func (fs *largeDirFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0555 | os.ModeDir}
+		return nil
+	}
+
+	op.Attributes = fs.entry(op.Inode).Attributes
+	return nil
+}
+
+func (fs *largeDirFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	atomic.AddUint64(&fs.lookups, 1)
+
+	var i int
+	if _, err := fmt.Sscanf(op.Name, "%05d", &i); err != nil ||
+		op.Parent != fuseops.RootInodeID ||
+		i >= largeDirSize {
+		return fuse.ENOENT
+	}
+
+	op.Entry = fs.entry(fs.dirent(i).Inode)
+	return nil
+}
+
+func (fs *largeDirFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *largeDirFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	for i := int(op.Offset); i < largeDirSize; i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fs.dirent(i))
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *largeDirFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	for i := int(op.Offset); i < largeDirSize; i++ {
+		d := fs.dirent(i)
+		n := fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], d, fs.entry(d.Inode))
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *largeDirFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+// Compare listing a large directory the way `ls -l` does, reading it and then
+// calling lstat(2) on each entry, with and without readdirplus. Each iteration
+// uses a fresh mount so that nothing is cached to begin with; the lookups
+// metric shows the round trips saved.
+func BenchmarkListLargeDir(b *testing.B) {
+	for _, plus := range []bool{false, true} {
+		b.Run(fmt.Sprintf("readdirplus=%v", plus), func(b *testing.B) {
+			benchmarkListLargeDir(b, plus)
+		})
+	}
+}
+
+func benchmarkListLargeDir(b *testing.B, plus bool) {
+	ctx := context.Background()
+
+	var lookups uint64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fs := &largeDirFS{}
+		mfs := mountFS(b, fs, &fuse.MountConfig{
+			Capabilities: fuse.Capabilities{Readdirplus: plus},
+		})
+
+		dir := mfs.Dir()
+		b.StartTimer()
+		f, err := os.Open(dir)
+		if err != nil {
+			b.Fatalf("Open: %v", err)
+		}
+
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			b.Fatalf("Readdirnames: %v", err)
+		}
+
+		for _, name := range names {
+			if _, err := os.Lstat(path.Join(dir, name)); err != nil {
+				b.Fatalf("Lstat: %v", err)
+			}
+		}
+
+		b.StopTimer()
+		lookups += atomic.LoadUint64(&fs.lookups)
+
+		if err := fuse.Unmount(mfs.Dir()); err != nil {
+			b.Fatalf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(ctx); err != nil {
+			b.Fatalf("Joining: %v", err)
+		}
+
+		b.StartTimer()
+	}
+
+	b.ReportMetric(float64(lookups)/float64(b.N), "lookups/op")
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+// Each op that gets a reply, along with the fields that the file system sets
+// for it. Their docs in package fuseops start "Set by the file system".
+var opReplyFields = []struct {
+	op     interface{}
+	fields []string
+}{
+	{&fuseops.StatFSOp{}, []string{
+		"BlockSize",
+		"Blocks",
+		"BlocksFree",
+		"BlocksAvailable",
+		"IoSize",
+		"Inodes",
+		"InodesFree",
+		"MaxNameLength",
+	}},
+	{&fuseops.LookUpInodeOp{}, []string{"Entry"}},
+	{&fuseops.GetInodeAttributesOp{}, []string{
+		"Attributes",
+		"AttributesExpiration",
+		"AttributesValidity",
+	}},
+	{&fuseops.SetInodeAttributesOp{}, []string{
+		"Attributes",
+		"AttributesExpiration",
+		"AttributesValidity",
+	}},
+	{&fuseops.MkDirOp{}, []string{"Entry"}},
+	{&fuseops.MkNodeOp{}, []string{"Entry"}},
+	{&fuseops.CreateFileOp{}, []string{"Entry", "Handle"}},
+	{&fuseops.CreateSymlinkOp{}, []string{"Entry"}},
+	{&fuseops.CreateLinkOp{}, []string{"Entry"}},
+	{&fuseops.RenameOp{}, nil},
+	{&fuseops.RmDirOp{}, nil},
+	{&fuseops.UnlinkOp{}, nil},
+	{&fuseops.OpenDirOp{}, []string{"Handle"}},
+	{&fuseops.ReadDirOp{}, []string{"BytesRead"}},
+	{&fuseops.ReadDirPlusOp{}, []string{"BytesRead"}},
+	{&fuseops.ReleaseDirHandleOp{}, nil},
+	{&fuseops.OpenFileOp{}, []string{
+		"Handle",
+		"KeepPageCache",
+		"UseDirectIO",
+		"NoFlush",
+	}},
+	{&fuseops.ReadFileOp{}, []string{"BytesRead"}},
+	{&fuseops.WriteFileOp{}, nil},
+	{&fuseops.SyncFileOp{}, nil},
+	{&fuseops.FlushFileOp{}, nil},
+	{&fuseops.ReleaseFileHandleOp{}, nil},
+	{&fuseops.ReadSymlinkOp{}, []string{"Target"}},
+	{&fuseops.RemoveXattrOp{}, nil},
+	{&fuseops.GetXattrOp{}, []string{"BytesRead"}},
+	{&fuseops.ListXattrOp{}, []string{"BytesRead"}},
+	{&fuseops.SetXattrOp{}, nil},
+	{&fuseops.FallocateOp{}, nil},
+	{&fuseops.CopyFileRangeOp{}, []string{"BytesCopied"}},
+	{&fuseops.GetLkOp{}, []string{"Lock"}},
+	{&fuseops.SetLkOp{}, nil},
+	{&fuseops.SetLkwOp{}, nil},
+}
+
+// Request fields that are legitimately echoed in the reply.
+var echoedRequestFields = map[string]bool{
+	"GetInodeAttributesOp.Inode": true, // As the attributes' inode number
+	"SetInodeAttributesOp.Inode": true, // Likewise
+	"WriteFileOp.Data":           true, // As the number of bytes written
+}
+
+// Set v, recursively, to a value with every field non-zero.
+func setNonZero(t *testing.T, v reflect.Value, now time.Time) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+
+	case reflect.String:
+		v.SetString("taco")
+
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		setNonZero(t, v.Index(0), now)
+
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		setNonZero(t, v.Elem(), now)
+
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(now.Add(time.Hour)))
+			return
+		}
+
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				setNonZero(t, v.Field(i), now)
+			}
+		}
+
+	default:
+		t.Fatalf("Don't know how to set a %v", v.Type())
+	}
+}
+
+// Every field of an op that shapes the kernel's reply must be one that the
+// file system sets, and every field that the file system sets must shape the
+// reply. This catches reply fields that are documented but never sent, and
+// request fields that are mistakenly sent back.
+func TestReplyFieldsShapeKernelResponse(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	c := &Connection{
+		cfg: MountConfig{Clock: &clock},
+		protocol: fusekernel.Protocol{
+			Major: fusekernel.ProtoVersionMaxMajor,
+			Minor: fusekernel.ProtoVersionMaxMinor,
+		},
+	}
+
+	// Render the reply for an op, giving it a destination buffer at the end
+	// of the message as convertInMessage would if it has one.
+	reply := func(op reflect.Value) []byte {
+		m := new(buffer.OutMessage)
+		m.Reset()
+		if dst := op.Elem().FieldByName("Dst"); dst.IsValid() {
+			m.Grow(16)
+			dst.SetBytes(make([]byte, 16))
+		}
+
+		c.kernelResponseForOp(m, op.Interface())
+		return append([]byte(nil), m.Bytes()...)
+	}
+
+	for _, tc := range opReplyFields {
+		typ := reflect.TypeOf(tc.op).Elem()
+		base := reply(reflect.New(typ))
+
+		isReply := make(map[string]bool)
+		for _, f := range tc.fields {
+			if _, ok := typ.FieldByName(f); !ok {
+				t.Errorf("%s has no field %s", typ.Name(), f)
+			}
+
+			isReply[f] = true
+		}
+
+		for i := 0; i < typ.NumField(); i++ {
+			name := typ.Field(i).Name
+			if name == "Dst" || name == "OpContext" {
+				continue
+			}
+
+			op := reflect.New(typ)
+			setNonZero(t, op.Elem().Field(i), clock.Now())
+			changed := !bytes.Equal(reply(op), base)
+
+			switch {
+			case isReply[name] && !changed:
+				t.Errorf(
+					"%s.%s is set by the file system but not replied",
+					typ.Name(),
+					name)
+
+			case !isReply[name] && changed && !echoedRequestFields[typ.Name()+"."+name]:
+				t.Errorf(
+					"%s.%s is a request field but shapes the reply",
+					typ.Name(),
+					name)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Return the bytes making up the supplied struct, which must be a pointer.
+func structBytes(p unsafe.Pointer, size uintptr) []byte {
+	return append([]byte(nil), (*[1 << 20]byte)(p)[:size:size]...)
+}
+
+// Build a request message with the given opcode and body, in the format read
+// from /dev/fuse.
+func makeRequest(opcode uint32, body ...[]byte) []byte {
+	h := fusekernel.InHeader{
+		Opcode: opcode,
+		Unique: 17,
+		Nodeid: 19,
+		Uid:    23,
+		Gid:    29,
+		Pid:    31,
+	}
+
+	var payload []byte
+	for _, b := range body {
+		payload = append(payload, b...)
+	}
+
+	h.Len = uint32(fusekernel.InHeaderSize + len(payload))
+	msg := structBytes(unsafe.Pointer(&h), unsafe.Sizeof(h))
+	return append(msg, payload...)
+}
+
+// Requests of the sort captured from a real kernel, used to seed the fuzzer.
+func seedRequests() [][]byte {
+	init := fusekernel.InitIn{Major: 7, Minor: 31, MaxReadahead: 1 << 17}
+	setattr := fusekernel.SetattrIn{}
+	setattr.Valid = uint32(fusekernel.SetattrSize | fusekernel.SetattrMode)
+	setattr.Size = 1024
+	setattr.Mode = 0644
+	read := fusekernel.ReadIn{Fh: 3, Offset: 4096, Size: 4096}
+	write := fusekernel.WriteIn{Fh: 3, Offset: 0, Size: 4}
+	mkdir := fusekernel.MkdirIn{Mode: 0755}
+	create := fusekernel.CreateIn{Flags: 0x8241, Mode: 0100644}
+	rename := fusekernel.RenameIn{Newdir: 37}
+	link := fusekernel.LinkIn{Oldnodeid: 41}
+	getxattr := fusekernel.GetxattrIn{}
+	getxattr.Size = 256
+	setxattr := fusekernel.SetxattrIn{}
+	setxattr.Size = 5
+	fallocate := fusekernel.FallocateIn{Fh: 3, Length: 1 << 20, Mode: 1}
+	copyFileRange := fusekernel.CopyFileRangeIn{FhIn: 3, NodeidOut: 43, FhOut: 5, Len: 1 << 20}
+	interrupt := fusekernel.InterruptIn{Unique: 17}
+	batchForget := fusekernel.BatchForgetIn{Count: 2}
+	forgets := [2]fusekernel.ForgetOne{{Nodeid: 19, Nlookup: 1}, {Nodeid: 23, Nlookup: 2}}
+
+	return [][]byte{
+		makeRequest(
+			fusekernel.OpInit,
+			structBytes(unsafe.Pointer(&init), unsafe.Sizeof(init))),
+		makeRequest(fusekernel.OpLookup, []byte("foo\x00")),
+		makeRequest(fusekernel.OpGetattr, make([]byte, 16)),
+		makeRequest(
+			fusekernel.OpSetattr,
+			structBytes(unsafe.Pointer(&setattr), unsafe.Sizeof(setattr))),
+		makeRequest(
+			fusekernel.OpRead,
+			structBytes(unsafe.Pointer(&read), unsafe.Sizeof(read))),
+		makeRequest(
+			fusekernel.OpWrite,
+			structBytes(unsafe.Pointer(&write), unsafe.Sizeof(write)),
+			[]byte("taco")),
+		makeRequest(
+			fusekernel.OpMkdir,
+			structBytes(unsafe.Pointer(&mkdir), unsafe.Sizeof(mkdir)),
+			[]byte("dir\x00")),
+		makeRequest(
+			fusekernel.OpCreate,
+			structBytes(unsafe.Pointer(&create), unsafe.Sizeof(create)),
+			[]byte("file\x00")),
+		makeRequest(fusekernel.OpSymlink, []byte("link\x00target\x00")),
+		makeRequest(
+			fusekernel.OpRename,
+			structBytes(unsafe.Pointer(&rename), unsafe.Sizeof(rename)),
+			[]byte("old\x00new\x00")),
+		makeRequest(
+			fusekernel.OpLink,
+			structBytes(unsafe.Pointer(&link), unsafe.Sizeof(link)),
+			[]byte("hard\x00")),
+		makeRequest(
+			fusekernel.OpGetxattr,
+			structBytes(unsafe.Pointer(&getxattr), unsafe.Sizeof(getxattr)),
+			[]byte("user.foo\x00")),
+		makeRequest(
+			fusekernel.OpSetxattr,
+			structBytes(unsafe.Pointer(&setxattr), unsafe.Sizeof(setxattr)),
+			[]byte("user.foo\x00hello")),
+		makeRequest(
+			fusekernel.OpFallocate,
+			structBytes(unsafe.Pointer(&fallocate), unsafe.Sizeof(fallocate))),
+		makeRequest(
+			fusekernel.OpCopyFileRange,
+			structBytes(unsafe.Pointer(&copyFileRange), unsafe.Sizeof(copyFileRange))),
+		makeRequest(
+			fusekernel.OpBatchForget,
+			structBytes(unsafe.Pointer(&batchForget), unsafe.Sizeof(batchForget)),
+			structBytes(unsafe.Pointer(&forgets), unsafe.Sizeof(forgets))),
+		makeRequest(
+			fusekernel.OpInterrupt,
+			structBytes(unsafe.Pointer(&interrupt), unsafe.Sizeof(interrupt))),
+		makeRequest(fusekernel.OpStatfs),
+	}
+}
+
+// Every seed request for FuzzParseRequest should parse successfully.
+func TestSeedRequestsParse(t *testing.T) {
+	protocol := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	for _, seed := range seedRequests() {
+		inMsg := buffer.NewInMessage()
+		if err := inMsg.Init(bytes.NewReader(seed)); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		outMsg := new(buffer.OutMessage)
+		outMsg.Reset()
+
+		if _, err := convertInMessage(inMsg, outMsg, protocol, Capabilities{}); err != nil {
+			t.Errorf("opcode %d: %v", inMsg.Header().Opcode, err)
+		}
+	}
+}
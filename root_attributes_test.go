@@ -0,0 +1,45 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestRootAttributes(t *testing.T) {
+	// Mount a file system that doesn't implement GetInodeAttributes.
+	dir := mountFS(t, &minimalFS{}, &fuse.MountConfig{
+		RootAttributes: &fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0751 | os.ModeDir,
+			Uid:   uint32(os.Getuid()),
+			Gid:   uint32(os.Getgid()),
+		},
+	}).Dir()
+
+	// Stat the mount point.
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if fi.Mode() != 0751|os.ModeDir {
+		t.Errorf("Mode: %v", fi.Mode())
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A tool for measuring the op throughput this package achieves on the local
+// machine with a given configuration, using a file system that does no work of
+// its own (see fusetesting.NewNullFS).
+//
+// For example, to compare throughput when reading from one and four device descriptors:
+//
+//	benchmark --clones 0 --workers 4
+//	benchmark --clones 3 --workers 4
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+var fDuration = flag.Duration("duration", 5*time.Second, "How long to run each benchmark.")
+var fWorkers = flag.Int("workers", 1, "Number of goroutines issuing syscalls.")
+var fBlockSize = flag.Int("block_size", 4096, "Size of each read and write.")
+var fClones = flag.Int("clones", 0, "Number of device clones (MountConfig.DeviceClones).")
+var fAsyncReads = flag.Bool("async_reads", false, "Enable async reads.")
+var fBenchmarks = flag.String("benchmarks", "reads,writes,lookups", "Comma-separated benchmarks to run.")
+
+var benchmarks = map[string]func(string, fusetesting.BenchmarkConfig) (fusetesting.BenchmarkResult, error){
+	"reads":   fusetesting.BenchmarkReads,
+	"writes":  fusetesting.BenchmarkWrites,
+	"lookups": fusetesting.BenchmarkLookUps,
+}
+
+func main() {
+	flag.Parse()
+
+	dir, err := ioutil.TempDir("", "benchmark")
+	if err != nil {
+		log.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cfg := &fuse.MountConfig{
+		DeviceClones: *fClones,
+		Capabilities: fuse.Capabilities{AsyncRead: *fAsyncReads},
+	}
+
+	server := fuseutil.NewFileSystemServer(fusetesting.NewNullFS())
+	mfs, err := fuse.Mount(dir, server, cfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	bcfg := fusetesting.BenchmarkConfig{
+		Duration:  *fDuration,
+		Workers:   *fWorkers,
+		BlockSize: *fBlockSize,
+	}
+
+	for _, name := range strings.Split(*fBenchmarks, ",") {
+		f, ok := benchmarks[name]
+		if !ok {
+			log.Printf("Unknown benchmark %q", name)
+			continue
+		}
+
+		r, err := f(dir, bcfg)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			continue
+		}
+
+		fmt.Printf("%-8s %v\n", name, r)
+	}
+
+	if err := fuse.Unmount(dir); err != nil {
+		log.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
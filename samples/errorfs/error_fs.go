@@ -33,7 +33,7 @@ const fooInodeID = fuseops.RootInodeID + 1
 var fooAttrs = fuseops.InodeAttributes{
 	Nlink: 1,
 	Size:  uint64(len(FooContents)),
-	Mode:  0444,
+	Mode:  0666,
 }
 
 // A file system whose sole contents are a file named "foo" containing the
@@ -216,3 +216,19 @@ func (fs *errorFS) ReadDir(
 
 	return nil
 }
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *errorFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	var err error
+	if fs.transformError(op, &err) {
+		return err
+	}
+
+	if op.Inode != fooInodeID {
+		return fmt.Errorf("Unsupported inode ID: %d", op.Inode)
+	}
+
+	return nil
+}
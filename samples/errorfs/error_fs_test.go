@@ -22,6 +22,7 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/fuse/samples"
@@ -55,6 +56,9 @@ func (t *ErrorFSTest) SetUp(ti *TestInfo) {
 
 	t.Server = fuseutil.NewFileSystemServer(t.fs)
 
+	// Make write errors visible to write(2), rather than only to a later flush.
+	t.MountConfig.DisableWritebackCaching = true
+
 	// Mount it.
 	t.SampleTest.SetUp(ti)
 }
@@ -84,6 +88,23 @@ func (t *ErrorFSTest) ReadFile() {
 	ExpectThat(err, Error(MatchesRegexp("read.*: .*owner died")))
 }
 
+func (t *ErrorFSTest) WriteFile_QuotaExceeded() {
+	t.fs.SetError(reflect.TypeOf(&fuseops.WriteFileOp{}), fuse.EDQUOT)
+
+	// Open
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY, 0)
+	defer f.Close()
+	AssertEq(nil, err)
+
+	// Write
+	_, err = f.Write([]byte("taco"))
+	ExpectThat(err, Error(MatchesRegexp("write.*: .*quota exceeded")))
+
+	pathErr, ok := err.(*os.PathError)
+	AssertTrue(ok, "%T", err)
+	ExpectEq(syscall.EDQUOT, pathErr.Err)
+}
+
 func (t *ErrorFSTest) OpenDir() {
 	t.fs.SetError(reflect.TypeOf(&fuseops.OpenDirOp{}), syscall.EOWNERDEAD)
 
@@ -53,6 +53,10 @@ type flushFSTest struct {
 	// File handles that are closed in TearDown if non-nil.
 	f1 *os.File
 	f2 *os.File
+
+	// Additional flags to pass to mount_sample, set by suites before calling
+	// setUp.
+	extraMountFlags []string
 }
 
 func (t *flushFSTest) setUp(
@@ -83,6 +87,8 @@ func (t *flushFSTest) setUp(
 		t.MountFlags = append(t.MountFlags, "--read_only")
 	}
 
+	t.MountFlags = append(t.MountFlags, t.extraMountFlags...)
+
 	t.MountFiles = map[string]*os.File{
 		"flushfs.flushes_file": t.flushes,
 		"flushfs.fsyncs_file":  t.fsyncs,
@@ -793,6 +799,71 @@ func (t *NoErrorsTest) Directory() {
 	// ExpectThat(t.getFsyncs(), ElementsAre())
 }
 
+////////////////////////////////////////////////////////////////////////
+// No flush for read-only handles
+////////////////////////////////////////////////////////////////////////
+
+type ReadOnlyNoFlushTest struct {
+	flushFSTest
+}
+
+func init() { RegisterTestSuite(&ReadOnlyNoFlushTest{}) }
+
+func (t *ReadOnlyNoFlushTest) SetUp(ti *TestInfo) {
+	const noErr = 0
+	t.extraMountFlags = []string{
+		"--disable_writeback_caching",
+		"--read_only_no_flush",
+	}
+
+	t.flushFSTest.setUp(ti, noErr, noErr, false)
+}
+
+func (t *ReadOnlyNoFlushTest) Close_ReadOnly() {
+	var err error
+
+	// Open the file.
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDONLY, 0)
+	AssertEq(nil, err)
+
+	// Close the file.
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	// On Linux the kernel should not have bothered to send a flush.
+	var expectedFlushes []interface{}
+	if isDarwin {
+		expectedFlushes = append(expectedFlushes, "")
+	}
+
+	ExpectThat(t.getFlushes(), ElementsAre(expectedFlushes...))
+	ExpectThat(t.getFsyncs(), ElementsAre())
+}
+
+func (t *ReadOnlyNoFlushTest) Close_ReadWrite() {
+	var n int
+	var err error
+
+	// Open the file.
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	// Write some contents to the file.
+	n, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+	AssertEq(4, n)
+
+	// Close the file.
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	// Handles opened for writing should still be flushed.
+	ExpectThat(t.getFlushes(), ElementsAre("taco"))
+	ExpectThat(t.getFsyncs(), ElementsAre())
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Flush error
 ////////////////////////////////////////////////////////////////////////
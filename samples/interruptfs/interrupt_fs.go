@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"syscall"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -54,12 +55,16 @@ type InterruptFS struct {
 	// Must hold the mutex when closing these.
 	readReceived  chan struct{}
 	flushReceived chan struct{}
+
+	// Receives the context of each read that blocks, if there is room.
+	blockedReads chan context.Context
 }
 
 func New() *InterruptFS {
 	return &InterruptFS{
 		readReceived:  make(chan struct{}),
 		flushReceived: make(chan struct{}),
+		blockedReads:  make(chan context.Context, 1),
 	}
 }
 
@@ -77,6 +82,12 @@ func (fs *InterruptFS) WaitForFirstFlush() {
 	<-fs.flushReceived
 }
 
+// Return a channel that receives the context of a read that has blocked, for
+// use with fusetesting.AssertInterruptible.
+func (fs *InterruptFS) BlockedReads() <-chan context.Context {
+	return fs.blockedReads
+}
+
 // Enable blocking until interrupted for the next (and subsequent) read ops.
 func (fs *InterruptFS) EnableReadBlocking() {
 	fs.mu.Lock()
@@ -167,8 +178,13 @@ func (fs *InterruptFS) ReadFile(
 			panic("Expected non-nil channel.")
 		}
 
+		select {
+		case fs.blockedReads <- ctx:
+		default:
+		}
+
 		<-done
-		return ctx.Err()
+		return syscall.EINTR
 	}
 
 	return nil
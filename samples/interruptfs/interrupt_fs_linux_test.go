@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interruptfs_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/interruptfs"
+)
+
+func TestInterruptedDuringRead_EndToEnd(t *testing.T) {
+	fs := interruptfs.New()
+	fs.EnableReadBlocking()
+
+	fusetesting.AssertInterruptible(
+		t,
+		func(t testing.TB) (string, <-chan context.Context) {
+			dir := fusetesting.MountForTest(
+				t,
+				fuseutil.NewFileSystemServer(fs),
+				&fuse.MountConfig{}).Dir()
+
+			return dir, fs.BlockedReads()
+		},
+		func(dir string) func() error {
+			return func() error {
+				f, err := os.Open(path.Join(dir, "foo"))
+				if err != nil {
+					return err
+				}
+
+				defer f.Close()
+
+				_, err = syscall.Read(int(f.Fd()), make([]byte, 16))
+				return err
+			}
+		})
+}
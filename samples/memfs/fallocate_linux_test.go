@@ -0,0 +1,168 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/sys/unix"
+)
+
+type FallocateTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&FallocateTest{}) }
+
+// Create a file with the given contents and open it for modification.
+func (t *FallocateTest) openFile(contents string) (*os.File, string) {
+	p := path.Join(t.Dir, "foo")
+	err := ioutil.WriteFile(p, []byte(contents), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	AssertEq(nil, err)
+	t.ToClose = append(t.ToClose, f)
+
+	return f, p
+}
+
+func (t *FallocateTest) PastEOF_GrowsFile() {
+	f, p := t.openFile("taco")
+
+	err := unix.Fallocate(int(f.Fd()), 0, 2, 8)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(10, fi.Size())
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectEq("taco\x00\x00\x00\x00\x00\x00", string(contents))
+}
+
+func (t *FallocateTest) PastEOF_KeepSize() {
+	f, p := t.openFile("taco")
+
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 2, 8)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(4, fi.Size())
+}
+
+func (t *FallocateTest) PunchHole() {
+	f, p := t.openFile("burrito")
+
+	err := unix.Fallocate(
+		int(f.Fd()),
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		2,
+		3)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectEq("bu\x00\x00\x00to", string(contents))
+}
+
+// Return the disk usage of the file at p in KiB, as reported by du(1), which
+// is derived from st_blocks.
+func du(p string) int {
+	out, err := exec.Command("du", "-k", p).Output()
+	AssertEq(nil, err)
+
+	kib, err := strconv.Atoi(strings.Fields(string(out))[0])
+	AssertEq(nil, err)
+
+	return kib
+}
+
+func (t *FallocateTest) PreallocateThenPunchHole_TracksBlocks() {
+	if _, err := exec.LookPath("du"); err != nil {
+		return
+	}
+
+	f, p := t.openFile("")
+
+	// Preallocate a MiB.
+	err := unix.Fallocate(int(f.Fd()), 0, 0, 1<<20)
+	AssertEq(nil, err)
+	ExpectEq(1024, du(p))
+
+	// Punch a quarter of it out.
+	err = unix.Fallocate(
+		int(f.Fd()),
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		1<<18,
+		1<<18)
+	AssertEq(nil, err)
+	ExpectEq(768, du(p))
+
+	// The size is unchanged.
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(1<<20, fi.Size())
+
+	// Filling the hole back in restores the allocation.
+	_, err = f.WriteAt(make([]byte, 1<<18), 1<<18)
+	AssertEq(nil, err)
+	AssertEq(nil, f.Sync())
+	ExpectEq(1024, du(p))
+}
+
+func (t *FallocateTest) PunchWholeFile_NoBlocks() {
+	if _, err := exec.LookPath("du"); err != nil {
+		return
+	}
+
+	f, p := t.openFile("taco")
+	AssertEq(1, du(p))
+
+	// With the whole file punched out, nothing is allocated although the size
+	// is unchanged.
+	err := unix.Fallocate(
+		int(f.Fd()),
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		0,
+		4)
+	AssertEq(nil, err)
+	ExpectEq(0, du(p))
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(4, fi.Size())
+}
+
+func (t *FallocateTest) UnsupportedMode() {
+	f, p := t.openFile("taco")
+
+	// memfs doesn't support zeroing ranges. (Older kernels reject the mode
+	// themselves, with the same error.)
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_ZERO_RANGE, 0, 2)
+	ExpectEq(unix.EOPNOTSUPP, err)
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
@@ -58,6 +58,13 @@ type inode struct {
 	// INVARIANT: If !isFile(), len(contents) == 0
 	contents []byte
 
+	// For files, the ranges of contents that are allocated rather than holes,
+	// which are written to or preallocated with fallocate. We report them in
+	// attrs.Blocks, although our contents are never actually sparse.
+	//
+	// INVARIANT: attrs.Blocks == alloc.Blocks()
+	alloc fuseutil.Allocation
+
 	// For symlinks, the target of the symlink.
 	//
 	// INVARIANT: If !isSymlink(), len(target) == 0
@@ -79,6 +86,9 @@ func newInode(attrs fuseops.InodeAttributes) *inode {
 	attrs.Mtime = now
 	attrs.Crtime = now
 
+	// We report the blocks allocated, even when there are none.
+	attrs.BlocksValid = true
+
 	// Create the object.
 	return &inode{
 		attrs:  attrs,
@@ -105,6 +115,14 @@ func (in *inode) CheckInvariants() {
 			len(in.contents)))
 	}
 
+	// INVARIANT: attrs.Blocks == alloc.Blocks()
+	if in.attrs.Blocks != in.alloc.Blocks() {
+		panic(fmt.Sprintf(
+			"Blocks mismatch: %d vs. %d",
+			in.attrs.Blocks,
+			in.alloc.Blocks()))
+	}
+
 	// INVARIANT: If !isDir(), len(entries) == 0
 	if !in.isDir() && len(in.entries) != 0 {
 		panic(fmt.Sprintf("Unexpected entries length: %d", len(in.entries)))
@@ -337,6 +355,8 @@ func (in *inode) WriteAt(p []byte, off int64) (int, error) {
 
 	// Copy in the data.
 	n := copy(in.contents[off:], p)
+	in.alloc.Allocate(uint64(off), uint64(n))
+	in.attrs.Blocks = in.alloc.Blocks()
 
 	// Sanity check.
 	if n != len(p) {
@@ -368,6 +388,8 @@ func (in *inode) SetAttributes(
 
 		// Update attributes.
 		in.attrs.Size = *size
+		in.alloc.Truncate(*size)
+		in.attrs.Blocks = in.alloc.Blocks()
 	}
 
 	// Change mode?
@@ -381,15 +403,59 @@ func (in *inode) SetAttributes(
 	}
 }
 
-func (in *inode) Fallocate(mode uint32, offset uint64, length uint64) error {
-	if mode != 0 {
-		return fuse.ENOSYS
+// Clear the setuid bit, and the setgid bit if the file is group-executable, as
+// the kernel does when a file is modified by an unprivileged user.
+func (in *inode) KillSuidgid() {
+	in.attrs.Mode &^= os.ModeSetuid
+	if in.attrs.Mode&0010 != 0 {
+		in.attrs.Mode &^= os.ModeSetgid
 	}
-	newSize := int(offset + length)
-	if newSize > len(in.contents) {
-		padding := make([]byte, newSize-len(in.contents))
-		in.contents = append(in.contents, padding...)
-		in.attrs.Size = offset + length
+}
+
+// Flags for fallocate(2), as in FallocateOp.Mode. (These are Linux's, which
+// package unix defines only there.)
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+// Allocate or deallocate the given range, as described by fuseops.FallocateOp.
+// Preallocating is free for us, so this only affects the size, the contents,
+// and the reported allocation.
+func (in *inode) Fallocate(mode uint32, offset uint64, length uint64) error {
+	end := offset + length
+
+	switch mode {
+	case 0:
+		// Allocate, growing the file if the range extends past its end.
+		if end > uint64(len(in.contents)) {
+			padding := make([]byte, end-uint64(len(in.contents)))
+			in.contents = append(in.contents, padding...)
+			in.attrs.Size = end
+		}
+
+		in.alloc.Allocate(offset, length)
+
+	case fallocKeepSize:
+		// Allocate without changing the size.
+		in.alloc.Allocate(offset, length)
+
+	case fallocPunchHole | fallocKeepSize:
+		// Deallocate, which reads back as zeroes.
+		in.alloc.Deallocate(offset, length)
+
+		if end > uint64(len(in.contents)) {
+			end = uint64(len(in.contents))
+		}
+
+		for i := offset; i < end; i++ {
+			in.contents[i] = 0
+		}
+
+	default:
+		return fuse.EOPNOTSUPP
 	}
+
+	in.attrs.Blocks = in.alloc.Blocks()
 	return nil
 }
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"syscall"
 	"time"
 
@@ -71,6 +72,14 @@ type memFS struct {
 func NewMemFS(
 	uid uint32,
 	gid uint32) fuse.Server {
+	return fuseutil.NewFileSystemServer(NewFileSystem(uid, gid))
+}
+
+// NewFileSystem is like NewMemFS, but returns the file system itself rather
+// than a server for it, e.g. for use as a layer of another file system.
+func NewFileSystem(
+	uid uint32,
+	gid uint32) fuseutil.FileSystem {
 	// Set up the basic struct.
 	fs := &memFS{
 		inodes: make([]*inode, fuseops.RootInodeID+1),
@@ -90,7 +99,7 @@ func NewMemFS(
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
-	return fuseutil.NewFileSystemServer(fs)
+	return fs
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -270,6 +279,9 @@ func (fs *memFS) SetInodeAttributes(
 
 	// Handle the request.
 	inode.SetAttributes(op.Size, op.Mode, op.Mtime)
+	if op.KillSuidgid {
+		inode.KillSuidgid()
+	}
 
 	// Fill in the response.
 	op.Attributes = inode.attrs
@@ -338,7 +350,7 @@ func (fs *memFS) MkNode(
 	defer fs.mu.Unlock()
 
 	var err error
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, op.Rdev)
 	return err
 }
 
@@ -346,7 +358,8 @@ func (fs *memFS) MkNode(
 func (fs *memFS) createFile(
 	parentID fuseops.InodeID,
 	name string,
-	mode os.FileMode) (fuseops.ChildInodeEntry, error) {
+	mode os.FileMode,
+	rdev uint32) (fuseops.ChildInodeEntry, error) {
 	// Grab the parent, which we will update shortly.
 	parent := fs.getInodeOrDie(parentID)
 
@@ -368,13 +381,14 @@ func (fs *memFS) createFile(
 		Crtime: now,
 		Uid:    fs.uid,
 		Gid:    fs.gid,
+		Rdev:   rdev,
 	}
 
 	// Allocate a child.
 	childID, child := fs.allocateInode(childAttrs)
 
 	// Add an entry in the parent.
-	parent.AddChild(childID, name, fuseutil.DT_File)
+	parent.AddChild(childID, name, direntType(mode))
 
 	// Fill in the response entry.
 	var entry fuseops.ChildInodeEntry
@@ -400,10 +414,29 @@ func (fs *memFS) CreateFile(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, 0)
 	return err
 }
 
+// The directory entry type for a file created by createFile.
+func direntType(mode os.FileMode) fuseutil.DirentType {
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		return fuseutil.DT_Char
+
+	case mode&os.ModeDevice != 0:
+		return fuseutil.DT_Block
+
+	case mode&os.ModeNamedPipe != 0:
+		return fuseutil.DT_FIFO
+
+	case mode&os.ModeSocket != 0:
+		return fuseutil.DT_Socket
+	}
+
+	return fuseutil.DT_File
+}
+
 func (fs *memFS) CreateSymlink(
 	ctx context.Context,
 	op *fuseops.CreateSymlinkOp) error {
@@ -674,6 +707,10 @@ func (fs *memFS) OpenFile(
 		panic("Found non-file.")
 	}
 
+	if op.KillSuidgid {
+		inode.KillSuidgid()
+	}
+
 	return nil
 }
 
@@ -715,8 +752,17 @@ func (fs *memFS) WriteFile(
 	// Find the inode in question.
 	inode := fs.getInodeOrDie(op.Inode)
 
-	// Serve the request.
-	_, err := inode.WriteAt(op.Data, op.Offset)
+	// Serve the request. Appends go at the end of the file as we know it, which
+	// is where the kernel will have put them unless it is out of date.
+	offset := op.Offset
+	if op.OpenFlags.IsAppend() {
+		offset = int64(len(inode.contents))
+	}
+
+	_, err := inode.WriteAt(op.Data, offset)
+	if op.KillSuidgid {
+		inode.KillSuidgid()
+	}
 
 	return err
 }
@@ -765,7 +811,7 @@ func (fs *memFS) GetXattr(ctx context.Context,
 		if len(op.Dst) >= len(value) {
 			copy(op.Dst, value)
 		} else if len(op.Dst) != 0 {
-			return syscall.ERANGE
+			return fuse.ERANGE
 		}
 	} else {
 		return fuse.ENOATTR
@@ -785,20 +831,16 @@ func (fs *memFS) ListXattr(ctx context.Context,
 
 	inode := fs.getInodeOrDie(op.Inode)
 
-	dst := op.Dst[:]
+	names := make([]string, 0, len(inode.xattrs))
 	for key := range inode.xattrs {
-		keyLen := len(key) + 1
-
-		if len(dst) >= keyLen {
-			copy(dst, key)
-			dst = dst[keyLen:]
-		} else if len(op.Dst) != 0 {
-			return syscall.ERANGE
-		}
-		op.BytesRead += keyLen
+		names = append(names, key)
 	}
 
-	return nil
+	sort.Strings(names)
+
+	var err error
+	op.BytesRead, err = fuseutil.WriteXattrNames(op.Dst, names)
+	return err
 }
 
 func (fs *memFS) RemoveXattr(ctx context.Context,
@@ -857,6 +899,5 @@ func (fs *memFS) Fallocate(ctx context.Context,
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	inode := fs.getInodeOrDie(op.Inode)
-	inode.Fallocate(op.Mode, op.Offset, op.Length)
-	return nil
+	return inode.Fallocate(op.Mode, op.Offset, op.Length)
 }
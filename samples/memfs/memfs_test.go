@@ -16,6 +16,7 @@ package memfs_test
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -24,6 +25,8 @@ import (
 	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -875,6 +878,66 @@ func (t *MemFSTest) AppendMode() {
 	ExpectThat(string(buf[:n]), AnyOf("Jello, world!", "Jello, world!H"))
 }
 
+func (t *MemFSTest) AppendMode_ConcurrentWriters() {
+	const writers = 8
+	const recordsPerWriter = 100
+
+	fileName := path.Join(t.Dir, "foo")
+	err := ioutil.WriteFile(fileName, nil, 0600)
+	AssertEq(nil, err)
+
+	// Have several writers append fixed-size records through their own file
+	// descriptors at once.
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			defer f.Close()
+
+			for j := 0; j < recordsPerWriter; j++ {
+				if _, err := fmt.Fprintf(f, "%02d:%04d\n", i, j); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		AssertEq(nil, err)
+	}
+
+	// Every record should be present exactly once and intact, and each writer's
+	// records should be in order.
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	AssertEq(writers*recordsPerWriter, len(lines))
+
+	next := make(map[string]int)
+	for _, line := range lines {
+		var i, j int
+		_, err := fmt.Sscanf(line, "%02d:%04d", &i, &j)
+		AssertEq(nil, err, "line: %q", line)
+
+		writer := fmt.Sprintf("%02d", i)
+		ExpectEq(next[writer], j, "writer %s", writer)
+		next[writer] = j + 1
+	}
+}
+
 func (t *MemFSTest) ReadsPastEndOfFile() {
 	var err error
 	var n int
@@ -1240,6 +1303,14 @@ func (t *MemFSTest) CreateHardlink() {
 	ExpectEq("foo", fi.Name())
 	ExpectEq(0444, fi.Mode())
 
+	// Both names refer to the same inode, which now has two links.
+	orig, err := os.Lstat(fileName)
+	AssertEq(nil, err)
+
+	ExpectTrue(os.SameFile(orig, fi))
+	ExpectEq(2, orig.Sys().(*syscall.Stat_t).Nlink)
+	ExpectEq(2, fi.Sys().(*syscall.Stat_t).Nlink)
+
 	// Read the parent directory.
 	entries, err := fusetesting.ReadDirPicky(t.Dir)
 	AssertEq(nil, err)
@@ -1869,6 +1940,30 @@ func (t *MemFSTest) SetXAttr() {
 	AssertEq("bar", string(buf[:sz]))
 }
 
+func (t *MemFSTest) SetXAttr_EmptyValue() {
+	var err error
+	var sz int
+	var buf [1024]byte
+
+	// Create a file.
+	filePath := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Set an attribute with no value, as a flag.
+	err = unix.Setxattr(filePath, "user.foo", nil, unix.XATTR_CREATE)
+	AssertEq(nil, err)
+
+	// It should exist, with an empty value.
+	sz, err = unix.Getxattr(filePath, "user.foo", buf[:])
+	AssertEq(nil, err)
+	ExpectEq(0, sz)
+
+	sz, err = unix.Listxattr(filePath, buf[:])
+	AssertEq(nil, err)
+	ExpectEq("user.foo\000", string(buf[:sz]))
+}
+
 func (t *MemFSTest) RemoveXAttr() {
 	var err error
 
@@ -1890,6 +1985,68 @@ func (t *MemFSTest) RemoveXAttr() {
 	AssertEq(fuse.ENOATTR, err)
 }
 
+func (t *MemFSTest) SetXAttr_CreateAndReplaceFlags() {
+	t.checkSetXattrFlags()
+}
+
+// Check that XATTR_CREATE and XATTR_REPLACE are enforced.
+func (t *memFSTest) checkSetXattrFlags() {
+	var err error
+	var buf [1024]byte
+
+	// Create a file.
+	filePath := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Replacing an attribute that doesn't exist fails, and doesn't create it.
+	err = unix.Setxattr(filePath, "user.foo", []byte("bar"), unix.XATTR_REPLACE)
+	ExpectEq(fuse.ENOATTR, err)
+
+	_, err = unix.Getxattr(filePath, "user.foo", buf[:])
+	ExpectEq(fuse.ENOATTR, err)
+
+	// Creating one that does fails, and leaves its value alone.
+	err = unix.Setxattr(filePath, "user.foo", []byte("bar"), 0)
+	AssertEq(nil, err)
+
+	err = unix.Setxattr(filePath, "user.foo", []byte("baz"), unix.XATTR_CREATE)
+	ExpectEq(fuse.EEXIST, err)
+
+	sz, err := unix.Getxattr(filePath, "user.foo", buf[:])
+	AssertEq(nil, err)
+	ExpectEq("bar", string(buf[:sz]))
+
+	// Replacing one that does succeeds.
+	err = unix.Setxattr(filePath, "user.foo", []byte("qux"), unix.XATTR_REPLACE)
+	AssertEq(nil, err)
+
+	sz, err = unix.Getxattr(filePath, "user.foo", buf[:])
+	AssertEq(nil, err)
+	ExpectEq("qux", string(buf[:sz]))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Extended setxattr
+////////////////////////////////////////////////////////////////////////
+
+// The same flags, with the kernel sending the extended form of setxattr
+// requests where it supports it.
+type SetxattrExtTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&SetxattrExtTest{}) }
+
+func (t *SetxattrExtTest) SetUp(ti *TestInfo) {
+	t.MountConfig.Capabilities.SetxattrExt = true
+	t.memFSTest.SetUp(ti)
+}
+
+func (t *SetxattrExtTest) CreateAndReplaceFlags() {
+	t.checkSetXattrFlags()
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Mknod
 ////////////////////////////////////////////////////////////////////////
@@ -1927,6 +2084,56 @@ func (t *MknodTest) File() {
 	ExpectEq("", string(contents))
 }
 
+func (t *MknodTest) FIFO() {
+	// mknod(2) only works for root on OS X.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	var err error
+	p := path.Join(t.Dir, "foo")
+
+	// Create
+	err = syscall.Mknod(p, syscall.S_IFIFO|0640, 0)
+	AssertEq(nil, err)
+
+	// Stat
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeNamedPipe|0640, fi.Mode())
+
+	// The directory listing agrees.
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq(os.ModeNamedPipe|0640, entries[0].Mode())
+}
+
+func (t *MknodTest) CharDevice() {
+	// mknod(2) only works for root on OS X.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	var err error
+	p := path.Join(t.Dir, "foo")
+	dev := unix.Mkdev(1, 3)
+
+	// Create. Device nodes need CAP_MKNOD.
+	err = syscall.Mknod(p, syscall.S_IFCHR|0666, int(dev))
+	if err == syscall.EPERM {
+		return
+	}
+
+	AssertEq(nil, err)
+
+	// Stat
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeDevice|os.ModeCharDevice|0666, fi.Mode())
+	ExpectEq(dev, uint64(fi.Sys().(*syscall.Stat_t).Rdev))
+}
+
 func (t *MknodTest) Directory() {
 	// mknod(2) only works for root on OS X.
 	if runtime.GOOS == "darwin" {
@@ -2005,3 +2212,104 @@ func (t *MknodTest) Fallocate_Larger() {
 	AssertEq(nil, err)
 	ExpectEq("taco\x00\x00", string(contents))
 }
+
+////////////////////////////////////////////////////////////////////////
+// HandleKillPrivV2
+////////////////////////////////////////////////////////////////////////
+
+type KillPrivV2Test struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&KillPrivV2Test{}) }
+
+func (t *KillPrivV2Test) SetUp(ti *TestInfo) {
+	t.MountConfig.Capabilities.HandleKillPrivV2 = true
+	t.memFSTest.SetUp(ti)
+}
+
+// Return the mode that a file with the supplied mode should have after being
+// modified by the current user. Only unprivileged users lose the bits; we
+// assume that root has CAP_FSETID.
+func killedMode(m os.FileMode) os.FileMode {
+	if os.Geteuid() == 0 {
+		return m
+	}
+
+	m &^= os.ModeSetuid
+	if m&0010 != 0 {
+		m &^= os.ModeSetgid
+	}
+
+	return m
+}
+
+// Create a file with the given mode, bypassing the umask.
+func (t *KillPrivV2Test) createFile(name string, mode os.FileMode) string {
+	p := path.Join(t.Dir, name)
+	err := ioutil.WriteFile(p, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Chmod(p, mode)
+	AssertEq(nil, err)
+
+	return p
+}
+
+func (t *KillPrivV2Test) Write() {
+	const mode = 0775 | os.ModeSetuid | os.ModeSetgid
+	p := t.createFile("foo", mode)
+
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	// Opening alone changes nothing.
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(mode, fi.Mode())
+
+	// Writing may clear both bits.
+	_, err = f.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	fi, err = os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(killedMode(mode), fi.Mode())
+}
+
+func (t *KillPrivV2Test) Write_NotGroupExecutable() {
+	const mode = 0764 | os.ModeSetuid | os.ModeSetgid
+	p := t.createFile("foo", mode)
+
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	// The setgid bit means mandatory locking rather than anything to do with
+	// privileges, so it should be left alone.
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(killedMode(mode), fi.Mode())
+	ExpectNe(0, fi.Mode()&os.ModeSetgid)
+}
+
+func (t *KillPrivV2Test) Truncate() {
+	const mode = 0775 | os.ModeSetuid | os.ModeSetgid
+	p := t.createFile("foo", mode)
+
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	err = f.Truncate(2)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(2, fi.Size())
+	ExpectEq(killedMode(mode), fi.Mode())
+}
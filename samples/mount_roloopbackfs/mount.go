@@ -26,6 +26,7 @@ import (
 
 var fPhysicalPath = flag.String("path", "", "Physical path to loopback.")
 var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+var fContained = flag.Bool("contained", false, "Refuse access to anything outside --path, even through symlinks.")
 
 var fDebug = flag.Bool("debug", false, "Enable debug logging.")
 
@@ -48,7 +49,12 @@ func main() {
 		log.Fatalf("Failed to create mount point at '%v'", *fMountPoint)
 	}
 
-	server, err := roloopbackfs.NewReadonlyLoopbackServer(*fPhysicalPath, errorLogger)
+	newServer := roloopbackfs.NewReadonlyLoopbackServer
+	if *fContained {
+		newServer = roloopbackfs.NewContainedReadonlyLoopbackServer
+	}
+
+	server, err := newServer(*fPhysicalPath, errorLogger)
 	if err != nil {
 		log.Fatalf("makeFS: %v", err)
 	}
@@ -40,6 +40,8 @@ var fFlushError = flag.Int("flushfs.flush_error", 0, "")
 var fFsyncError = flag.Int("flushfs.fsync_error", 0, "")
 
 var fReadOnly = flag.Bool("read_only", false, "Mount in read-only mode.")
+var fDisableWritebackCaching = flag.Bool("disable_writeback_caching", false, "Disable writeback caching.")
+var fReadOnlyNoFlush = flag.Bool("read_only_no_flush", false, "Skip flushes for read-only handles.")
 var fDebug = flag.Bool("debug", false, "Enable debug logging.")
 
 func makeFlushFS() (fuse.Server, error) {
@@ -128,7 +130,9 @@ func main() {
 	}
 
 	cfg := &fuse.MountConfig{
-		ReadOnly: *fReadOnly,
+		ReadOnly:                *fReadOnly,
+		DisableWritebackCaching: *fDisableWritebackCaching,
+		EnableReadOnlyNoFlush:   *fReadOnlyNoFlush,
 	}
 
 	if *fDebug {
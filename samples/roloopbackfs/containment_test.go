@@ -0,0 +1,221 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package roloopbackfs
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Create a backing tree with a directory to serve, a sibling of it to be kept
+// out of reach, and symlinks within the former leading to both. Return the
+// path of the directory to serve.
+func makeContainmentTree(t *testing.T) string {
+	base, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(base) })
+
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{root, filepath.Join(root, "sub"), outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+
+	files := map[string]string{
+		filepath.Join(root, "inside.txt"):    "inside",
+		filepath.Join(outside, "secret.txt"): "secret",
+	}
+	for p, contents := range files {
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	links := map[string]string{
+		"link_inside":   "inside.txt",
+		"sub/link_up":   "../inside.txt",
+		"escape_file":   "../outside/secret.txt",
+		"escape_dir":    "../outside",
+		"escape_abs":    filepath.Join(outside, "secret.txt"),
+		"sub/escape_up": "../../outside",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+	}
+
+	return root
+}
+
+func newContainmentFS(t *testing.T, root string, contained bool) *readonlyLoopbackFs {
+	fs, err := newReadonlyLoopbackFs(root, contained, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("newReadonlyLoopbackFs: %v", err)
+	}
+
+	return fs
+}
+
+// Look up the supplied path one component at a time, as the kernel would,
+// returning the inode found and the error for the first component that
+// couldn't be.
+func lookUpPath(fs *readonlyLoopbackFs, names ...string) (fuseops.InodeID, error) {
+	inode := fuseops.InodeID(fuseops.RootInodeID)
+	for _, name := range names {
+		op := &fuseops.LookUpInodeOp{Parent: inode, Name: name}
+		if err := fs.LookUpInode(context.Background(), op); err != nil {
+			return 0, err
+		}
+
+		inode = op.Entry.Child
+	}
+
+	return inode, nil
+}
+
+func readFile(fs *readonlyLoopbackFs, inode fuseops.InodeID) (string, error) {
+	op := &fuseops.ReadFileOp{Inode: inode, Dst: make([]byte, 64)}
+	if err := fs.ReadFile(context.Background(), op); err != nil {
+		return "", err
+	}
+
+	return string(op.Dst[:op.BytesRead]), nil
+}
+
+func TestContained_DotDotEscapes(t *testing.T) {
+	fs := newContainmentFS(t, makeContainmentTree(t), true)
+
+	// However they're spelled, names that would climb out of a directory don't
+	// exist in it.
+	testCases := [][]string{
+		{".."},
+		{"..", "outside", "secret.txt"},
+		{"../outside"},
+		{"sub", ".."},
+		{"sub", "..", "..", "outside"},
+		{"sub/../../outside"},
+		{"."},
+		{""},
+	}
+
+	for _, names := range testCases {
+		if _, err := lookUpPath(fs, names...); err != fuse.ENOENT {
+			t.Errorf("LookUpInode(%q): got %v, want ENOENT", names, err)
+		}
+	}
+}
+
+func TestContained_SymlinkEscapes(t *testing.T) {
+	fs := newContainmentFS(t, makeContainmentTree(t), true)
+
+	testCases := [][]string{
+		{"escape_file"},
+		{"escape_abs"},
+		{"escape_dir"},
+		{"sub", "escape_up"},
+	}
+
+	for _, names := range testCases {
+		if _, err := lookUpPath(fs, names...); err != syscall.EACCES {
+			t.Errorf("LookUpInode(%q): got %v, want EACCES", names, err)
+		}
+	}
+}
+
+func TestContained_SymlinksWithinRoot(t *testing.T) {
+	fs := newContainmentFS(t, makeContainmentTree(t), true)
+
+	for _, names := range [][]string{{"inside.txt"}, {"link_inside"}, {"sub", "link_up"}} {
+		inode, err := lookUpPath(fs, names...)
+		if err != nil {
+			t.Fatalf("LookUpInode(%q): %v", names, err)
+		}
+
+		contents, err := readFile(fs, inode)
+		if err != nil || contents != "inside" {
+			t.Errorf("ReadFile(%q): got (%q, %v), want \"inside\"", names, contents, err)
+		}
+	}
+}
+
+func TestContained_ResolvedOnEachUse(t *testing.T) {
+	root := makeContainmentTree(t)
+	fs := newContainmentFS(t, root, true)
+
+	// Look up a directory and a file within it while both are inside the root.
+	if err := ioutil.WriteFile(filepath.Join(root, "sub", "secret.txt"), []byte("decoy"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	dir, err := lookUpPath(fs, "sub")
+	if err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	file, err := lookUpPath(fs, "sub", "secret.txt")
+	if err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	// Then swap the directory for a symlink leading out of the root. The inodes
+	// already handed out must not follow it.
+	if err := os.RemoveAll(filepath.Join(root, "sub")); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+
+	if err := os.Symlink("../outside", filepath.Join(root, "sub")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	if contents, err := readFile(fs, file); err != syscall.EACCES {
+		t.Errorf("ReadFile: got (%q, %v), want EACCES", contents, err)
+	}
+
+	readDir := &fuseops.ReadDirOp{Inode: dir, Dst: make([]byte, 4096)}
+	if err := fs.ReadDir(context.Background(), readDir); err != syscall.EACCES {
+		t.Errorf("ReadDir: got %v, want EACCES", err)
+	}
+
+	getAttrs := &fuseops.GetInodeAttributesOp{Inode: file}
+	if err := fs.GetInodeAttributes(context.Background(), getAttrs); err != syscall.EACCES {
+		t.Errorf("GetInodeAttributes: got %v, want EACCES", err)
+	}
+}
+
+func TestUncontained_FollowsSymlinksAnywhere(t *testing.T) {
+	fs := newContainmentFS(t, makeContainmentTree(t), false)
+
+	inode, err := lookUpPath(fs, "escape_file")
+	if err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if contents, err := readFile(fs, inode); err != nil || contents != "secret" {
+		t.Errorf("ReadFile: got (%q, %v), want \"secret\"", contents, err)
+	}
+}
@@ -15,10 +15,12 @@
 package roloopbackfs
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -33,6 +35,10 @@ var (
 	allocatedInodeId uint64 = fuseops.RootInodeID
 )
 
+// Returned when an inode's path resolves to somewhere outside the tree that
+// contains the file system.
+var errEscapesRoot = errors.New("path leads outside the root")
+
 func nextInodeID() (next fuseops.InodeID) {
 	nextInodeId := atomic.AddUint64(&allocatedInodeId, 1)
 	return fuseops.InodeID(nextInodeId)
@@ -52,7 +58,18 @@ func getOrCreateInode(inodes *sync.Map, parentId fuseops.InodeID, name string) (
 	if !found {
 		return nil, nil
 	}
-	parentPath := parent.(Inode).Path()
+
+	// Directory listings never contain these, but make sure that they can't be
+	// used to climb out of the parent regardless.
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return nil, nil
+	}
+
+	parentEntry := parent.(*inodeEntry)
+	parentPath, err := parentEntry.resolve()
+	if err != nil {
+		return nil, err
+	}
 	entries, err := ioutil.ReadDir(parentPath)
 	if err != nil {
 		return nil, err
@@ -61,7 +78,8 @@ func getOrCreateInode(inodes *sync.Map, parentId fuseops.InodeID, name string) (
 		if entry.Name() == name {
 			inodeEntry := &inodeEntry{
 				id:   nextInodeID(),
-				path: filepath.Join(parentPath, name),
+				path: filepath.Join(parentEntry.path, name),
+				root: parentEntry.root,
 			}
 			storedEntry, _ := inodes.LoadOrStore(inodeEntry.id, inodeEntry)
 			return storedEntry.(Inode), nil
@@ -73,6 +91,10 @@ func getOrCreateInode(inodes *sync.Map, parentId fuseops.InodeID, name string) (
 type inodeEntry struct {
 	id   fuseops.InodeID
 	path string
+
+	// The resolved path of the tree that the file system is contained within,
+	// outside of which path must not lead, or empty if it isn't contained.
+	root string
 }
 
 var _ Inode = &inodeEntry{}
@@ -96,8 +118,33 @@ func (in *inodeEntry) String() string {
 	return fmt.Sprintf("%v::%v", in.id, in.path)
 }
 
+// Return the path at which the inode's contents may be found. If the file
+// system is contained, this has had its symlinks resolved and is known to lie
+// within the root; otherwise it is the inode's path as is.
+func (in *inodeEntry) resolve() (string, error) {
+	if in.root == "" {
+		return in.path, nil
+	}
+
+	p, err := filepath.EvalSymlinks(in.path)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(in.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errEscapesRoot
+	}
+
+	return p, nil
+}
+
 func (in *inodeEntry) Attributes() (*fuseops.InodeAttributes, error) {
-	fileInfo, err := os.Stat(in.path)
+	p, err := in.resolve()
+	if err != nil {
+		return &fuseops.InodeAttributes{}, err
+	}
+	fileInfo, err := os.Stat(p)
 	if err != nil {
 		return &fuseops.InodeAttributes{}, err
 	}
@@ -115,7 +162,11 @@ func (in *inodeEntry) Attributes() (*fuseops.InodeAttributes, error) {
 }
 
 func (in *inodeEntry) ListChildren(inodes *sync.Map) ([]*fuseutil.Dirent, error) {
-	children, err := ioutil.ReadDir(in.path)
+	p, err := in.resolve()
+	if err != nil {
+		return nil, err
+	}
+	children, err := ioutil.ReadDir(p)
 	if err != nil {
 		return nil, err
 	}
@@ -147,5 +198,9 @@ func (in *inodeEntry) ListChildren(inodes *sync.Map) ([]*fuseutil.Dirent, error)
 }
 
 func (in *inodeEntry) Contents() ([]byte, error) {
-	return ioutil.ReadFile(in.path)
+	p, err := in.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
 }
@@ -18,7 +18,9 @@ import (
 	"golang.org/x/net/context"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"syscall"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -37,23 +39,75 @@ var _ fuseutil.FileSystem = &readonlyLoopbackFs{}
 // Create a file system that mirrors an existing physical path, in a readonly mode
 
 func NewReadonlyLoopbackServer(loopbackPath string, logger *log.Logger) (server fuse.Server, err error) {
+	fs, err := newReadonlyLoopbackFs(loopbackPath, false, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	server = fuseutil.NewFileSystemServer(fs)
+	return
+}
+
+// Create a file system like NewReadonlyLoopbackServer, but contained within
+// the tree at loopbackPath, which may be a subdirectory of a larger one that
+// is to be kept out of reach. Every path is resolved, symlinks included, before
+// it is used, and one that leads outside the tree is refused with EACCES; a
+// symlink within the tree to elsewhere within it works as usual.
+//
+// The backing tree is trusted not to change while a path is being resolved:
+// someone able to swap a directory for a symlink between its resolution and
+// its use can still escape.
+func NewContainedReadonlyLoopbackServer(loopbackPath string, logger *log.Logger) (server fuse.Server, err error) {
+	fs, err := newReadonlyLoopbackFs(loopbackPath, true, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	server = fuseutil.NewFileSystemServer(fs)
+	return
+}
 
-	if _, err = os.Stat(loopbackPath); err != nil {
+func newReadonlyLoopbackFs(loopbackPath string, contained bool, logger *log.Logger) (*readonlyLoopbackFs, error) {
+	if _, err := os.Stat(loopbackPath); err != nil {
 		return nil, err
 	}
 
-	inodes := &sync.Map{}
 	root := &inodeEntry{
 		id:   fuseops.RootInodeID,
 		path: loopbackPath,
 	}
+
+	// Paths are compared against the root once resolved, so it must be
+	// resolved too.
+	if contained {
+		abs, err := filepath.Abs(loopbackPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if root.root, err = filepath.EvalSymlinks(abs); err != nil {
+			return nil, err
+		}
+	}
+
+	inodes := &sync.Map{}
 	inodes.Store(root.Id(), root)
-	server = fuseutil.NewFileSystemServer(&readonlyLoopbackFs{
+	return &readonlyLoopbackFs{
 		loopbackPath: loopbackPath,
 		inodes:       inodes,
 		logger:       logger,
-	})
-	return
+	}, nil
+}
+
+// Translate an error from reading the backing tree into one for the kernel,
+// logging those that shouldn't happen.
+func (fs *readonlyLoopbackFs) backingError(desc string, entry interface{}, err error) error {
+	if err == errEscapesRoot {
+		return syscall.EACCES
+	}
+
+	fs.logger.Printf("%s for '%v': %v", desc, entry, err)
+	return fuse.EIO
 }
 
 func (fs *readonlyLoopbackFs) StatFS(
@@ -67,8 +121,7 @@ func (fs *readonlyLoopbackFs) LookUpInode(
 	op *fuseops.LookUpInodeOp) error {
 	entry, err := getOrCreateInode(fs.inodes, op.Parent, op.Name)
 	if err != nil {
-		fs.logger.Printf("fs.LookUpInode for '%v' on '%v': %v", entry, op.Name, err)
-		return fuse.EIO
+		return fs.backingError("fs.LookUpInode", op.Name, err)
 	}
 	if entry == nil {
 		return fuse.ENOENT
@@ -77,8 +130,7 @@ func (fs *readonlyLoopbackFs) LookUpInode(
 	outputEntry.Child = entry.Id()
 	attributes, err := entry.Attributes()
 	if err != nil {
-		fs.logger.Printf("fs.LookUpInode.Attributes for '%v' on '%v': %v", entry, op.Name, err)
-		return fuse.EIO
+		return fs.backingError("fs.LookUpInode.Attributes", entry, err)
 	}
 	outputEntry.Attributes = *attributes
 	return nil
@@ -93,8 +145,7 @@ func (fs *readonlyLoopbackFs) GetInodeAttributes(
 	}
 	attributes, err := entry.(Inode).Attributes()
 	if err != nil {
-		fs.logger.Printf("fs.GetInodeAttributes for '%v': %v", entry, err)
-		return fuse.EIO
+		return fs.backingError("fs.GetInodeAttributes", entry, err)
 	}
 	op.Attributes = *attributes
 	return nil
@@ -116,8 +167,7 @@ func (fs *readonlyLoopbackFs) ReadDir(
 	}
 	children, err := entry.(Inode).ListChildren(fs.inodes)
 	if err != nil {
-		fs.logger.Printf("fs.ReadDir for '%v': %v", entry, err)
-		return fuse.EIO
+		return fs.backingError("fs.ReadDir", entry, err)
 	}
 
 	if op.Offset > fuseops.DirOffset(len(children)) {
@@ -152,8 +202,7 @@ func (fs *readonlyLoopbackFs) ReadFile(
 	}
 	contents, err := entry.(Inode).Contents()
 	if err != nil {
-		fs.logger.Printf("fs.ReadFile for '%v': %v", entry, err)
-		return fuse.EIO
+		return fs.backingError("fs.ReadFile", entry, err)
 	}
 
 	if op.Offset > int64(len(contents)) {
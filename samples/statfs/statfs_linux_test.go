@@ -159,3 +159,36 @@ func (t *StatFSTest) IoSizes() {
 		ExpectEq(bs, stat.Bsize, "%s", desc)
 	}
 }
+
+func (t *StatFSTest) MaxNameLength() {
+	var err error
+
+	// glibc answers pathconf(2) for _PC_NAME_MAX using statfs::f_namelen, so
+	// checking the latter is equivalent to calling pathconf.
+	testCases := []struct {
+		configured uint32
+		expected   int64
+	}{
+		{0, 255},
+		{17, 17},
+		{1024, 1024},
+	}
+
+	for _, tc := range testCases {
+		desc := fmt.Sprintf("max name length %d", tc.configured)
+
+		// Set up.
+		canned := fuseops.StatFSOp{
+			MaxNameLength: tc.configured,
+		}
+
+		t.fs.SetStatFSResponse(canned)
+
+		// Check.
+		var stat syscall.Statfs_t
+		err = syscall.Statfs(t.Dir, &stat)
+		AssertEq(nil, err)
+
+		ExpectEq(tc.expected, stat.Namelen, "%s", desc)
+	}
+}
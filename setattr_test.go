@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestChmodAndChown(t *testing.T) {
+	// Mount a file system with a setuid file owned by the current user.
+	uid := uint32(os.Getuid())
+	gid := uint32(os.Getgid())
+	fs := &fileFS{
+		attrs: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0755 | os.ModeSetuid,
+			Uid:   uid,
+			Gid:   gid,
+		},
+	}
+
+	mfs := mountFS(t, fs, &fuse.MountConfig{})
+
+	// Set the mode and then the ownership, as install(1) does.
+	p := path.Join(mfs.Dir(), "foo")
+	if err := os.Chmod(p, 0750|os.ModeSetuid); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	if err := os.Chown(p, int(uid), int(gid)); err != nil {
+		t.Fatalf("Chown: %v", err)
+	}
+
+	// The system calls should have arrived as one op each, the second changing
+	// the owner and group together (and, where the kernel clears the setuid bit
+	// on chown, the mode along with them).
+	var ops []*fuseops.SetInodeAttributesOp
+	for _, op := range fs.recorded() {
+		if op, ok := op.(*fuseops.SetInodeAttributesOp); ok {
+			ops = append(ops, op)
+		}
+	}
+
+	if len(ops) != 2 {
+		t.Fatalf("Got %d ops; want 2", len(ops))
+	}
+
+	chmod := ops[0]
+	if chmod.Mode == nil || *chmod.Mode != 0750|os.ModeSetuid {
+		t.Errorf("chmod mode: %v", chmod.Mode)
+	}
+
+	if chmod.Uid != nil || chmod.Gid != nil {
+		t.Errorf("chmod changed ownership: %v %v", chmod.Uid, chmod.Gid)
+	}
+
+	chown := ops[1]
+	if chown.Uid == nil || *chown.Uid != uid || chown.Gid == nil || *chown.Gid != gid {
+		t.Errorf("chown ownership: %v %v", chown.Uid, chown.Gid)
+	}
+
+	if chown.Mode != nil && *chown.Mode&os.ModeSetuid != 0 {
+		t.Errorf("chown mode: %v", *chown.Mode)
+	}
+}
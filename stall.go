@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Watch for requests sitting unread in the kernel for at least the given
+// threshold, logging a warning when they start to and when they stop. See
+// MountConfig.ReadStallThreshold. Returns when the connection is closed or
+// lost.
+func (c *Connection) watchForStalls(threshold time.Duration) {
+	ticker := time.NewTicker(threshold / 2)
+	defer ticker.Stop()
+
+	var stalled bool
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		pending, ok := c.requestsPending()
+		if !ok || c.Health() == Dead {
+			return
+		}
+
+		// A reader waiting in read(2) would have taken any pending request, so
+		// the loop is stalled only if there has been none for a while.
+		busy := c.queueStats.busyFor(time.Now())
+		switch {
+		case !stalled && pending && busy >= threshold:
+			stalled = true
+			c.errorLogger.Printf(
+				"No request read from the kernel for %v while some are pending; "+
+					"is an op handler blocking the goroutine calling ReadOp?",
+				busy.Round(time.Millisecond))
+
+		case stalled && busy < threshold:
+			stalled = false
+			c.errorLogger.Printf("Reading requests from the kernel has resumed")
+		}
+	}
+}
+
+// Does the kernel have requests waiting to be read? Returns ok false if the
+// device can no longer be polled, e.g. because the connection has been lost.
+func (c *Connection) requestsPending() (pending bool, ok bool) {
+	fd := c.dev.Fd()
+	if fd == ^uintptr(0) {
+		return false, false
+	}
+
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	if _, err := unix.Poll(fds, 0); err != nil {
+		return false, err == unix.EINTR
+	}
+
+	if fds[0].Revents&(unix.POLLERR|unix.POLLHUP|unix.POLLNVAL) != 0 {
+		return false, false
+	}
+
+	return fds[0].Revents&unix.POLLIN != 0, true
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A writer that may be written to concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Wait up to a few seconds for the buffer to contain the given string.
+func waitForLog(b *syncBuffer, s string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Contains(b.String(), s) {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestReadStallWarning(t *testing.T) {
+	const threshold = 50 * time.Millisecond
+
+	var logged syncBuffer
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{
+		ErrorLogger:        log.New(&logged, "", 0),
+		ReadStallThreshold: threshold,
+	})
+
+	defer kernel.Close()
+
+	// Serve ops with a single worker that handles each on the goroutine that
+	// reads it, blocking in the first until told to stop.
+	unblock := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			ctx, _, err := c.ReadOp()
+			if err != nil {
+				return
+			}
+
+			if i == 0 {
+				<-unblock
+			}
+
+			c.Reply(ctx, nil)
+		}
+	}()
+
+	// While the worker waits for requests, there is no stall.
+	time.Sleep(4 * threshold)
+	if s := logged.String(); s != "" {
+		t.Errorf("Logged while idle: %q", s)
+	}
+
+	// Send a request that blocks the worker, and another queued behind it.
+	getattr := func(unique uint64) []byte {
+		var in fusekernel.GetattrIn
+		msg := makeRequest(
+			fusekernel.OpGetattr,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+		(*fusekernel.InHeader)(unsafe.Pointer(&msg[0])).Unique = unique
+		return msg
+	}
+
+	for _, unique := range []uint64{17, 18} {
+		if _, err := kernel.Write(getattr(unique)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if !waitForLog(&logged, "No request read from the kernel") {
+		t.Errorf("No stall warning logged: %q", logged.String())
+	}
+
+	// Once the worker is unblocked, both requests are answered and the stall
+	// ends.
+	close(unblock)
+	buf := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		if _, err := kernel.Read(buf); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+
+	if !waitForLog(&logged, "has resumed") {
+		t.Errorf("No resumption logged: %q", logged.String())
+	}
+
+	kernel.Close()
+	<-done
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionStats contains statistics about the requests that a connection has
+// read from the kernel. See Connection.Stats.
+type ConnectionStats struct {
+	// The number of requests read from the kernel.
+	Requests uint64
+
+	// An estimate of how long recent requests sat in the kernel's queue before
+	// being read, as a moving average, and the largest such estimate seen.
+	//
+	// The protocol carries no timing information, so this is inferred from the
+	// gaps between reads: a request that is read without waiting is assumed to
+	// have been queued for as long as every reader had been busy elsewhere, and
+	// one that a reader had to wait for is assumed not to have been queued at
+	// all. This overestimates when requests trickle in while the readers are
+	// busy, but a value that grows with load is a sign that ops are arriving
+	// faster than the file system is serving them, and that more readers or
+	// workers are needed.
+	QueueLatency    time.Duration
+	MaxQueueLatency time.Duration
+}
+
+// Reads that complete within this long are assumed to have found a request
+// already queued, rather than having waited for one.
+const immediateReadThreshold = time.Millisecond
+
+// queueStats tracks the time that readers spend in and out of read(2) on the
+// device, in order to estimate queue latency for ConnectionStats.
+type queueStats struct {
+	mu sync.Mutex
+
+	// The number of readers currently in read(2), and the time at which that
+	// last dropped to zero.
+	//
+	// GUARDED_BY(mu)
+	reading   int
+	busySince time.Time
+
+	// GUARDED_BY(mu)
+	stats ConnectionStats
+}
+
+// Record that a reader is about to call read(2), returning the time at which
+// it did so and for how long no reader has been waiting for requests.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *queueStats) startRead() (start time.Time, busy time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start = time.Now()
+	if s.reading == 0 && !s.busySince.IsZero() {
+		busy = start.Sub(s.busySince)
+	}
+
+	s.reading++
+	return start, busy
+}
+
+// Record the end of a call to read(2) begun with startRead, which succeeded if
+// ok is true.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *queueStats) finishRead(start time.Time, busy time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.reading--
+	if s.reading == 0 {
+		s.busySince = now
+	}
+
+	if !ok {
+		return
+	}
+
+	// If we had to wait for the request, it wasn't queued.
+	var latency time.Duration
+	if now.Sub(start) < immediateReadThreshold {
+		latency = busy
+	}
+
+	s.stats.Requests++
+	s.stats.QueueLatency += (latency - s.stats.QueueLatency) / 8
+	if latency > s.stats.MaxQueueLatency {
+		s.stats.MaxQueueLatency = latency
+	}
+}
+
+// Return how long no reader has been waiting for requests, or zero if one is
+// waiting now.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *queueStats) busyFor(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reading != 0 || s.busySince.IsZero() {
+		return 0
+	}
+
+	return now.Sub(s.busySince)
+}
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *queueStats) get() ConnectionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestQueueLatencyRisesUnderBackpressure(t *testing.T) {
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{})
+	defer c.close()
+	defer kernel.Close()
+
+	// Drain replies in the background.
+	go func() {
+		buf := make([]byte, 1<<16)
+		for {
+			if _, err := kernel.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	var getattrIn fusekernel.GetattrIn
+	getattr := makeRequest(
+		fusekernel.OpGetattr,
+		structBytes(unsafe.Pointer(&getattrIn), unsafe.Sizeof(getattrIn)))
+
+	const handlerDelay = 10 * time.Millisecond
+	serve := func(delay time.Duration) {
+		ctx, _, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		time.Sleep(delay)
+		c.Reply(ctx, ENOSYS)
+	}
+
+	// Without backpressure, each request arrives while we're waiting for it.
+	for i := 0; i < 5; i++ {
+		go func() {
+			time.Sleep(handlerDelay)
+			kernel.Write(getattr)
+		}()
+
+		serve(0)
+	}
+
+	idle := c.Stats()
+	if idle.QueueLatency >= handlerDelay/2 {
+		t.Errorf("Queue latency without backpressure: %v", idle.QueueLatency)
+	}
+
+	// Queue up requests faster than a slow handler serves them.
+	const n = 20
+	for i := 0; i < n; i++ {
+		if _, err := kernel.Write(getattr); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		serve(handlerDelay)
+	}
+
+	busy := c.Stats()
+	if busy.Requests != idle.Requests+n {
+		t.Errorf("Requests: %d, want %d", busy.Requests, idle.Requests+n)
+	}
+
+	if busy.QueueLatency < handlerDelay/2 || busy.QueueLatency <= idle.QueueLatency {
+		t.Errorf(
+			"Queue latency with backpressure: %v (vs. %v)",
+			busy.QueueLatency,
+			idle.QueueLatency)
+	}
+
+	if busy.MaxQueueLatency < handlerDelay {
+		t.Errorf("Max queue latency: %v", busy.MaxQueueLatency)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A timeChecker remembers the latest mtime and ctime returned to the kernel
+// for each inode, and notices when a later reply goes back in time. See
+// MountConfig.EnableTimeMonotonicityCheck.
+type timeChecker struct {
+	mu sync.Mutex
+
+	// The latest times returned for each inode.
+	//
+	// GUARDED_BY(mu)
+	last map[fuseops.InodeID]inodeTimes
+}
+
+type inodeTimes struct {
+	mtime time.Time
+	ctime time.Time
+}
+
+func newTimeChecker() *timeChecker {
+	return &timeChecker{
+		last: make(map[fuseops.InodeID]inodeTimes),
+	}
+}
+
+// Inspect the successful reply to the supplied op, returning a description of
+// any times that went backwards or the empty string if none.
+//
+// LOCKS_EXCLUDED(tc.mu)
+func (tc *timeChecker) check(op interface{}) string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return tc.checkTimes(o.Entry.Child, o.Entry.Attributes, false)
+
+	case *fuseops.MkDirOp:
+		return tc.checkTimes(o.Entry.Child, o.Entry.Attributes, false)
+
+	case *fuseops.MkNodeOp:
+		return tc.checkTimes(o.Entry.Child, o.Entry.Attributes, false)
+
+	case *fuseops.CreateFileOp:
+		return tc.checkTimes(o.Entry.Child, o.Entry.Attributes, false)
+
+	case *fuseops.CreateSymlinkOp:
+		return tc.checkTimes(o.Entry.Child, o.Entry.Attributes, false)
+
+	case *fuseops.CreateLinkOp:
+		return tc.checkTimes(o.Entry.Child, o.Entry.Attributes, false)
+
+	case *fuseops.GetInodeAttributesOp:
+		return tc.checkTimes(o.Inode, o.Attributes, false)
+
+	// The user may set mtime to whatever they like, e.g. with touch -d, but
+	// doing so updates ctime.
+	case *fuseops.SetInodeAttributesOp:
+		return tc.checkTimes(o.Inode, o.Attributes, o.Mtime != nil)
+
+	case *fuseops.ForgetInodeOp:
+		delete(tc.last, o.Inode)
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range o.Entries {
+			delete(tc.last, e.Inode)
+		}
+	}
+
+	return ""
+}
+
+// Record the times in the supplied attributes for the inode, checking them
+// against those previously recorded. If mtimeSet is true, the user has just
+// set mtime and it isn't checked.
+//
+// LOCKS_REQUIRED(tc.mu)
+func (tc *timeChecker) checkTimes(
+	inode fuseops.InodeID,
+	attrs fuseops.InodeAttributes,
+	mtimeSet bool) (msg string) {
+	prev, ok := tc.last[inode]
+	tc.last[inode] = inodeTimes{attrs.Mtime, attrs.Ctime}
+
+	if !ok {
+		return ""
+	}
+
+	switch {
+	case attrs.Ctime.Before(prev.ctime):
+		msg = fmt.Sprintf("ctime %v, previously %v", attrs.Ctime, prev.ctime)
+
+	case !mtimeSet && attrs.Mtime.Before(prev.mtime):
+		msg = fmt.Sprintf("mtime %v, previously %v", attrs.Mtime, prev.mtime)
+
+	default:
+		return ""
+	}
+
+	return fmt.Sprintf("inode %d: time went backwards: %s", inode, msg)
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Replies from a file system whose clock jumps back between replies.
+func TestTimeChecker(t *testing.T) {
+	t0 := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	attrs := func(mtime, ctime time.Time) fuseops.InodeAttributes {
+		return fuseops.InodeAttributes{Mtime: mtime, Ctime: ctime}
+	}
+
+	mtime := t0
+	testCases := []struct {
+		name string
+		op   interface{}
+		want string
+	}{
+		{
+			"first lookup",
+			&fuseops.LookUpInodeOp{
+				Entry: fuseops.ChildInodeEntry{Child: 17, Attributes: attrs(t1, t1)},
+			},
+			"",
+		},
+		{
+			"same times",
+			&fuseops.GetInodeAttributesOp{Inode: 17, Attributes: attrs(t1, t1)},
+			"",
+		},
+		{
+			"mtime backwards",
+			&fuseops.GetInodeAttributesOp{Inode: 17, Attributes: attrs(t0, t1)},
+			"inode 17: time went backwards: mtime",
+		},
+		{
+			"ctime backwards",
+			&fuseops.GetInodeAttributesOp{Inode: 17, Attributes: attrs(t0, t0)},
+			"inode 17: time went backwards: ctime",
+		},
+		{
+			"other inode",
+			&fuseops.GetInodeAttributesOp{Inode: 19, Attributes: attrs(t0, t0)},
+			"",
+		},
+		{
+			"mtime set by the user",
+			&fuseops.SetInodeAttributesOp{
+				Inode:      19,
+				Mtime:      &mtime,
+				Attributes: attrs(t0.Add(-time.Hour), t1),
+			},
+			"",
+		},
+		{
+			"forgotten",
+			&fuseops.ForgetInodeOp{Inode: 19, N: 1},
+			"",
+		},
+		{
+			"looked up again after being forgotten",
+			&fuseops.LookUpInodeOp{
+				Entry: fuseops.ChildInodeEntry{Child: 19, Attributes: attrs(t0, t0)},
+			},
+			"",
+		},
+	}
+
+	tc := newTimeChecker()
+	for _, c := range testCases {
+		got := tc.check(c.op)
+		if c.want == "" && got != "" || !strings.HasPrefix(got, c.want) {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
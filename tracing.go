@@ -0,0 +1,51 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// OpTraceInfo describes an op for the benefit of an OpTracer.
+type OpTraceInfo struct {
+	// The kind of op, e.g. "LookUpInodeOp".
+	Type OpType
+
+	// The fuse "unique" ID of the request, which identifies it in debug logs.
+	FuseID uint64
+
+	// The inode to which the request is addressed. For ops that act on a name
+	// within a directory, such as LookUpInodeOp, this is the directory.
+	Inode fuseops.InodeID
+}
+
+// An OpTracer is told about each op as it is read from the kernel and again
+// when it is replied to, so that ops may be recorded as spans in a tracing
+// system. For example, an OpenTelemetry tracer may be adapted with a few
+// lines: StartOp calls Tracer.Start with info.Type as the span name and the
+// remaining fields as attributes, and the returned function records a non-nil
+// error with Span.SetStatus before calling Span.End.
+type OpTracer interface {
+	// Called before the op is given to the file system, with the context that
+	// would otherwise be used for the op (derived from MountConfig.OpContext, so
+	// that a span in it may serve as the parent). Returns the context to use
+	// instead, and a function to be called with the op's result when it is
+	// replied to.
+	StartOp(
+		ctx context.Context,
+		info OpTraceInfo) (context.Context, func(err error))
+}
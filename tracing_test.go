@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+type spanKey struct{}
+
+type recordedSpan struct {
+	parent interface{}
+	info   OpTraceInfo
+	ended  bool
+	err    error
+}
+
+// An OpTracer that records spans in memory.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan // GUARDED_BY(mu)
+}
+
+func (rt *recordingTracer) StartOp(
+	ctx context.Context,
+	info OpTraceInfo) (context.Context, func(error)) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	s := &recordedSpan{
+		parent: ctx.Value(spanKey{}),
+		info:   info,
+	}
+
+	rt.spans = append(rt.spans, s)
+	ctx = context.WithValue(ctx, spanKey{}, s)
+
+	return ctx, func(err error) {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+
+		s.ended = true
+		s.err = err
+	}
+}
+
+func TestOpTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	c, kernel := newSocketConnection(t, latestInit, MountConfig{
+		OpContext: context.WithValue(context.Background(), spanKey{}, "mount"),
+		OpTracer:  tracer,
+	})
+
+	defer c.close()
+	defer kernel.Close()
+
+	// Send a lookup.
+	req := makeRequest(fusekernel.OpLookup, []byte("foo\x00"))
+	if _, err := kernel.Write(req); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	ctx, op, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	if _, ok := op.(*fuseops.LookUpInodeOp); !ok {
+		t.Fatalf("Unexpected op: %#v", op)
+	}
+
+	// The op's context should carry the span.
+	tracer.mu.Lock()
+	if len(tracer.spans) != 1 {
+		t.Fatalf("Got %d spans; want 1", len(tracer.spans))
+	}
+
+	s := tracer.spans[0]
+	tracer.mu.Unlock()
+
+	if ctx.Value(spanKey{}) != s {
+		t.Errorf("Op context doesn't carry the span")
+	}
+
+	c.Reply(ctx, ENOENT)
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	expected := OpTraceInfo{
+		Type:   "LookUpInodeOp",
+		FuseID: 17,
+		Inode:  19,
+	}
+
+	if s.info != expected {
+		t.Errorf("Info: %+v, want %+v", s.info, expected)
+	}
+
+	if s.parent != "mount" {
+		t.Errorf("Parent: %v", s.parent)
+	}
+
+	if !s.ended || s.err != ENOENT {
+		t.Errorf("Ended: %v, error: %v", s.ended, s.err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// Return the name of the volume mounted at the supplied path, as shown in the
+// Finder, using getattrlist(2).
+func volumeName(p string) (string, error) {
+	path, err := unix.BytePtrFromString(p)
+	if err != nil {
+		return "", err
+	}
+
+	// struct attrlist
+	attrs := struct {
+		bitmapCount uint16
+		reserved    uint16
+		commonAttr  uint32
+		volAttr     uint32
+		dirAttr     uint32
+		fileAttr    uint32
+		forkAttr    uint32
+	}{
+		bitmapCount: unix.ATTR_BIT_MAP_COUNT,
+		volAttr:     unix.ATTR_VOL_INFO | unix.ATTR_VOL_NAME,
+	}
+
+	buf := make([]byte, 1024)
+	_, _, errno := unix.Syscall6(
+		unix.SYS_GETATTRLIST,
+		uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&attrs)),
+		uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(len(buf)),
+		0,
+		0)
+
+	if errno != 0 {
+		return "", errno
+	}
+
+	// The buffer holds its length, then an attrreference_t giving the offset of
+	// the NUL-terminated name relative to itself, and its length.
+	const refOffset = 4
+	ref := (*struct {
+		offset int32
+		length uint32
+	})(unsafe.Pointer(&buf[refOffset]))
+
+	start := refOffset + int(ref.offset)
+	return string(buf[start : start+int(ref.length)-1]), nil
+}
+
+func TestVolumeName(t *testing.T) {
+	// Mount with a name.
+	const name = "Taco Volume"
+	mfs := mountFS(t, &minimalFS{}, &fuse.MountConfig{VolumeName: name})
+
+	got, err := volumeName(mfs.Dir())
+	if err != nil {
+		t.Fatalf("volumeName: %v", err)
+	}
+
+	if got != name {
+		t.Errorf("Volume name: got %q, want %q", got, name)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestWritebackSizeBeforeFlush(t *testing.T) {
+	// Mount with writeback caching, the default, a file system that reports the
+	// file as empty whatever is written to it, as if the writes had not yet
+	// reached a backend from which it gets the size.
+	fs := &fileFS{attrs: fuseops.InodeAttributes{Nlink: 1, Mode: 0666}}
+	mfs := mountFS(t, fs, &fuse.MountConfig{})
+
+	// Write to the file without closing it, then stat it.
+	f, err := os.OpenFile(path.Join(mfs.Dir(), "foo"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	defer f.Close()
+
+	if _, err := f.WriteString("taco"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	// The size should reflect the buffered write, whatever the file system says.
+	if fi.Size() != 4 {
+		t.Errorf("Size: %d", fi.Size())
+	}
+}
+
+// Make n writes of the given size to consecutive offsets of the file "foo" in
+// a fileFS mounted with the given config, returning the write ops the file
+// system received by the time the file was closed.
+func writeSmallChunks(
+	t *testing.T,
+	cfg *fuse.MountConfig,
+	n int,
+	size int) []*fuseops.WriteFileOp {
+	fs := &fileFS{attrs: fuseops.InodeAttributes{Nlink: 1, Mode: 0666}}
+	mfs := mountFS(t, fs, cfg)
+
+	// Write, then close the file, which flushes any dirty pages.
+	f, err := os.OpenFile(path.Join(mfs.Dir(), "foo"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	chunk := bytes.Repeat([]byte("a"), size)
+	for i := 0; i < n; i++ {
+		if _, err := f.WriteAt(chunk, int64(i*size)); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	var writes []*fuseops.WriteFileOp
+	for _, op := range fs.recorded() {
+		if op, ok := op.(*fuseops.WriteFileOp); ok {
+			writes = append(writes, op)
+		}
+	}
+
+	return writes
+}
+
+func TestWritebackCoalescesWrites(t *testing.T) {
+	const (
+		n    = 256
+		size = 64
+	)
+
+	// Without writeback caching, each write should be sent through as made.
+	writes := writeSmallChunks(t, &fuse.MountConfig{DisableWritebackCaching: true}, n, size)
+	if len(writes) != n {
+		t.Errorf("Without writeback caching: got %d write ops, want %d", len(writes), n)
+	}
+
+	// With it, the same writes should arrive as fewer, larger, page-aligned
+	// ops covering the same data.
+	writes = writeSmallChunks(t, &fuse.MountConfig{}, n, size)
+	if len(writes) == 0 || len(writes) >= n {
+		t.Errorf("With writeback caching: got %d write ops", len(writes))
+	}
+
+	total := 0
+	pageSize := os.Getpagesize()
+	for _, w := range writes {
+		total += len(w.Data)
+		if w.Offset%int64(pageSize) != 0 {
+			t.Errorf("Write at offset %d isn't page-aligned", w.Offset)
+		}
+	}
+
+	if total != n*size {
+		t.Errorf("Write ops carried %d bytes, want %d", total, n*size)
+	}
+}